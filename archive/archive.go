@@ -414,6 +414,13 @@ func (w *archiveWorker) archive(ro readerOpener, name, path string, size int64,
 	}
 
 	w.depot.adjustSize(root, compressedSize-estimatedCompressedSize, sha1Hex)
+
+	if !w.pm.noDB {
+		err = w.depot.RomDB.UpdateRomStatus(rom, true)
+		if err != nil {
+			return 0, err
+		}
+	}
 	return compressedSize, nil
 }
 
@@ -33,6 +33,8 @@ package archive
 import (
 	"bufio"
 	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"github.com/uwedeportivo/romba/worker"
 	"io"
 	"os"
@@ -59,6 +61,62 @@ type gameBuilder struct {
 	index    int
 	deduper  dedup.Deduper
 	sha1Tree int
+	failures *[]*BuildFailure
+	stats    *DatStats
+}
+
+// RomBuildError is returned from building a game when a specific rom of it fails.
+type RomBuildError struct {
+	Rom *types.Rom
+	Err error
+}
+
+func (e *RomBuildError) Error() string {
+	return fmt.Sprintf("rom %s (sha1 %s): %v", e.Rom.Name, hex.EncodeToString(e.Rom.Sha1), e.Err)
+}
+
+// BuildFailure records a game that failed to build in keep-going mode.
+type BuildFailure struct {
+	Game  string `json:"game"`
+	Rom   string `json:"rom,omitempty"`
+	Sha1  string `json:"sha1,omitempty"`
+	Error string `json:"error"`
+}
+
+type buildErrorReport struct {
+	Dat      string          `json:"dat"`
+	Path     string          `json:"path"`
+	Failures []*BuildFailure `json:"failures"`
+}
+
+func newBuildFailure(game *types.Game, err error) *BuildFailure {
+	bf := &BuildFailure{
+		Game:  game.Name,
+		Error: err.Error(),
+	}
+	if rerr, ok := err.(*RomBuildError); ok {
+		bf.Rom = rerr.Rom.Name
+		bf.Sha1 = hex.EncodeToString(rerr.Rom.Sha1)
+		bf.Error = rerr.Err.Error()
+	}
+	return bf
+}
+
+func (gb *gameBuilder) cleanupGame(gamePath string) error {
+	if gb.sha1Tree > 0 {
+		return nil
+	}
+
+	var err error
+	if gb.fixDat.UnzipGames {
+		err = os.RemoveAll(gamePath)
+	} else {
+		err = os.Remove(gamePath + zipSuffix)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
 }
 
 func (gb *gameBuilder) work() {
@@ -68,32 +126,38 @@ func (gb *gameBuilder) work() {
 		if gb.sha1Tree > 0 {
 			gamePath = gb.datPath
 		}
-		fixGame, foundRom, err := gb.depot.buildGame(game, gamePath, gb.fixDat.UnzipGames, gb.deduper, gb.sha1Tree)
+		gt := new(gameTally)
+		fixGame, foundRom, err := gb.depot.buildGame(game, gamePath, gb.fixDat.UnzipGames, gb.deduper, gb.sha1Tree, gt)
 		if err != nil {
 			glog.Errorf("error processing %s: %v", gamePath, err)
+
+			cerr := gb.cleanupGame(gamePath)
+			if cerr != nil {
+				glog.Errorf("error removing partial output %s: %v", gamePath, cerr)
+			}
+
+			if gb.failures != nil {
+				gb.mutex.Lock()
+				*gb.failures = append(*gb.failures, newBuildFailure(game, err))
+				gb.mutex.Unlock()
+				gb.stats.addFailedGame(game)
+				continue
+			}
 			gb.erc <- err
 			break
 		}
+		gb.stats.addGame(gt)
 		if fixGame != nil {
 			gb.mutex.Lock()
 			gb.fixDat.Games = append(gb.fixDat.Games, fixGame)
 			gb.mutex.Unlock()
 		}
-		if !foundRom && gb.sha1Tree == 0 {
-			if gb.fixDat.UnzipGames {
-				err := os.RemoveAll(gamePath)
-				if err != nil && !os.IsNotExist(err) {
-					glog.Errorf("error removing %s: %v", gamePath, err)
-					gb.erc <- err
-					break
-				}
-			} else {
-				err := os.Remove(gamePath + zipSuffix)
-				if err != nil && !os.IsNotExist(err) {
-					glog.Errorf("error removing %s: %v", gamePath+zipSuffix, err)
-					gb.erc <- err
-					break
-				}
+		if !foundRom {
+			err := gb.cleanupGame(gamePath)
+			if err != nil {
+				glog.Errorf("error removing %s: %v", gamePath, err)
+				gb.erc <- err
+				break
 			}
 		}
 	}
@@ -102,8 +166,22 @@ func (gb *gameBuilder) work() {
 	return
 }
 
+// BuildDat builds the games of dat into outpath. With keepGoing set, games that fail are
+// cleaned up and skipped and the failures are written to a build-errors json file next to
+// the fix DAT. Game and rom names are mapped to safe paths by names and the renames are
+// listed in the returned stats.
 func (depot *Depot) BuildDat(dat *types.Dat, outpath string, numSubworkers int, deduper dedup.Deduper,
-	unzipAllGames bool, sha1Tree int) (bool, error) {
+	unzipAllGames bool, sha1Tree int, keepGoing bool, format string, names *types.NameMapper) (*DatStats, error) {
+	stats := newDatStats(dat)
+
+	dat, renames, err := names.SanitizeDat(dat)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range renames {
+		glog.Infof("dat %s: %s", dat.Name, r)
+	}
+	stats.Renames = renames
 
 	datPath := filepath.Join(outpath, dat.Name)
 	if sha1Tree > 0 {
@@ -113,15 +191,14 @@ func (depot *Depot) BuildDat(dat *types.Dat, outpath string, numSubworkers int,
 	if sha1Tree == 0 {
 		err := os.Mkdir(datPath, 0777)
 		if err != nil {
-			return false, err
+			return nil, err
 		}
 	}
 
 	fixDat := new(types.Dat)
+	fixDat.CopyHeader(dat)
 	fixDat.FixDat = true
 	fixDat.Name = "fix_" + dat.Name
-	fixDat.Description = dat.Description
-	fixDat.Path = dat.Path
 	fixDat.UnzipGames = dat.UnzipGames || unzipAllGames
 
 	wc := make(chan *types.Game)
@@ -129,6 +206,8 @@ func (depot *Depot) BuildDat(dat *types.Dat, outpath string, numSubworkers int,
 	closeC := make(chan bool)
 	mutex := new(sync.Mutex)
 
+	var failures []*BuildFailure
+
 	for i := 0; i < numSubworkers; i++ {
 		gb := new(gameBuilder)
 		gb.depot = depot
@@ -141,6 +220,10 @@ func (depot *Depot) BuildDat(dat *types.Dat, outpath string, numSubworkers int,
 		gb.deduper = deduper
 		gb.closeC = closeC
 		gb.sha1Tree = sha1Tree
+		gb.stats = stats
+		if keepGoing {
+			gb.failures = &failures
+		}
 
 		go gb.work()
 	}
@@ -178,15 +261,22 @@ endLoop2:
 	}
 
 	if minionErr != nil {
-		return false, minionErr
+		return nil, minionErr
+	}
+
+	if len(failures) > 0 {
+		err := writeBuildErrors(dat, failures, filepath.Join(outpath, "build-errors-"+dat.Filename()+".json"))
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if len(fixDat.Games) > 0 {
-		fixDatPath := filepath.Join(outpath, fixPrefix+dat.Filename()+datSuffix)
+		fixDatPath := filepath.Join(outpath, fixPrefix+dat.Filename()+types.FormatSuffix(format))
 
 		fixFile, err := os.Create(fixDatPath)
 		if err != nil {
-			return false, err
+			return nil, err
 		}
 		defer func() {
 			err := fixFile.Close()
@@ -203,13 +293,37 @@ endLoop2:
 			}
 		}()
 
-		err = types.ComposeCompliantDat(fixDat, fixWriter)
+		err = types.ComposeDatAs(fixDat, format, fixWriter)
 		if err != nil {
-			return false, err
+			return nil, err
 		}
 	}
 
-	return len(fixDat.Games) > 0, nil
+	stats.finish()
+	return stats, nil
+}
+
+func writeBuildErrors(dat *types.Dat, failures []*BuildFailure, errorsPath string) error {
+	glog.Warningf("%d games of dat %s failed to build, see %s", len(failures), dat.Name, errorsPath)
+
+	errorsFile, err := os.Create(errorsPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := errorsFile.Close()
+		if err != nil {
+			glog.Errorf("error, failed to close %s: %v", errorsPath, err)
+		}
+	}()
+
+	enc := json.NewEncoder(errorsFile)
+	enc.SetIndent("", "  ")
+	return enc.Encode(&buildErrorReport{
+		Dat:      dat.Name,
+		Path:     dat.Path,
+		Failures: failures,
+	})
 }
 
 type nopWriterCloser struct {
@@ -259,9 +373,16 @@ func cpGZUncompressed(srcName, dstName string) error {
 }
 
 func (depot *Depot) buildGame(game *types.Game, gamePath string,
-	unzipGame bool, deduper dedup.Deduper, sha1Tree int) (*types.Game, bool, error) {
+	unzipGame bool, deduper dedup.Deduper, sha1Tree int, gt *gameTally) (_ *types.Game, _ bool, rerr error) {
 
 	var gameTorrent *torrentzip.Writer
+	var curRom *types.Rom
+
+	defer func() {
+		if rerr != nil && curRom != nil {
+			rerr = &RomBuildError{Rom: curRom, Err: rerr}
+		}
+	}()
 
 	glog.V(4).Infof("building game %s with path %s", game.Name, gamePath)
 
@@ -295,7 +416,12 @@ func (depot *Depot) buildGame(game *types.Game, gamePath string,
 				}
 			}()
 
-			gameTorrent, err = torrentzip.NewWriterWithTemp(gameFile, config.GlobalConfig.General.TmpDir)
+			cw := &countWriter{w: gameFile}
+			defer func() {
+				gt.bytes += cw.count
+			}()
+
+			gameTorrent, err = torrentzip.NewWriterWithTemp(cw, config.GlobalConfig.General.TmpDir)
 			if err != nil {
 				glog.Errorf("error writing to torrentzip file %s: %v", gamePath+zipSuffix, err)
 				return nil, false, err
@@ -314,6 +440,8 @@ func (depot *Depot) buildGame(game *types.Game, gamePath string,
 	foundRom := false
 
 	for _, rom := range game.Roms {
+		curRom = rom
+
 		croms, err := depot.RomDB.CompleteRom(rom)
 		if err != nil {
 			glog.Errorf("error completing rom %s: %v", rom.Name, err)
@@ -324,7 +452,9 @@ func (depot *Depot) buildGame(game *types.Game, gamePath string,
 			game.Roms = append(game.Roms, croms...)
 		}
 
-		if rom.Sha1 == nil && rom.Size > 0 {
+		if rom.Sha1 == nil && rom.Size != 0 {
+			gt.miss++
+
 			if fixGame == nil {
 				fixGame = new(types.Game)
 				fixGame.Name = game.Name
@@ -341,6 +471,10 @@ func (depot *Depot) buildGame(game *types.Game, gamePath string,
 		}
 
 		if seenRom {
+			err = depot.tallyRom(rom, gt)
+			if err != nil {
+				return nil, false, err
+			}
 			continue
 		}
 
@@ -359,11 +493,13 @@ func (depot *Depot) buildGame(game *types.Game, gamePath string,
 			}
 
 			if !exists {
+				gt.miss++
 				if glog.V(2) {
 					glog.Warningf("game %s has missing rom %s (sha1 %s)", game.Name, rom.Name,
 						hexStr)
 				}
 			} else {
+				gt.have++
 				var destPath string
 				if sha1Tree == 1 {
 					destPath = pathFromSha1HexEncoding(gamePath, hexStr, gzipSuffix)
@@ -376,6 +512,9 @@ func (depot *Depot) buildGame(game *types.Game, gamePath string,
 					glog.Errorf("error copying rom %s from depot to %s: %v", rompath, destPath, err)
 					return nil, false, err
 				}
+				if fi, err := os.Stat(destPath); err == nil {
+					gt.bytes += fi.Size()
+				}
 			}
 			continue
 		}
@@ -387,6 +526,7 @@ func (depot *Depot) buildGame(game *types.Game, gamePath string,
 		}
 
 		if romGZ == nil {
+			gt.miss++
 			if glog.V(2) {
 				glog.Warningf("game %s has missing rom %s (sha1 %s)", game.Name, rom.Name,
 					hex.EncodeToString(rom.Sha1))
@@ -403,6 +543,7 @@ func (depot *Depot) buildGame(game *types.Game, gamePath string,
 		}
 
 		foundRom = true
+		gt.have++
 
 		src, err := gzip.NewReader(romGZ)
 		if err != nil {
@@ -435,11 +576,14 @@ func (depot *Depot) buildGame(game *types.Game, gamePath string,
 			}
 			dstWriter = nopWriterCloser{dst}
 		}
-		_, err = io.Copy(dstWriter, src)
+		n, err := io.Copy(dstWriter, src)
 		if err != nil {
 			glog.Errorf("error copying rom %s: %v", rom.Name, err)
 			return nil, false, err
 		}
+		if unzipGame {
+			gt.bytes += n
+		}
 
 		err = src.Close()
 		if err != nil {
@@ -0,0 +1,160 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/dedup"
+	"github.com/uwedeportivo/romba/types"
+)
+
+// addCorruptTestRom puts a file into the depot that claims to hold content but isn't
+// a gzip, so building a game with it fails.
+func addCorruptTestRom(t *testing.T, depot *Depot, name, content string) *types.Rom {
+	sha1Bytes := sha1.Sum([]byte(content))
+	sha1Hex := hex.EncodeToString(sha1Bytes[:])
+
+	outpath := pathFromSha1HexEncoding(depot.roots[0].path, sha1Hex, gzipSuffix)
+	err := os.MkdirAll(filepath.Dir(outpath), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(outpath, []byte("not a gzip"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	depot.adjustSize(0, 10, sha1Hex)
+
+	return &types.Rom{
+		Name: name,
+		Size: int64(len(content)),
+		Sha1: sha1Bytes[:],
+	}
+}
+
+func TestBuildDatKeepGoing(t *testing.T) {
+	depot := NewTestDepot(t, new(db.NoOpDB))
+	romA := AddTestRom(t, depot, "a.bin", "rom a", true)
+	romB := AddTestRom(t, depot, "b.bin", "rom b", true)
+	romC := AddTestRom(t, depot, "c.bin", "rom c", true)
+	romX := addCorruptTestRom(t, depot, "x.bin", "rom x")
+	romM := &types.Rom{Name: "m.bin", Size: 5, Sha1: make([]byte, sha1.Size)}
+
+	dat := &types.Dat{
+		Name: "test",
+		Path: "/dats/test.dat",
+		Games: types.GameSlice{
+			{Name: "good", Roms: types.RomSlice{romA}},
+			{Name: "half", Roms: types.RomSlice{romB, romM}},
+			{Name: "bad", Roms: types.RomSlice{romC, romX}},
+		},
+	}
+	names, err := types.NewNameMapper("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outpath := t.TempDir()
+	stats, err := depot.BuildDat(dat, outpath, 1, dedup.NewMemoryDeduper(), false, 0, true,
+		types.FormatDat, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.GamesTotal != 3 || stats.GamesComplete != 1 || stats.GamesPartial != 1 ||
+		stats.GamesMissing != 0 || stats.GamesFailed != 1 {
+		t.Fatalf("unexpected game counts: %+v", stats)
+	}
+	if stats.RomsHave != 2 || stats.RomsMiss != 3 || !stats.Incomplete() {
+		t.Fatalf("unexpected rom counts: %+v", stats)
+	}
+	if stats.BytesWritten <= 0 {
+		t.Fatalf("expected bytes written to be counted: %+v", stats)
+	}
+
+	for _, name := range []string{"good.zip", "half.zip"} {
+		if _, err := os.Stat(filepath.Join(outpath, "test", name)); err != nil {
+			t.Fatalf("expected %s to be built: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(outpath, "test", "bad.zip")); !os.IsNotExist(err) {
+		t.Fatalf("expected partial output of failed game to be removed: %v", err)
+	}
+
+	bs, err := ioutil.ReadFile(filepath.Join(outpath, "build-errors-test.dat.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report buildErrorReport
+	err = json.Unmarshal(bs, &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Dat != "test" || report.Path != "/dats/test.dat" || len(report.Failures) != 1 {
+		t.Fatalf("unexpected build errors report: %s", bs)
+	}
+	bf := report.Failures[0]
+	if bf.Game != "bad" || bf.Rom != "x.bin" || bf.Sha1 != hex.EncodeToString(romX.Sha1) || bf.Error == "" {
+		t.Fatalf("unexpected build failure: %+v", bf)
+	}
+}
+
+func TestBuildDatStopsOnFailure(t *testing.T) {
+	depot := NewTestDepot(t, new(db.NoOpDB))
+	romX := addCorruptTestRom(t, depot, "x.bin", "rom x")
+
+	dat := &types.Dat{
+		Name:  "test",
+		Games: types.GameSlice{{Name: "bad", Roms: types.RomSlice{romX}}},
+	}
+	names, err := types.NewNameMapper("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outpath := t.TempDir()
+	_, err = depot.BuildDat(dat, outpath, 1, dedup.NewMemoryDeduper(), false, 0, false,
+		types.FormatDat, names)
+	if _, ok := err.(*RomBuildError); !ok {
+		t.Fatalf("expected a rom build error, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(outpath, "build-errors-test.json")); !os.IsNotExist(err) {
+		t.Fatalf("expected no build errors report without keep going: %v", err)
+	}
+}
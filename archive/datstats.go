@@ -0,0 +1,129 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// DatStats summarizes a build or fixdat run of a single DAT.
+type DatStats struct {
+	Dat           string  `json:"dat"`
+	Path          string  `json:"path"`
+	GamesTotal    int     `json:"games_total"`
+	GamesComplete int     `json:"games_complete"`
+	GamesPartial  int     `json:"games_partial"`
+	GamesMissing  int     `json:"games_missing"`
+	GamesFailed   int     `json:"games_failed,omitempty"`
+	RomsHave      int     `json:"roms_have"`
+	RomsMiss      int     `json:"roms_miss"`
+	BytesWritten  int64   `json:"bytes_written"`
+	Duration      float64 `json:"duration_seconds"`
+
+	Renames []*types.Rename `json:"renames,omitempty"`
+
+	mutex sync.Mutex
+	start time.Time
+}
+
+func newDatStats(dat *types.Dat) *DatStats {
+	return &DatStats{
+		Dat:   dat.Name,
+		Path:  dat.Path,
+		start: time.Now(),
+	}
+}
+
+// Incomplete reports whether any rom of the DAT is missing.
+func (ds *DatStats) Incomplete() bool {
+	return ds.RomsMiss > 0
+}
+
+func (ds *DatStats) addGame(gt *gameTally) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	ds.GamesTotal++
+	switch {
+	case gt.miss == 0:
+		ds.GamesComplete++
+	case gt.have == 0:
+		ds.GamesMissing++
+	default:
+		ds.GamesPartial++
+	}
+	ds.RomsHave += gt.have
+	ds.RomsMiss += gt.miss
+	ds.BytesWritten += gt.bytes
+}
+
+func (ds *DatStats) addFailedGame(game *types.Game) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	ds.GamesTotal++
+	ds.GamesFailed++
+	ds.RomsMiss += len(game.Roms)
+}
+
+func (ds *DatStats) finish() {
+	ds.Duration = time.Since(ds.start).Seconds()
+}
+
+// gameTally counts the roms of a single game.
+type gameTally struct {
+	have  int
+	miss  int
+	bytes int64
+}
+
+// tallyRom counts rom as have or miss depending on whether it is in the depot.
+func (depot *Depot) tallyRom(rom *types.Rom, gt *gameTally) error {
+	if rom.Size == 0 {
+		gt.have++
+		return nil
+	}
+
+	exists, _, err := depot.RomInDepot(hex.EncodeToString(rom.Sha1))
+	if err != nil {
+		return err
+	}
+	if exists {
+		gt.have++
+	} else {
+		gt.miss++
+	}
+	return nil
+}
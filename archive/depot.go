@@ -214,6 +214,7 @@ func (depot *Depot) SHA1InDepot(sha1Hex string) (bool, *Hashes, string, int64, e
 			} else {
 				glog.Warningf("rom %s has missing gzip md5 or crc header", rompath)
 			}
+			hh.Size = size
 
 			depot.cache.Set(sha1Hex, &cacheValue{
 				hh:        hh,
@@ -79,7 +79,9 @@ func (rw *romWalker) visit(path string, f os.FileInfo, err error) error {
 	return nil
 }
 
-func Dir2Dat(dat *types.Dat, srcpath, outpath string) error {
+// Dir2Dat writes a DAT of the files in srcpath to outpath. File names are
+// mapped to safe paths by names and the renames are returned.
+func Dir2Dat(dat *types.Dat, srcpath, outpath, format string, names *types.NameMapper) ([]*types.Rename, error) {
 	glog.Infof("composing DAT from source %s into output %s", srcpath, outpath)
 
 	rw := &romWalker{
@@ -89,17 +91,22 @@ func Dir2Dat(dat *types.Dat, srcpath, outpath string) error {
 
 	err := filepath.Walk(srcpath, rw.visit)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	dat, renames, err := names.SanitizeDat(dat)
+	if err != nil {
+		return nil, err
 	}
 
 	outf, err := os.Create(outpath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer outf.Close()
 
 	outbuf := bufio.NewWriter(outf)
 	defer outbuf.Flush()
 
-	return types.ComposeCompliantDat(dat, outbuf)
+	return renames, types.ComposeDatAs(dat, format, outbuf)
 }
@@ -0,0 +1,740 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/util"
+	"github.com/uwedeportivo/romba/worker"
+	"github.com/uwedeportivo/torrentzip"
+)
+
+type FixStatus int
+
+const (
+	FixCorrect FixStatus = iota
+	FixMisnamed
+	FixUnneeded
+	FixMissing
+)
+
+func (fs FixStatus) String() string {
+	switch fs {
+	case FixCorrect:
+		return "correct"
+	case FixMisnamed:
+		return "misnamed"
+	case FixUnneeded:
+		return "unneeded"
+	case FixMissing:
+		return "missing"
+	}
+	return "unknown"
+}
+
+// FixEntry is one line of a set audit. Target is the correct rom name for misnamed
+// entries. Fixed is set once the entry has been repaired (or could be in a dry run).
+type FixEntry struct {
+	Status    FixStatus
+	Game      string
+	Name      string
+	Target    string
+	Container string
+	Sha1      []byte
+	Fixed     bool
+}
+
+type FixReport struct {
+	DryRun  bool
+	Entries []*FixEntry
+	Renames []*types.Rename
+}
+
+func (fr *FixReport) add(fe *FixEntry) {
+	fr.Entries = append(fr.Entries, fe)
+}
+
+// Count returns the number of entries with the given status.
+func (fr *FixReport) Count(status FixStatus) int {
+	n := 0
+	for _, fe := range fr.Entries {
+		if fe.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// Fixable returns the number of entries with the given status that were or can be fixed.
+func (fr *FixReport) Fixable(status FixStatus) int {
+	n := 0
+	for _, fe := range fr.Entries {
+		if fe.Status == status && fe.Fixed {
+			n++
+		}
+	}
+	return n
+}
+
+func (fr *FixReport) Summary() string {
+	return fmt.Sprintf("%d correct, %d misnamed, %d unneeded, %d missing (%d of them available in depot)",
+		fr.Count(FixCorrect), fr.Count(FixMisnamed), fr.Count(FixUnneeded), fr.Count(FixMissing),
+		fr.Fixable(FixMissing))
+}
+
+func (fr *FixReport) Print(w io.Writer) error {
+	for _, r := range fr.Renames {
+		_, err := fmt.Fprintln(w, r)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, fe := range fr.Entries {
+		if fe.Status == FixCorrect {
+			continue
+		}
+
+		var action string
+		switch fe.Status {
+		case FixMisnamed:
+			action = "rename to " + fe.Target
+		case FixUnneeded:
+			action = "move to backup"
+		case FixMissing:
+			if fe.Fixed {
+				action = "add from depot"
+			} else {
+				action = "not in depot"
+			}
+		}
+		if fe.Fixed && !fr.DryRun {
+			action += " (done)"
+		}
+
+		_, err := fmt.Fprintf(w, "%-8s %s: %s [%s] %s\n", fe.Status, fe.Container, fe.Name,
+			hex.EncodeToString(fe.Sha1), action)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%s\n", fr.Summary())
+	return err
+}
+
+// fixItem is a rom found in the set, either a zip entry or a loose file.
+type fixItem struct {
+	name  string
+	path  string
+	zf    *zip.File
+	rom   *types.Rom
+	entry *FixEntry
+	want  *types.Rom
+}
+
+type fixContainer struct {
+	game    *types.Game
+	path    string
+	zipped  bool
+	items   []*fixItem
+	missing []*types.Rom
+	changed bool
+	relName string
+}
+
+type setFixer struct {
+	depot      *Depot
+	dat        *types.Dat
+	setPath    string
+	backupPath string
+	dryRun     bool
+	report     *FixReport
+	games      map[string]*types.Game
+	seen       map[string]bool
+	numUnsafe  int
+}
+
+func normalizeRomName(name string) string {
+	return strings.Replace(name, "\\", "/", -1)
+}
+
+// FixSet audits the set in setPath against dat and, unless dryRun is set, repairs it in place:
+// misnamed roms are renamed, unneeded files are moved into backupPath and missing roms are added
+// from the depot. Zipped games that change are rewritten as torrentzips. Game and rom names are
+// mapped to safe paths by names first and the renames are listed in the report.
+func (depot *Depot) FixSet(dat *types.Dat, setPath, backupPath string, dryRun bool,
+	names *types.NameMapper) (*FixReport, error) {
+	dat, renames, err := names.SanitizeDat(dat)
+	if err != nil {
+		return nil, err
+	}
+
+	sf := &setFixer{
+		depot:      depot,
+		dat:        dat,
+		setPath:    setPath,
+		backupPath: backupPath,
+		dryRun:     dryRun,
+		report:     &FixReport{DryRun: dryRun, Renames: renames},
+		games:      make(map[string]*types.Game),
+		seen:       make(map[string]bool),
+	}
+
+	for _, game := range dat.Games {
+		sf.games[normalizeRomName(game.Name)] = game
+	}
+
+	err = filepath.Walk(setPath, sf.visit)
+	if err != nil {
+		return nil, err
+	}
+
+	unseen := make([]string, 0, len(sf.games))
+	for name := range sf.games {
+		if !sf.seen[name] {
+			unseen = append(unseen, name)
+		}
+	}
+	sort.Strings(unseen)
+
+	for _, name := range unseen {
+		game := sf.games[name]
+		fc := &fixContainer{
+			game:    game,
+			relName: name,
+			zipped:  !dat.UnzipGames,
+		}
+		if fc.zipped {
+			fc.path = filepath.Join(setPath, filepath.FromSlash(name)+zipSuffix)
+		} else {
+			fc.path = filepath.Join(setPath, filepath.FromSlash(name))
+		}
+		err = sf.fixGame(fc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return sf.report, nil
+}
+
+func (sf *setFixer) visit(path string, info os.FileInfo, err error) error {
+	if err != nil {
+		return err
+	}
+	if path == sf.setPath {
+		return nil
+	}
+
+	rel, err := filepath.Rel(sf.setPath, path)
+	if err != nil {
+		return err
+	}
+	rel = filepath.ToSlash(rel)
+
+	if info.IsDir() {
+		if game, ok := sf.games[rel]; ok && sf.dat.UnzipGames {
+			sf.seen[rel] = true
+			err = sf.fixGame(&fixContainer{game: game, path: path, relName: rel})
+			if err != nil {
+				return err
+			}
+			return filepath.SkipDir
+		}
+		return nil
+	}
+
+	if strings.HasSuffix(rel, zipSuffix) {
+		name := strings.TrimSuffix(rel, zipSuffix)
+		if game, ok := sf.games[name]; ok && !sf.dat.UnzipGames {
+			sf.seen[name] = true
+			return sf.fixGame(&fixContainer{game: game, path: path, relName: name, zipped: true})
+		}
+	}
+
+	fe := &FixEntry{
+		Status:    FixUnneeded,
+		Name:      filepath.Base(path),
+		Container: filepath.Dir(rel),
+		Fixed:     true,
+	}
+	sf.report.add(fe)
+
+	if !sf.dryRun {
+		err = worker.Mv(path, filepath.Join(sf.backupPath, filepath.FromSlash(rel)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// identifyZipEntry hashes a zip entry. If the entry's CRC and size resolve to exactly one
+// SHA1 in the index we trust that instead of decompressing.
+func (sf *setFixer) identifyZipEntry(zf *zip.File) (*types.Rom, error) {
+	rom := &types.Rom{
+		Name: normalizeRomName(zf.Name),
+		Size: int64(zf.UncompressedSize64),
+		Crc:  make([]byte, crc32.Size),
+	}
+	binary.BigEndian.PutUint32(rom.Crc, zf.CRC32)
+
+	croms, err := sf.depot.RomDB.CompleteRom(rom)
+	if err != nil {
+		return nil, err
+	}
+	if rom.Sha1 != nil && len(croms) == 0 {
+		return rom, nil
+	}
+
+	rc, err := zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	hh, err := hashesForReader(rc)
+	if err != nil {
+		return nil, err
+	}
+	rom.Crc = hh.Crc
+	rom.Md5 = hh.Md5
+	rom.Sha1 = hh.Sha1
+	return rom, nil
+}
+
+func identifyFile(path, name string, size int64) (*types.Rom, error) {
+	hh, err := HashesForFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &types.Rom{
+		Name: name,
+		Size: size,
+		Crc:  hh.Crc,
+		Md5:  hh.Md5,
+		Sha1: hh.Sha1,
+	}, nil
+}
+
+func romMatches(want, have *types.Rom) bool {
+	if want.Size >= 0 && want.Size != have.Size {
+		return false
+	}
+	if want.Sha1 != nil && have.Sha1 != nil {
+		return bytes.Equal(want.Sha1, have.Sha1)
+	}
+	if want.Size < 0 {
+		// hash files don't record sizes
+		return (want.Crc != nil && bytes.Equal(want.Crc, have.Crc)) ||
+			(want.Md5 != nil && bytes.Equal(want.Md5, have.Md5))
+	}
+	return want.HashesMatch(have)
+}
+
+func (sf *setFixer) scanContainer(fc *fixContainer) error {
+	if fc.zipped {
+		zr, err := zip.OpenReader(fc.path)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+
+		for _, zf := range zr.File {
+			if zf.FileInfo().IsDir() {
+				continue
+			}
+			rom, err := sf.identifyZipEntry(zf)
+			if err != nil {
+				return fmt.Errorf("error reading %s from %s: %v", zf.Name, fc.path, err)
+			}
+			fc.items = append(fc.items, &fixItem{name: rom.Name, rom: rom})
+		}
+		return nil
+	}
+
+	return filepath.Walk(fc.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(fc.path, path)
+		if err != nil {
+			return err
+		}
+		rom, err := identifyFile(path, filepath.ToSlash(rel), info.Size())
+		if err != nil {
+			return err
+		}
+		fc.items = append(fc.items, &fixItem{name: rom.Name, path: path, rom: rom})
+		return nil
+	})
+}
+
+func (sf *setFixer) fixGame(fc *fixContainer) error {
+	exists, err := PathExists(fc.path)
+	if err != nil {
+		return err
+	}
+	if exists {
+		err = sf.scanContainer(fc)
+		if err != nil {
+			return err
+		}
+	}
+
+	wants := make([]*types.Rom, 0, len(fc.game.Roms))
+	for _, rom := range fc.game.Roms {
+		r, err := sf.depot.resolveRom(rom)
+		if err != nil {
+			return err
+		}
+		if r == nil {
+			r = rom
+		}
+		w := new(types.Rom)
+		*w = *r
+		w.Name = normalizeRomName(rom.Name)
+		wants = append(wants, w)
+	}
+	satisfied := make([]bool, len(wants))
+
+	for _, item := range fc.items {
+		for i, want := range wants {
+			if !satisfied[i] && want.Name == item.name && romMatches(want, item.rom) {
+				satisfied[i] = true
+				item.want = want
+				item.entry = &FixEntry{Status: FixCorrect}
+				break
+			}
+		}
+	}
+
+	for _, item := range fc.items {
+		if item.entry != nil {
+			continue
+		}
+		for i, want := range wants {
+			if !satisfied[i] && romMatches(want, item.rom) {
+				satisfied[i] = true
+				item.want = want
+				item.entry = &FixEntry{Status: FixMisnamed, Target: want.Name, Fixed: true}
+				fc.changed = true
+				break
+			}
+		}
+		if item.entry == nil {
+			item.entry = &FixEntry{Status: FixUnneeded, Fixed: true}
+			fc.changed = true
+		}
+	}
+
+	for _, item := range fc.items {
+		item.entry.Game = fc.game.Name
+		item.entry.Name = item.name
+		item.entry.Container = fc.relName
+		item.entry.Sha1 = item.rom.Sha1
+		sf.report.add(item.entry)
+	}
+
+	for i, want := range wants {
+		if satisfied[i] {
+			continue
+		}
+		fe := &FixEntry{
+			Status:    FixMissing,
+			Game:      fc.game.Name,
+			Name:      want.Name,
+			Container: fc.relName,
+			Sha1:      want.Sha1,
+		}
+		if want.Size == 0 {
+			fe.Fixed = true
+		} else if want.Sha1 != nil {
+			inDepot, _, err := sf.depot.RomInDepot(hex.EncodeToString(want.Sha1))
+			if err != nil {
+				return err
+			}
+			fe.Fixed = inDepot
+		}
+		if fe.Fixed {
+			fc.missing = append(fc.missing, want)
+			fc.changed = true
+		}
+		sf.report.add(fe)
+	}
+
+	if sf.dryRun || !fc.changed {
+		return nil
+	}
+
+	if fc.zipped {
+		return sf.rewriteZip(fc)
+	}
+	return sf.fixDir(fc)
+}
+
+// backupItemPath returns where the unneeded item goes under the backup path. Zip entry
+// names are untrusted, names that are absolute or lead out of the zip are replaced.
+func (sf *setFixer) backupItemPath(fc *fixContainer, item *fixItem) (string, error) {
+	name, ok := util.ArchiveEntryName(item.name)
+	if !ok {
+		sf.numUnsafe++
+		name = fmt.Sprintf("unsafe-entry-%d", sf.numUnsafe)
+		glog.Warningf("backing up entry %q of %s as %s, it is not a relative path inside the zip",
+			item.name, fc.path, name)
+	}
+
+	backupPath := filepath.Join(sf.backupPath, filepath.FromSlash(fc.relName), name)
+	rel, err := filepath.Rel(sf.backupPath, backupPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("backup of %s in %s leads out of %s", item.name, fc.path, sf.backupPath)
+	}
+	return backupPath, nil
+}
+
+func (sf *setFixer) rewriteZip(fc *fixContainer) error {
+	glog.V(2).Infof("fixing %s", fc.path)
+
+	err := os.MkdirAll(filepath.Dir(fc.path), 0777)
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := ioutil.TempFile(filepath.Dir(fc.path), ".romba-fix-")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmpFile.Name()
+
+	n, err := sf.writeFixedZip(fc, tmpFile)
+	cerr := tmpFile.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if n == 0 {
+		// nothing left worth keeping in this zip
+		err = os.Remove(tmpPath)
+		if err != nil {
+			return err
+		}
+		return os.Remove(fc.path)
+	}
+	return os.Rename(tmpPath, fc.path)
+}
+
+func (sf *setFixer) writeFixedZip(fc *fixContainer, w io.Writer) (int, error) {
+	tz, err := torrentzip.NewWriterWithTemp(w, config.GlobalConfig.General.TmpDir)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+
+	if len(fc.items) > 0 {
+		zr, err := zip.OpenReader(fc.path)
+		if err != nil {
+			tz.Close()
+			return 0, err
+		}
+		defer zr.Close()
+
+		for _, zf := range zr.File {
+			if zf.FileInfo().IsDir() {
+				continue
+			}
+			var item *fixItem
+			for _, it := range fc.items {
+				if it.name == normalizeRomName(zf.Name) && it.zf == nil {
+					item = it
+					it.zf = zf
+					break
+				}
+			}
+			if item == nil {
+				continue
+			}
+
+			if item.entry.Status == FixUnneeded {
+				var backupPath string
+				backupPath, err = sf.backupItemPath(fc, item)
+				if err == nil {
+					err = extractZipEntry(zf, backupPath)
+				}
+			} else {
+				err = copyZipEntry(tz, zf, item.want.Name)
+				n++
+			}
+			if err != nil {
+				tz.Close()
+				return 0, err
+			}
+		}
+	}
+
+	for _, rom := range fc.missing {
+		written, err := sf.depot.writeRomEntry(tz, rom)
+		if err != nil {
+			tz.Close()
+			return 0, err
+		}
+		if !written {
+			tz.Close()
+			return 0, fmt.Errorf("rom %s for game %s disappeared from depot", rom.Name, fc.game.Name)
+		}
+		n++
+	}
+
+	return n, tz.Close()
+}
+
+func copyZipEntry(tz *torrentzip.Writer, zf *zip.File, name string) error {
+	rc, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	dst, err := tz.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, rc)
+	return err
+}
+
+func extractZipEntry(zf *zip.File, dstPath string) error {
+	rc, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	err = os.MkdirAll(filepath.Dir(dstPath), 0777)
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, rc)
+	cerr := dst.Close()
+	if err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (sf *setFixer) fixDir(fc *fixContainer) error {
+	glog.V(2).Infof("fixing %s", fc.path)
+
+	// move everything that needs to go out of the way first, so renames can't collide
+	var renames []*fixItem
+	for i, item := range fc.items {
+		switch item.entry.Status {
+		case FixUnneeded:
+			backupPath, err := sf.backupItemPath(fc, item)
+			if err != nil {
+				return err
+			}
+			err = worker.Mv(item.path, backupPath)
+			if err != nil {
+				return err
+			}
+		case FixMisnamed:
+			tmpPath := filepath.Join(fc.path, fmt.Sprintf(".romba-fix-%d", i))
+			err := os.Rename(item.path, tmpPath)
+			if err != nil {
+				return err
+			}
+			item.path = tmpPath
+			renames = append(renames, item)
+		}
+	}
+
+	for _, item := range renames {
+		err := worker.Mv(item.path, filepath.Join(fc.path, filepath.FromSlash(item.want.Name)))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, rom := range fc.missing {
+		dstPath := filepath.Join(fc.path, filepath.FromSlash(rom.Name))
+		if rom.Size == 0 {
+			err := os.MkdirAll(filepath.Dir(dstPath), 0777)
+			if err != nil {
+				return err
+			}
+			err = ioutil.WriteFile(dstPath, nil, 0666)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		_, rompath, err := sf.depot.RomInDepot(hex.EncodeToString(rom.Sha1))
+		if err != nil {
+			return err
+		}
+		err = cpGZUncompressed(rompath, dstPath)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
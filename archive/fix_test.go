@@ -0,0 +1,293 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/types"
+)
+
+func writeTestZip(t *testing.T, path string, entries [][2]string) {
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	for _, e := range entries {
+		w, err := zw.Create(e[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write([]byte(e[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path, buf.Bytes(), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestZip(t *testing.T, path string) (map[string]string, string) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+
+	entries := make(map[string]string)
+	for _, zf := range zr.File {
+		rc, err := zf.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		bs, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[zf.Name] = string(bs)
+	}
+	return entries, zr.Comment
+}
+
+func readTestFile(t *testing.T, path string) string {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(bs)
+}
+
+func checkFixCounts(t *testing.T, fr *FixReport, correct, misnamed, unneeded, missing int) {
+	if fr.Count(FixCorrect) != correct || fr.Count(FixMisnamed) != misnamed ||
+		fr.Count(FixUnneeded) != unneeded || fr.Count(FixMissing) != missing {
+		t.Fatalf("unexpected fix report: %s", fr.Summary())
+	}
+}
+
+func TestFixSetZipped(t *testing.T) {
+	depot := NewTestDepot(t, new(db.NoOpDB))
+	romA := AddTestRom(t, depot, "a.bin", "rom a", true)
+	romB := AddTestRom(t, depot, "b.bin", "rom b", true)
+	romC := AddTestRom(t, depot, "c.bin", "rom c", true)
+
+	dat := &types.Dat{
+		Name: "test",
+		Games: types.GameSlice{
+			{Name: "g", Roms: types.RomSlice{romA, romB, romC}},
+		},
+	}
+	names, err := types.NewNameMapper("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setPath := t.TempDir()
+	backupPath := t.TempDir()
+	zipPath := filepath.Join(setPath, "g.zip")
+	writeTestZip(t, zipPath, [][2]string{
+		{"a.bin", "rom a"},
+		{"wrong.bin", "rom b"},
+		{"junk.txt", "junk"},
+	})
+	err = ioutil.WriteFile(filepath.Join(setPath, "stray.txt"), []byte("stray"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := readTestFile(t, zipPath)
+
+	fr, err := depot.FixSet(dat, setPath, backupPath, true, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFixCounts(t, fr, 1, 1, 2, 1)
+	if fr.Fixable(FixMissing) != 1 {
+		t.Fatalf("expected missing rom to be available in depot: %s", fr.Summary())
+	}
+	if readTestFile(t, zipPath) != before {
+		t.Fatalf("dry run modified %s", zipPath)
+	}
+	if _, err := os.Stat(filepath.Join(setPath, "stray.txt")); err != nil {
+		t.Fatalf("dry run moved stray file: %v", err)
+	}
+
+	fr, err = depot.FixSet(dat, setPath, backupPath, false, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFixCounts(t, fr, 1, 1, 2, 1)
+
+	entries, comment := readTestZip(t, zipPath)
+	if len(entries) != 3 || entries["a.bin"] != "rom a" || entries["b.bin"] != "rom b" ||
+		entries["c.bin"] != "rom c" {
+		t.Fatalf("unexpected entries in fixed zip: %v", entries)
+	}
+	if !strings.HasPrefix(comment, "TORRENTZIPPED-") {
+		t.Fatalf("fixed zip is not a torrentzip, comment %q", comment)
+	}
+
+	if readTestFile(t, filepath.Join(backupPath, "g", "junk.txt")) != "junk" {
+		t.Fatalf("unneeded zip entry not moved to backup")
+	}
+	if readTestFile(t, filepath.Join(backupPath, "stray.txt")) != "stray" {
+		t.Fatalf("unneeded file not moved to backup")
+	}
+	if _, err := os.Stat(filepath.Join(setPath, "stray.txt")); !os.IsNotExist(err) {
+		t.Fatalf("unneeded file still in set: %v", err)
+	}
+
+	fixed := readTestFile(t, zipPath)
+	fr, err = depot.FixSet(dat, setPath, backupPath, false, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFixCounts(t, fr, 3, 0, 0, 0)
+	if readTestFile(t, zipPath) != fixed {
+		t.Fatalf("fixing a correct set rewrote %s", zipPath)
+	}
+}
+
+func TestFixSetUnsafeEntry(t *testing.T) {
+	depot := NewTestDepot(t, new(db.NoOpDB))
+	romA := AddTestRom(t, depot, "a.bin", "rom a", true)
+
+	dat := &types.Dat{
+		Name: "test",
+		Games: types.GameSlice{
+			{Name: "g", Roms: types.RomSlice{romA}},
+		},
+	}
+	names, err := types.NewNameMapper("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	setPath := filepath.Join(dir, "set")
+	backupPath := filepath.Join(dir, "backup")
+	zipPath := filepath.Join(setPath, "g.zip")
+	err = os.MkdirAll(setPath, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestZip(t, zipPath, [][2]string{
+		{"a.bin", "rom a"},
+		{"../../escape.bin", "escape"},
+		{"sub/../inside.bin", "inside"},
+	})
+
+	fr, err := depot.FixSet(dat, setPath, backupPath, false, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFixCounts(t, fr, 1, 0, 2, 0)
+
+	if _, err := os.Stat(filepath.Join(dir, "escape.bin")); !os.IsNotExist(err) {
+		t.Fatalf("unneeded zip entry written outside of backup: %v", err)
+	}
+	if readTestFile(t, filepath.Join(backupPath, "g", "unsafe-entry-1")) != "escape" {
+		t.Fatalf("unsafe zip entry not moved to backup under a generated name")
+	}
+	if readTestFile(t, filepath.Join(backupPath, "g", "inside.bin")) != "inside" {
+		t.Fatalf("unneeded zip entry not moved to backup")
+	}
+
+	entries, _ := readTestZip(t, zipPath)
+	if len(entries) != 1 || entries["a.bin"] != "rom a" {
+		t.Fatalf("unexpected entries in fixed zip: %v", entries)
+	}
+}
+
+func TestFixSetUnzipped(t *testing.T) {
+	depot := NewTestDepot(t, new(db.NoOpDB))
+	romA := AddTestRom(t, depot, "a.bin", "rom a", true)
+	romB := AddTestRom(t, depot, "b.bin", "rom b", true)
+
+	dat := &types.Dat{
+		Name:       "test",
+		UnzipGames: true,
+		Games: types.GameSlice{
+			{Name: "h", Roms: types.RomSlice{romA, romB}},
+		},
+	}
+	names, err := types.NewNameMapper("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setPath := t.TempDir()
+	backupPath := t.TempDir()
+	gameDir := filepath.Join(setPath, "h")
+	err = os.Mkdir(gameDir, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"old.bin": "rom a", "extra.txt": "extra"} {
+		err = ioutil.WriteFile(filepath.Join(gameDir, name), []byte(content), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fr, err := depot.FixSet(dat, setPath, backupPath, false, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFixCounts(t, fr, 0, 1, 1, 1)
+
+	if readTestFile(t, filepath.Join(gameDir, "a.bin")) != "rom a" {
+		t.Fatalf("misnamed rom not renamed")
+	}
+	if readTestFile(t, filepath.Join(gameDir, "b.bin")) != "rom b" {
+		t.Fatalf("missing rom not added from depot")
+	}
+	if readTestFile(t, filepath.Join(backupPath, "h", "extra.txt")) != "extra" {
+		t.Fatalf("unneeded file not moved to backup")
+	}
+	fis, err := ioutil.ReadDir(gameDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fis) != 2 {
+		t.Fatalf("expected only the dat roms in %s, found %d files", gameDir, len(fis))
+	}
+}
@@ -53,18 +53,21 @@ type fixdatBuilder struct {
 	index     int
 	deduper   dedup.Deduper
 	bloomOnly bool
+	stats     *DatStats
 }
 
 func (gb *fixdatBuilder) work() {
 	glog.V(4).Infof("starting subworker %d", gb.index)
 	for game := range gb.wc {
 		gamePath := filepath.Join(gb.datPath, game.Name)
-		fixGame, err := gb.depot.fixdatGame(game, gamePath, gb.fixDat.UnzipGames, gb.deduper, gb.bloomOnly)
+		gt := new(gameTally)
+		fixGame, err := gb.depot.fixdatGame(game, gamePath, gb.fixDat.UnzipGames, gb.deduper, gb.bloomOnly, gt)
 		if err != nil {
 			glog.Errorf("error processing %s: %v", gamePath, err)
 			gb.erc <- err
 			break
 		}
+		gb.stats.addGame(gt)
 		if fixGame != nil {
 			gb.mutex.Lock()
 			gb.fixDat.Games = append(gb.fixDat.Games, fixGame)
@@ -77,14 +80,14 @@ func (gb *fixdatBuilder) work() {
 }
 
 func (depot *Depot) FixDat(dat *types.Dat, outpath string,
-	numSubworkers int, deduper dedup.Deduper, bloomOnly bool) (bool, error) {
+	numSubworkers int, deduper dedup.Deduper, bloomOnly bool, format string) (*DatStats, error) {
 	datPath := filepath.Join(outpath, dat.Name)
+	stats := newDatStats(dat)
 
 	fixDat := new(types.Dat)
+	fixDat.CopyHeader(dat)
 	fixDat.FixDat = true
 	fixDat.Name = "fix_" + dat.Name
-	fixDat.Description = dat.Description
-	fixDat.Path = dat.Path
 	fixDat.UnzipGames = dat.UnzipGames
 
 	wc := make(chan *types.Game)
@@ -104,6 +107,7 @@ func (depot *Depot) FixDat(dat *types.Dat, outpath string,
 		gb.deduper = deduper
 		gb.closeC = closeC
 		gb.bloomOnly = bloomOnly
+		gb.stats = stats
 		go gb.work()
 	}
 
@@ -140,32 +144,33 @@ endLoop2:
 	}
 
 	if minionErr != nil {
-		return false, minionErr
+		return nil, minionErr
 	}
 
 	if len(fixDat.Games) > 0 {
-		fixDatPath := filepath.Join(outpath, fixPrefix+dat.Filename()+datSuffix)
+		fixDatPath := filepath.Join(outpath, fixPrefix+dat.Filename()+types.FormatSuffix(format))
 
 		fixFile, err := os.Create(fixDatPath)
 		if err != nil {
-			return false, err
+			return nil, err
 		}
 		defer fixFile.Close()
 
 		fixWriter := bufio.NewWriter(fixFile)
 		defer fixWriter.Flush()
 
-		err = types.ComposeCompliantDat(fixDat, fixWriter)
+		err = types.ComposeDatAs(fixDat, format, fixWriter)
 		if err != nil {
-			return false, err
+			return nil, err
 		}
 	}
 
-	return len(fixDat.Games) > 0, nil
+	stats.finish()
+	return stats, nil
 }
 
 func (depot *Depot) fixdatGame(game *types.Game, gamePath string,
-	unzipGame bool, deduper dedup.Deduper, bloomOnly bool) (*types.Game, error) {
+	unzipGame bool, deduper dedup.Deduper, bloomOnly bool, gt *gameTally) (*types.Game, error) {
 
 	var fixGame *types.Game
 
@@ -181,7 +186,8 @@ func (depot *Depot) fixdatGame(game *types.Game, gamePath string,
 		}
 
 		if rom.Sha1 == nil {
-			if rom.Size > 0 {
+			if rom.Size != 0 {
+				gt.miss++
 				if fixGame == nil {
 					fixGame = new(types.Game)
 					fixGame.Name = game.Name
@@ -189,6 +195,8 @@ func (depot *Depot) fixdatGame(game *types.Game, gamePath string,
 				}
 
 				fixGame.Roms = append(fixGame.Roms, rom)
+			} else {
+				gt.have++
 			}
 			continue
 		}
@@ -201,6 +209,7 @@ func (depot *Depot) fixdatGame(game *types.Game, gamePath string,
 		}
 
 		if !exists {
+			gt.miss++
 			if glog.V(2) {
 				glog.Warningf("game %s has missing rom %s (sha1 %s)", game.Name, rom.Name, hex.EncodeToString(rom.Sha1))
 			}
@@ -227,6 +236,53 @@ func (depot *Depot) fixdatGame(game *types.Game, gamePath string,
 			}
 			continue
 		}
+		gt.have++
 	}
 	return fixGame, nil
 }
+
+// HaveMiss splits the roms of dat into those in the depot and those missing from it, using
+// the same depot checks as fixdat. Each returned DAT only holds the games with at least one
+// rom in the respective category.
+func (depot *Depot) HaveMiss(dat *types.Dat, bloomOnly bool) (*types.Dat, *types.Dat, error) {
+	have := new(types.Dat)
+	have.CopyHeader(dat)
+	miss := new(types.Dat)
+	miss.CopyHeader(dat)
+
+	for _, game := range dat.Games {
+		var haveGame, missGame *types.Game
+
+		for _, rom := range game.Roms {
+			_, err := depot.RomDB.CompleteRom(rom)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			exists := rom.Size == 0
+			if !exists && rom.Sha1 != nil {
+				exists, _, err = depot.RomInDepotBloom(hex.EncodeToString(rom.Sha1), bloomOnly)
+				if err != nil {
+					return nil, nil, err
+				}
+			}
+
+			if exists {
+				if haveGame == nil {
+					haveGame = new(types.Game)
+					haveGame.CopyHeader(game)
+					have.Games = append(have.Games, haveGame)
+				}
+				haveGame.Roms = append(haveGame.Roms, rom)
+			} else {
+				if missGame == nil {
+					missGame = new(types.Game)
+					missGame.CopyHeader(game)
+					miss.Games = append(miss.Games, missGame)
+				}
+				missGame.Roms = append(missGame.Roms, rom)
+			}
+		}
+	}
+	return have, miss, nil
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"crypto/sha1"
+	"reflect"
+	"testing"
+
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/types"
+)
+
+func romNames(dat *types.Dat) map[string][]string {
+	names := make(map[string][]string)
+	for _, g := range dat.Games {
+		for _, r := range g.Roms {
+			names[g.Name] = append(names[g.Name], r.Name)
+		}
+	}
+	return names
+}
+
+func TestHaveMiss(t *testing.T) {
+	depot := NewTestDepot(t, new(db.NoOpDB))
+	present := AddTestRom(t, depot, "present.bin", "present rom", true)
+	missing := &types.Rom{Name: "missing.bin", Size: 7, Sha1: make([]byte, sha1.Size)}
+	empty := &types.Rom{Name: "empty.bin", Size: 0}
+	other := &types.Rom{Name: "other.bin", Size: 3, Crc: []byte{1, 2, 3, 4}}
+
+	dat := &types.Dat{
+		Name: "test",
+		Games: types.GameSlice{
+			{Name: "mixed", Roms: types.RomSlice{present, missing, empty}},
+			{Name: "absent", Roms: types.RomSlice{other}},
+		},
+	}
+
+	for _, bloomOnly := range []bool{false, true} {
+		have, miss, err := depot.HaveMiss(dat, bloomOnly)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have.Name != "test" || miss.Name != "test" {
+			t.Fatalf("expected have and miss DATs to keep the header")
+		}
+
+		expectedHave := map[string][]string{"mixed": {"present.bin", "empty.bin"}}
+		if names := romNames(have); !reflect.DeepEqual(names, expectedHave) {
+			t.Fatalf("bloomOnly %v: have %v, expected %v", bloomOnly, names, expectedHave)
+		}
+		expectedMiss := map[string][]string{"mixed": {"missing.bin"}, "absent": {"other.bin"}}
+		if names := romNames(miss); !reflect.DeepEqual(names, expectedMiss) {
+			t.Fatalf("bloomOnly %v: miss %v, expected %v", bloomOnly, names, expectedMiss)
+		}
+	}
+}
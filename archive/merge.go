@@ -230,5 +230,5 @@ func (w *mergeWorker) mergeGzip(path string, size int64) error {
 	}
 
 	w.depot.adjustSize(root, size, sha1Hex)
-	return nil
+	return w.depot.RomDB.UpdateRomStatus(rom, true)
 }
@@ -286,6 +286,9 @@ func (w *purgeWorker) Process(inpath string, size int64) error {
 		if index != -1 {
 			w.pm.depot.adjustSize(index, -size, "")
 		}
+
+		rom.Size = hh.Size
+		return w.pm.depot.RomDB.UpdateRomStatus(rom, false)
 	}
 	return nil
 }
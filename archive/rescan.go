@@ -0,0 +1,274 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+type rescanGru struct {
+	depot           *Depot
+	resumePath      string
+	numWorkers      int
+	pt              worker.ProgressTracker
+	soFar           chan *completed
+	resumeLogFile   *os.File
+	resumeLogWriter *bufio.Writer
+	numFromHeader   int64
+	numHashed       int64
+	numCorrupt      int64
+}
+
+type rescanWorker struct {
+	depot        *Depot
+	romBatch     db.RomBatch
+	md5crcBuffer []byte
+	index        int
+	pm           *rescanGru
+}
+
+// Rescan indexes the CRC and MD5 to SHA1 mappings of the roms in the depot
+// root at root, or in all depot roots if root is empty. The hashes are read
+// from the gzip headers of the depot files, and computed from their contents
+// where a header lacks them. Like Archive it writes a resume log into logDir
+// and continues after the point recorded in the log at resumePath.
+func (depot *Depot) Rescan(root string, resumePath string, numWorkers int, logDir string,
+	pt worker.ProgressTracker) (string, error) {
+	roots := depot.Paths()
+	if root != "" {
+		absRoot, err := filepath.Abs(root)
+		if err != nil {
+			return "", err
+		}
+
+		roots = nil
+		for _, dr := range depot.Paths() {
+			absDr, err := filepath.Abs(dr)
+			if err != nil {
+				return "", err
+			}
+			if absDr == absRoot {
+				roots = []string{dr}
+				break
+			}
+		}
+		if roots == nil {
+			return "", fmt.Errorf("%s is not a depot root", root)
+		}
+	}
+
+	resumeLogPath := filepath.Join(logDir, fmt.Sprintf("depot-rescan-resume-%s.log", time.Now().Format(ResumeDateFormat)))
+	resumeLogFile, err := os.Create(resumeLogPath)
+	if err != nil {
+		return "", err
+	}
+	resumeLogWriter := bufio.NewWriter(resumeLogFile)
+
+	resumePoint := ""
+	if len(resumePath) > 0 {
+		resumePoint, err = extractResumePoint(resumePath, numWorkers)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	glog.Infof("resuming with path %s", resumePoint)
+
+	pm := new(rescanGru)
+	pm.depot = depot
+	pm.resumePath = resumePoint
+	pm.pt = pt
+	pm.numWorkers = numWorkers
+	pm.soFar = make(chan *completed)
+	pm.resumeLogWriter = resumeLogWriter
+	pm.resumeLogFile = resumeLogFile
+
+	go loopObserver(pm.numWorkers, pm.soFar, pm.depot, pm.resumeLogWriter)
+
+	endMsg, err := worker.Work("rescan depot", roots, pm)
+
+	return endMsg + fmt.Sprintf("roms indexed from gzip headers: %d, roms hashed: %d, corrupt depot files: %d\n",
+		atomic.LoadInt64(&pm.numFromHeader), atomic.LoadInt64(&pm.numHashed), atomic.LoadInt64(&pm.numCorrupt)), err
+}
+
+func (pm *rescanGru) Accept(path string) bool {
+	if filepath.Ext(path) != gzipSuffix {
+		return false
+	}
+	if pm.resumePath != "" {
+		return path > pm.resumePath
+	}
+	return true
+}
+
+func (pm *rescanGru) CalculateWork() bool {
+	return false
+}
+
+func (pm *rescanGru) NeedsSizeInfo() bool {
+	return false
+}
+
+func (pm *rescanGru) NewWorker(workerIndex int) worker.Worker {
+	return &rescanWorker{
+		depot:        pm.depot,
+		romBatch:     pm.depot.RomDB.StartBatch(),
+		md5crcBuffer: make([]byte, md5.Size+crc32.Size+8),
+		index:        workerIndex,
+		pm:           pm,
+	}
+}
+
+func (pm *rescanGru) NumWorkers() int {
+	return pm.numWorkers
+}
+
+func (pm *rescanGru) ProgressTracker() worker.ProgressTracker {
+	return pm.pt
+}
+
+func (pm *rescanGru) FinishUp() error {
+	pm.soFar <- &completed{
+		workerIndex: -1,
+	}
+
+	pm.depot.RomDB.Flush()
+	pm.resumeLogWriter.Flush()
+
+	return pm.resumeLogFile.Close()
+}
+
+func (pm *rescanGru) Start() error {
+	return nil
+}
+
+func (pm *rescanGru) Scanned(numFiles int, numBytes int64, commonRootPath string) {}
+
+func (w *rescanWorker) Process(inpath string, size int64) error {
+	rom, err := RomFromGZDepotFile(inpath)
+	if err != nil {
+		return w.corrupt(inpath, err)
+	}
+
+	hh, romSize, err := HashesFromGZHeader(inpath, w.md5crcBuffer)
+	if err != nil {
+		return w.corrupt(inpath, err)
+	}
+
+	if hh != nil {
+		atomic.AddInt64(&w.pm.numFromHeader, 1)
+	} else {
+		glog.V(2).Infof("depot file %s has no md5 and crc header, hashing it", inpath)
+
+		hh, romSize, err = hashGZContent(inpath)
+		if err != nil {
+			return w.corrupt(inpath, err)
+		}
+		if !bytes.Equal(hh.Sha1, rom.Sha1) {
+			return w.corrupt(inpath, fmt.Errorf("its content has sha1 %s", hex.EncodeToString(hh.Sha1)))
+		}
+		atomic.AddInt64(&w.pm.numHashed, 1)
+	}
+
+	rom.Md5 = hh.Md5
+	rom.Crc = hh.Crc
+	rom.Size = romSize
+
+	err = w.romBatch.IndexRom(rom)
+	if err != nil {
+		return err
+	}
+
+	if w.romBatch.Size() >= db.MaxBatchSize {
+		glog.V(3).Infof("flushing batch of size %d", w.romBatch.Size())
+		err = w.romBatch.Flush()
+		if err != nil {
+			return fmt.Errorf("failed to flush: %v", err)
+		}
+	}
+
+	w.pm.soFar <- &completed{
+		path:        inpath,
+		workerIndex: w.index,
+	}
+	return nil
+}
+
+// corrupt counts the depot file at inpath as corrupt and moves on to the next one.
+func (w *rescanWorker) corrupt(inpath string, err error) error {
+	glog.Errorf("depot file %s is corrupt: %v", inpath, err)
+	atomic.AddInt64(&w.pm.numCorrupt, 1)
+	w.pm.soFar <- &completed{
+		path:        inpath,
+		workerIndex: w.index,
+	}
+	return nil
+}
+
+func (w *rescanWorker) Close() error {
+	err := w.romBatch.Close()
+	w.romBatch = nil
+	return err
+}
+
+// hashGZContent computes the hashes and size of the content of the gzip file
+// at inpath.
+func hashGZContent(inpath string) (*Hashes, int64, error) {
+	gzr, err := openGzipReadCloser(inpath)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer gzr.Close()
+
+	cw := &countWriter{w: ioutil.Discard}
+
+	hh, err := hashesForReader(io.TeeReader(gzr, cw))
+	if err != nil {
+		return nil, 0, err
+	}
+	return hh, cw.count, nil
+}
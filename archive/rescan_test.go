@@ -0,0 +1,108 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/db"
+	_ "github.com/uwedeportivo/romba/db/golevel"
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+func TestRescan(t *testing.T) {
+	romDB, err := db.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer romDB.Close()
+
+	depot := NewTestDepot(t, romDB)
+
+	withHeader := AddTestRom(t, depot, "a.bin", "rom with header", true)
+	withoutHeader := AddTestRom(t, depot, "b.bin", "rom without header", false)
+
+	// a depot file whose content does not hash to the sha1 it is stored under
+	corruptSha1 := sha1.Sum([]byte("something else"))
+	_, err = archive(pathFromSha1HexEncoding(depot.roots[0].path, hex.EncodeToString(corruptSha1[:]), gzipSuffix),
+		bytes.NewBufferString("corrupt rom"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a truncated depot file whose gzip can't be read to the end
+	truncated := AddTestRom(t, depot, "c.bin", "truncated rom", false)
+	truncatedPath := pathFromSha1HexEncoding(depot.roots[0].path, hex.EncodeToString(truncated.Sha1), gzipSuffix)
+	fi, err := os.Stat(truncatedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Truncate(truncatedPath, fi.Size()/2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	endMsg, err := depot.Rescan("", "", 1, t.TempDir(), worker.NewProgressTracker(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(endMsg, "roms indexed from gzip headers: 1, roms hashed: 1, corrupt depot files: 2") {
+		t.Fatalf("unexpected rescan summary %q", endMsg)
+	}
+
+	for _, rom := range []*types.Rom{withHeader, withoutHeader} {
+		byCrc := &types.Rom{Size: rom.Size, Crc: rom.Crc}
+		_, err = romDB.CompleteRom(byCrc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(byCrc.Sha1, rom.Sha1) {
+			t.Fatalf("%s: crc %s maps to sha1 %s, want %s", rom.Name, hex.EncodeToString(rom.Crc),
+				hex.EncodeToString(byCrc.Sha1), hex.EncodeToString(rom.Sha1))
+		}
+
+		byMd5 := &types.Rom{Size: rom.Size, Md5: rom.Md5}
+		_, err = romDB.CompleteRom(byMd5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(byMd5.Sha1, rom.Sha1) {
+			t.Fatalf("%s: md5 %s maps to sha1 %s, want %s", rom.Name, hex.EncodeToString(rom.Md5),
+				hex.EncodeToString(byMd5.Sha1), hex.EncodeToString(rom.Sha1))
+		}
+	}
+}
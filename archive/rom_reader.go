@@ -0,0 +1,175 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"crypto/md5"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/klauspost/compress/gzip"
+
+	"github.com/uwedeportivo/romba/util"
+)
+
+// RomReader reads the uncompressed contents of a depot rom. Seeking forward skips
+// through the gzip stream, seeking backwards reopens it.
+type RomReader struct {
+	path string
+	size int64
+	pos  int64
+	file *os.File
+	gzr  *gzip.Reader
+	rpos int64
+}
+
+// OpenRom opens the depot rom with the given SHA1. It returns nil if the rom isn't in the depot.
+func (depot *Depot) OpenRom(sha1Hex string) (*RomReader, error) {
+	exists, rompath, err := depot.RomInDepot(sha1Hex)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, nil
+	}
+
+	rr := &RomReader{path: rompath}
+	err = rr.reopen()
+	if err != nil {
+		return nil, err
+	}
+
+	md5crcBuffer := rr.gzr.Header.Extra
+	if len(md5crcBuffer) == md5.Size+crc32.Size+8 {
+		rr.size = util.BytesToInt64(md5crcBuffer[md5.Size+crc32.Size:])
+	} else {
+		// no size in the header, count it
+		rr.size, err = io.Copy(ioutil.Discard, rr.gzr)
+		if err != nil {
+			rr.Close()
+			return nil, err
+		}
+		err = rr.reopen()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rr, nil
+}
+
+func (rr *RomReader) reopen() error {
+	rr.Close()
+
+	file, err := os.Open(rr.path)
+	if err != nil {
+		return err
+	}
+
+	gzr, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	rr.file = file
+	rr.gzr = gzr
+	rr.rpos = 0
+	return nil
+}
+
+// Size returns the uncompressed size of the rom.
+func (rr *RomReader) Size() int64 {
+	return rr.size
+}
+
+func (rr *RomReader) Read(p []byte) (int, error) {
+	if rr.pos >= rr.size {
+		return 0, io.EOF
+	}
+
+	if rr.gzr == nil || rr.rpos > rr.pos {
+		err := rr.reopen()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if rr.rpos < rr.pos {
+		n, err := io.CopyN(ioutil.Discard, rr.gzr, rr.pos-rr.rpos)
+		rr.rpos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rr.gzr.Read(p)
+	rr.rpos += int64(n)
+	rr.pos = rr.rpos
+	return n, err
+}
+
+func (rr *RomReader) Seek(offset int64, whence int) (int64, error) {
+	var npos int64
+	switch whence {
+	case io.SeekStart:
+		npos = offset
+	case io.SeekCurrent:
+		npos = rr.pos + offset
+	case io.SeekEnd:
+		npos = rr.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if npos < 0 {
+		return 0, errors.New("negative position")
+	}
+	rr.pos = npos
+	return npos, nil
+}
+
+func (rr *RomReader) Close() error {
+	var err error
+	if rr.gzr != nil {
+		err = rr.gzr.Close()
+		rr.gzr = nil
+	}
+	if rr.file != nil {
+		ferr := rr.file.Close()
+		if err == nil {
+			err = ferr
+		}
+		rr.file = nil
+	}
+	return err
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"hash/crc32"
+	"os"
+	"testing"
+
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/util"
+)
+
+// NewTestDepot returns a depot with a single root in a temporary directory of t, for
+// tests of this and other packages.
+func NewTestDepot(t testing.TB, romDB db.RomDB) *Depot {
+	if config.GlobalConfig == nil {
+		config.GlobalConfig = new(config.Config)
+		config.GlobalConfig.General.TmpDir = os.TempDir()
+	}
+
+	depot, err := NewDepot([]string{t.TempDir()}, []int64{1 << 30}, romDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return depot
+}
+
+// AddTestRom stores content in the depot the way archiving does and returns the rom
+// describing it. Without header the gzip carries no md5/crc/size extra field.
+func AddTestRom(t testing.TB, depot *Depot, name, content string, header bool) *types.Rom {
+	hh, err := hashesForReader(bytes.NewBufferString(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var extra []byte
+	if header {
+		extra = make([]byte, md5.Size+crc32.Size+8)
+		copy(extra[0:md5.Size], hh.Md5)
+		copy(extra[md5.Size:md5.Size+crc32.Size], hh.Crc)
+		util.Int64ToBytes(int64(len(content)), extra[md5.Size+crc32.Size:])
+	}
+
+	sha1Hex := hex.EncodeToString(hh.Sha1)
+	n, err := archive(pathFromSha1HexEncoding(depot.roots[0].path, sha1Hex, gzipSuffix),
+		bytes.NewBufferString(content), extra)
+	if err != nil {
+		t.Fatal(err)
+	}
+	depot.adjustSize(0, n, sha1Hex)
+
+	return &types.Rom{
+		Name: name,
+		Size: int64(len(content)),
+		Crc:  hh.Crc,
+		Md5:  hh.Md5,
+		Sha1: hh.Sha1,
+	}
+}
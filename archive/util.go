@@ -51,7 +51,6 @@ const (
 	zipSuffix      = ".zip"
 	gzipSuffix     = ".gz"
 	sevenzipSuffix = ".7z"
-	datSuffix      = ".dat"
 	fixPrefix      = "fix-"
 )
 
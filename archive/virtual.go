@@ -0,0 +1,209 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/golang/glog"
+	"github.com/klauspost/compress/gzip"
+
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/torrentzip"
+)
+
+// resolveRom returns rom with its SHA1 filled in from the index if it only carries
+// a CRC or MD5. It returns nil if the SHA1 cannot be resolved. rom itself is not
+// modified.
+func (depot *Depot) resolveRom(rom *types.Rom) (*types.Rom, error) {
+	if rom.Sha1 != nil || rom.Size == 0 {
+		return rom, nil
+	}
+
+	r := new(types.Rom)
+	*r = *rom
+	_, err := depot.RomDB.CompleteRom(r)
+	if err != nil {
+		return nil, err
+	}
+	if r.Sha1 == nil {
+		return nil, nil
+	}
+	return r, nil
+}
+
+// resolveGameRoms returns the roms of game with resolvable SHA1s, deduplicated by name.
+// The game itself is not modified.
+func (depot *Depot) resolveGameRoms(game *types.Game) ([]*types.Rom, error) {
+	roms := make([]*types.Rom, 0, len(game.Roms))
+	seen := make(map[string]bool)
+
+	for _, rom := range game.Roms {
+		if seen[rom.Name] {
+			continue
+		}
+
+		r, err := depot.resolveRom(rom)
+		if err != nil {
+			return nil, err
+		}
+		if r == nil {
+			continue
+		}
+		seen[rom.Name] = true
+		roms = append(roms, r)
+	}
+	return roms, nil
+}
+
+// HaveRom reports whether the depot has rom, resolving its SHA1 from the index
+// if it only carries a CRC or MD5. Roms of size 0 are always had. rom itself is
+// not modified.
+func (depot *Depot) HaveRom(rom *types.Rom) (bool, error) {
+	r, err := depot.resolveRom(rom)
+	if err != nil || r == nil {
+		return false, err
+	}
+	if r.Size == 0 {
+		return true, nil
+	}
+
+	exists, _, err := depot.RomInDepot(hex.EncodeToString(r.Sha1))
+	return exists, err
+}
+
+// GameComplete reports whether every rom of game is present in the depot.
+func (depot *Depot) GameComplete(game *types.Game) (bool, error) {
+	if len(game.Roms) == 0 {
+		return false, nil
+	}
+
+	missing, err := depot.missingGameRoms(game, true)
+	if err != nil {
+		return false, err
+	}
+	return len(missing) == 0, nil
+}
+
+// MissingGameRoms returns the roms of game that are not present in the depot.
+func (depot *Depot) MissingGameRoms(game *types.Game) ([]*types.Rom, error) {
+	return depot.missingGameRoms(game, false)
+}
+
+func (depot *Depot) missingGameRoms(game *types.Game, firstOnly bool) ([]*types.Rom, error) {
+	var missing []*types.Rom
+
+	for _, rom := range game.Roms {
+		exists, err := depot.HaveRom(rom)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			missing = append(missing, rom)
+			if firstOnly {
+				break
+			}
+		}
+	}
+	return missing, nil
+}
+
+// WriteGameZip writes game as a torrentzip to w using the roms available in the depot.
+// Missing roms are skipped. It returns the number of roms written.
+func (depot *Depot) WriteGameZip(game *types.Game, w io.Writer) (int, error) {
+	roms, err := depot.resolveGameRoms(game)
+	if err != nil {
+		return 0, err
+	}
+
+	gameTorrent, err := torrentzip.NewWriterWithTemp(w, config.GlobalConfig.General.TmpDir)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, rom := range roms {
+		written, err := depot.writeRomEntry(gameTorrent, rom)
+		if err != nil {
+			gameTorrent.Close()
+			return n, err
+		}
+		if written {
+			n++
+		} else if glog.V(2) {
+			glog.Warningf("game %s has missing rom %s (sha1 %s)", game.Name, rom.Name,
+				hex.EncodeToString(rom.Sha1))
+		}
+	}
+
+	return n, gameTorrent.Close()
+}
+
+func (depot *Depot) writeRomEntry(gameTorrent *torrentzip.Writer, rom *types.Rom) (bool, error) {
+	if rom.Size == 0 {
+		_, err := gameTorrent.Create(rom.Name)
+		return err == nil, err
+	}
+
+	romGZ, err := depot.OpenRomGZ(rom)
+	if err != nil {
+		return false, err
+	}
+	if romGZ == nil {
+		return false, nil
+	}
+	defer func() {
+		err := romGZ.Close()
+		if err != nil {
+			glog.Errorf("error, failed close rom gz stream file %s: %v", rom.Name, err)
+		}
+	}()
+
+	src, err := gzip.NewReader(romGZ)
+	if err != nil {
+		return false, fmt.Errorf("error opening rom gz file %s: %v", rom.Name, err)
+	}
+	defer src.Close()
+
+	dst, err := gameTorrent.Create(rom.Name)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
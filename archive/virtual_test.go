@@ -0,0 +1,103 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package archive
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/types"
+)
+
+// sha1DB resolves roms to the SHA1s it knows by CRC, filling them in place like the
+// real index does.
+type sha1DB struct {
+	db.NoOpDB
+	byCrc map[string][]byte
+}
+
+func (sdb *sha1DB) CompleteRom(rom *types.Rom) ([]*types.Rom, error) {
+	if sha1, ok := sdb.byCrc[string(rom.Crc)]; ok {
+		rom.Sha1 = sha1
+	}
+	return nil, nil
+}
+
+func TestGameCompleteCrcOnly(t *testing.T) {
+	sdb := &sha1DB{byCrc: make(map[string][]byte)}
+	depot := NewTestDepot(t, sdb)
+
+	rom := AddTestRom(t, depot, "a.bin", "some rom content", true)
+	sdb.byCrc[string(rom.Crc)] = rom.Sha1
+
+	datRom := &types.Rom{
+		Name: rom.Name,
+		Size: rom.Size,
+		Crc:  rom.Crc,
+	}
+	game := &types.Game{
+		Name: "game",
+		Roms: []*types.Rom{datRom},
+	}
+
+	complete, err := depot.GameComplete(game)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !complete {
+		t.Fatalf("expected game with crc only rom to be complete")
+	}
+	if datRom.Sha1 != nil {
+		t.Fatalf("resolving the rom modified the DAT rom")
+	}
+
+	var buf bytes.Buffer
+	n, err := depot.WriteGameZip(game, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 rom in game zip, got %d", n)
+	}
+
+	missing := &types.Game{
+		Name: "missing",
+		Roms: []*types.Rom{{Name: "b.bin", Size: 3, Crc: []byte{1, 2, 3, 4}}},
+	}
+	complete, err = depot.GameComplete(missing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if complete {
+		t.Fatalf("expected game with unresolvable rom to be incomplete")
+	}
+}
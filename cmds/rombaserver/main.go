@@ -57,7 +57,7 @@ import (
 	"github.com/uwedeportivo/romba/db"
 	"github.com/uwedeportivo/romba/service"
 
-	_ "github.com/uwedeportivo/romba/db/clevel"
+	_ "github.com/uwedeportivo/romba/db/golevel"
 )
 
 func signalCatcher(rs *service.RombaService) {
@@ -104,6 +104,7 @@ func findINI(flagVal string) (string, error) {
 }
 
 var iniPath = flag.String("ini", "", "location of .ini file")
+var restorePath = flag.String("restore", "", "rebuild the db from this db-backup file before starting")
 
 func main() {
 	flag.Parse()
@@ -172,6 +173,21 @@ func main() {
 	flag.Set("alsologtostderr", "true")
 	flag.Set("v", strconv.Itoa(cfg.General.Verbosity))
 
+	err = db.UseStore(cfg.Backend())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "opening db failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *restorePath != "" {
+		manifest, err := db.Restore(*restorePath, cfg.Index.Db)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "restoring db from %s failed: %v\n", *restorePath, err)
+			os.Exit(1)
+		}
+		glog.Infof("restored db from backup %s written at %s", *restorePath, manifest.Created)
+	}
+
 	romDB, err := db.New(cfg.Index.Db)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "opening db failed: %v\n", err)
@@ -194,6 +210,11 @@ func main() {
 	http.Handle("/", http.StripPrefix("/", http.FileServer(http.Dir(cfg.General.WebDir))))
 	http.Handle("/jsonrpc/", s)
 	http.Handle("/progress", websocket.Handler(rs.SendProgress))
+	http.HandleFunc("/api/game", rs.ServeGame)
+	http.HandleFunc("/api/rom/", rs.ServeRom)
+	if cfg.Server.WebDAV {
+		http.Handle("/dav/", rs.NewWebDAVHandler("/dav", cfg.Server.WebDAVAllGames))
+	}
 
 	fmt.Printf("starting romba server version %s at localhost:%d/romba.html\n", service.Version, cfg.Server.Port)
 
@@ -1,3 +1,6 @@
+//go:build cgo && !noleveldb
+// +build cgo,!noleveldb
+
 // Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
 
 /*
@@ -42,9 +45,14 @@ import (
 
 	"github.com/jmhodges/levigo"
 
+	"github.com/uwedeportivo/romba/config"
 	"github.com/uwedeportivo/romba/types"
 )
 
+func init() {
+	backends[config.BackendLevelDB] = NewLevelDBCombiner
+}
+
 var ro *levigo.ReadOptions = levigo.NewReadOptions()
 var wo *levigo.WriteOptions = levigo.NewWriteOptions()
 
@@ -30,10 +30,29 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 
 package combine
 
-import "github.com/uwedeportivo/romba/types"
+import (
+	"fmt"
+
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/types"
+)
 
 type Combiner interface {
 	Declare(rom *types.Rom) error
 	ForEachRom(romF func(rom *types.Rom) error) error
 	Close() error
 }
+
+// backends are the disk backed combiners by key-value store backend.
+var backends = make(map[string]func(tempPath string) (Combiner, error))
+
+// New returns a disk backed Combiner in tempPath on the key-value store
+// backend of the config.
+func New(tempPath string) (Combiner, error) {
+	backend := config.GlobalConfig.Backend()
+	newCombiner, ok := backends[backend]
+	if !ok {
+		return nil, fmt.Errorf("unknown or not built in key-value store backend %q", backend)
+	}
+	return newCombiner(tempPath)
+}
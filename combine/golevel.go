@@ -0,0 +1,139 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package combine
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+	"github.com/klauspost/crc32"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/filter"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/util"
+)
+
+func init() {
+	backends[config.BackendGoLevelDB] = NewGoLevelDBCombiner
+}
+
+type goCombiner struct {
+	sha1DB   *leveldb.DB
+	tempPath string
+}
+
+// NewGoLevelDBCombiner returns a Combiner on goleveldb, which needs no cgo.
+func NewGoLevelDBCombiner(tempPath string) (Combiner, error) {
+	path := filepath.Join(tempPath, "sha1_db")
+	dbn, err := leveldb.OpenFile(path, &opt.Options{
+		Filter:                 filter.NewBloomFilter(16),
+		BlockCacheCapacity:     10490000,
+		OpenFilesCacheCapacity: 500,
+		WriteBuffer:            62914560,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open db at %s: %v", path, err)
+	}
+
+	return &goCombiner{
+		sha1DB:   dbn,
+		tempPath: tempPath,
+	}, nil
+}
+
+func (gc *goCombiner) Declare(rom *types.Rom) error {
+	glog.V(4).Infof("combining rom %s with size %d", hex.EncodeToString(rom.Sha1), rom.Size)
+
+	if rom.Sha1 == nil {
+		glog.V(4).Infof("combining rom %s with missing SHA1", rom.Name)
+		return nil
+	}
+
+	rBytes, err := gc.sha1DB.Get(rom.Sha1, nil)
+	if err == leveldb.ErrNotFound {
+		rBytes = make([]byte, crc32.Size+md5.Size+8)
+		util.Int64ToBytes(rom.Size, rBytes[crc32.Size+md5.Size:])
+	} else if err != nil {
+		return err
+	}
+
+	if rom.Crc != nil {
+		glog.V(4).Infof("declaring crc %s <-> sha1 %s mapping", hex.EncodeToString(rom.Crc), hex.EncodeToString(rom.Sha1))
+
+		copy(rBytes, rom.Crc)
+	}
+	if rom.Md5 != nil {
+		glog.V(4).Infof("declaring md5 %s <-> sha1 %s mapping", hex.EncodeToString(rom.Md5), hex.EncodeToString(rom.Sha1))
+
+		copy(rBytes[crc32.Size:], rom.Md5)
+	}
+
+	return gc.sha1DB.Put(rom.Sha1, rBytes, nil)
+}
+
+func (gc *goCombiner) ForEachRom(romF func(rom *types.Rom) error) error {
+	it := gc.sha1DB.NewIterator(nil, nil)
+	defer it.Release()
+
+	for it.Next() {
+		rom := new(types.Rom)
+
+		// the iterator reuses its buffers
+		rom.Sha1 = append([]byte(nil), it.Key()...)
+		rom.Name = hex.EncodeToString(rom.Sha1)
+
+		buf := append([]byte(nil), it.Value()...)
+
+		rom.Crc = buf[:crc32.Size]
+		rom.Md5 = buf[crc32.Size : crc32.Size+md5.Size]
+		rom.Size = util.BytesToInt64(buf[crc32.Size+md5.Size:])
+
+		glog.V(4).Infof("combiner processing rom %s", rom.Name)
+		err := romF(rom)
+		if err != nil {
+			return err
+		}
+	}
+	return it.Error()
+}
+
+func (gc *goCombiner) Close() error {
+	gc.sha1DB.Close()
+
+	return os.RemoveAll(gc.tempPath)
+}
@@ -30,6 +30,13 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 
 package config
 
+// Key-value store backends of the index and of the temporary stores of
+// build, diffdat and export.
+const (
+	BackendLevelDB   = "leveldb"
+	BackendGoLevelDB = "goleveldb"
+)
+
 type Config struct {
 	General struct {
 		LogDir    string
@@ -47,14 +54,31 @@ type Config struct {
 	}
 
 	Index struct {
-		Db   string
-		Dats string
+		Db      string
+		Dats    string
+		Backend string
 	}
 
 	Server struct {
-		Port int
-		Host string
+		Port           int
+		Host           string
+		WebDAV         bool
+		WebDAVAllGames bool
+	}
+
+	Names struct {
+		Replacement string
+		Map         []string
 	}
 }
 
 var GlobalConfig *Config
+
+// Backend returns the key-value store backend named in the index section, or
+// the default one of this build if there is none.
+func (cfg *Config) Backend() string {
+	if cfg.Index.Backend != "" {
+		return cfg.Index.Backend
+	}
+	return defaultBackend
+}
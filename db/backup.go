@@ -0,0 +1,433 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package db
+
+import (
+	"archive/zip"
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	backupManifestName = "manifest.json"
+	backupFormat       = 2
+
+	// maxBackupRecordSize guards against allocating huge records from a
+	// corrupt backup before its checksum can be verified.
+	maxBackupRecordSize = 1 << 30
+)
+
+// BackupManifest describes the stores in a backup written by Backup.
+type BackupManifest struct {
+	Format        int
+	Created       time.Time
+	Generation    int64
+	SchemaVersion int
+	Stores        []*BackupStore
+}
+
+// BackupStore describes one store in a backup. Its entry holds the keys and
+// values of the store, each preceded by its length as a uvarint.
+type BackupStore struct {
+	Name    string
+	KeySize int
+	NumKeys int64
+	Sha256  string
+}
+
+// Backup writes all stores of the index into a zip file at outPath, together
+// with a manifest holding their checksums. The stores are read from snapshots
+// taken together, so writes during the backup don't end up in it.
+func (kvdb *kvStore) Backup(outPath string) (*BackupManifest, error) {
+	kvdb.Flush()
+
+	tmpPath := outPath + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpPath)
+
+	manifest, err := kvdb.writeBackup(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return nil, err
+	}
+	return manifest, os.Rename(tmpPath, outPath)
+}
+
+func (kvdb *kvStore) writeBackup(w io.Writer) (*BackupManifest, error) {
+	bw := bufio.NewWriter(w)
+	zw := zip.NewWriter(bw)
+
+	manifest := &BackupManifest{
+		Format:        backupFormat,
+		Created:       time.Now(),
+		Generation:    kvdb.generation,
+		SchemaVersion: kvdb.schemaVersion,
+	}
+
+	nss := kvdb.namedStores()
+	snaps, err := kvdb.snapshotStores(nss)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, snap := range snaps {
+			snap.Release()
+		}
+	}()
+
+	for i, ns := range nss {
+		glog.Infof("backing up %s", ns.name)
+
+		ew, err := zw.Create(ns.name)
+		if err != nil {
+			return nil, err
+		}
+
+		bs := &BackupStore{
+			Name:    ns.name,
+			KeySize: ns.keySize,
+		}
+
+		h := sha256.New()
+		rw := &recordWriter{w: io.MultiWriter(ew, h)}
+
+		err = snaps[i].Iterate(func(key, value []byte) (bool, error) {
+			err := rw.write(key)
+			if err != nil {
+				return false, err
+			}
+			err = rw.write(value)
+			if err != nil {
+				return false, err
+			}
+			bs.NumKeys++
+			return true, nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to back up %s: %v", ns.name, err)
+		}
+
+		bs.Sha256 = hex.EncodeToString(h.Sum(nil))
+		manifest.Stores = append(manifest.Stores, bs)
+
+		glog.Infof("backed up %d keys of %s", bs.NumKeys, ns.name)
+	}
+
+	ew, err := zw.Create(backupManifestName)
+	if err != nil {
+		return nil, err
+	}
+
+	enc := json.NewEncoder(ew)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return manifest, bw.Flush()
+}
+
+// snapshotStores takes snapshots of the stores of nss. Holding statusMutex keeps
+// the counters in statusDB in step with the rom updates they are made for.
+func (kvdb *kvStore) snapshotStores(nss []namedStore) ([]KVSnapshot, error) {
+	kvdb.statusMutex.Lock()
+	defer kvdb.statusMutex.Unlock()
+
+	snaps := make([]KVSnapshot, 0, len(nss))
+	for _, ns := range nss {
+		snap, err := ns.store.Snapshot()
+		if err != nil {
+			for _, snap := range snaps {
+				snap.Release()
+			}
+			return nil, fmt.Errorf("failed to take snapshot of %s: %v", ns.name, err)
+		}
+		snaps = append(snaps, snap)
+	}
+	return snaps, nil
+}
+
+type recordWriter struct {
+	w   io.Writer
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (rw *recordWriter) write(bs []byte) error {
+	n := binary.PutUvarint(rw.buf[:], uint64(len(bs)))
+	_, err := rw.w.Write(rw.buf[:n])
+	if err != nil {
+		return err
+	}
+	_, err = rw.w.Write(bs)
+	return err
+}
+
+// Restore rebuilds the index at root from the backup at backupPath, in the
+// current key-value store backend. root must not hold an index yet. The
+// checksums of all stores are verified before the index is moved into place.
+func Restore(backupPath, root string) (*BackupManifest, error) {
+	_, err := os.Stat(filepath.Join(root, datsDBName))
+	if err == nil {
+		return nil, fmt.Errorf("%s already holds an index, move it away before restoring", root)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	zr, err := zip.OpenReader(backupPath)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	entries := make(map[string]*zip.File)
+	for _, zf := range zr.File {
+		entries[zf.Name] = zf
+	}
+
+	manifest, err := readBackupManifest(entries[backupManifestName])
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest of %s: %v", backupPath, err)
+	}
+
+	tmpRoot := root + ".restore"
+	err = os.RemoveAll(tmpRoot)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(tmpRoot, 0755)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpRoot)
+
+	for _, bs := range manifest.Stores {
+		glog.Infof("restoring %s", bs.Name)
+
+		err = restoreStore(entries[bs.Name], bs, filepath.Join(tmpRoot, bs.Name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to restore %s: %v", bs.Name, err)
+		}
+
+		glog.Infof("restored %d keys of %s", bs.NumKeys, bs.Name)
+	}
+
+	err = WriteGenerationFile(tmpRoot, manifest.Generation)
+	if err != nil {
+		return nil, err
+	}
+	err = restoreSchemaVersion(filepath.Join(tmpRoot, datsDBName), manifest.SchemaVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(root, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	fis, err := ioutil.ReadDir(tmpRoot)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range fis {
+		err = os.Rename(filepath.Join(tmpRoot, fi.Name()), filepath.Join(root, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return manifest, nil
+}
+
+// restoreSchemaVersion records version in the restored dats db at path, as
+// backups taken before a migration lack the record.
+func restoreSchemaVersion(path string, version int) error {
+	store, err := StoreOpener(path, sha1.Size)
+	if err != nil {
+		return err
+	}
+
+	err = writeSchemaVersion(store, version)
+	if err != nil {
+		store.Close()
+		return err
+	}
+	return store.Close()
+}
+
+func readBackupManifest(zf *zip.File) (*BackupManifest, error) {
+	if zf == nil {
+		return nil, fmt.Errorf("no %s", backupManifestName)
+	}
+
+	r, err := zf.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	manifest := new(BackupManifest)
+	err = json.NewDecoder(r).Decode(manifest)
+	if err != nil {
+		return nil, err
+	}
+	if manifest.Format != backupFormat {
+		return nil, fmt.Errorf("unknown backup format %d", manifest.Format)
+	}
+	return manifest, nil
+}
+
+func restoreStore(zf *zip.File, bs *BackupStore, path string) error {
+	if zf == nil {
+		return fmt.Errorf("backup has no entry for it")
+	}
+
+	r, err := zf.Open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	dst, err := StoreOpener(path, bs.KeySize)
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	numKeys, err := restoreRecords(bufio.NewReader(io.TeeReader(r, h)), dst)
+	if err != nil {
+		dst.Close()
+		return err
+	}
+
+	err = dst.Close()
+	if err != nil {
+		return err
+	}
+
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != bs.Sha256 {
+		return fmt.Errorf("checksum mismatch, expected %s, got %s", bs.Sha256, sum)
+	}
+	if numKeys != bs.NumKeys {
+		return fmt.Errorf("expected %d keys, got %d", bs.NumKeys, numKeys)
+	}
+	return nil
+}
+
+func restoreRecords(br *bufio.Reader, dst KVStore) (int64, error) {
+	batch := dst.StartBatch()
+	pending := 0
+	var numKeys int64
+
+	for {
+		key, err := readRecord(br)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return numKeys, err
+		}
+
+		value, err := readRecord(br)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return numKeys, err
+		}
+
+		err = batch.Set(key, value)
+		if err != nil {
+			return numKeys, err
+		}
+
+		numKeys++
+		pending++
+		if pending >= migrateBatchKeys {
+			err = dst.WriteBatch(batch)
+			if err != nil {
+				return numKeys, err
+			}
+			batch.Clear()
+			pending = 0
+		}
+	}
+
+	if pending > 0 {
+		err := dst.WriteBatch(batch)
+		if err != nil {
+			return numKeys, err
+		}
+	}
+	return numKeys, nil
+}
+
+func readRecord(br *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxBackupRecordSize {
+		return nil, fmt.Errorf("record of size %d is too large", n)
+	}
+
+	bs := make([]byte, n)
+	_, err = io.ReadFull(br, bs)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return bs, err
+}
@@ -1,3 +1,6 @@
+//go:build cgo && !noleveldb
+// +build cgo,!noleveldb
+
 // Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
 
 /*
@@ -34,6 +37,7 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/jmhodges/levigo"
+	"github.com/uwedeportivo/romba/config"
 	"github.com/uwedeportivo/romba/db"
 )
 
@@ -41,7 +45,7 @@ var rOptions *levigo.ReadOptions = levigo.NewReadOptions()
 var wOptions *levigo.WriteOptions = levigo.NewWriteOptions()
 
 func init() {
-	db.StoreOpener = openDb
+	db.RegisterStore(config.BackendLevelDB, openDb)
 }
 
 func openDb(path string, keySize int) (db.KVStore, error) {
@@ -120,6 +124,11 @@ func (s *store) PrintStats() string {
 
 func (s *store) Flush() {}
 
+func (s *store) Compact() error {
+	s.dbn.CompactRange(levigo.Range{})
+	return nil
+}
+
 func (s *store) Size() int64 {
 	return 0
 }
@@ -142,7 +151,33 @@ func (s *store) Close() error {
 }
 
 func (s *store) Iterate(df func(key, value []byte) (bool, error)) error {
-	it := s.dbn.NewIterator(rOptions)
+	return iterate(s.dbn.NewIterator(rOptions), df)
+}
+
+func (s *store) Snapshot() (db.KVSnapshot, error) {
+	snap := s.dbn.NewSnapshot()
+	ro := levigo.NewReadOptions()
+	ro.SetFillCache(false)
+	ro.SetSnapshot(snap)
+	return &snapshot{s: s, snap: snap, ro: ro}, nil
+}
+
+type snapshot struct {
+	s    *store
+	snap *levigo.Snapshot
+	ro   *levigo.ReadOptions
+}
+
+func (ss *snapshot) Iterate(df func(key, value []byte) (bool, error)) error {
+	return iterate(ss.s.dbn.NewIterator(ss.ro), df)
+}
+
+func (ss *snapshot) Release() {
+	ss.ro.Close()
+	ss.s.dbn.ReleaseSnapshot(ss.snap)
+}
+
+func iterate(it *levigo.Iterator, df func(key, value []byte) (bool, error)) error {
 	defer it.Close()
 
 	it.SeekToFirst()
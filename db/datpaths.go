@@ -0,0 +1,158 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package db
+
+import (
+	"crypto/sha1"
+	"fmt"
+
+	"github.com/uwedeportivo/romba/util"
+)
+
+const datPathFixedSize = 3 * 8
+
+// DatPath is what refresh-dats saw of a DAT file or DAT archive the last
+// time it found it. A file with the same size and modification time is
+// taken to be unchanged and isn't parsed again.
+type DatPath struct {
+	Size int64
+	// ModTime is the modification time in nanoseconds since the epoch.
+	ModTime int64
+	// Generation is the generation of the last refresh that found the file.
+	Generation int64
+	// Sha1s are the SHA1s of the DATs in the file, more than one for archives.
+	Sha1s [][]byte
+}
+
+func encodeDatPath(dp *DatPath) []byte {
+	bs := make([]byte, datPathFixedSize, datPathFixedSize+len(dp.Sha1s)*sha1.Size)
+	util.Int64ToBytes(dp.Size, bs[0:8])
+	util.Int64ToBytes(dp.ModTime, bs[8:16])
+	util.Int64ToBytes(dp.Generation, bs[16:24])
+	for _, sha1Bytes := range dp.Sha1s {
+		bs = append(bs, sha1Bytes...)
+	}
+	return bs
+}
+
+func decodeDatPath(bs []byte) (*DatPath, error) {
+	if len(bs) < datPathFixedSize || (len(bs)-datPathFixedSize)%sha1.Size != 0 {
+		return nil, fmt.Errorf("dat path record has invalid length %d", len(bs))
+	}
+
+	dp := &DatPath{
+		Size:       util.BytesToInt64(bs[0:8]),
+		ModTime:    util.BytesToInt64(bs[8:16]),
+		Generation: util.BytesToInt64(bs[16:24]),
+	}
+	for i := datPathFixedSize; i < len(bs); i += sha1.Size {
+		dp.Sha1s = append(dp.Sha1s, bs[i:i+sha1.Size])
+	}
+	return dp, nil
+}
+
+func (kvdb *kvStore) GetDatPath(path string) (*DatPath, error) {
+	bs, err := kvdb.datPathsDB.Get([]byte(path))
+	if err != nil || bs == nil {
+		return nil, err
+	}
+	return decodeDatPath(bs)
+}
+
+// RemoveStaleDatPaths deletes the paths that the current generation's refresh
+// didn't find and returns how many there were.
+func (kvdb *kvStore) RemoveStaleDatPaths() (int64, error) {
+	batch := kvdb.datPathsDB.StartBatch()
+	pending := 0
+	var removed int64
+
+	err := kvdb.datPathsDB.Iterate(func(key, value []byte) (bool, error) {
+		dp, err := decodeDatPath(value)
+		if err != nil {
+			return false, err
+		}
+		if dp.Generation >= kvdb.generation {
+			return true, nil
+		}
+
+		err = batch.Delete(key)
+		if err != nil {
+			return false, err
+		}
+		removed++
+
+		pending++
+		if pending >= migrateBatchKeys {
+			err = kvdb.datPathsDB.WriteBatch(batch)
+			if err != nil {
+				return false, err
+			}
+			batch.Clear()
+			pending = 0
+		}
+		return true, nil
+	})
+	if err != nil {
+		return removed, err
+	}
+
+	if pending > 0 {
+		err = kvdb.datPathsDB.WriteBatch(batch)
+	}
+	return removed, err
+}
+
+// IndexDatPath stores dp for path, stamped with the current generation.
+func (kvb *kvBatch) IndexDatPath(path string, dp *DatPath) error {
+	dp.Generation = kvb.db.generation
+
+	bs := encodeDatPath(dp)
+	err := kvb.datPathsBatch.Set([]byte(path), bs)
+	if err != nil {
+		return err
+	}
+	kvb.size += int64(len(path) + len(bs))
+	return nil
+}
+
+// AdvanceDatGeneration marks the DAT with SHA1 sha1Bytes as seen by the current
+// generation without rewriting its header.
+func (kvb *kvBatch) AdvanceDatGeneration(sha1Bytes []byte) error {
+	gBytes := make([]byte, 8)
+	util.Int64ToBytes(kvb.db.generation, gBytes)
+
+	err := kvb.generationsBatch.Set(sha1Bytes, gBytes)
+	if err != nil {
+		return err
+	}
+	kvb.size += int64(sha1.Size + 8)
+	return nil
+}
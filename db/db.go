@@ -32,6 +32,8 @@ package db
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/sha1"
 	"fmt"
 	"github.com/uwedeportivo/romba/combine"
 	"io"
@@ -39,6 +41,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/glog"
@@ -56,6 +59,10 @@ const (
 type RomBatch interface {
 	IndexRom(rom *types.Rom) error
 	IndexDat(dat *types.Dat, sha1 []byte) error
+	IndexDatHeader(dat *types.Dat, sha1 []byte) error
+	IndexGame(datSha1 []byte, index int, game *types.Game) error
+	IndexDatPath(path string, dp *DatPath) error
+	AdvanceDatGeneration(sha1 []byte) error
 	Size() int64
 	Flush() error
 	Close() error
@@ -68,7 +75,11 @@ type RomDB interface {
 	OrphanDats() error
 	Flush()
 	Close() error
+	HasDat(sha1 []byte) (bool, error)
 	GetDat(sha1 []byte) (*types.Dat, error)
+	GetDatHeader(sha1 []byte) (*types.Dat, error)
+	GetDatPath(path string) (*DatPath, error)
+	RemoveStaleDatPaths() (int64, error)
 	IsRomReferencedByDats(rom *types.Rom) (bool, error)
 	DatsForRom(rom *types.Rom) ([]*types.Dat, error)
 	FilteredDatsForRom(rom *types.Rom, filter func(*types.Dat) bool) ([]*types.Dat, []*types.Dat, error)
@@ -82,6 +93,15 @@ type RomDB interface {
 	ForEachDat(datF func(dat *types.Dat) error) error
 	JoinCrcMd5(combiner combine.Combiner) error
 	NumRoms() int64
+	CopyTo(path string, backend string) error
+	PurgeDats(keepGenerations int64) (*PurgeStats, error)
+	Backup(outPath string) (*BackupManifest, error)
+	Fsck(repair bool, depotRom func(sha1 []byte) (*types.Rom, error)) (*FsckReport, error)
+	GetDatStatus(sha1 []byte) (*DatStatus, error)
+	ForEachDatStatus(statusF func(sha1 []byte, dat *types.Dat, ds *DatStatus) error) error
+	ForEachGameStatus(sha1 []byte, statusF func(game *types.Game, gs *DatStatus) error) error
+	CountDats(haveRom HaveRomFunc) (int64, error)
+	UpdateRomStatus(rom *types.Rom, have bool) error
 }
 
 var Factory func(path string) (RomDB, error)
@@ -170,9 +190,185 @@ func ReadGenerationFile(root string) (int64, error) {
 type refreshWorker struct {
 	romBatch RomBatch
 	pm       *refreshGru
+	sha1s    [][]byte
 }
 
 func (pw *refreshWorker) Process(path string, size int64) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	dp := &DatPath{
+		Size:    fi.Size(),
+		ModTime: fi.ModTime().UnixNano(),
+	}
+
+	oldDp, err := pw.pm.romdb.GetDatPath(path)
+	if err != nil {
+		return err
+	}
+
+	// An explicit encoding may change the names in DATs that are already
+	// indexed, so all files are parsed again.
+	if oldDp != nil && pw.pm.encoding == "" && oldDp.Size == dp.Size && oldDp.ModTime == dp.ModTime {
+		unchanged, err := pw.advanceDats(oldDp.Sha1s)
+		if err != nil {
+			return err
+		}
+		if unchanged {
+			atomic.AddInt64(&pw.pm.numUnchanged, 1)
+			return pw.romBatch.IndexDatPath(path, oldDp)
+		}
+	}
+
+	pw.sha1s = nil
+
+	if parser.IsDatArchive(path) {
+		err = parser.ForEachDatInArchive(path, pw.pm.encoding, pw.indexDat)
+		if err != nil {
+			return err
+		}
+	} else {
+		sha1Bytes, err := fileSha1(path)
+		if err != nil {
+			return err
+		}
+
+		// a file that was only touched keeps its DAT
+		if oldDp != nil && pw.pm.encoding == "" && len(oldDp.Sha1s) == 1 && bytes.Equal(oldDp.Sha1s[0], sha1Bytes) {
+			unchanged, err := pw.advanceDats(oldDp.Sha1s)
+			if err != nil {
+				return err
+			}
+			if unchanged {
+				atomic.AddInt64(&pw.pm.numUnchanged, 1)
+				dp.Sha1s = oldDp.Sha1s
+				return pw.romBatch.IndexDatPath(path, dp)
+			}
+		}
+
+		err = pw.indexDatFile(path, sha1Bytes)
+		if err != nil {
+			return err
+		}
+	}
+
+	if oldDp == nil {
+		atomic.AddInt64(&pw.pm.numAdded, 1)
+	} else {
+		atomic.AddInt64(&pw.pm.numChanged, 1)
+	}
+
+	dp.Sha1s = pw.sha1s
+	return pw.romBatch.IndexDatPath(path, dp)
+}
+
+// advanceDats advances the DATs with the given SHA1s to the current generation
+// and returns true, unless one of them is missing from the index.
+func (pw *refreshWorker) advanceDats(sha1s [][]byte) (bool, error) {
+	var dats []*types.Dat
+
+	for _, sha1Bytes := range sha1s {
+		dat, err := pw.pm.romdb.GetDatHeader(sha1Bytes)
+		if err != nil {
+			return false, err
+		}
+		if dat == nil {
+			return false, nil
+		}
+		dats = append(dats, dat)
+	}
+
+	for i, dat := range dats {
+		err := pw.flushIfFull()
+		if err != nil {
+			return false, err
+		}
+
+		err = pw.romBatch.AdvanceDatGeneration(sha1s[i])
+		if err != nil {
+			return false, err
+		}
+
+		err = pw.declareMissingSha1s(dat)
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (pw *refreshWorker) indexDatFile(path string, sha1Bytes []byte) error {
+	pw.sha1s = append(pw.sha1s, sha1Bytes)
+
+	exists, err := pw.pm.romdb.HasDat(sha1Bytes)
+	if err != nil {
+		return err
+	}
+	// An explicit encoding may change the names in DATs that are already
+	// indexed, so their games are stored again.
+	exists = exists && pw.pm.encoding == ""
+
+	di := &datIndexer{
+		pw:        pw,
+		sha1Bytes: sha1Bytes,
+		exists:    exists,
+	}
+
+	parsedSha1, err := parser.ParseWithListenerAndEncoding(path, pw.pm.encoding, di)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(parsedSha1, sha1Bytes) {
+		return fmt.Errorf("dat %s changed while indexing it", path)
+	}
+
+	dat := di.dat
+	if dat == nil {
+		dat = &types.Dat{Path: path}
+	}
+	dat.MissingSha1s = dat.MissingSha1s || di.missingSha1s
+
+	err = pw.declareMissingSha1s(dat)
+	if err != nil {
+		return err
+	}
+	return pw.romBatch.IndexDatHeader(dat, sha1Bytes)
+}
+
+func (pw *refreshWorker) indexDat(dat *types.Dat, sha1Bytes []byte) error {
+	pw.sha1s = append(pw.sha1s, sha1Bytes)
+
+	err := pw.flushIfFull()
+	if err != nil {
+		return err
+	}
+
+	err = pw.declareMissingSha1s(dat)
+	if err != nil {
+		return err
+	}
+
+	if pw.pm.encoding == "" {
+		return pw.romBatch.IndexDat(dat, sha1Bytes)
+	}
+
+	for i, g := range dat.Games {
+		err = pw.flushIfFull()
+		if err != nil {
+			return err
+		}
+
+		err = pw.romBatch.IndexGame(sha1Bytes, i, g)
+		if err != nil {
+			return err
+		}
+	}
+	return pw.romBatch.IndexDatHeader(dat, sha1Bytes)
+}
+
+func (pw *refreshWorker) flushIfFull() error {
 	if pw.romBatch.Size() >= MaxBatchSize {
 		glog.V(3).Infof("flushing batch of size %d", pw.romBatch.Size())
 		err := pw.romBatch.Flush()
@@ -180,19 +376,73 @@ func (pw *refreshWorker) Process(path string, size int64) error {
 			return fmt.Errorf("failed to flush: %v", err)
 		}
 	}
-	dat, sha1Bytes, err := parser.Parse(path)
-	if err != nil {
-		return err
-	}
+	return nil
+}
 
+func (pw *refreshWorker) declareMissingSha1s(dat *types.Dat) error {
 	if pw.pm.missingSha1sWriter != nil && dat.MissingSha1s {
-		_, err = fmt.Fprintln(pw.pm.missingSha1sWriter, dat.Path)
+		_, err := fmt.Fprintln(pw.pm.missingSha1sWriter, dat.Path)
 		if err != nil {
 			return err
 		}
 	}
+	return nil
+}
+
+// datIndexer indexes the games of a DAT as the parser hands them over, so that
+// refreshing never holds a whole DAT in memory. The header is stored last, once
+// all games are in, and games are skipped if the DAT is already indexed.
+type datIndexer struct {
+	pw           *refreshWorker
+	sha1Bytes    []byte
+	exists       bool
+	dat          *types.Dat
+	numGames     int
+	missingSha1s bool
+}
 
-	return pw.romBatch.IndexDat(dat, sha1Bytes)
+func (di *datIndexer) ParsedDatStmt(dat *types.Dat) error {
+	di.dat = dat
+	return nil
+}
+
+func (di *datIndexer) ParsedGameStmt(game *types.Game) error {
+	for _, r := range game.Roms {
+		if r.Sha1 == nil {
+			di.missingSha1s = true
+		}
+	}
+
+	if di.exists {
+		return nil
+	}
+
+	err := di.pw.flushIfFull()
+	if err != nil {
+		return err
+	}
+
+	err = di.pw.romBatch.IndexGame(di.sha1Bytes, di.numGames, game)
+	if err != nil {
+		return err
+	}
+	di.numGames++
+	return nil
+}
+
+func fileSha1(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	h := sha1.New()
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
 }
 
 func (pw *refreshWorker) Close() error {
@@ -206,6 +456,11 @@ type refreshGru struct {
 	numWorkers         int
 	pt                 worker.ProgressTracker
 	missingSha1sWriter io.Writer
+	encoding           string
+	numAdded           int64
+	numChanged         int64
+	numUnchanged       int64
+	numRemoved         int64
 }
 
 func (pm *refreshGru) CalculateWork() bool {
@@ -217,8 +472,7 @@ func (pm *refreshGru) NeedsSizeInfo() bool {
 }
 
 func (pm *refreshGru) Accept(path string) bool {
-	ext := filepath.Ext(path)
-	return ext == ".dat" || ext == ".xml"
+	return parser.IsDatFile(path) || parser.IsDatArchive(path)
 }
 
 func (pm *refreshGru) NewWorker(workerIndex int) worker.Worker {
@@ -239,6 +493,15 @@ func (pm *refreshGru) ProgressTracker() worker.ProgressTracker {
 func (pm *refreshGru) FinishUp() error {
 	pm.romdb.Flush()
 
+	// a cancelled refresh hasn't seen all paths
+	if !pm.pt.Stopped() {
+		numRemoved, err := pm.romdb.RemoveStaleDatPaths()
+		if err != nil {
+			return err
+		}
+		pm.numRemoved = numRemoved
+	}
+
 	return pm.romdb.EndDatRefresh()
 }
 
@@ -248,7 +511,10 @@ func (pm *refreshGru) Start() error {
 
 func (pm *refreshGru) Scanned(numFiles int, numBytes int64, commonRootPath string) {}
 
-func Refresh(romdb RomDB, datsPath string, numWorkers int, pt worker.ProgressTracker, missingSha1s string) (string, error) {
+// Refresh indexes the DATs under datsPath. If haveRom is not nil, the roms of
+// the DATs without have and miss counters are counted afterwards.
+func Refresh(romdb RomDB, datsPath string, numWorkers int, pt worker.ProgressTracker, missingSha1s string,
+	encoding string, haveRom HaveRomFunc) (string, error) {
 	err := romdb.OrphanDats()
 	if err != nil {
 		return "", err
@@ -284,7 +550,25 @@ func Refresh(romdb RomDB, datsPath string, numWorkers int, pt worker.ProgressTra
 		numWorkers:         numWorkers,
 		pt:                 pt,
 		missingSha1sWriter: missingSha1sWriter,
+		encoding:           encoding,
 	}
 
-	return worker.Work("refresh dats", []string{datsPath}, pm)
+	endMsg, err := worker.Work("refresh dats", []string{datsPath}, pm)
+	if err != nil {
+		return endMsg, err
+	}
+
+	endMsg += fmt.Sprintf("dat files added: %d, changed: %d, unchanged: %d, removed: %d\n",
+		pm.numAdded, pm.numChanged, pm.numUnchanged, pm.numRemoved)
+
+	if haveRom != nil && !pt.Stopped() {
+		glog.Infof("counting roms of new dats")
+
+		numCounted, err := romdb.CountDats(haveRom)
+		if err != nil {
+			return endMsg, err
+		}
+		endMsg += fmt.Sprintf("dats counted for datstatus: %d\n", numCounted)
+	}
+	return endMsg, nil
 }
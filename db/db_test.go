@@ -31,17 +31,21 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package db_test
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/gob"
 	"encoding/hex"
 	"fmt"
 	"github.com/uwedeportivo/romba/db"
 	"github.com/uwedeportivo/romba/parser"
 	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
-
-	_ "github.com/uwedeportivo/romba/db/clevel"
+	"time"
 )
 
 const datText = `
@@ -119,10 +123,9 @@ func TestDB(t *testing.T) {
 
 	datFromDb = dats[0]
 
-	if !datFromDb.Equals(dat) {
+	if datFromDb.Name != dat.Name || len(datFromDb.Games) != 1 || !datFromDb.Games[0].Equals(findGame(dat, "Afterburner (1989)(Sega)(Side A)[cr NEC]")) {
 		fmt.Printf("datFromDb=%s\n", string(types.PrintDat(datFromDb)))
-		fmt.Printf("dat=%s\n", string(types.PrintDat(dat)))
-		t.Fatalf("dat differs from db dat")
+		t.Fatalf("dat for rom should only hold the game containing the rom")
 	}
 
 	err = krdb.Close()
@@ -135,3 +138,765 @@ func TestDB(t *testing.T) {
 		t.Fatalf("failed to remove test db dir %s: %v", dbDir, err)
 	}
 }
+
+func findGame(dat *types.Dat, name string) *types.Game {
+	for _, g := range dat.Games {
+		if g.Name == name {
+			return g
+		}
+	}
+	return nil
+}
+
+// TestDBMigrateDatsLayout writes an index in the layout storing each DAT as one
+// gob value and checks that opening it migrates it to game records.
+func TestDBMigrateDatsLayout(t *testing.T) {
+	dbDir, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test db: %v", err)
+	}
+	defer os.RemoveAll(dbDir)
+
+	dat, sha1Bytes, err := parser.ParseDat(strings.NewReader(datText), "testing/dat")
+	if err != nil {
+		t.Fatalf("failed to parse test dat: %v", err)
+	}
+
+	datsDB, err := db.StoreOpener(filepath.Join(dbDir, "dats_db"), sha1.Size)
+	if err != nil {
+		t.Fatalf("failed to open dats db: %v", err)
+	}
+	var buf bytes.Buffer
+	err = gob.NewEncoder(&buf).Encode(dat)
+	if err != nil {
+		t.Fatalf("failed to encode dat: %v", err)
+	}
+	err = datsDB.Set(sha1Bytes, buf.Bytes())
+	if err != nil {
+		t.Fatalf("failed to store dat: %v", err)
+	}
+	err = datsDB.Close()
+	if err != nil {
+		t.Fatalf("failed to close dats db: %v", err)
+	}
+
+	sha1DB, err := db.StoreOpener(filepath.Join(dbDir, "sha1_db"), sha1.Size)
+	if err != nil {
+		t.Fatalf("failed to open sha1 db: %v", err)
+	}
+	for _, g := range dat.Games {
+		for _, r := range g.Roms {
+			if r.Sha1 != nil {
+				err = sha1DB.Set(r.Sha1Sha1Key(sha1Bytes), []byte{1})
+				if err != nil {
+					t.Fatalf("failed to store rom reference: %v", err)
+				}
+			}
+		}
+	}
+	err = sha1DB.Close()
+	if err != nil {
+		t.Fatalf("failed to close sha1 db: %v", err)
+	}
+
+	krdb, err := db.New(dbDir)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer krdb.Close()
+
+	backups, err := filepath.Glob(dbDir + "-schema-v1-backup-*.zip")
+	if err != nil {
+		t.Fatalf("failed to glob for backups: %v", err)
+	}
+	for _, backup := range backups {
+		defer os.Remove(backup)
+	}
+	if len(backups) != 1 {
+		t.Fatalf("expected a backup of the db before migrating it, found %d", len(backups))
+	}
+
+	datFromDb, err := krdb.GetDat(sha1Bytes)
+	if err != nil {
+		t.Fatalf("failed to retrieve migrated dat: %v", err)
+	}
+	if datFromDb == nil || !datFromDb.Equals(dat) {
+		t.Fatalf("migrated dat differs from dat")
+	}
+
+	romSha1Bytes, err := hex.DecodeString("80353cb168dc5d7cc1dce57971f4ea2640a50ac4")
+	if err != nil {
+		t.Fatalf("failed to hex decode: %v", err)
+	}
+
+	dats, err := krdb.DatsForRom(&types.Rom{Sha1: romSha1Bytes})
+	if err != nil {
+		t.Fatalf("failed to retrieve dats for rom: %v", err)
+	}
+	if len(dats) != 1 || len(dats[0].Games) != 1 {
+		t.Fatalf("expected one dat with one game for rom after migration, got %d dats", len(dats))
+	}
+
+	var numDats int
+	err = krdb.ForEachDat(func(d *types.Dat) error {
+		numDats++
+		if !d.Equals(dat) {
+			t.Fatalf("iterated dat differs from dat")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to iterate dats: %v", err)
+	}
+	if numDats != 1 {
+		t.Fatalf("expected 1 dat, iterated %d", numDats)
+	}
+}
+
+func TestDBNewerSchemaVersion(t *testing.T) {
+	dbDir, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test db: %v", err)
+	}
+	defer os.RemoveAll(dbDir)
+
+	krdb, err := db.New(dbDir)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	err = krdb.Close()
+	if err != nil {
+		t.Fatalf("failed to close db: %v", err)
+	}
+
+	datsDB, err := db.StoreOpener(filepath.Join(dbDir, "dats_db"), sha1.Size)
+	if err != nil {
+		t.Fatalf("failed to open dats db: %v", err)
+	}
+	err = datsDB.Set([]byte("schema-version"), []byte("1000"))
+	if err != nil {
+		t.Fatalf("failed to store schema version: %v", err)
+	}
+	err = datsDB.Close()
+	if err != nil {
+		t.Fatalf("failed to close dats db: %v", err)
+	}
+
+	_, err = db.New(dbDir)
+	if err == nil || !strings.Contains(err.Error(), "schema version 1000") {
+		t.Fatalf("expected opening a db with a newer schema version to fail, got %v", err)
+	}
+}
+
+func TestDBDatStatus(t *testing.T) {
+	dbDir, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test db: %v", err)
+	}
+	defer os.RemoveAll(dbDir)
+
+	datsDir, err := ioutil.TempDir("", "rombadats")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test dats: %v", err)
+	}
+	defer os.RemoveAll(datsDir)
+
+	krdb, err := db.New(dbDir)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer krdb.Close()
+
+	err = ioutil.WriteFile(filepath.Join(datsDir, "test.dat"), []byte(datText), 0644)
+	if err != nil {
+		t.Fatalf("failed to write test dat: %v", err)
+	}
+	_, sha1Bytes, err := parser.ParseDat(strings.NewReader(datText), "testing/dat")
+	if err != nil {
+		t.Fatalf("failed to parse test dat: %v", err)
+	}
+
+	afterburnerSha1, err := hex.DecodeString("80353cb168dc5d7cc1dce57971f4ea2640a50ac4")
+	if err != nil {
+		t.Fatalf("failed to hex decode: %v", err)
+	}
+	afterburner := &types.Rom{Sha1: afterburnerSha1, Size: 333744}
+
+	acornMd5, err := hex.DecodeString("43ee6acc0c173048f47826307c0a262e")
+	if err != nil {
+		t.Fatalf("failed to hex decode: %v", err)
+	}
+	acorn := &types.Rom{Md5: acornMd5, Sha1: make([]byte, sha1.Size), Size: 819200}
+
+	depot := map[string]bool{string(afterburnerSha1): true}
+	haveRom := func(r *types.Rom) (bool, error) {
+		if r.Md5 != nil && bytes.Equal(r.Md5, acornMd5) {
+			return depot["acorn"], nil
+		}
+		return depot[string(r.Sha1)], nil
+	}
+
+	checkStatus := func(numHave, haveBytes int64) {
+		ds, err := krdb.GetDatStatus(sha1Bytes)
+		if err != nil {
+			t.Fatalf("failed to get dat status: %v", err)
+		}
+		if ds == nil {
+			t.Fatalf("expected dat to be counted")
+		}
+		if ds.NumRoms != 2 || ds.Bytes != 819200+333744 || ds.NumHave != numHave || ds.HaveBytes != haveBytes {
+			t.Fatalf("expected %d of 2 roms and %d bytes had, got %+v", numHave, haveBytes, ds)
+		}
+	}
+
+	endMsg, err := db.Refresh(krdb, datsDir, 1, worker.NewProgressTracker(1), "", "", haveRom)
+	if err != nil {
+		t.Fatalf("failed to refresh dats: %v", err)
+	}
+	if !strings.Contains(endMsg, "dats counted for datstatus: 1") {
+		t.Fatalf("expected refresh to count the dat, got %s", endMsg)
+	}
+	checkStatus(1, 333744)
+
+	// archiving a rom again or purging it twice must not move the counters
+	depot["acorn"] = true
+	for i := 0; i < 2; i++ {
+		err = krdb.UpdateRomStatus(acorn, true)
+		if err != nil {
+			t.Fatalf("failed to update rom status: %v", err)
+		}
+		checkStatus(2, 819200+333744)
+	}
+
+	delete(depot, string(afterburnerSha1))
+	for i := 0; i < 2; i++ {
+		err = krdb.UpdateRomStatus(afterburner, false)
+		if err != nil {
+			t.Fatalf("failed to update rom status: %v", err)
+		}
+		checkStatus(1, 819200)
+	}
+
+	var incomplete []string
+	err = krdb.ForEachGameStatus(sha1Bytes, func(game *types.Game, gs *db.DatStatus) error {
+		if gs.NumHave != gs.NumRoms {
+			incomplete = append(incomplete, game.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to iterate game status: %v", err)
+	}
+	if len(incomplete) != 1 || incomplete[0] != "Afterburner (1989)(Sega)(Side A)[cr NEC]" {
+		t.Fatalf("expected Afterburner to be the incomplete game, got %v", incomplete)
+	}
+
+	endMsg, err = db.Refresh(krdb, datsDir, 1, worker.NewProgressTracker(1), "", "", haveRom)
+	if err != nil {
+		t.Fatalf("failed to refresh dats: %v", err)
+	}
+	if !strings.Contains(endMsg, "dats counted for datstatus: 0") {
+		t.Fatalf("expected refresh to keep the counters, got %s", endMsg)
+	}
+	checkStatus(1, 819200)
+}
+
+func TestDBCopyTo(t *testing.T) {
+	dbDir, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test db: %v", err)
+	}
+	defer os.RemoveAll(dbDir)
+
+	err = os.Mkdir(filepath.Join(dbDir, "from"), 0755)
+	if err != nil {
+		t.Fatalf("cannot create test db dir: %v", err)
+	}
+
+	krdb, err := db.New(filepath.Join(dbDir, "from"))
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+
+	dat, sha1Bytes, err := parser.ParseDat(strings.NewReader(datText), "testing/dat")
+	if err != nil {
+		t.Fatalf("failed to parse test dat: %v", err)
+	}
+
+	err = krdb.IndexDat(dat, sha1Bytes)
+	if err != nil {
+		t.Fatalf("failed to index test dat: %v", err)
+	}
+
+	err = krdb.CopyTo(filepath.Join(dbDir, "to"), "goleveldb")
+	if err != nil {
+		t.Fatalf("failed to copy db: %v", err)
+	}
+
+	err = krdb.CopyTo(filepath.Join(dbDir, "to"), "goleveldb")
+	if err == nil {
+		t.Fatalf("expected copying onto an existing index to fail")
+	}
+
+	err = krdb.Close()
+	if err != nil {
+		t.Fatalf("failed to close db: %v", err)
+	}
+
+	copyDB, err := db.New(filepath.Join(dbDir, "to"))
+	if err != nil {
+		t.Fatalf("failed to open copied db: %v", err)
+	}
+	defer copyDB.Close()
+
+	datFromDb, err := copyDB.GetDat(sha1Bytes)
+	if err != nil {
+		t.Fatalf("failed to retrieve copied dat: %v", err)
+	}
+	if datFromDb == nil || !datFromDb.Equals(dat) {
+		t.Fatalf("copied dat differs from dat")
+	}
+
+	romSha1Bytes, err := hex.DecodeString("80353cb168dc5d7cc1dce57971f4ea2640a50ac4")
+	if err != nil {
+		t.Fatalf("failed to hex decode: %v", err)
+	}
+
+	dats, err := copyDB.DatsForRom(&types.Rom{Sha1: romSha1Bytes})
+	if err != nil {
+		t.Fatalf("failed to retrieve dats for rom: %v", err)
+	}
+	if len(dats) != 1 {
+		t.Fatalf("expected one dat for rom in copied db, got %d", len(dats))
+	}
+}
+
+func TestDBPurgeDats(t *testing.T) {
+	dbDir, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test db: %v", err)
+	}
+	defer os.RemoveAll(dbDir)
+
+	krdb, err := db.New(dbDir)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer krdb.Close()
+
+	dat, sha1Bytes, err := parser.ParseDat(strings.NewReader(datText), "testing/dat")
+	if err != nil {
+		t.Fatalf("failed to parse test dat: %v", err)
+	}
+
+	err = krdb.IndexDat(dat, sha1Bytes)
+	if err != nil {
+		t.Fatalf("failed to index test dat: %v", err)
+	}
+
+	err = krdb.OrphanDats()
+	if err != nil {
+		t.Fatalf("failed to orphan dats: %v", err)
+	}
+
+	stats, err := krdb.PurgeDats(1)
+	if err != nil {
+		t.Fatalf("failed to purge dats: %v", err)
+	}
+	if stats.NumDats != 0 {
+		t.Fatalf("expected dat of previous generation to be kept, %d dats purged", stats.NumDats)
+	}
+
+	romSha1Bytes, err := hex.DecodeString("80353cb168dc5d7cc1dce57971f4ea2640a50ac4")
+	if err != nil {
+		t.Fatalf("failed to hex decode: %v", err)
+	}
+
+	refs := krdb.DebugGet(romSha1Bytes, 0)
+	if !strings.Contains(refs, hex.EncodeToString(sha1Bytes)) {
+		t.Fatalf("expected rom references of kept dat, got %s", refs)
+	}
+
+	stats, err = krdb.PurgeDats(0)
+	if err != nil {
+		t.Fatalf("failed to purge dats: %v", err)
+	}
+	if stats.NumDats != 1 || stats.NumGames != 2 || stats.NumRefs != 5 {
+		t.Fatalf("expected 1 dat, 2 games and 5 refs purged, got %d dats, %d games and %d refs",
+			stats.NumDats, stats.NumGames, stats.NumRefs)
+	}
+
+	datFromDb, err := krdb.GetDat(sha1Bytes)
+	if err != nil {
+		t.Fatalf("failed to retrieve dat: %v", err)
+	}
+	if datFromDb != nil {
+		t.Fatalf("expected purged dat to be gone")
+	}
+
+	refs = krdb.DebugGet(romSha1Bytes, 0)
+	if strings.Contains(refs, hex.EncodeToString(sha1Bytes)) {
+		t.Fatalf("expected rom references of purged dat to be gone, got %s", refs)
+	}
+}
+
+func TestRefreshIncremental(t *testing.T) {
+	dbDir, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test db: %v", err)
+	}
+	defer os.RemoveAll(dbDir)
+
+	datsDir, err := ioutil.TempDir("", "rombadats")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test dats: %v", err)
+	}
+	defer os.RemoveAll(datsDir)
+
+	krdb, err := db.New(dbDir)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer krdb.Close()
+
+	datPath := filepath.Join(datsDir, "test.dat")
+	otherPath := filepath.Join(datsDir, "other.dat")
+	err = ioutil.WriteFile(datPath, []byte(datText), 0644)
+	if err != nil {
+		t.Fatalf("failed to write test dat: %v", err)
+	}
+	err = ioutil.WriteFile(otherPath, []byte(strings.Replace(datText, "Applications", "Games", -1)), 0644)
+	if err != nil {
+		t.Fatalf("failed to write test dat: %v", err)
+	}
+
+	refresh := func(expected string) {
+		endMsg, err := db.Refresh(krdb, datsDir, 1, worker.NewProgressTracker(1), "", "", nil)
+		if err != nil {
+			t.Fatalf("failed to refresh dats: %v", err)
+		}
+		if !strings.Contains(endMsg, expected) {
+			t.Fatalf("expected refresh to report %q, got %s", expected, endMsg)
+		}
+	}
+
+	refresh("added: 2, changed: 0, unchanged: 0, removed: 0")
+	refresh("added: 0, changed: 0, unchanged: 2, removed: 0")
+
+	err = os.Remove(otherPath)
+	if err != nil {
+		t.Fatalf("failed to remove test dat: %v", err)
+	}
+	err = ioutil.WriteFile(datPath, []byte(strings.Replace(datText, "2008-10-11", "2008-10-12", -1)), 0644)
+	if err != nil {
+		t.Fatalf("failed to write test dat: %v", err)
+	}
+	later := time.Now().Add(time.Hour)
+	err = os.Chtimes(datPath, later, later)
+	if err != nil {
+		t.Fatalf("failed to change mtime of test dat: %v", err)
+	}
+
+	refresh("added: 0, changed: 1, unchanged: 0, removed: 1")
+
+	datsForRom := func() []*types.Dat {
+		romSha1Bytes, err := hex.DecodeString("80353cb168dc5d7cc1dce57971f4ea2640a50ac4")
+		if err != nil {
+			t.Fatalf("failed to hex decode: %v", err)
+		}
+
+		dats, err := krdb.DatsForRom(&types.Rom{Sha1: romSha1Bytes})
+		if err != nil {
+			t.Fatalf("failed to retrieve dats for rom: %v", err)
+		}
+		return dats
+	}
+
+	dats := datsForRom()
+	if len(dats) != 1 || dats[0].Version != "2008-10-12" {
+		t.Fatalf("expected only the changed dat to be current, got %d dats", len(dats))
+	}
+
+	refresh("added: 0, changed: 0, unchanged: 1, removed: 0")
+
+	dats = datsForRom()
+	if len(dats) != 1 || dats[0].Version != "2008-10-12" {
+		t.Fatalf("expected unchanged dat to stay current, got %d dats", len(dats))
+	}
+}
+
+func TestDBBackupRestore(t *testing.T) {
+	dbDir, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test db: %v", err)
+	}
+	defer os.RemoveAll(dbDir)
+
+	krdb, err := db.New(dbDir)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+
+	dat, sha1Bytes, err := parser.ParseDat(strings.NewReader(datText), "testing/dat")
+	if err != nil {
+		t.Fatalf("failed to parse test dat: %v", err)
+	}
+
+	err = krdb.IndexDat(dat, sha1Bytes)
+	if err != nil {
+		t.Fatalf("failed to index test dat: %v", err)
+	}
+
+	backupDir, err := ioutil.TempDir("", "rombabackup")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for backup: %v", err)
+	}
+	defer os.RemoveAll(backupDir)
+
+	backupPath := filepath.Join(backupDir, "backup.zip")
+
+	manifest, err := krdb.Backup(backupPath)
+	if err != nil {
+		t.Fatalf("failed to back up db: %v", err)
+	}
+	if len(manifest.Stores) == 0 || manifest.Stores[0].NumKeys != 4 {
+		t.Fatalf("expected dats db with a header, two games and the schema version in backup")
+	}
+
+	err = krdb.Close()
+	if err != nil {
+		t.Fatalf("failed to close db: %v", err)
+	}
+
+	_, err = db.Restore(backupPath, dbDir)
+	if err == nil {
+		t.Fatalf("expected restoring onto an existing index to fail")
+	}
+
+	restoreDir := filepath.Join(backupDir, "db")
+
+	_, err = db.Restore(backupPath, restoreDir)
+	if err != nil {
+		t.Fatalf("failed to restore db: %v", err)
+	}
+	if _, err := os.Stat(restoreDir + ".restore"); !os.IsNotExist(err) {
+		t.Fatalf("expected restore to clean up its temp dir: %v", err)
+	}
+
+	restoredDB, err := db.New(restoreDir)
+	if err != nil {
+		t.Fatalf("failed to open restored db: %v", err)
+	}
+	defer restoredDB.Close()
+
+	datFromDb, err := restoredDB.GetDat(sha1Bytes)
+	if err != nil {
+		t.Fatalf("failed to retrieve restored dat: %v", err)
+	}
+	if datFromDb == nil || !datFromDb.Equals(dat) {
+		t.Fatalf("restored dat differs from dat")
+	}
+}
+
+func TestDBFsck(t *testing.T) {
+	dbDir, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test db: %v", err)
+	}
+	defer os.RemoveAll(dbDir)
+
+	krdb, err := db.New(dbDir)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+
+	dat, sha1Bytes, err := parser.ParseDat(strings.NewReader(datText), "testing/dat")
+	if err != nil {
+		t.Fatalf("failed to parse test dat: %v", err)
+	}
+
+	err = krdb.IndexDat(dat, sha1Bytes)
+	if err != nil {
+		t.Fatalf("failed to index test dat: %v", err)
+	}
+
+	err = krdb.Close()
+	if err != nil {
+		t.Fatalf("failed to close db: %v", err)
+	}
+
+	afterburner := findGame(dat, "Afterburner (1989)(Sega)(Side A)[cr NEC]")
+	missingDat := bytes.Repeat([]byte{1}, sha1.Size)
+
+	openStore := func(name string, keySize int) db.KVStore {
+		store, err := db.StoreOpener(filepath.Join(dbDir, name), keySize)
+		if err != nil {
+			t.Fatalf("failed to open %s: %v", name, err)
+		}
+		return store
+	}
+
+	sha1DB := openStore("sha1_db", sha1.Size)
+	err = sha1DB.Set(afterburner.Roms[0].Sha1GameKey(missingDat, 5), []byte{1})
+	if err != nil {
+		t.Fatalf("failed to store dangling reference: %v", err)
+	}
+	sha1DB.Close()
+
+	datsDB := openStore("dats_db", sha1.Size)
+	var buf bytes.Buffer
+	err = gob.NewEncoder(&buf).Encode(afterburner)
+	if err != nil {
+		t.Fatalf("failed to encode game: %v", err)
+	}
+	err = datsDB.Set(types.GameKey(missingDat, 0), buf.Bytes())
+	if err != nil {
+		t.Fatalf("failed to store game without dat: %v", err)
+	}
+	datsDB.Close()
+
+	generationsDB := openStore("generations_db", sha1.Size)
+	err = generationsDB.Set(missingDat, make([]byte, 8))
+	if err != nil {
+		t.Fatalf("failed to store generation: %v", err)
+	}
+	generationsDB.Close()
+
+	crcDB := openStore("crc_db", 16+sha1.Size)
+	for i, g := range dat.Games {
+		for _, r := range g.Roms {
+			err = crcDB.Delete(r.CrcWithSizeGameKey(sha1Bytes, i))
+			if err != nil {
+				t.Fatalf("failed to delete reference: %v", err)
+			}
+		}
+	}
+	crcDB.Close()
+
+	krdb, err = db.New(dbDir)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer krdb.Close()
+
+	depotRom := func(romSha1 []byte) (*types.Rom, error) {
+		if !bytes.Equal(romSha1, afterburner.Roms[0].Sha1) {
+			return nil, nil
+		}
+		rom := *afterburner.Roms[0]
+		rom.Crc = []byte{1, 2, 3, 4}
+		return &rom, nil
+	}
+
+	expected := map[string]int64{
+		db.FsckGameWithoutDat:        1,
+		db.FsckRomWithoutRef:         2,
+		db.FsckRefToMissingDat:       1,
+		db.FsckGenerationMissingDat:  1,
+		db.FsckMappingContradictsRom: 1,
+	}
+
+	for _, repair := range []bool{false, true} {
+		report, err := krdb.Fsck(repair, depotRom)
+		if err != nil {
+			t.Fatalf("failed to check db: %v", err)
+		}
+		for category, n := range expected {
+			if report.Problems[category] != n {
+				t.Fatalf("expected %d problems of category %s, got report\n%s", n, category, report)
+			}
+		}
+		if len(report.Problems) != len(expected) {
+			t.Fatalf("expected %d categories of problems, got report\n%s", len(expected), report)
+		}
+	}
+
+	report, err := krdb.Fsck(false, depotRom)
+	if err != nil {
+		t.Fatalf("failed to check db: %v", err)
+	}
+	if len(report.Problems) != 0 {
+		t.Fatalf("expected no problems after repair, got report\n%s", report)
+	}
+}
+
+func TestDBSizeUnknownRoms(t *testing.T) {
+	dbDir, err := ioutil.TempDir("", "rombadb")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test db: %v", err)
+	}
+	defer os.RemoveAll(dbDir)
+
+	datsDir, err := ioutil.TempDir("", "rombadats")
+	if err != nil {
+		t.Fatalf("cannot create temp dir for test dats: %v", err)
+	}
+	defer os.RemoveAll(datsDir)
+
+	krdb, err := db.New(dbDir)
+	if err != nil {
+		t.Fatalf("failed to open db: %v", err)
+	}
+	defer krdb.Close()
+
+	crc, _ := hex.DecodeString("01020304")
+	md5Bytes, _ := hex.DecodeString("43ee6acc0c173048f47826307c0a262e")
+	romSha1 := sha1.Sum([]byte("rom content"))
+	depotRom := &types.Rom{Crc: crc, Md5: md5Bytes, Sha1: romSha1[:], Size: 4096}
+
+	err = krdb.IndexRom(depotRom)
+	if err != nil {
+		t.Fatalf("failed to index rom: %v", err)
+	}
+
+	sfvText := "game.bin 01020304\nother.bin 0a0b0c0d\n"
+	err = ioutil.WriteFile(filepath.Join(datsDir, "test.sfv"), []byte(sfvText), 0644)
+	if err != nil {
+		t.Fatalf("failed to write test sfv: %v", err)
+	}
+	sfvSha1 := sha1.Sum([]byte(sfvText))
+
+	haveRom := func(r *types.Rom) (bool, error) {
+		return false, nil
+	}
+	_, err = db.Refresh(krdb, datsDir, 1, worker.NewProgressTracker(1), "", "", haveRom)
+	if err != nil {
+		t.Fatalf("failed to refresh dats: %v", err)
+	}
+
+	for _, r := range []*types.Rom{
+		{Crc: crc, Size: types.SizeUnknown},
+		{Md5: md5Bytes, Size: types.SizeUnknown},
+	} {
+		croms, err := krdb.CompleteRom(r)
+		if err != nil {
+			t.Fatalf("failed to complete rom: %v", err)
+		}
+		if len(croms) != 0 || !bytes.Equal(r.Sha1, romSha1[:]) || r.Size != 4096 {
+			t.Fatalf("expected rom of unknown size to resolve to the depot rom, got %+v", r)
+		}
+	}
+
+	dats, err := krdb.DatsForRom(depotRom)
+	if err != nil {
+		t.Fatalf("failed to look up dats for rom: %v", err)
+	}
+	if len(dats) != 1 || dats[0].Name != "test" {
+		t.Fatalf("expected the sfv dat to reference the depot rom, got %v", dats)
+	}
+
+	// the second update of the same rom must not count the other rom of the game
+	for i := 0; i < 2; i++ {
+		err = krdb.UpdateRomStatus(depotRom, true)
+		if err != nil {
+			t.Fatalf("failed to update rom status: %v", err)
+		}
+		ds, err := krdb.GetDatStatus(sfvSha1[:])
+		if err != nil {
+			t.Fatalf("failed to get dat status: %v", err)
+		}
+		if ds == nil || ds.NumRoms != 2 || ds.NumHave != 1 || ds.Bytes != 0 || ds.HaveBytes != 0 {
+			t.Fatalf("expected 1 of 2 roms of unknown size had, got %+v", ds)
+		}
+	}
+}
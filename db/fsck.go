@@ -0,0 +1,513 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package db
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"sort"
+
+	"github.com/golang/glog"
+
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/util"
+)
+
+// Categories of problems Fsck finds.
+const (
+	FsckGameWithoutDat        = "game without dat header"
+	FsckRomWithoutRef         = "rom of game without hash reference"
+	FsckRefToMissingDat       = "hash reference to missing dat"
+	FsckRefToMissingGame      = "hash reference to missing game"
+	FsckRefToGameWithoutRom   = "hash reference to game without that rom"
+	FsckKeyOfUnknownLayout    = "key of unknown layout"
+	FsckDatPathOfMissingDat   = "dat path of missing dat"
+	FsckGenerationMissingDat  = "generation of missing dat"
+	FsckMappingContradictsRom = "hash mapping contradicting depot rom"
+	FsckStatusOfMissingDat    = "counters of missing dat"
+)
+
+const fsckGameCacheSize = 10000
+
+// FsckReport counts the problems Fsck found by category.
+type FsckReport struct {
+	NumKeys  int64
+	Problems map[string]int64
+	Repaired int64
+}
+
+func (fr *FsckReport) String() string {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "checked %d keys\n", fr.NumKeys)
+
+	categories := make([]string, 0, len(fr.Problems))
+	for category := range fr.Problems {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+
+	for _, category := range categories {
+		fmt.Fprintf(&buf, "%s: %d\n", category, fr.Problems[category])
+	}
+	if len(categories) == 0 {
+		buf.WriteString("no problems found\n")
+	}
+	fmt.Fprintf(&buf, "repaired: %d\n", fr.Repaired)
+	return buf.String()
+}
+
+type fsck struct {
+	kvdb     *kvStore
+	kvb      *kvBatch
+	repair   bool
+	report   *FsckReport
+	dats     map[string]bool
+	games    map[string]*types.Game
+	depotRom func(sha1Bytes []byte) (*types.Rom, error)
+}
+
+func (fc *fsck) problem(category string, format string, args ...interface{}) {
+	fc.report.Problems[category]++
+	glog.V(2).Infof("db-fsck: %s: %s", category, fmt.Sprintf(format, args...))
+}
+
+func (fc *fsck) repaired() error {
+	fc.report.Repaired++
+	if fc.kvb.size >= MaxBatchSize {
+		return fc.kvb.Flush()
+	}
+	return nil
+}
+
+// Fsck cross-checks the stores of the index against each other and reports
+// dangling and contradictory entries. If depotRom is not nil, the hash
+// mappings are also checked against the depot: depotRom returns the rom the
+// depot holds for a SHA1, with the hashes from its gzip header, or nil. With
+// repair the problems are fixed, mostly by deleting the offending entries.
+// Nothing else may write to the index while Fsck runs.
+func (kvdb *kvStore) Fsck(repair bool, depotRom func(sha1Bytes []byte) (*types.Rom, error)) (*FsckReport, error) {
+	kvdb.Flush()
+
+	fc := &fsck{
+		kvdb:     kvdb,
+		kvb:      kvdb.StartBatch().(*kvBatch),
+		repair:   repair,
+		report:   &FsckReport{Problems: make(map[string]int64)},
+		dats:     make(map[string]bool),
+		games:    make(map[string]*types.Game),
+		depotRom: depotRom,
+	}
+
+	for _, step := range []struct {
+		name  string
+		check func() error
+	}{
+		{"dats", fc.checkDats},
+		{"sha1 references", func() error { return fc.checkRefs(kvdb.sha1DB, sha1.Size, fc.kvb.sha1Batch) }},
+		{"md5 references", func() error { return fc.checkRefs(kvdb.md5DB, md5.Size+8, fc.kvb.md5Batch) }},
+		{"crc references", func() error { return fc.checkRefs(kvdb.crcDB, crc32.Size+8, fc.kvb.crcBatch) }},
+		{"dat paths", fc.checkDatPaths},
+		{"generations", fc.checkGenerations},
+		{"counters", fc.checkStatus},
+		{"crc mappings", func() error { return fc.checkMappings(kvdb.crcsha1DB, crc32.Size, fc.kvb.crcsha1Batch) }},
+		{"md5 mappings", func() error { return fc.checkMappings(kvdb.md5sha1DB, md5.Size, fc.kvb.md5sha1Batch) }},
+	} {
+		glog.Infof("db-fsck checking %s", step.name)
+
+		err := step.check()
+		if err != nil {
+			return nil, fmt.Errorf("failed checking %s: %v", step.name, err)
+		}
+
+		// later steps read what earlier ones repaired
+		err = fc.kvb.Flush()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return fc.report, fc.kvb.Close()
+}
+
+// checkDats checks that every game has a DAT header and that the roms of the
+// games are referenced from their hashes. It also collects the DAT SHA1s for
+// the later steps.
+func (fc *fsck) checkDats() error {
+	var datSha1 []byte
+
+	return fc.kvdb.datsDB.Iterate(func(key, value []byte) (bool, error) {
+		fc.report.NumKeys++
+
+		switch len(key) {
+		case sha1.Size:
+			datSha1 = append(datSha1[:0], key...)
+			fc.dats[string(key)] = true
+		case gameRefSize:
+			game, err := decodeGame(value)
+			if err != nil {
+				return false, err
+			}
+
+			index := types.GameIndex(key)
+
+			if !bytes.Equal(key[:sha1.Size], datSha1) {
+				fc.problem(FsckGameWithoutDat, "game %s #%d of dat %s", game.Name, index, hex.EncodeToString(key[:sha1.Size]))
+
+				if fc.repair {
+					err = fc.kvb.deleteGameRefs(key[:sha1.Size], index, game, new(PurgeStats))
+					if err != nil {
+						return false, err
+					}
+					err = fc.kvb.datsBatch.Delete(key)
+					if err != nil {
+						return false, err
+					}
+					fc.kvb.size += int64(len(key))
+					return true, fc.repaired()
+				}
+				return true, nil
+			}
+
+			err = fc.checkRomRefs(key[:sha1.Size], index, game)
+			if err != nil {
+				return false, err
+			}
+		default:
+			if bytes.Equal(key, schemaVersionKey) {
+				return true, nil
+			}
+
+			fc.problem(FsckKeyOfUnknownLayout, "dats db key %s", hex.EncodeToString(key))
+
+			if fc.repair {
+				err := fc.kvb.datsBatch.Delete(key)
+				if err != nil {
+					return false, err
+				}
+				fc.kvb.size += int64(len(key))
+				return true, fc.repaired()
+			}
+		}
+		return true, nil
+	})
+}
+
+func (fc *fsck) checkRomRefs(datSha1 []byte, index int, game *types.Game) error {
+	for _, r := range game.Roms {
+		for _, ref := range []struct {
+			store KVStore
+			batch KVBatch
+			key   []byte
+		}{
+			{fc.kvdb.sha1DB, fc.kvb.sha1Batch, r.Sha1GameKey(datSha1, index)},
+			{fc.kvdb.md5DB, fc.kvb.md5Batch, r.Md5WithSizeGameKey(datSha1, index)},
+			{fc.kvdb.crcDB, fc.kvb.crcBatch, r.CrcWithSizeGameKey(datSha1, index)},
+		} {
+			if ref.key == nil {
+				continue
+			}
+
+			exists, err := ref.store.Exists(ref.key)
+			if err != nil {
+				return err
+			}
+			if exists {
+				continue
+			}
+
+			fc.problem(FsckRomWithoutRef, "rom %s of game %s #%d of dat %s", r.Name, game.Name, index,
+				hex.EncodeToString(datSha1))
+
+			if fc.repair {
+				err = ref.batch.Set(ref.key, oneValue)
+				if err != nil {
+					return err
+				}
+				fc.kvb.size += int64(len(ref.key))
+				err = fc.repaired()
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkRefs checks that the references from hashes in store point to games
+// that exist and contain a rom with that hash. hashSize is the size of the
+// hash part of the keys.
+func (fc *fsck) checkRefs(store KVStore, hashSize int, batch KVBatch) error {
+	return store.Iterate(func(key, value []byte) (bool, error) {
+		fc.report.NumKeys++
+
+		category := ""
+		detail := hex.EncodeToString(key)
+
+		if len(key) != hashSize+gameRefSize {
+			category = FsckKeyOfUnknownLayout
+		} else {
+			hash := key[:hashSize]
+			datSha1 := key[hashSize : hashSize+sha1.Size]
+			index := types.GameIndex(key)
+			detail = fmt.Sprintf("%s -> dat %s #%d", hex.EncodeToString(hash), hex.EncodeToString(datSha1), index)
+
+			if !fc.dats[string(datSha1)] {
+				category = FsckRefToMissingDat
+			} else {
+				game, err := fc.game(datSha1, index)
+				if err != nil {
+					return false, err
+				}
+
+				if game == nil {
+					category = FsckRefToMissingGame
+				} else if !gameHasRom(game, hash) {
+					category = FsckRefToGameWithoutRom
+				}
+			}
+		}
+
+		if category == "" {
+			return true, nil
+		}
+
+		fc.problem(category, "%s", detail)
+
+		if fc.repair {
+			err := batch.Delete(key)
+			if err != nil {
+				return false, err
+			}
+			fc.kvb.size += int64(len(key))
+			return true, fc.repaired()
+		}
+		return true, nil
+	})
+}
+
+// game returns the game with the given index of the DAT with SHA1 datSha1.
+// Decoded games are cached since the roms of a game are referenced from
+// keys all over the stores.
+func (fc *fsck) game(datSha1 []byte, index int) (*types.Game, error) {
+	key := string(types.GameKey(datSha1, index))
+
+	game, ok := fc.games[key]
+	if ok {
+		return game, nil
+	}
+
+	game, err := fc.kvdb.getGame(datSha1, index)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(fc.games) >= fsckGameCacheSize {
+		fc.games = make(map[string]*types.Game)
+	}
+	fc.games[key] = game
+	return game, nil
+}
+
+// gameHasRom returns true if game has a rom with the SHA1, the MD5 and size or
+// the CRC and size in hash.
+func gameHasRom(game *types.Game, hash []byte) bool {
+	for _, r := range game.Roms {
+		var rh []byte
+
+		switch len(hash) {
+		case sha1.Size:
+			rh = r.Sha1
+		case md5.Size + 8:
+			rh = r.Md5WithSizeKey()
+		case crc32.Size + 8:
+			rh = r.CrcWithSizeKey()
+		}
+
+		if rh != nil && bytes.Equal(rh, hash) {
+			return true
+		}
+	}
+	return false
+}
+
+func (fc *fsck) checkDatPaths() error {
+	return fc.kvdb.datPathsDB.Iterate(func(key, value []byte) (bool, error) {
+		fc.report.NumKeys++
+
+		dp, err := decodeDatPath(value)
+		if err != nil {
+			return false, err
+		}
+
+		for _, sha1Bytes := range dp.Sha1s {
+			if fc.dats[string(sha1Bytes)] {
+				continue
+			}
+
+			fc.problem(FsckDatPathOfMissingDat, "%s -> dat %s", string(key), hex.EncodeToString(sha1Bytes))
+
+			// the next refresh-dats parses the file again
+			if fc.repair {
+				err = fc.kvb.datPathsBatch.Delete(key)
+				if err != nil {
+					return false, err
+				}
+				fc.kvb.size += int64(len(key))
+				return true, fc.repaired()
+			}
+			break
+		}
+		return true, nil
+	})
+}
+
+func (fc *fsck) checkGenerations() error {
+	return fc.kvdb.generationsDB.Iterate(func(key, value []byte) (bool, error) {
+		fc.report.NumKeys++
+
+		if fc.dats[string(key)] {
+			return true, nil
+		}
+
+		fc.problem(FsckGenerationMissingDat, "dat %s", hex.EncodeToString(key))
+
+		if fc.repair {
+			err := fc.kvb.generationsBatch.Delete(key)
+			if err != nil {
+				return false, err
+			}
+			fc.kvb.size += int64(len(key))
+			return true, fc.repaired()
+		}
+		return true, nil
+	})
+}
+
+// checkStatus checks that the counters in the status db belong to DATs.
+func (fc *fsck) checkStatus() error {
+	return fc.kvdb.statusDB.Iterate(func(key, value []byte) (bool, error) {
+		fc.report.NumKeys++
+
+		known := len(key) == sha1.Size || len(key) == gameRefSize
+		if known && fc.dats[string(key[:sha1.Size])] {
+			return true, nil
+		}
+
+		if known {
+			fc.problem(FsckStatusOfMissingDat, "dat %s", hex.EncodeToString(key[:sha1.Size]))
+		} else {
+			fc.problem(FsckKeyOfUnknownLayout, "status db key %s", hex.EncodeToString(key))
+		}
+
+		if fc.repair {
+			err := fc.kvb.statusBatch.Delete(key)
+			if err != nil {
+				return false, err
+			}
+			fc.kvb.size += int64(len(key))
+			return true, fc.repaired()
+		}
+		return true, nil
+	})
+}
+
+// checkMappings checks the hash to SHA1 mappings in store against the hashes
+// in the gzip headers of the depot roms. hashSize is the size of the CRC or
+// MD5 the keys start with.
+func (fc *fsck) checkMappings(store KVStore, hashSize int, batch KVBatch) error {
+	if fc.depotRom == nil {
+		return nil
+	}
+
+	return store.Iterate(func(key, value []byte) (bool, error) {
+		fc.report.NumKeys++
+
+		if len(key) != hashSize+8+sha1.Size {
+			fc.problem(FsckKeyOfUnknownLayout, "mapping key %s", hex.EncodeToString(key))
+
+			if fc.repair {
+				err := batch.Delete(key)
+				if err != nil {
+					return false, err
+				}
+				fc.kvb.size += int64(len(key))
+				return true, fc.repaired()
+			}
+			return true, nil
+		}
+
+		sha1Bytes := key[hashSize+8:]
+
+		rom, err := fc.depotRom(sha1Bytes)
+		if err != nil {
+			return false, err
+		}
+		if rom == nil {
+			return true, nil
+		}
+
+		var romKey []byte
+		if hashSize == crc32.Size {
+			romKey = rom.CrcWithSizeAndSha1Key(sha1Bytes)
+		} else {
+			romKey = rom.Md5WithSizeAndSha1Key(sha1Bytes)
+		}
+
+		// depot roms archived without hashes in their header can't be checked
+		if romKey == nil || bytes.Equal(romKey, key) {
+			return true, nil
+		}
+
+		fc.problem(FsckMappingContradictsRom, "%s with size %d -> sha1 %s, depot has %s with size %d",
+			hex.EncodeToString(key[:hashSize]), util.BytesToInt64(key[hashSize:hashSize+8]),
+			hex.EncodeToString(sha1Bytes), hex.EncodeToString(romKey[:hashSize]), rom.Size)
+
+		if fc.repair {
+			err = batch.Delete(key)
+			if err != nil {
+				return false, err
+			}
+			err = batch.Set(romKey, oneValue)
+			if err != nil {
+				return false, err
+			}
+			fc.kvb.size += int64(len(key) + len(romKey))
+			return true, fc.repaired()
+		}
+		return true, nil
+	})
+}
@@ -0,0 +1,207 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+// Package golevel is a KVStore backend on goleveldb, a LevelDB written in pure
+// Go, for builds of romba without cgo.
+package golevel
+
+import (
+	"fmt"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/filter"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/db"
+)
+
+func init() {
+	db.RegisterStore(config.BackendGoLevelDB, openDb)
+}
+
+// options are the goleveldb options matching the ones romba uses for LevelDB.
+func options() *opt.Options {
+	return &opt.Options{
+		Filter:                 filter.NewBloomFilter(16),
+		BlockCacheCapacity:     10490000,
+		OpenFilesCacheCapacity: 500,
+		WriteBuffer:            62914560,
+	}
+}
+
+func openDb(path string, keySize int) (db.KVStore, error) {
+	dbn, err := leveldb.OpenFile(path, options())
+	if err != nil {
+		return nil, fmt.Errorf("failed to open db at %s: %v", path, err)
+	}
+	return &store{
+		dbn: dbn,
+	}, nil
+}
+
+type store struct {
+	dbn *leveldb.DB
+}
+
+func (s *store) Set(key, value []byte) error {
+	return s.dbn.Put(key, value, nil)
+}
+
+func (s *store) Get(key []byte) ([]byte, error) {
+	v, err := s.dbn.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	return v, err
+}
+
+func (s *store) GetKeySuffixesFor(keyPrefix []byte) ([]byte, error) {
+	var suffixes []byte
+
+	it := s.dbn.NewIterator(util.BytesPrefix(keyPrefix), nil)
+	defer it.Release()
+	n := len(keyPrefix)
+
+	for it.Next() {
+		suffixes = append(suffixes, it.Key()[n:]...)
+	}
+	return suffixes, it.Error()
+}
+
+func (s *store) Delete(key []byte) error {
+	return s.dbn.Delete(key, nil)
+}
+
+func (s *store) Exists(key []byte) (bool, error) {
+	return s.dbn.Has(key, nil)
+}
+
+func (s *store) BeginRefresh() error { return nil }
+func (s *store) EndRefresh() error   { return nil }
+func (s *store) PrintStats() string {
+	stats, err := s.dbn.GetProperty("leveldb.stats")
+	if err != nil {
+		return err.Error()
+	}
+	return stats
+}
+
+func (s *store) Flush() {}
+
+func (s *store) Compact() error {
+	return s.dbn.CompactRange(util.Range{})
+}
+
+// Size is not supported, leveldb keeps no count of its keys. It returns 0 like the
+// cgo backend does.
+func (s *store) Size() int64 {
+	return 0
+}
+
+func (s *store) StartBatch() db.KVBatch {
+	return &batch{
+		bn: new(leveldb.Batch),
+	}
+}
+
+func (s *store) WriteBatch(b db.KVBatch) error {
+	gb := b.(*batch)
+	return s.dbn.Write(gb.bn, nil)
+}
+
+func (s *store) Close() error {
+	return s.dbn.Close()
+}
+
+// Iterate hands copies of the keys and values to df, as levigo does, since
+// goleveldb reuses the buffers of its iterators.
+func (s *store) Iterate(df func(key, value []byte) (bool, error)) error {
+	return iterate(s.dbn.NewIterator(nil, nil), df)
+}
+
+func (s *store) Snapshot() (db.KVSnapshot, error) {
+	snap, err := s.dbn.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &snapshot{snap: snap}, nil
+}
+
+type snapshot struct {
+	snap *leveldb.Snapshot
+}
+
+func (ss *snapshot) Iterate(df func(key, value []byte) (bool, error)) error {
+	return iterate(ss.snap.NewIterator(nil, nil), df)
+}
+
+func (ss *snapshot) Release() {
+	ss.snap.Release()
+}
+
+func iterate(it iterator.Iterator, df func(key, value []byte) (bool, error)) error {
+	defer it.Release()
+
+	for it.Next() {
+		key := append([]byte(nil), it.Key()...)
+		value := append([]byte(nil), it.Value()...)
+
+		goOn, err := df(key, value)
+		if err != nil {
+			return err
+		}
+
+		if !goOn {
+			break
+		}
+	}
+	return it.Error()
+}
+
+type batch struct {
+	bn *leveldb.Batch
+}
+
+func (b *batch) Set(key, value []byte) error {
+	b.bn.Put(key, value)
+	return nil
+}
+
+func (b *batch) Delete(key []byte) error {
+	b.bn.Delete(key)
+	return nil
+}
+
+func (b *batch) Clear() {
+	b.bn.Reset()
+}
@@ -39,6 +39,8 @@ import (
 	"fmt"
 	"hash/crc32"
 	"path/filepath"
+	"sort"
+	"sync"
 
 	"github.com/uwedeportivo/romba/combine"
 
@@ -55,6 +57,10 @@ const (
 	sha1DBName    = "sha1_db"
 	crcsha1DBName = "crcsha1_db"
 	md5sha1DBName = "md5sha1_db"
+
+	datPathsDBName    = "datpaths_db"
+	generationsDBName = "generations_db"
+	statusDBName      = "status_db"
 )
 
 var oneValue []byte
@@ -79,6 +85,15 @@ type KVStore interface {
 	EndRefresh() error
 	PrintStats() string
 	Iterate(func(key, value []byte) (bool, error)) error
+	Snapshot() (KVSnapshot, error)
+	Compact() error
+}
+
+// KVSnapshot is a read-only view of a KVStore as it was when the snapshot was
+// taken. It has to be released when done.
+type KVSnapshot interface {
+	Iterate(func(key, value []byte) (bool, error)) error
+	Release()
 }
 
 type KVBatch interface {
@@ -89,6 +104,36 @@ type KVBatch interface {
 
 var StoreOpener func(pathPrefix string, keySize int) (KVStore, error)
 
+var storeOpeners = make(map[string]func(pathPrefix string, keySize int) (KVStore, error))
+
+// RegisterStore makes the KVStore backend opened by opener available as name.
+// The first backend registered is used until UseStore picks another one.
+func RegisterStore(name string, opener func(pathPrefix string, keySize int) (KVStore, error)) {
+	storeOpeners[name] = opener
+	if StoreOpener == nil {
+		StoreOpener = opener
+	}
+}
+
+func storeOpener(name string) (func(pathPrefix string, keySize int) (KVStore, error), error) {
+	opener, ok := storeOpeners[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown or not built in key-value store backend %q", name)
+	}
+	return opener, nil
+}
+
+// UseStore makes the KVStore backend registered as name the one indexes are
+// opened with.
+func UseStore(name string) error {
+	opener, err := storeOpener(name)
+	if err != nil {
+		return err
+	}
+	StoreOpener = opener
+	return nil
+}
+
 type kvStore struct {
 	generation int64
 	datsDB     KVStore
@@ -97,18 +142,55 @@ type kvStore struct {
 	sha1DB     KVStore
 	crcsha1DB  KVStore
 	md5sha1DB  KVStore
-	path       string
+	// datPathsDB maps the paths of DAT files to what refresh-dats last saw of
+	// them, see DatPath.
+	datPathsDB KVStore
+	// generationsDB maps DAT SHA1s to the last generation that saw them, so
+	// refreshing unchanged DATs doesn't rewrite their headers.
+	generationsDB KVStore
+	// statusDB holds the have and miss counters of DATs and games under the
+	// keys of their records in datsDB, see DatStatus.
+	statusDB      KVStore
+	path          string
+	schemaVersion int
+	// statusMutex serializes the updates of the counters in statusDB.
+	statusMutex sync.Mutex
 }
 
 type kvBatch struct {
-	db           *kvStore
-	datsBatch    KVBatch
-	crcBatch     KVBatch
-	md5Batch     KVBatch
-	sha1Batch    KVBatch
-	crcsha1Batch KVBatch
-	md5sha1Batch KVBatch
-	size         int64
+	db               *kvStore
+	datsBatch        KVBatch
+	crcBatch         KVBatch
+	md5Batch         KVBatch
+	sha1Batch        KVBatch
+	crcsha1Batch     KVBatch
+	md5sha1Batch     KVBatch
+	datPathsBatch    KVBatch
+	generationsBatch KVBatch
+	statusBatch      KVBatch
+	size             int64
+}
+
+// namedStore is one of the stores of the index with the name of its directory
+// and the size of the keys GetKeySuffixesFor strips.
+type namedStore struct {
+	name    string
+	store   KVStore
+	keySize int
+}
+
+func (kvdb *kvStore) namedStores() []namedStore {
+	return []namedStore{
+		{datsDBName, kvdb.datsDB, sha1.Size},
+		{crcDBName, kvdb.crcDB, crc32.Size + sha1.Size + 8},
+		{md5DBName, kvdb.md5DB, md5.Size + sha1.Size + 8},
+		{sha1DBName, kvdb.sha1DB, sha1.Size},
+		{crcsha1DBName, kvdb.crcsha1DB, crc32.Size + sha1.Size + 8},
+		{md5sha1DBName, kvdb.md5sha1DB, md5.Size + sha1.Size + 8},
+		{datPathsDBName, kvdb.datPathsDB, 0},
+		{generationsDBName, kvdb.generationsDB, sha1.Size},
+		{statusDBName, kvdb.statusDB, sha1.Size},
+	}
 }
 
 func openDb(pathPrefix string, keySize int) (KVStore, error) {
@@ -168,6 +250,33 @@ func NewKVStoreDB(path string) (RomDB, error) {
 	}
 	kvdb.md5sha1DB = db
 
+	glog.Infof("Loading DAT Paths DB")
+	db, err = openDb(filepath.Join(path, datPathsDBName), 0)
+	if err != nil {
+		return nil, err
+	}
+	kvdb.datPathsDB = db
+
+	glog.Infof("Loading Generations DB")
+	db, err = openDb(filepath.Join(path, generationsDBName), sha1.Size)
+	if err != nil {
+		return nil, err
+	}
+	kvdb.generationsDB = db
+
+	glog.Infof("Loading Status DB")
+	db, err = openDb(filepath.Join(path, statusDBName), sha1.Size)
+	if err != nil {
+		return nil, err
+	}
+	kvdb.statusDB = db
+
+	err = kvdb.migrate()
+	if err != nil {
+		kvdb.Close()
+		return nil, err
+	}
+
 	return kvdb, nil
 }
 
@@ -222,127 +331,224 @@ func decodeDat(dBytes []byte) (*types.Dat, error) {
 	return &dat, nil
 }
 
-func (kvdb *kvStore) GetDat(sha1Bytes []byte) (*types.Dat, error) {
-	dBytes, err := kvdb.datsDB.Get(sha1Bytes)
+func decodeGame(gBytes []byte) (*types.Game, error) {
+	if gBytes == nil {
+		return nil, nil
+	}
+	buf := bytes.NewBuffer(gBytes)
+	gameDecoder := gob.NewDecoder(buf)
+
+	var game types.Game
+
+	err := gameDecoder.Decode(&game)
 	if err != nil {
 		return nil, err
 	}
-	return decodeDat(dBytes)
+	return &game, nil
 }
 
-func (kvdb *kvStore) IsRomReferencedByDats(rom *types.Rom) (bool, error) {
-	var dBytes []byte
+// GetDatHeader returns the DAT with SHA1 sha1Bytes without its games.
+func (kvdb *kvStore) GetDatHeader(sha1Bytes []byte) (*types.Dat, error) {
+	dBytes, err := kvdb.datsDB.Get(sha1Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return kvdb.decodeDatHeader(sha1Bytes, dBytes)
+}
 
-	if len(rom.Sha1) == sha1.Size {
-		bs, err := kvdb.sha1DB.GetKeySuffixesFor(rom.Sha1)
-		if err != nil {
-			return false, err
-		}
-		if bs != nil {
-			dBytes = append(dBytes, bs...)
-		}
+// decodeDatHeader decodes the header record of the DAT with SHA1 sha1Bytes and
+// advances its generation to the one in the generations db, if that is later.
+func (kvdb *kvStore) decodeDatHeader(sha1Bytes, dBytes []byte) (*types.Dat, error) {
+	dat, err := decodeDat(dBytes)
+	if err != nil || dat == nil {
+		return nil, err
 	}
-	if len(rom.Md5) == md5.Size && rom.Size > 0 {
-		bs, err := kvdb.md5DB.GetKeySuffixesFor(rom.Md5WithSizeKey())
-		if err != nil {
-			return false, err
-		}
-		if bs != nil {
-			dBytes = append(dBytes, bs...)
-		}
+
+	gBytes, err := kvdb.generationsDB.Get(sha1Bytes)
+	if err != nil {
+		return nil, err
 	}
-	if len(rom.Crc) == crc32.Size && rom.Size > 0 {
-		bs, err := kvdb.crcDB.GetKeySuffixesFor(rom.CrcWithSizeKey())
-		if err != nil {
-			return false, err
-		}
-		if bs != nil {
-			dBytes = append(dBytes, bs...)
+	if len(gBytes) == 8 {
+		gen := util.BytesToInt64(gBytes)
+		if gen > dat.Generation {
+			dat.Generation = gen
 		}
 	}
+	return dat, nil
+}
 
-	if dBytes == nil {
-		return false, nil
+func (kvdb *kvStore) getGame(sha1Bytes []byte, index int) (*types.Game, error) {
+	gBytes, err := kvdb.datsDB.Get(types.GameKey(sha1Bytes, index))
+	if err != nil {
+		return nil, err
 	}
+	return decodeGame(gBytes)
+}
 
-	for i := 0; i < len(dBytes); i += sha1.Size {
-		sha1Bytes := dBytes[i : i+sha1.Size]
+func (kvdb *kvStore) HasDat(sha1Bytes []byte) (bool, error) {
+	return kvdb.datsDB.Exists(sha1Bytes)
+}
+
+func (kvdb *kvStore) GetDat(sha1Bytes []byte) (*types.Dat, error) {
+	dat, err := kvdb.GetDatHeader(sha1Bytes)
+	if err != nil || dat == nil {
+		return nil, err
+	}
 
-		dat, err := kvdb.GetDat(sha1Bytes)
+	for i := 0; ; i++ {
+		game, err := kvdb.getGame(sha1Bytes, i)
 		if err != nil {
-			return false, err
+			return nil, err
 		}
-		if dat != nil {
-			if dat.Generation == kvdb.Generation() {
-				return true, nil
-			}
+		if game == nil {
+			break
 		}
+		dat.Games = append(dat.Games, game)
 	}
-
-	return false, nil
+	sort.Sort(dat.Games)
+	return dat, nil
 }
 
-func (kvdb *kvStore) FilteredDatsForRom(rom *types.Rom, filter func(*types.Dat) bool) ([]*types.Dat, []*types.Dat, error) {
+// romRefs returns the concatenated (DAT SHA1, game index) references of all games
+// containing rom.
+func (kvdb *kvStore) romRefs(rom *types.Rom) ([]byte, error) {
 	var dBytes []byte
 
 	if len(rom.Sha1) == sha1.Size {
 		bs, err := kvdb.sha1DB.GetKeySuffixesFor(rom.Sha1)
 		if err != nil {
-			return nil, nil, err
-		}
-		if bs != nil {
-			dBytes = append(dBytes, bs...)
+			return nil, err
 		}
+		dBytes = append(dBytes, bs...)
 	}
 	if len(rom.Md5) == md5.Size && rom.Size > 0 {
-		bs, err := kvdb.md5DB.GetKeySuffixesFor(rom.Md5WithSizeKey())
+		bs, err := hashRefs(kvdb.md5DB, rom.Md5, rom.Md5WithSizeKey())
 		if err != nil {
-			return nil, nil, err
-		}
-		if bs != nil {
-			dBytes = append(dBytes, bs...)
+			return nil, err
 		}
+		dBytes = append(dBytes, bs...)
 	}
 	if len(rom.Crc) == crc32.Size && rom.Size > 0 {
-		bs, err := kvdb.crcDB.GetKeySuffixesFor(rom.CrcWithSizeKey())
+		bs, err := hashRefs(kvdb.crcDB, rom.Crc, rom.CrcWithSizeKey())
 		if err != nil {
-			return nil, nil, err
-		}
-		if bs != nil {
-			dBytes = append(dBytes, bs...)
+			return nil, err
 		}
+		dBytes = append(dBytes, bs...)
 	}
+	return dBytes, nil
+}
 
-	if dBytes == nil {
-		return nil, nil, nil
+// hashRefs returns the game references of the roms with hash and the size in
+// keyWithSize, and of the roms with hash whose DATs don't record a size.
+func hashRefs(store KVStore, hash, keyWithSize []byte) ([]byte, error) {
+	dBytes, err := store.GetKeySuffixesFor(keyWithSize)
+	if err != nil {
+		return nil, err
 	}
 
-	var dats []*types.Dat
-	var rejectedDats []*types.Dat
+	unknownKey := make([]byte, len(hash)+8)
+	copy(unknownKey, hash)
+	util.Int64ToBytes(types.SizeUnknown, unknownKey[len(hash):])
 
-	seen := make(map[string]bool)
+	bs, err := store.GetKeySuffixesFor(unknownKey)
+	if err != nil {
+		return nil, err
+	}
+	return append(dBytes, bs...), nil
+}
 
-	for i := 0; i < len(dBytes); i += sha1.Size {
-		sha1Bytes := dBytes[i : i+sha1.Size]
+const gameRefSize = sha1.Size + types.KeySizeGameIndex
+
+type datGames struct {
+	sha1Bytes []byte
+	indexes   []int
+}
 
-		if seen[string(sha1Bytes)] {
+// groupRefs groups the game references returned by romRefs by DAT, in the order
+// the DATs first appear.
+func groupRefs(refs []byte) []*datGames {
+	var dgs []*datGames
+	byDat := make(map[string]*datGames)
+	seen := make(map[string]bool)
+
+	for i := 0; i+gameRefSize <= len(refs); i += gameRefSize {
+		ref := refs[i : i+gameRefSize]
+		if seen[string(ref)] {
 			continue
 		}
-		seen[string(sha1Bytes)] = true
+		seen[string(ref)] = true
+
+		sha1Bytes := ref[:sha1.Size]
+		dg := byDat[string(sha1Bytes)]
+		if dg == nil {
+			dg = &datGames{sha1Bytes: sha1Bytes}
+			byDat[string(sha1Bytes)] = dg
+			dgs = append(dgs, dg)
+		}
+		dg.indexes = append(dg.indexes, types.GameIndex(ref))
+	}
+	return dgs
+}
+
+func (kvdb *kvStore) IsRomReferencedByDats(rom *types.Rom) (bool, error) {
+	refs, err := kvdb.romRefs(rom)
+	if err != nil {
+		return false, err
+	}
 
-		dat, err := kvdb.GetDat(sha1Bytes)
+	for _, dg := range groupRefs(refs) {
+		dat, err := kvdb.GetDatHeader(dg.sha1Bytes)
 		if err != nil {
-			return nil, nil, err
+			return false, err
 		}
 		if dat != nil {
-			if filter(dat) {
-				dats = append(dats, dat)
-			} else {
-				rejectedDats = append(rejectedDats, dat)
+			if dat.Generation == kvdb.Generation() {
+				return true, nil
 			}
 		}
 	}
 
+	return false, nil
+}
+
+// FilteredDatsForRom returns the DATs containing rom, split by filter. Each DAT only
+// holds the games containing rom.
+func (kvdb *kvStore) FilteredDatsForRom(rom *types.Rom, filter func(*types.Dat) bool) ([]*types.Dat, []*types.Dat, error) {
+	refs, err := kvdb.romRefs(rom)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var dats []*types.Dat
+	var rejectedDats []*types.Dat
+
+	for _, dg := range groupRefs(refs) {
+		dat, err := kvdb.GetDatHeader(dg.sha1Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		if dat == nil {
+			continue
+		}
+
+		for _, index := range dg.indexes {
+			game, err := kvdb.getGame(dg.sha1Bytes, index)
+			if err != nil {
+				return nil, nil, err
+			}
+			if game != nil {
+				dat.Games = append(dat.Games, game)
+			}
+		}
+		sort.Sort(dat.Games)
+
+		if filter(dat) {
+			dats = append(dats, dat)
+		} else {
+			rejectedDats = append(rejectedDats, dat)
+		}
+	}
+
 	return dats, rejectedDats, nil
 }
 
@@ -362,55 +568,55 @@ func (kvdb *kvStore) CompleteRom(rom *types.Rom) ([]*types.Rom, error) {
 	}
 
 	if rom.Md5 != nil {
-		dBytes, err := kvdb.md5sha1DB.GetKeySuffixesFor(rom.Md5WithSizeKey())
-		if err != nil {
-			return nil, err
-		}
-		if len(dBytes) < sha1.Size {
-			return nil, nil
-		}
-		rom.Sha1 = dBytes[:sha1.Size]
-		if len(dBytes) == sha1.Size {
-			return nil, nil
-		}
-		var croms []*types.Rom
-		for rb := dBytes[sha1.Size:]; len(rb) >= sha1.Size; rb = rb[sha1.Size:] {
-			croms = append(croms, &types.Rom{
-				Sha1: rb[:sha1.Size],
-				Md5:  rom.Md5,
-				Crc:  rom.Crc,
-				Name: rom.Name,
-				Size: rom.Size,
-			})
-		}
-		return croms, nil
+		return completeRomFrom(kvdb.md5sha1DB, rom, rom.Md5, rom.Md5WithSizeKey())
 	}
 
 	if rom.Crc != nil {
-		dBytes, err := kvdb.crcsha1DB.GetKeySuffixesFor(rom.CrcWithSizeKey())
-		if err != nil {
-			return nil, err
-		}
-		if len(dBytes) < sha1.Size {
-			return nil, nil
-		}
-		rom.Sha1 = dBytes[:sha1.Size]
-		if len(dBytes) == sha1.Size {
-			return nil, nil
+		return completeRomFrom(kvdb.crcsha1DB, rom, rom.Crc, rom.CrcWithSizeKey())
+	}
+	return nil, nil
+}
+
+// completeRomFrom fills in the SHA1 of rom from the hash to sha1 store. Roms of unknown
+// size are looked up by hash alone and take over the size of what they resolve to.
+// Further SHA1s matching the rom are returned as extra roms.
+func completeRomFrom(store KVStore, rom *types.Rom, hash, keyWithSize []byte) ([]*types.Rom, error) {
+	sizeUnknown := rom.Size < 0
+
+	key := keyWithSize
+	recordSize := sha1.Size
+	if sizeUnknown {
+		key = hash
+		recordSize = 8 + sha1.Size
+	}
+
+	dBytes, err := store.GetKeySuffixesFor(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var croms []*types.Rom
+	for rb := dBytes; len(rb) >= recordSize; rb = rb[recordSize:] {
+		size := rom.Size
+		if sizeUnknown {
+			size = util.BytesToInt64(rb[:8])
 		}
-		var croms []*types.Rom
-		for rb := dBytes[sha1.Size:]; len(rb) >= sha1.Size; rb = rb[sha1.Size:] {
-			croms = append(croms, &types.Rom{
-				Sha1: rb[:sha1.Size],
-				Md5:  rom.Md5,
-				Crc:  rom.Crc,
-				Name: rom.Name,
-				Size: rom.Size,
-			})
+		sha1Bytes := rb[recordSize-sha1.Size : recordSize]
+
+		if rom.Sha1 == nil {
+			rom.Sha1 = sha1Bytes
+			rom.Size = size
+			continue
 		}
-		return croms, nil
+		croms = append(croms, &types.Rom{
+			Sha1: sha1Bytes,
+			Md5:  rom.Md5,
+			Crc:  rom.Crc,
+			Name: rom.Name,
+			Size: size,
+		})
 	}
-	return nil, nil
+	return croms, nil
 }
 
 func (kvdb *kvStore) Flush() {
@@ -420,6 +626,9 @@ func (kvdb *kvStore) Flush() {
 	kvdb.sha1DB.Flush()
 	kvdb.crcsha1DB.Flush()
 	kvdb.md5sha1DB.Flush()
+	kvdb.datPathsDB.Flush()
+	kvdb.generationsDB.Flush()
+	kvdb.statusDB.Flush()
 }
 
 func (kvdb *kvStore) Close() error {
@@ -454,6 +663,21 @@ func (kvdb *kvStore) Close() error {
 	if err != nil {
 		return err
 	}
+
+	err = kvdb.datPathsDB.Close()
+	if err != nil {
+		return err
+	}
+
+	err = kvdb.generationsDB.Close()
+	if err != nil {
+		return err
+	}
+
+	err = kvdb.statusDB.Close()
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -470,6 +694,9 @@ func (kvdb *kvStore) PrintStats() string {
 	fmt.Fprintf(buf, "sha1DB stats: %s\n", kvdb.sha1DB.PrintStats())
 	fmt.Fprintf(buf, "crcsha1DB stats: %s\n", kvdb.crcsha1DB.PrintStats())
 	fmt.Fprintf(buf, "md5sha1DB stats: %s\n", kvdb.md5sha1DB.PrintStats())
+	fmt.Fprintf(buf, "datPathsDB stats: %s\n", kvdb.datPathsDB.PrintStats())
+	fmt.Fprintf(buf, "generationsDB stats: %s\n", kvdb.generationsDB.PrintStats())
+	fmt.Fprintf(buf, "statusDB stats: %s\n", kvdb.statusDB.PrintStats())
 
 	return buf.String()
 }
@@ -480,13 +707,16 @@ func (kvdb *kvStore) EndDatRefresh() error {
 
 func (kvdb *kvStore) StartBatch() RomBatch {
 	return &kvBatch{
-		db:           kvdb,
-		datsBatch:    kvdb.datsDB.StartBatch(),
-		crcBatch:     kvdb.crcDB.StartBatch(),
-		md5Batch:     kvdb.md5DB.StartBatch(),
-		sha1Batch:    kvdb.sha1DB.StartBatch(),
-		crcsha1Batch: kvdb.crcsha1DB.StartBatch(),
-		md5sha1Batch: kvdb.md5sha1DB.StartBatch(),
+		db:               kvdb,
+		datsBatch:        kvdb.datsDB.StartBatch(),
+		crcBatch:         kvdb.crcDB.StartBatch(),
+		md5Batch:         kvdb.md5DB.StartBatch(),
+		sha1Batch:        kvdb.sha1DB.StartBatch(),
+		crcsha1Batch:     kvdb.crcsha1DB.StartBatch(),
+		md5sha1Batch:     kvdb.md5sha1DB.StartBatch(),
+		datPathsBatch:    kvdb.datPathsDB.StartBatch(),
+		generationsBatch: kvdb.generationsDB.StartBatch(),
+		statusBatch:      kvdb.statusDB.StartBatch(),
 	}
 }
 
@@ -531,6 +761,24 @@ func (kvb *kvBatch) Flush() error {
 	}
 	kvb.md5sha1Batch.Clear()
 
+	err = kvb.db.datPathsDB.WriteBatch(kvb.datPathsBatch)
+	if err != nil {
+		return err
+	}
+	kvb.datPathsBatch.Clear()
+
+	err = kvb.db.generationsDB.WriteBatch(kvb.generationsBatch)
+	if err != nil {
+		return err
+	}
+	kvb.generationsBatch.Clear()
+
+	err = kvb.db.statusDB.WriteBatch(kvb.statusBatch)
+	if err != nil {
+		return err
+	}
+	kvb.statusBatch.Clear()
+
 	kvb.size = 0
 	return nil
 }
@@ -575,69 +823,121 @@ func (kvb *kvBatch) IndexDat(dat *types.Dat, sha1Bytes []byte) error {
 		return fmt.Errorf("sha1 is nil for %s", dat.Path)
 	}
 
+	exists, err := kvb.db.HasDat(sha1Bytes)
+	if err != nil {
+		return fmt.Errorf("failed to lookup sha1 indexing dats: %v", err)
+	}
+
+	if !exists {
+		for i, g := range dat.Games {
+			if kvb.size >= MaxBatchSize {
+				err = kvb.Flush()
+				if err != nil {
+					return err
+				}
+			}
+
+			err = kvb.IndexGame(sha1Bytes, i, g)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return kvb.IndexDatHeader(dat, sha1Bytes)
+}
+
+// IndexDatHeader stores the header record of dat, stamped with the current
+// generation. The games of dat are not stored.
+func (kvb *kvBatch) IndexDatHeader(dat *types.Dat, sha1Bytes []byte) error {
+	if sha1Bytes == nil {
+		return fmt.Errorf("sha1 is nil for %s", dat.Path)
+	}
+
 	dat.Generation = kvb.db.generation
+	return kvb.setDatHeader(dat, sha1Bytes)
+}
+
+func (kvb *kvBatch) setDatHeader(dat *types.Dat, sha1Bytes []byte) error {
+	hdr := *dat
+	hdr.Games = nil
+	hdr.Software = nil
+	hdr.Machines = nil
 
 	var buf bytes.Buffer
 
 	gobEncoder := gob.NewEncoder(&buf)
-	err := gobEncoder.Encode(dat)
+	err := gobEncoder.Encode(&hdr)
 	if err != nil {
 		return err
 	}
 
-	exists, err := kvb.db.datsDB.Exists(sha1Bytes)
+	err = kvb.datsBatch.Set(sha1Bytes, buf.Bytes())
 	if err != nil {
-		return fmt.Errorf("failed to lookup sha1 indexing dats: %v", err)
+		return err
 	}
-
-	kvb.datsBatch.Set(sha1Bytes, buf.Bytes())
 	kvb.size += int64(sha1.Size + buf.Len())
+	return nil
+}
 
-	if !exists {
-		for _, g := range dat.Games {
-			glog.V(4).Infof("indexing game %s", g.Name)
-			for _, r := range g.Roms {
-				if r.Sha1 != nil {
-					err = kvb.sha1Batch.Set(r.Sha1Sha1Key(sha1Bytes), oneValue)
-					if err != nil {
-						return err
-					}
-					kvb.size += int64(sha1.Size)
-				}
+// IndexGame stores the game with the given index of the DAT with SHA1 datSha1
+// and references it from the hashes of its roms.
+func (kvb *kvBatch) IndexGame(datSha1 []byte, index int, g *types.Game) error {
+	glog.V(4).Infof("indexing game %s", g.Name)
 
-				if r.Md5 != nil {
-					err = kvb.md5Batch.Set(r.Md5WithSizeAndSha1Key(sha1Bytes), oneValue)
-					if err != nil {
-						return err
-					}
-					kvb.size += int64(sha1.Size)
-
-					if r.Sha1 != nil {
-						glog.V(4).Infof("declaring md5 %s -> sha1 %s mapping", hex.EncodeToString(r.Md5), hex.EncodeToString(r.Sha1))
-						err = kvb.md5sha1Batch.Set(r.Md5WithSizeAndSha1Key(nil), oneValue)
-						if err != nil {
-							return err
-						}
-						kvb.size += int64(sha1.Size)
-					}
+	var buf bytes.Buffer
+
+	gobEncoder := gob.NewEncoder(&buf)
+	err := gobEncoder.Encode(g)
+	if err != nil {
+		return err
+	}
+
+	err = kvb.datsBatch.Set(types.GameKey(datSha1, index), buf.Bytes())
+	if err != nil {
+		return err
+	}
+	kvb.size += int64(gameRefSize + buf.Len())
+
+	for _, r := range g.Roms {
+		if r.Sha1 != nil {
+			err = kvb.sha1Batch.Set(r.Sha1GameKey(datSha1, index), oneValue)
+			if err != nil {
+				return err
+			}
+			kvb.size += int64(gameRefSize)
+		}
+
+		if r.Md5 != nil {
+			err = kvb.md5Batch.Set(r.Md5WithSizeGameKey(datSha1, index), oneValue)
+			if err != nil {
+				return err
+			}
+			kvb.size += int64(gameRefSize)
+
+			if r.Sha1 != nil {
+				glog.V(4).Infof("declaring md5 %s -> sha1 %s mapping", hex.EncodeToString(r.Md5), hex.EncodeToString(r.Sha1))
+				err = kvb.md5sha1Batch.Set(r.Md5WithSizeAndSha1Key(nil), oneValue)
+				if err != nil {
+					return err
 				}
+				kvb.size += int64(sha1.Size)
+			}
+		}
 
-				if r.Crc != nil {
-					err = kvb.crcBatch.Set(r.CrcWithSizeAndSha1Key(sha1Bytes), oneValue)
-					if err != nil {
-						return err
-					}
-					kvb.size += int64(sha1.Size)
-
-					if r.Sha1 != nil {
-						glog.V(4).Infof("declaring crc %s -> sha1 %s mapping", hex.EncodeToString(r.Crc), hex.EncodeToString(r.Sha1))
-						err = kvb.crcsha1Batch.Set(r.CrcWithSizeAndSha1Key(nil), oneValue)
-						if err != nil {
-							return err
-						}
-						kvb.size += int64(sha1.Size)
-					}
+		if r.Crc != nil {
+			err = kvb.crcBatch.Set(r.CrcWithSizeGameKey(datSha1, index), oneValue)
+			if err != nil {
+				return err
+			}
+			kvb.size += int64(gameRefSize)
+
+			if r.Sha1 != nil {
+				glog.V(4).Infof("declaring crc %s -> sha1 %s mapping", hex.EncodeToString(r.Crc), hex.EncodeToString(r.Sha1))
+				err = kvb.crcsha1Batch.Set(r.CrcWithSizeAndSha1Key(nil), oneValue)
+				if err != nil {
+					return err
 				}
+				kvb.size += int64(sha1.Size)
 			}
 		}
 	}
@@ -666,6 +966,21 @@ func printSha1s(vBytes []byte) string {
 	return buf.String()
 }
 
+func printGameRefs(vBytes []byte) string {
+	var buf bytes.Buffer
+
+	buf.WriteString("[")
+	for i := 0; i+gameRefSize <= len(vBytes); i += gameRefSize {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(fmt.Sprintf("%s#%d", hex.EncodeToString(vBytes[i:i+sha1.Size]),
+			types.GameIndex(vBytes[i:i+gameRefSize])))
+	}
+	buf.WriteString("]")
+	return buf.String()
+}
+
 func (kvdb *kvStore) DebugGet(key []byte, size int64) string {
 	var buf bytes.Buffer
 
@@ -678,7 +993,7 @@ func (kvdb *kvStore) DebugGet(key []byte, size int64) string {
 		if err != nil {
 			glog.Errorf("error getting from md5DB: %v", err)
 		} else {
-			buf.WriteString(fmt.Sprintf("md5DB -> %s\n", printSha1s(sha1s)))
+			buf.WriteString(fmt.Sprintf("md5DB -> %s\n", printGameRefs(sha1s)))
 		}
 
 		sha1s, err = kvdb.md5sha1DB.GetKeySuffixesFor(key)
@@ -696,7 +1011,7 @@ func (kvdb *kvStore) DebugGet(key []byte, size int64) string {
 		if err != nil {
 			glog.Errorf("error getting from crcDB: %v", err)
 		} else {
-			buf.WriteString(fmt.Sprintf("crcDB -> %s\n", printSha1s(sha1s)))
+			buf.WriteString(fmt.Sprintf("crcDB -> %s\n", printGameRefs(sha1s)))
 		}
 
 		sha1s, err = kvdb.crcsha1DB.GetKeySuffixesFor(key)
@@ -710,7 +1025,7 @@ func (kvdb *kvStore) DebugGet(key []byte, size int64) string {
 		if err != nil {
 			glog.Errorf("error getting from sha1DB: %v", err)
 		} else {
-			buf.WriteString(fmt.Sprintf("sha1DB -> %s\n", printSha1s(sha1s)))
+			buf.WriteString(fmt.Sprintf("sha1DB -> %s\n", printGameRefs(sha1s)))
 		}
 	default:
 		glog.Errorf("found unknown hash size: %d", len(key))
@@ -732,17 +1047,48 @@ func (kvdb *kvStore) ResolveHash(key []byte) ([]byte, error) {
 }
 
 func (kvdb *kvStore) ForEachDat(datF func(dat *types.Dat) error) error {
-	return kvdb.datsDB.Iterate(func(key, value []byte) (bool, error) {
-		dat, err := decodeDat(value)
-		if err != nil {
-			return false, err
-		}
-		err = datF(dat)
-		if err != nil {
-			return false, err
+	var dat *types.Dat
+	var datSha1 []byte
+
+	err := kvdb.datsDB.Iterate(func(key, value []byte) (bool, error) {
+		switch len(key) {
+		case sha1.Size:
+			if dat != nil {
+				sort.Sort(dat.Games)
+				err := datF(dat)
+				if err != nil {
+					return false, err
+				}
+			}
+
+			var err error
+			dat, err = kvdb.decodeDatHeader(key, value)
+			if err != nil {
+				return false, err
+			}
+			datSha1 = append(datSha1[:0], key...)
+		case gameRefSize:
+			if dat == nil || !bytes.Equal(key[:sha1.Size], datSha1) {
+				return true, nil
+			}
+
+			game, err := decodeGame(value)
+			if err != nil {
+				return false, err
+			}
+			dat.Games = append(dat.Games, game)
 		}
 		return true, nil
 	})
+	if err != nil {
+		return err
+	}
+
+	if dat != nil {
+		sort.Sort(dat.Games)
+		return datF(dat)
+	}
+	return nil
 }
 
 func (kvdb *kvStore) JoinCrcMd5(combiner combine.Combiner) error {
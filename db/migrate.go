@@ -0,0 +1,407 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package db
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// legacyDatsLayoutFilename is the file that recorded the layout of the dats
+	// db before the schema version was kept in the index itself.
+	legacyDatsLayoutFilename = "romba-dats-layout"
+
+	// schemaVersionDatsPerValue stores each DAT as one gob value.
+	schemaVersionDatsPerValue = 1
+
+	// schemaVersionGames stores a header record per DAT plus a record per game, and has
+	// the rom hash stores reference games instead of whole DATs.
+	schemaVersionGames = 2
+
+	// schemaVersionStatus adds the have and miss counters of DATs and games.
+	schemaVersionStatus = 3
+
+	// currentSchemaVersion is the schema version this romba writes. Raising it
+	// requires registering a migration to it.
+	currentSchemaVersion = schemaVersionStatus
+
+	migrateBatchKeys = 100000
+)
+
+// schemaVersionKey is the key of the schema version record in the dats db. Its
+// length differs from those of DAT and game keys.
+var schemaVersionKey = []byte("schema-version")
+
+// migration upgrades an index from schema version to-1 to version to.
+type migration struct {
+	to          int
+	description string
+	run         func(kvdb *kvStore) error
+}
+
+var migrations = make(map[int]*migration)
+
+// registerMigration registers run as the step that upgrades an index from
+// schema version to-1 to version to. Steps must be safe to rerun after an
+// interruption.
+func registerMigration(to int, description string, run func(kvdb *kvStore) error) {
+	if _, ok := migrations[to]; ok {
+		panic(fmt.Sprintf("migration to schema version %d registered twice", to))
+	}
+	migrations[to] = &migration{
+		to:          to,
+		description: description,
+		run:         run,
+	}
+}
+
+func init() {
+	registerMigration(schemaVersionGames, "store dats game by game", (*kvStore).migrateDatsLayout)
+	registerMigration(schemaVersionStatus, "add have and miss counters", (*kvStore).migrateDatStatus)
+}
+
+// readSchemaVersion returns the schema version of the index. Indexes from
+// before the version record fall back to the legacy layout file, and empty
+// indexes without either are new.
+func (kvdb *kvStore) readSchemaVersion() (int, error) {
+	bs, err := kvdb.datsDB.Get(schemaVersionKey)
+	if err != nil {
+		return 0, err
+	}
+	if bs != nil {
+		return strconv.Atoi(string(bs))
+	}
+
+	bs, err = ioutil.ReadFile(filepath.Join(kvdb.path, legacyDatsLayoutFilename))
+	if err == nil {
+		return strconv.Atoi(strings.TrimSpace(string(bs)))
+	}
+	if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	empty := true
+	err = kvdb.datsDB.Iterate(func(key, value []byte) (bool, error) {
+		empty = false
+		return false, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if empty {
+		return currentSchemaVersion, nil
+	}
+	return schemaVersionDatsPerValue, nil
+}
+
+func writeSchemaVersion(store KVStore, version int) error {
+	err := store.Set(schemaVersionKey, []byte(strconv.Itoa(version)))
+	if err != nil {
+		return err
+	}
+	store.Flush()
+	return nil
+}
+
+// migrate brings the index up to the current schema version, running the
+// registered migrations in order. Before the first step it backs the index up
+// next to its directory. Indexes written by a newer romba are refused.
+func (kvdb *kvStore) migrate() error {
+	version, err := kvdb.readSchemaVersion()
+	if err != nil {
+		return fmt.Errorf("failed to read schema version of index at %s: %v", kvdb.path, err)
+	}
+	kvdb.schemaVersion = version
+
+	if version > currentSchemaVersion {
+		return fmt.Errorf("index at %s has schema version %d, but this romba only understands versions up to %d;"+
+			" upgrade romba or restore a backup of the index made with this version", kvdb.path, version,
+			currentSchemaVersion)
+	}
+
+	if version < currentSchemaVersion {
+		for v := version + 1; v <= currentSchemaVersion; v++ {
+			if migrations[v] == nil {
+				return fmt.Errorf("no migration registered from schema version %d to %d", v-1, v)
+			}
+		}
+
+		backupPath := fmt.Sprintf("%s-schema-v%d-backup-%s.zip", filepath.Clean(kvdb.path), version,
+			time.Now().Format("2006-01-02-15_04_05"))
+		glog.Infof("backing up index at %s to %s before migrating it from schema version %d to %d",
+			kvdb.path, backupPath, version, currentSchemaVersion)
+
+		_, err = kvdb.Backup(backupPath)
+		if err != nil {
+			return fmt.Errorf("failed to back up index before migrating it: %v", err)
+		}
+
+		for v := version + 1; v <= currentSchemaVersion; v++ {
+			m := migrations[v]
+			glog.Infof("migrating index to schema version %d (step %d of %d): %s", m.to,
+				v-version, currentSchemaVersion-version, m.description)
+			startTime := time.Now()
+
+			err = m.run(kvdb)
+			if err != nil {
+				return fmt.Errorf("failed to migrate index to schema version %d: %v", m.to, err)
+			}
+
+			err = writeSchemaVersion(kvdb.datsDB, m.to)
+			if err != nil {
+				return err
+			}
+			kvdb.schemaVersion = m.to
+
+			glog.Infof("migrated index to schema version %d in %s", m.to, FormatDuration(time.Since(startTime)))
+		}
+	} else {
+		err = writeSchemaVersion(kvdb.datsDB, version)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.Remove(filepath.Join(kvdb.path, legacyDatsLayoutFilename))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// migrateDatsLayout rewrites an index that stores each DAT as one value into the
+// game by game layout.
+func (kvdb *kvStore) migrateDatsLayout() error {
+	for _, sweep := range []struct {
+		store   KVStore
+		keySize int
+	}{
+		{kvdb.sha1DB, sha1.Size + sha1.Size},
+		{kvdb.md5DB, md5.Size + 8 + sha1.Size},
+		{kvdb.crcDB, crc32.Size + 8 + sha1.Size},
+	} {
+		err := deleteKeysOfSize(sweep.store, sweep.keySize)
+		if err != nil {
+			return err
+		}
+	}
+
+	batch := kvdb.StartBatch().(*kvBatch)
+	numDats := 0
+
+	err := kvdb.datsDB.Iterate(func(key, value []byte) (bool, error) {
+		if len(key) != sha1.Size {
+			return true, nil
+		}
+
+		dat, err := decodeDat(value)
+		if err != nil {
+			return false, err
+		}
+
+		sha1Bytes := append([]byte(nil), key...)
+		for i, g := range dat.Games {
+			if batch.size >= MaxBatchSize {
+				err = batch.Flush()
+				if err != nil {
+					return false, err
+				}
+			}
+
+			err = batch.IndexGame(sha1Bytes, i, g)
+			if err != nil {
+				return false, err
+			}
+		}
+
+		err = batch.setDatHeader(dat, sha1Bytes)
+		if err != nil {
+			return false, err
+		}
+
+		numDats++
+		if numDats%1000 == 0 {
+			glog.Infof("migrated %d dats", numDats)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	err = batch.Close()
+	if err != nil {
+		return err
+	}
+
+	glog.Infof("migrated %d dats to game by game layout", numDats)
+	return nil
+}
+
+// migrateDatStatus leaves the counters of all DATs to the next refresh-dats,
+// which counts the DATs that have none.
+func (kvdb *kvStore) migrateDatStatus() error {
+	glog.Infof("the have and miss counters of the dats are filled in by the next refresh-dats")
+	return nil
+}
+
+// deleteKeysOfSize deletes all keys of length keySize from store.
+func deleteKeysOfSize(store KVStore, keySize int) error {
+	batch := store.StartBatch()
+	pending := 0
+
+	err := store.Iterate(func(key, value []byte) (bool, error) {
+		if len(key) != keySize {
+			return true, nil
+		}
+
+		err := batch.Delete(key)
+		if err != nil {
+			return false, err
+		}
+
+		pending++
+		if pending >= migrateBatchKeys {
+			err = store.WriteBatch(batch)
+			if err != nil {
+				return false, err
+			}
+			batch.Clear()
+			pending = 0
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if pending > 0 {
+		return store.WriteBatch(batch)
+	}
+	return nil
+}
+
+// CopyTo copies the index into a new index at path that is kept in the
+// key-value store backend. path must not hold an index yet.
+func (kvdb *kvStore) CopyTo(path string, backend string) error {
+	opener, err := storeOpener(backend)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stat(filepath.Join(path, datsDBName))
+	if err == nil {
+		return fmt.Errorf("%s already holds an index", path)
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	err = os.MkdirAll(path, 0755)
+	if err != nil {
+		return err
+	}
+
+	kvdb.Flush()
+
+	for _, st := range kvdb.namedStores() {
+		glog.Infof("copying %s", st.name)
+
+		dst, err := opener(filepath.Join(path, st.name), st.keySize)
+		if err != nil {
+			return err
+		}
+
+		n, err := copyStore(st.store, dst)
+		if err != nil {
+			dst.Close()
+			return fmt.Errorf("failed to copy %s: %v", st.name, err)
+		}
+
+		err = dst.Close()
+		if err != nil {
+			return err
+		}
+
+		glog.Infof("copied %d keys of %s", n, st.name)
+	}
+
+	return WriteGenerationFile(path, kvdb.generation)
+}
+
+// copyStore sets all keys of src in dst and returns how many there were.
+func copyStore(src, dst KVStore) (int64, error) {
+	batch := dst.StartBatch()
+	pending := 0
+	var n int64
+
+	err := src.Iterate(func(key, value []byte) (bool, error) {
+		err := batch.Set(key, value)
+		if err != nil {
+			return false, err
+		}
+
+		n++
+		pending++
+		if pending >= migrateBatchKeys {
+			err = dst.WriteBatch(batch)
+			if err != nil {
+				return false, err
+			}
+			batch.Clear()
+			pending = 0
+		}
+		return true, nil
+	})
+	if err != nil {
+		return n, err
+	}
+
+	if pending > 0 {
+		err = dst.WriteBatch(batch)
+		if err != nil {
+			return n, err
+		}
+	}
+	dst.Flush()
+	return n, nil
+}
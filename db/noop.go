@@ -55,6 +55,10 @@ func (noop *NoOpDB) Close() error {
 	return nil
 }
 
+func (noop *NoOpDB) HasDat(sha1 []byte) (bool, error) {
+	return false, nil
+}
+
 func (noop *NoOpDB) GetDat(sha1 []byte) (*types.Dat, error) {
 	return nil, nil
 }
@@ -91,6 +95,14 @@ func (noop *NoOpBatch) IndexDat(dat *types.Dat, sha1 []byte) error {
 	return nil
 }
 
+func (noop *NoOpBatch) IndexDatHeader(dat *types.Dat, sha1 []byte) error {
+	return nil
+}
+
+func (noop *NoOpBatch) IndexGame(datSha1 []byte, index int, game *types.Game) error {
+	return nil
+}
+
 func (noop *NoOpBatch) Size() int64 {
 	return 0
 }
@@ -132,3 +144,57 @@ func (noop *NoOpDB) Flush() {}
 func (noop *NoOpDB) Generation() int64 { return 0 }
 
 func (noop *NoOpDB) PrintStats() string { return "" }
+
+func (noop *NoOpDB) CopyTo(path string, backend string) error { return nil }
+
+func (noop *NoOpDB) PurgeDats(keepGenerations int64) (*PurgeStats, error) {
+	return new(PurgeStats), nil
+}
+
+func (noop *NoOpDB) GetDatHeader(sha1 []byte) (*types.Dat, error) {
+	return nil, nil
+}
+
+func (noop *NoOpDB) GetDatPath(path string) (*DatPath, error) {
+	return nil, nil
+}
+
+func (noop *NoOpDB) RemoveStaleDatPaths() (int64, error) {
+	return 0, nil
+}
+
+func (noop *NoOpBatch) IndexDatPath(path string, dp *DatPath) error {
+	return nil
+}
+
+func (noop *NoOpBatch) AdvanceDatGeneration(sha1 []byte) error {
+	return nil
+}
+
+func (noop *NoOpDB) Backup(outPath string) (*BackupManifest, error) {
+	return new(BackupManifest), nil
+}
+
+func (noop *NoOpDB) Fsck(repair bool, depotRom func(sha1 []byte) (*types.Rom, error)) (*FsckReport, error) {
+	return &FsckReport{Problems: make(map[string]int64)}, nil
+}
+
+func (noop *NoOpDB) GetDatStatus(sha1 []byte) (*DatStatus, error) {
+	return nil, nil
+}
+
+func (noop *NoOpDB) ForEachDatStatus(statusF func(sha1 []byte, dat *types.Dat, ds *DatStatus) error) error {
+	return nil
+}
+
+func (noop *NoOpDB) ForEachGameStatus(sha1 []byte, statusF func(game *types.Game, gs *DatStatus) error) error {
+	return nil
+}
+
+func (noop *NoOpDB) CountDats(haveRom HaveRomFunc) (int64, error) {
+	return 0, nil
+}
+
+func (noop *NoOpDB) UpdateRomStatus(rom *types.Rom, have bool) error {
+	return nil
+}
@@ -0,0 +1,226 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package db
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// PurgeStats reports what PurgeDats deleted from the index.
+type PurgeStats struct {
+	NumDats  int64
+	NumGames int64
+	NumRefs  int64
+	// RecordBytes is the size of the keys and values deleted.
+	RecordBytes int64
+	// DiskBefore and DiskAfter are the sizes of the index on disk before the
+	// purge and after compacting it.
+	DiskBefore int64
+	DiskAfter  int64
+}
+
+// PurgeDats deletes the DATs that were last seen by a refresh more than
+// keepGenerations generations ago, together with their games and the
+// references of their ROMs. Game records left without a DAT header by an
+// interrupted refresh are deleted as well. Afterwards the stores are compacted
+// so the space is given back to the file system.
+func (kvdb *kvStore) PurgeDats(keepGenerations int64) (*PurgeStats, error) {
+	if keepGenerations < 0 {
+		return nil, fmt.Errorf("keep generations must not be negative, got %d", keepGenerations)
+	}
+
+	kvdb.Flush()
+
+	stats := new(PurgeStats)
+
+	var err error
+	stats.DiskBefore, err = dirSize(kvdb.path)
+	if err != nil {
+		return nil, err
+	}
+
+	oldest := kvdb.generation - keepGenerations
+	glog.Infof("purging dats from generations before %d", oldest)
+
+	kvb := kvdb.StartBatch().(*kvBatch)
+
+	var datSha1 []byte
+	stale := false
+
+	err = kvdb.datsDB.Iterate(func(key, value []byte) (bool, error) {
+		switch len(key) {
+		case sha1.Size:
+			datSha1 = append(datSha1[:0], key...)
+
+			dat, err := kvdb.decodeDatHeader(key, value)
+			if err != nil {
+				return false, err
+			}
+
+			stale = dat.Generation < oldest
+			if !stale {
+				return true, nil
+			}
+
+			glog.V(2).Infof("purging dat %s from generation %d", dat.Path, dat.Generation)
+			stats.NumDats++
+
+			err = kvb.generationsBatch.Delete(key)
+			if err != nil {
+				return false, err
+			}
+		case gameRefSize:
+			// the header of a DAT sorts right before its games
+			if bytes.Equal(key[:sha1.Size], datSha1) && !stale {
+				return true, nil
+			}
+
+			game, err := decodeGame(value)
+			if err != nil {
+				return false, err
+			}
+
+			err = kvb.deleteGameRefs(key[:sha1.Size], types.GameIndex(key), game, stats)
+			if err != nil {
+				return false, err
+			}
+			stats.NumGames++
+		default:
+			return true, nil
+		}
+
+		err := kvb.datsBatch.Delete(key)
+		if err != nil {
+			return false, err
+		}
+		err = kvb.statusBatch.Delete(key)
+		if err != nil {
+			return false, err
+		}
+		kvb.size += int64(2 * len(key))
+		stats.RecordBytes += int64(len(key) + len(value))
+
+		if kvb.size >= MaxBatchSize {
+			err = kvb.Flush()
+			if err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = kvb.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	glog.Infof("purged %d dats with %d games, compacting db", stats.NumDats, stats.NumGames)
+
+	for _, store := range []KVStore{kvdb.datsDB, kvdb.sha1DB, kvdb.md5DB, kvdb.crcDB, kvdb.generationsDB, kvdb.statusDB} {
+		err = store.Compact()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	stats.DiskAfter, err = dirSize(kvdb.path)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// deleteGameRefs deletes the references from the hashes of the roms of the
+// game with the given index of the DAT with SHA1 datSha1. The hash to SHA1
+// mappings are kept, they hold for the roms no matter which DAT declares them.
+func (kvb *kvBatch) deleteGameRefs(datSha1 []byte, index int, g *types.Game, stats *PurgeStats) error {
+	for _, r := range g.Roms {
+		if r.Sha1 != nil {
+			err := kvb.deleteRef(kvb.sha1Batch, r.Sha1GameKey(datSha1, index), stats)
+			if err != nil {
+				return err
+			}
+		}
+
+		if r.Md5 != nil {
+			err := kvb.deleteRef(kvb.md5Batch, r.Md5WithSizeGameKey(datSha1, index), stats)
+			if err != nil {
+				return err
+			}
+		}
+
+		if r.Crc != nil {
+			err := kvb.deleteRef(kvb.crcBatch, r.CrcWithSizeGameKey(datSha1, index), stats)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (kvb *kvBatch) deleteRef(batch KVBatch, key []byte, stats *PurgeStats) error {
+	err := batch.Delete(key)
+	if err != nil {
+		return err
+	}
+	kvb.size += int64(len(key))
+	stats.NumRefs++
+	stats.RecordBytes += int64(len(key) + len(oneValue))
+	return nil
+}
+
+// dirSize returns the size of all files below root.
+func dirSize(root string) (int64, error) {
+	var size int64
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
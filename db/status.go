@@ -0,0 +1,450 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package db
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/util"
+)
+
+const datStatusSize = 5 * 8
+
+// DatStatus counts the roms of a DAT or game and how many of them the depot
+// has. Roms of size 0 count as had, as in fixdat.
+type DatStatus struct {
+	NumRoms   int64
+	NumHave   int64
+	Bytes     int64
+	HaveBytes int64
+	// Changed is the time the counts last changed in nanoseconds since the epoch.
+	Changed int64
+	// have is a bit per rom of a game that is set if the depot has the rom. The
+	// counters of a game are recounted from it, DATs have none.
+	have []byte
+}
+
+// MissBytes is the size of the roms the depot doesn't have.
+func (ds *DatStatus) MissBytes() int64 {
+	return ds.Bytes - ds.HaveBytes
+}
+
+// Percent is the percentage of the roms the depot has.
+func (ds *DatStatus) Percent() float64 {
+	if ds.NumRoms == 0 {
+		return 100
+	}
+	return 100 * float64(ds.NumHave) / float64(ds.NumRoms)
+}
+
+// HaveRomFunc reports whether the depot has rom. It must not modify rom.
+type HaveRomFunc func(rom *types.Rom) (bool, error)
+
+func (ds *DatStatus) hasRom(i int) bool {
+	return ds.have[i/8]&(1<<uint(i%8)) != 0
+}
+
+func (ds *DatStatus) setRom(i int, have bool) {
+	if have {
+		ds.have[i/8] |= 1 << uint(i%8)
+	} else {
+		ds.have[i/8] &^= 1 << uint(i%8)
+	}
+}
+
+// recountGame sets the have counters of the status of game from its rom bits.
+func (ds *DatStatus) recountGame(game *types.Game) {
+	ds.NumHave = 0
+	ds.HaveBytes = 0
+	for i, r := range game.Roms {
+		if ds.hasRom(i) {
+			ds.NumHave++
+			ds.HaveBytes += romBytes(r)
+		}
+	}
+}
+
+func encodeDatStatus(ds *DatStatus) []byte {
+	bs := make([]byte, datStatusSize+len(ds.have))
+	util.Int64ToBytes(ds.NumRoms, bs[0:8])
+	util.Int64ToBytes(ds.NumHave, bs[8:16])
+	util.Int64ToBytes(ds.Bytes, bs[16:24])
+	util.Int64ToBytes(ds.HaveBytes, bs[24:32])
+	util.Int64ToBytes(ds.Changed, bs[32:40])
+	copy(bs[datStatusSize:], ds.have)
+	return bs
+}
+
+func decodeDatStatus(bs []byte) (*DatStatus, error) {
+	if bs == nil {
+		return nil, nil
+	}
+	if len(bs) < datStatusSize {
+		return nil, fmt.Errorf("dat status record has invalid length %d", len(bs))
+	}
+
+	ds := &DatStatus{
+		NumRoms:   util.BytesToInt64(bs[0:8]),
+		NumHave:   util.BytesToInt64(bs[8:16]),
+		Bytes:     util.BytesToInt64(bs[16:24]),
+		HaveBytes: util.BytesToInt64(bs[24:32]),
+		Changed:   util.BytesToInt64(bs[32:40]),
+	}
+	if len(bs) > datStatusSize {
+		ds.have = append([]byte(nil), bs[datStatusSize:]...)
+	}
+	return ds, nil
+}
+
+// romBytes is the size rom contributes to the byte counters. Roms of unknown
+// size contribute nothing.
+func romBytes(r *types.Rom) int64 {
+	if r.Size < 0 {
+		return 0
+	}
+	return r.Size
+}
+
+// countGame counts the roms of game that haveRom reports as had.
+func countGame(game *types.Game, haveRom HaveRomFunc) (*DatStatus, error) {
+	gs := &DatStatus{
+		have: make([]byte, (len(game.Roms)+7)/8),
+	}
+
+	for i, r := range game.Roms {
+		gs.NumRoms++
+		gs.Bytes += romBytes(r)
+
+		have := r.Size == 0
+		if !have {
+			var err error
+			have, err = haveRom(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if have {
+			gs.NumHave++
+			gs.HaveBytes += romBytes(r)
+			gs.setRom(i, true)
+		}
+	}
+	return gs, nil
+}
+
+// romMatches reports whether the DAT rom r is satisfied by the depot rom rom,
+// comparing the strongest hash r carries. DAT roms of unknown size match on the
+// hash alone.
+func romMatches(r, rom *types.Rom) bool {
+	sizeMatches := r.Size < 0 || r.Size == rom.Size
+
+	switch {
+	case r.Sha1 != nil:
+		return bytes.Equal(r.Sha1, rom.Sha1)
+	case r.Md5 != nil:
+		return sizeMatches && bytes.Equal(r.Md5, rom.Md5)
+	case r.Crc != nil:
+		return sizeMatches && bytes.Equal(r.Crc, rom.Crc)
+	}
+	return false
+}
+
+// GetDatStatus returns the counters of the DAT with SHA1 sha1Bytes, or nil if
+// it hasn't been counted yet.
+func (kvdb *kvStore) GetDatStatus(sha1Bytes []byte) (*DatStatus, error) {
+	bs, err := kvdb.statusDB.Get(sha1Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return decodeDatStatus(bs)
+}
+
+// ForEachDatStatus calls statusF with the SHA1, the header and the counters of
+// every counted DAT.
+func (kvdb *kvStore) ForEachDatStatus(statusF func(sha1Bytes []byte, dat *types.Dat, ds *DatStatus) error) error {
+	return kvdb.statusDB.Iterate(func(key, value []byte) (bool, error) {
+		if len(key) != sha1.Size {
+			return true, nil
+		}
+
+		ds, err := decodeDatStatus(value)
+		if err != nil {
+			return false, err
+		}
+
+		dat, err := kvdb.GetDatHeader(key)
+		if err != nil {
+			return false, err
+		}
+		if dat == nil {
+			return true, nil
+		}
+		return true, statusF(key, dat, ds)
+	})
+}
+
+// ForEachGameStatus calls statusF with every game of the DAT with SHA1
+// sha1Bytes and its counters, in the order the games are stored.
+func (kvdb *kvStore) ForEachGameStatus(sha1Bytes []byte, statusF func(game *types.Game, gs *DatStatus) error) error {
+	for i := 0; ; i++ {
+		game, err := kvdb.getGame(sha1Bytes, i)
+		if err != nil {
+			return err
+		}
+		if game == nil {
+			return nil
+		}
+
+		bs, err := kvdb.statusDB.Get(types.GameKey(sha1Bytes, i))
+		if err != nil {
+			return err
+		}
+		gs, err := decodeDatStatus(bs)
+		if err != nil {
+			return err
+		}
+		if gs == nil {
+			continue
+		}
+
+		err = statusF(game, gs)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// CountDats counts the roms of the DATs of the current generation that have
+// no counters yet, using haveRom to look them up in the depot, and returns
+// how many DATs it counted. Afterwards UpdateRomStatus keeps the counters
+// current.
+func (kvdb *kvStore) CountDats(haveRom HaveRomFunc) (int64, error) {
+	kvdb.Flush()
+
+	kvb := kvdb.StartBatch().(*kvBatch)
+
+	var datSha1 []byte
+	var ds *DatStatus
+	var numDats int64
+
+	finishDat := func() error {
+		if ds == nil {
+			return nil
+		}
+
+		ds.Changed = time.Now().UnixNano()
+		err := kvb.setStatus(datSha1, ds)
+		if err != nil {
+			return err
+		}
+		ds = nil
+
+		numDats++
+		if numDats%1000 == 0 {
+			glog.Infof("counted roms of %d dats", numDats)
+		}
+		return nil
+	}
+
+	err := kvdb.datsDB.Iterate(func(key, value []byte) (bool, error) {
+		switch len(key) {
+		case sha1.Size:
+			err := finishDat()
+			if err != nil {
+				return false, err
+			}
+
+			dat, err := kvdb.decodeDatHeader(key, value)
+			if err != nil {
+				return false, err
+			}
+			if dat.Generation != kvdb.generation {
+				return true, nil
+			}
+
+			counted, err := kvdb.statusDB.Exists(key)
+			if err != nil {
+				return false, err
+			}
+			if counted {
+				return true, nil
+			}
+
+			datSha1 = append(datSha1[:0], key...)
+			ds = new(DatStatus)
+		case gameRefSize:
+			if ds == nil || !bytes.Equal(key[:sha1.Size], datSha1) {
+				return true, nil
+			}
+
+			game, err := decodeGame(value)
+			if err != nil {
+				return false, err
+			}
+
+			gs, err := countGame(game, haveRom)
+			if err != nil {
+				return false, err
+			}
+			gs.Changed = time.Now().UnixNano()
+
+			err = kvb.setStatus(key, gs)
+			if err != nil {
+				return false, err
+			}
+
+			ds.NumRoms += gs.NumRoms
+			ds.NumHave += gs.NumHave
+			ds.Bytes += gs.Bytes
+			ds.HaveBytes += gs.HaveBytes
+		}
+
+		if kvb.size >= MaxBatchSize {
+			err := kvb.Flush()
+			if err != nil {
+				return false, err
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return numDats, err
+	}
+
+	err = finishDat()
+	if err != nil {
+		return numDats, err
+	}
+	return numDats, kvb.Close()
+}
+
+// UpdateRomStatus updates the counters of the DATs and games containing rom
+// after the depot gained it, if have is true, or lost it. The roms of these
+// games matching rom are marked as had or missing and the games counted again
+// from their marks, so repeated updates change nothing. DATs that haven't been
+// counted yet are left alone.
+func (kvdb *kvStore) UpdateRomStatus(rom *types.Rom, have bool) error {
+	kvdb.statusMutex.Lock()
+	defer kvdb.statusMutex.Unlock()
+
+	refs, err := kvdb.romRefs(rom)
+	if err != nil {
+		return err
+	}
+
+	for _, dg := range groupRefs(refs) {
+		ds, err := kvdb.GetDatStatus(dg.sha1Bytes)
+		if err != nil {
+			return err
+		}
+		if ds == nil {
+			continue
+		}
+
+		changed := false
+
+		for _, index := range dg.indexes {
+			gameKey := types.GameKey(dg.sha1Bytes, index)
+
+			bs, err := kvdb.statusDB.Get(gameKey)
+			if err != nil {
+				return err
+			}
+			gs, err := decodeDatStatus(bs)
+			if err != nil {
+				return err
+			}
+
+			game, err := kvdb.getGame(dg.sha1Bytes, index)
+			if err != nil {
+				return err
+			}
+			if gs == nil || game == nil {
+				continue
+			}
+
+			if len(gs.have) != (len(game.Roms)+7)/8 {
+				return fmt.Errorf("status of game %s has %d rom bytes for %d roms", game.Name,
+					len(gs.have), len(game.Roms))
+			}
+
+			marked := false
+			for i, r := range game.Roms {
+				// roms of size 0 count as had regardless of the depot
+				if r.Size != 0 && romMatches(r, rom) && gs.hasRom(i) != have {
+					gs.setRom(i, have)
+					marked = true
+				}
+			}
+			if !marked {
+				continue
+			}
+
+			numHave, haveBytes := gs.NumHave, gs.HaveBytes
+			gs.recountGame(game)
+
+			ds.NumHave += gs.NumHave - numHave
+			ds.HaveBytes += gs.HaveBytes - haveBytes
+
+			gs.Changed = time.Now().UnixNano()
+			err = kvdb.statusDB.Set(gameKey, encodeDatStatus(gs))
+			if err != nil {
+				return err
+			}
+			changed = true
+		}
+
+		if changed {
+			ds.Changed = time.Now().UnixNano()
+			err = kvdb.statusDB.Set(dg.sha1Bytes, encodeDatStatus(ds))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (kvb *kvBatch) setStatus(key []byte, ds *DatStatus) error {
+	value := encodeDatStatus(ds)
+	err := kvb.statusBatch.Set(key, value)
+	if err != nil {
+		return err
+	}
+	kvb.size += int64(len(key) + len(value))
+	return nil
+}
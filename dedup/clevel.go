@@ -1,3 +1,6 @@
+//go:build cgo && !noleveldb
+// +build cgo,!noleveldb
+
 // Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
 
 /*
@@ -45,8 +48,9 @@ import (
 var ro *levigo.ReadOptions = levigo.NewReadOptions()
 var wo *levigo.WriteOptions = levigo.NewWriteOptions()
 
-var trueVal []byte = []byte{1}
-var falseVal []byte = []byte{0}
+func init() {
+	backends[config.BackendLevelDB] = NewLevelDBDeduper
+}
 
 type dbDeduper struct {
 	crcDB    *levigo.DB
@@ -30,7 +30,15 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 
 package dedup
 
-import "github.com/uwedeportivo/romba/types"
+import (
+	"fmt"
+
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/types"
+)
+
+var trueVal []byte = []byte{1}
+var falseVal []byte = []byte{0}
 
 type Deduper interface {
 	Declare(rom *types.Rom) error
@@ -38,6 +46,20 @@ type Deduper interface {
 	Close() error
 }
 
+// backends are the disk backed dedupers by key-value store backend.
+var backends = make(map[string]func() (Deduper, error))
+
+// New returns a disk backed Deduper on the key-value store backend of the
+// config.
+func New() (Deduper, error) {
+	backend := config.GlobalConfig.Backend()
+	newDeduper, ok := backends[backend]
+	if !ok {
+		return nil, fmt.Errorf("unknown or not built in key-value store backend %q", backend)
+	}
+	return newDeduper()
+}
+
 func Declare(d *types.Dat, deduper Deduper) error {
 	for _, g := range d.Games {
 		for _, r := range g.Roms {
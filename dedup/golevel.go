@@ -0,0 +1,162 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package dedup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/filter"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/types"
+)
+
+func init() {
+	backends[config.BackendGoLevelDB] = NewGoLevelDBDeduper
+}
+
+type goDeduper struct {
+	crcDB    *leveldb.DB
+	md5DB    *leveldb.DB
+	sha1DB   *leveldb.DB
+	tempPath string
+}
+
+func openGoDb(path string) (*leveldb.DB, error) {
+	dbn, err := leveldb.OpenFile(path, &opt.Options{
+		Filter:                 filter.NewBloomFilter(16),
+		BlockCacheCapacity:     10490000,
+		OpenFilesCacheCapacity: 500,
+		WriteBuffer:            62914560,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open db at %s: %v", path, err)
+	}
+	return dbn, nil
+}
+
+// NewGoLevelDBDeduper returns a Deduper on goleveldb, which needs no cgo.
+func NewGoLevelDBDeduper() (Deduper, error) {
+	tempPath, err := ioutil.TempDir(config.GlobalConfig.General.TmpDir, "romba_dedup")
+	if err != nil {
+		return nil, err
+	}
+	gd := new(goDeduper)
+
+	dbn, err := openGoDb(filepath.Join(tempPath, "crc_db"))
+	if err != nil {
+		return nil, err
+	}
+
+	gd.crcDB = dbn
+
+	dbn, err = openGoDb(filepath.Join(tempPath, "md5_db"))
+	if err != nil {
+		return nil, err
+	}
+
+	gd.md5DB = dbn
+
+	dbn, err = openGoDb(filepath.Join(tempPath, "sha1_db"))
+	if err != nil {
+		return nil, err
+	}
+
+	gd.sha1DB = dbn
+
+	gd.tempPath = tempPath
+
+	return gd, nil
+}
+
+func (gd *goDeduper) Declare(r *types.Rom) error {
+	if len(r.Crc) > 0 {
+		err := gd.crcDB.Put(r.CrcWithSizeKey(), trueVal, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(r.Md5) > 0 {
+		err := gd.md5DB.Put(r.Md5WithSizeKey(), trueVal, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(r.Sha1) > 0 {
+		err := gd.sha1DB.Put(r.Sha1, trueVal, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func seenIn(dbn *leveldb.DB, key []byte) (bool, error) {
+	val, err := dbn.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return len(val) == 1 && val[0] == 1, nil
+}
+
+func (gd *goDeduper) Seen(r *types.Rom) (bool, error) {
+	if len(r.Sha1) > 0 {
+		return seenIn(gd.sha1DB, r.Sha1)
+	}
+
+	if len(r.Md5) > 0 {
+		return seenIn(gd.md5DB, r.Md5WithSizeKey())
+	}
+
+	if len(r.Crc) > 0 {
+		return seenIn(gd.crcDB, r.CrcWithSizeKey())
+	}
+
+	return false, nil
+}
+
+func (gd *goDeduper) Close() error {
+	gd.crcDB.Close()
+	gd.md5DB.Close()
+	gd.sha1DB.Close()
+
+	return os.RemoveAll(gd.tempPath)
+}
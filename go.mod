@@ -7,6 +7,7 @@ require (
 	github.com/dgraph-io/ristretto v0.0.2
 	github.com/dustin/go-humanize v0.0.0-20171111073723-bb3d318650d4
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
+	github.com/golang/snappy v0.0.4 // indirect
 	github.com/gonuts/flag v0.0.0-20130524081338-741a6cbd37a3
 	github.com/gorilla/rpc v1.1.0
 	github.com/jmhodges/levigo v0.0.0-20161115193449-c42d9e0ca023
@@ -16,11 +17,13 @@ require (
 	github.com/klauspost/crc32 v0.0.0-20161016154125-cb6bfca970f6
 	github.com/scalingdata/gcfg v0.0.0-20140729183856-37aabad69cfd
 	github.com/spacemonkeygo/errors v0.0.0-20171212215202-9064522e9fd1
+	github.com/syndtr/goleveldb v1.0.0
 	github.com/uwedeportivo/commander v0.0.0-20140125225505-864bf82b82b3
 	github.com/uwedeportivo/lzmadec v0.0.0-20150722055128-4bc815c0eeb9
 	github.com/uwedeportivo/torrentzip v1.0.0
 	github.com/willf/bitset v1.1.10 // indirect
 	github.com/willf/bloom v2.0.3+incompatible
 	golang.org/x/net v0.0.0-20200226121028-0de0cce0169b
+	golang.org/x/text v0.3.0
 	golang.org/x/tools v0.0.0-20200626171337-aa94e735be7f // indirect
 )
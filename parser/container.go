@@ -0,0 +1,333 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package parser
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/klauspost/compress/gzip"
+	"github.com/uwedeportivo/lzmadec"
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/util"
+)
+
+const (
+	zipSuffix      = ".zip"
+	gzipSuffix     = ".gz"
+	sevenzipSuffix = ".7z"
+)
+
+// IsDatArchive reports whether path names a zip, gz or 7z file that may hold
+// DAT files.
+func IsDatArchive(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case zipSuffix, gzipSuffix, sevenzipSuffix:
+		return true
+	}
+	return false
+}
+
+// SplitArchivePath splits an archive-qualified DAT path like
+// dats/pack.zip/sub/a.dat into the archive dats/pack.zip and the path
+// sub/a.dat inside it.
+func SplitArchivePath(path string) (string, string, bool) {
+	for dir := filepath.Dir(path); dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		if !IsDatArchive(dir) {
+			continue
+		}
+		fi, err := os.Stat(dir)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		inner, err := filepath.Rel(dir, path)
+		if err != nil {
+			return "", "", false
+		}
+		return dir, inner, true
+	}
+	return "", "", false
+}
+
+// LogicalPath maps an archive-qualified DAT path to the path the DAT would have
+// if its archive was unpacked in place, dats/pack.zip/sub/a.dat becomes
+// dats/pack/sub/a.dat and dats/a.dat.gz/a.dat becomes dats/a.dat.
+// Other paths are returned unchanged.
+func LogicalPath(path string) string {
+	archivePath, inner, ok := SplitArchivePath(path)
+	if !ok {
+		return path
+	}
+	if strings.ToLower(filepath.Ext(archivePath)) == gzipSuffix {
+		return filepath.Join(filepath.Dir(archivePath), inner)
+	}
+	return filepath.Join(strings.TrimSuffix(archivePath, filepath.Ext(archivePath)), inner)
+}
+
+// ForEachDatInArchive parses every DAT inside the archive at path and calls fn
+// with it and the SHA1 of its content. The path of each DAT is the
+// archive-qualified path of the DAT. The DATs are read in the character
+// encoding called encoding, or in the detected one if encoding is empty.
+// Entries with absolute names or names leading out of the archive are skipped.
+func ForEachDatInArchive(path string, encoding string, fn func(dat *types.Dat, sha1Bytes []byte) error) error {
+	return forEachDatInArchive(path, IsDatFile, encoding, fn)
+}
+
+func forEachDatInArchive(path string, want func(name string) bool, encoding string,
+	fn func(dat *types.Dat, sha1Bytes []byte) error) error {
+	return forEachEntryInArchive(path, want, func(rc io.ReadCloser, entryPath string) error {
+		return parseArchived(rc, entryPath, encoding, fn)
+	})
+}
+
+// forEachEntryInArchive calls fn with a reader for every entry of the archive at
+// path whose cleaned name is wanted. fn must close the reader.
+func forEachEntryInArchive(path string, want func(name string) bool,
+	fn func(rc io.ReadCloser, entryPath string) error) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case zipSuffix:
+		return forEachEntryInZip(path, want, fn)
+	case gzipSuffix:
+		return forEachEntryInGzip(path, want, fn)
+	case sevenzipSuffix:
+		return forEachEntryIn7Zip(path, want, fn)
+	}
+	return fmt.Errorf("%s is not a zip, gz or 7z file", path)
+}
+
+func parseArchived(rc io.ReadCloser, path string, encoding string,
+	fn func(dat *types.Dat, sha1Bytes []byte) error) error {
+	dat, sha1Bytes, err := parseReader(rc, path, encoding)
+	cerr := rc.Close()
+	if err != nil {
+		return err
+	}
+	if cerr != nil {
+		return cerr
+	}
+	return fn(dat, sha1Bytes)
+}
+
+// wantedEntry cleans name and reports whether it is a wanted archive entry.
+func wantedEntry(archivePath, name string, want func(name string) bool) (string, bool) {
+	clean, ok := util.ArchiveEntryName(name)
+	if !ok {
+		glog.Warningf("skipping entry %q of %s, it is not a relative path inside the archive", name, archivePath)
+		return "", false
+	}
+	return clean, want(clean)
+}
+
+func forEachEntryInZip(path string, want func(name string) bool,
+	fn func(rc io.ReadCloser, entryPath string) error) error {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := zr.Close()
+		if err != nil {
+			glog.Errorf("error, failed to close zip %s: %v", path, err)
+		}
+	}()
+
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		name, ok := wantedEntry(path, zf.Name, want)
+		if !ok {
+			continue
+		}
+
+		rc, err := zf.Open()
+		if err != nil {
+			return err
+		}
+
+		err = fn(rc, filepath.Join(path, name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func forEachEntryInGzip(path string, want func(name string) bool,
+	fn func(rc io.ReadCloser, entryPath string) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := file.Close()
+		if err != nil {
+			glog.Errorf("error, failed to close file %s: %v", path, err)
+		}
+	}()
+
+	gzr, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+
+	name := filepath.Base(strings.Replace(gzr.Header.Name, "\\", "/", -1))
+	if gzr.Header.Name == "" {
+		name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	name, ok := wantedEntry(path, name, want)
+	if !ok {
+		return gzr.Close()
+	}
+
+	return fn(gzr, filepath.Join(path, name))
+}
+
+func forEachEntryIn7Zip(path string, want func(name string) bool,
+	fn func(rc io.ReadCloser, entryPath string) error) error {
+	zr, err := lzmadec.NewArchive(path)
+	if err != nil {
+		return err
+	}
+
+	for index, zf := range zr.Entries {
+		if strings.HasPrefix(zf.Attributes, "D") {
+			continue
+		}
+		name, ok := wantedEntry(path, zf.Path, want)
+		if !ok {
+			continue
+		}
+
+		rc, err := zr.GetFileReader(index)
+		if err != nil {
+			return err
+		}
+
+		err = fn(rc, filepath.Join(path, name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findInArchive returns the archive-qualified path of the DAT at inner path in
+// the archive, or of the only DAT in the archive if inner is empty.
+func findInArchive(archivePath, inner string) (string, error) {
+	want := IsDatFile
+	if inner != "" {
+		want = func(name string) bool {
+			return name == filepath.Clean(inner)
+		}
+	}
+
+	var found string
+	n := 0
+
+	err := forEachEntryInArchive(archivePath, want, func(rc io.ReadCloser, entryPath string) error {
+		found = entryPath
+		n++
+		return rc.Close()
+	})
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case n == 0 && inner != "":
+		return "", fmt.Errorf("no DAT %s in %s", inner, archivePath)
+	case n == 0:
+		return "", fmt.Errorf("no DAT in %s", archivePath)
+	case n > 1:
+		return "", fmt.Errorf("%s holds %d DATs, name one as %s/<dat>", archivePath, n,
+			archivePath)
+	}
+	return found, nil
+}
+
+// openInArchive finds the DAT at inner path in the archive like findInArchive
+// and calls fn with a reader for it and its archive-qualified path.
+func openInArchive(archivePath, inner string, fn func(r io.Reader, entryPath string) error) error {
+	found, err := findInArchive(archivePath, inner)
+	if err != nil {
+		return err
+	}
+
+	want := func(name string) bool {
+		return filepath.Join(archivePath, name) == found
+	}
+	return forEachEntryInArchive(archivePath, want, func(rc io.ReadCloser, entryPath string) error {
+		err := fn(rc, entryPath)
+		cerr := rc.Close()
+		if err == nil {
+			err = cerr
+		}
+		return err
+	})
+}
+
+// parseInArchive parses the DAT at inner path in the archive, or the only DAT
+// in the archive if inner is empty.
+func parseInArchive(archivePath, inner string, encoding string) (*types.Dat, []byte, error) {
+	var dat *types.Dat
+	var sha1Bytes []byte
+
+	err := openInArchive(archivePath, inner, func(r io.Reader, entryPath string) error {
+		var err error
+		dat, sha1Bytes, err = parseReader(r, entryPath, encoding)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return dat, sha1Bytes, nil
+}
+
+// parseInArchiveWithListener is parseInArchive reporting to pl.
+func parseInArchiveWithListener(archivePath, inner string, encoding string, pl ParseListener) ([]byte, error) {
+	var sha1Bytes []byte
+
+	err := openInArchive(archivePath, inner, func(r io.Reader, entryPath string) error {
+		var err error
+		sha1Bytes, err = parseReaderWithListener(r, entryPath, encoding, pl)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sha1Bytes, nil
+}
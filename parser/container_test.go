@@ -0,0 +1,199 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package parser
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+func writeZip(t *testing.T, path string, files map[string]string) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write([]byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(path, buf.Bytes(), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDatsInArchives(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datarchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	zipPath := filepath.Join(dir, "pack.zip")
+	writeZip(t, zipPath, map[string]string{
+		"Nintendo - Game Boy.dat": headerDatText,
+		"MAME/mame.xml":           mameXmlText,
+		"readme.txt":              "not a dat",
+	})
+
+	if !IsDatArchive(zipPath) {
+		t.Fatalf("expected %s to be a dat archive", zipPath)
+	}
+
+	var paths []string
+	err = ForEachDatInArchive(zipPath, "", func(dat *types.Dat, sha1Bytes []byte) error {
+		paths = append(paths, dat.Path)
+
+		var content string
+		switch dat.Path {
+		case filepath.Join(zipPath, "Nintendo - Game Boy.dat"):
+			content = headerDatText
+			checkHeader(t, dat)
+		case filepath.Join(zipPath, "MAME", "mame.xml"):
+			content = mameXmlText
+			checkFullSchema(t, dat)
+		default:
+			t.Fatalf("unexpected dat path %s", dat.Path)
+		}
+
+		expected := sha1.Sum([]byte(content))
+		if !bytes.Equal(sha1Bytes, expected[:]) {
+			t.Fatalf("sha1 of %s is not the sha1 of its content", dat.Path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error parsing dats in zip: %v", err)
+	}
+	sort.Strings(paths)
+	if len(paths) != 2 {
+		t.Fatalf("expected 2 dats in zip, got %v", paths)
+	}
+
+	dat, _, err := Parse(filepath.Join(zipPath, "MAME", "mame.xml"))
+	if err != nil {
+		t.Fatalf("error parsing archive-qualified path: %v", err)
+	}
+	checkFullSchema(t, dat)
+	parseBoth(t, filepath.Join(zipPath, "MAME", "mame.xml"))
+
+	_, _, err = Parse(zipPath)
+	if err == nil {
+		t.Fatalf("expected error parsing zip holding two dats")
+	}
+
+	if lp := LogicalPath(filepath.Join(zipPath, "MAME", "mame.xml")); lp != filepath.Join(dir, "pack", "MAME", "mame.xml") {
+		t.Fatalf("unexpected logical path %s", lp)
+	}
+
+	gzPath := filepath.Join(dir, "gameboy.dat.gz")
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	_, err = gzw.Write([]byte(headerDatText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = gzw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(gzPath, buf.Bytes(), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dat, _, err = Parse(gzPath)
+	if err != nil {
+		t.Fatalf("error parsing gz dat: %v", err)
+	}
+	checkHeader(t, dat)
+	if dat.Path != filepath.Join(gzPath, "gameboy.dat") || dat.Filename() != "gameboy.dat" {
+		t.Fatalf("unexpected path %s of gz dat", dat.Path)
+	}
+	if lp := LogicalPath(dat.Path); lp != filepath.Join(dir, "gameboy.dat") {
+		t.Fatalf("unexpected logical path %s", lp)
+	}
+	parseBoth(t, gzPath)
+}
+
+func TestDatArchiveEntryNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datarchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	zipPath := filepath.Join(dir, "pack.zip")
+	writeZip(t, zipPath, map[string]string{
+		"../escape.dat":         headerDatText,
+		"sub/../../escape2.dat": headerDatText,
+		"/abs.dat":              headerDatText,
+		"C:\\win.dat":           headerDatText,
+		"sub\\..\\inside.dat":   headerDatText,
+	})
+
+	var paths []string
+	err = ForEachDatInArchive(zipPath, "", func(dat *types.Dat, sha1Bytes []byte) error {
+		paths = append(paths, dat.Path)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("error parsing dats in zip: %v", err)
+	}
+	if len(paths) != 1 || paths[0] != filepath.Join(zipPath, "inside.dat") {
+		t.Fatalf("expected only the entry inside the archive, got %v", paths)
+	}
+	if lp := LogicalPath(paths[0]); lp != filepath.Join(dir, "pack", "inside.dat") {
+		t.Fatalf("unexpected logical path %s", lp)
+	}
+
+	dat := parseBoth(t, zipPath)
+	if dat.Path != filepath.Join(zipPath, "inside.dat") {
+		t.Fatalf("unexpected path %s of the only safe dat", dat.Path)
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/transform"
+)
+
+// encodingSniffSize is how much of a DAT is looked at to detect its encoding.
+const encodingSniffSize = 64 * 1024
+
+const (
+	encodingUTF8     = "utf-8"
+	encodingShiftJIS = "shift_jis"
+	encodingLatin1   = "windows-1252"
+)
+
+var boms = []struct {
+	bom      []byte
+	encoding string
+}{
+	{[]byte("\xef\xbb\xbf"), encodingUTF8},
+	{[]byte("\xff\xfe"), "utf-16le"},
+	{[]byte("\xfe\xff"), "utf-16be"},
+}
+
+var (
+	xmlDeclRe     = regexp.MustCompile(`^<\?xml[^>]*\?>`)
+	xmlEncodingRe = regexp.MustCompile(`encoding\s*=\s*("[^"]*"|'[^']*')`)
+)
+
+// EncodingName returns the canonical name of the character encoding called
+// label, e.g. windows-1252 for latin1.
+func EncodingName(label string) (string, error) {
+	enc, err := htmlindex.Get(label)
+	if err != nil {
+		return "", fmt.Errorf("unknown encoding %q", label)
+	}
+	return htmlindex.Name(enc)
+}
+
+// detectEncoding returns the encoding of the DAT starting with snippet and
+// the length of its byte order mark. The encoding is taken from a byte order
+// mark or an xml declaration if there is one and guessed from the bytes
+// otherwise.
+func detectEncoding(snippet []byte, atEOF bool) (string, int) {
+	for _, b := range boms {
+		if bytes.HasPrefix(snippet, b.bom) {
+			return b.encoding, len(b.bom)
+		}
+	}
+
+	if decl := xmlDeclRe.Find(snippet); decl != nil {
+		if m := xmlEncodingRe.FindSubmatch(decl); m != nil {
+			if name, err := EncodingName(string(m[1][1 : len(m[1])-1])); err == nil {
+				return name, 0
+			}
+		}
+	}
+
+	if !atEOF {
+		snippet = trimPartialRune(snippet)
+	}
+
+	switch {
+	case utf8.Valid(snippet):
+		return encodingUTF8, 0
+	case looksShiftJIS(snippet):
+		return encodingShiftJIS, 0
+	}
+	return encodingLatin1, 0
+}
+
+// trimPartialRune cuts off a UTF-8 sequence cut in half at the end of b.
+func trimPartialRune(b []byte) []byte {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				return b[:i]
+			}
+			break
+		}
+	}
+	return b
+}
+
+// looksShiftJIS reports whether b is well formed Shift_JIS with some kana in
+// it. Latin-1 text often happens to be well formed Shift_JIS too, but it
+// hardly ever decodes to hiragana or katakana, which almost all Japanese text
+// has.
+func looksShiftJIS(b []byte) bool {
+	kana, halfWidth, double := 0, 0, 0
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		switch {
+		case c < 0x80:
+		case c >= 0xa1 && c <= 0xdf:
+			halfWidth++
+		case (c >= 0x81 && c <= 0x9f) || (c >= 0xe0 && c <= 0xfc):
+			if i+1 == len(b) {
+				break
+			}
+			t := b[i+1]
+			if t < 0x40 || t == 0x7f || t > 0xfc {
+				return false
+			}
+			if c == 0x82 || c == 0x83 {
+				kana++
+			}
+			double++
+			i++
+		default:
+			return false
+		}
+	}
+	return kana > 0 && halfWidth <= double
+}
+
+// decodingReader returns a reader of the content of r converted to UTF-8 and
+// the name of the encoding r was read in. The encoding is detected unless
+// encoding is given. The xml declaration of a converted DAT is changed to say
+// UTF-8.
+func decodingReader(r io.Reader, encoding string) (io.Reader, string, error) {
+	br := bufio.NewReaderSize(r, encodingSniffSize)
+
+	snippet, err := br.Peek(encodingSniffSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, "", err
+	}
+
+	name, bomLen := "", 0
+	if encoding == "" {
+		name, bomLen = detectEncoding(snippet, err == io.EOF)
+	} else {
+		name, err = EncodingName(encoding)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, b := range boms {
+			if b.encoding == name && bytes.HasPrefix(snippet, b.bom) {
+				bomLen = len(b.bom)
+			}
+		}
+	}
+
+	if name == encodingUTF8 {
+		return fixXMLDecl(br, snippet), name, nil
+	}
+
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	_, err = br.Discard(bomLen)
+	if err != nil {
+		return nil, "", err
+	}
+
+	tr := bufio.NewReader(transform.NewReader(br, enc.NewDecoder()))
+	snippet, err = tr.Peek(sniffSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, "", err
+	}
+	return fixXMLDecl(tr, snippet), name, nil
+}
+
+// fixXMLDecl makes the xml declaration at the start of snippet, the content
+// buffered in br, declare UTF-8 so that the xml decoder reads the converted
+// content as it is.
+func fixXMLDecl(br *bufio.Reader, snippet []byte) io.Reader {
+	decl := xmlDeclRe.Find(bytes.TrimPrefix(snippet, boms[0].bom))
+	if decl == nil {
+		return br
+	}
+	m := xmlEncodingRe.FindSubmatch(decl)
+	if m == nil {
+		return br
+	}
+	if name, err := EncodingName(string(m[1][1 : len(m[1])-1])); err == nil && name == encodingUTF8 {
+		return br
+	}
+
+	offset := len(snippet) - len(bytes.TrimPrefix(snippet, boms[0].bom))
+	fixed := make([]byte, 0, offset+len(decl))
+	fixed = append(fixed, snippet[:offset]...)
+	fixed = append(fixed, xmlEncodingRe.ReplaceAll(decl, []byte(`encoding="UTF-8"`))...)
+
+	_, err := br.Discard(offset + len(decl))
+	if err != nil {
+		return br
+	}
+	return io.MultiReader(bytes.NewReader(fixed), br)
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package parser
+
+import (
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/unicode"
+)
+
+func shiftJIS(t *testing.T, s string) string {
+	bs, err := japanese.ShiftJIS.NewEncoder().String(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bs
+}
+
+func TestDetectEncoding(t *testing.T) {
+	tests := []struct {
+		name     string
+		snippet  string
+		atEOF    bool
+		encoding string
+		bomLen   int
+	}{
+		{"ascii", "clrmamepro (\n\tname \"x\"\n)\n", true, "utf-8", 0},
+		{"utf-8", "game ( name \"Pokémon\" )", true, "utf-8", 0},
+		{"utf-8 bom", "\xef\xbb\xbfgame ( name \"x\" )", true, "utf-8", 3},
+		{"utf-16le bom", "\xff\xfe<\x00?\x00", true, "utf-16le", 2},
+		{"xml declaration", "<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?>\n<datafile/>", true, "windows-1252", 0},
+		{"cut utf-8", "game ( name \"Pok\xc3", false, "utf-8", 0},
+		{"latin1", "game ( name \"Pok\xe9mon\" )", true, "windows-1252", 0},
+		{"latin1 accents", "game ( name \"Caf\xe9 \xc0 la cr\xe8me\" )", true, "windows-1252", 0},
+		{"shift_jis", "game ( name \"" + shiftJIS(t, "ドラゴンクエスト") + "\" )", true, "shift_jis", 0},
+	}
+
+	for _, test := range tests {
+		encoding, bomLen := detectEncoding([]byte(test.snippet), test.atEOF)
+		if encoding != test.encoding || bomLen != test.bomLen {
+			t.Errorf("%s: got encoding %s and bom length %d, want %s and %d", test.name,
+				encoding, bomLen, test.encoding, test.bomLen)
+		}
+	}
+}
+
+func checkEncoded(t *testing.T, path string, encoding string, wantEncoding, wantGame string) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawSha1 := sha1.Sum(raw)
+
+	d, sha1Bytes, err := ParseWithEncoding(path, encoding)
+	if err != nil {
+		t.Fatalf("parsing %s: %v", path, err)
+	}
+	if string(sha1Bytes) != string(rawSha1[:]) {
+		t.Errorf("%s: sha1 isn't taken over the file as it is on disk", path)
+	}
+	if d.Encoding != wantEncoding {
+		t.Errorf("%s: got encoding %s, want %s", path, d.Encoding, wantEncoding)
+	}
+	if len(d.Games) != 1 || d.Games[0].Name != wantGame {
+		t.Fatalf("%s: got games %v, want %s", path, d.Games, wantGame)
+	}
+
+	dc := new(datCollector)
+	sha1Bytes, err = ParseWithListenerAndEncoding(path, encoding, dc)
+	if err != nil {
+		t.Fatalf("parsing %s with listener: %v", path, err)
+	}
+	if string(sha1Bytes) != string(rawSha1[:]) {
+		t.Errorf("%s: listener sha1 isn't taken over the file as it is on disk", path)
+	}
+	if dc.d.Encoding != wantEncoding {
+		t.Errorf("%s: listener got encoding %s, want %s", path, dc.d.Encoding, wantEncoding)
+	}
+	if len(dc.d.Games) != 1 || dc.d.Games[0].Name != wantGame {
+		t.Errorf("%s: listener got games %v, want %s", path, dc.d.Games, wantGame)
+	}
+}
+
+func TestParseEncodings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romba_encoding")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	datText := func(name string) string {
+		return "clrmamepro (\n\tname \"test\"\n)\n\ngame (\n\tname \"" + name +
+			"\"\n\trom ( name \"a.bin\" size 4 crc 12345678 sha1 74591cc9501af93873f9a5d3eb12da12c0723bbc )\n)\n"
+	}
+	xmlText := func(encoding, name string) string {
+		return "<?xml version=\"1.0\" encoding=\"" + encoding + "\"?>\n<datafile>\n\t<header>\n\t\t<name>test</name>\n\t</header>\n" +
+			"\t<game name=\"" + name + "\">\n\t\t<description>x</description>\n" +
+			"\t\t<rom name=\"a.bin\" size=\"4\" crc=\"12345678\" sha1=\"74591cc9501af93873f9a5d3eb12da12c0723bbc\"/>\n\t</game>\n</datafile>\n"
+	}
+
+	utf16, err := unicode.UTF16(unicode.LittleEndian, unicode.UseBOM).NewEncoder().String(xmlText("UTF-16", "Pokémon"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkEncoded(t, writeTemp(t, dir, "utf8.dat", datText("Pokémon")), "", "utf-8", "Pokémon")
+	checkEncoded(t, writeTemp(t, dir, "latin1.dat", datText("Pok\xe9mon")), "", "windows-1252", "Pokémon")
+	checkEncoded(t, writeTemp(t, dir, "latin1.xml", xmlText("ISO-8859-1", "Pok\xe9mon")), "", "windows-1252", "Pokémon")
+	checkEncoded(t, writeTemp(t, dir, "utf16.xml", utf16), "", "utf-16le", "Pokémon")
+
+	sjisPath := writeTemp(t, dir, "sjis.dat", datText(shiftJIS(t, "ドラゴンクエスト")))
+	checkEncoded(t, sjisPath, "", "shift_jis", "ドラゴンクエスト")
+	checkEncoded(t, sjisPath, "sjis", "shift_jis", "ドラゴンクエスト")
+
+	latin1Path := writeTemp(t, dir, "forced.dat", datText("Caf\xc3\xa9"))
+	checkEncoded(t, latin1Path, "latin1", "windows-1252", "CafÃ©")
+
+	_, _, err = ParseWithEncoding(latin1Path, "no-such-encoding")
+	if err == nil {
+		t.Errorf("expected an error for an unknown encoding")
+	}
+}
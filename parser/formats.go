@@ -0,0 +1,271 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+type datFormat int
+
+const (
+	formatClrMamePro datFormat = iota
+	formatXML
+	formatRomCenter
+	formatSeparated
+	formatHashFile
+)
+
+// sniffSize is how much of a DAT is looked at to detect its format.
+const sniffSize = 4096
+
+var datExts = map[string]bool{
+	".dat":  true,
+	".xml":  true,
+	".tsv":  true,
+	".csv":  true,
+	".sfv":  true,
+	".md5":  true,
+	".sha1": true,
+}
+
+// IsDatFile reports whether path has the extension of a file romba reads DATs
+// from.
+func IsDatFile(path string) bool {
+	return datExts[strings.ToLower(filepath.Ext(path))]
+}
+
+func sniffFormat(br *bufio.Reader, path string) (datFormat, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".sfv", ".md5", ".sha1":
+		return formatHashFile, nil
+	case ".tsv", ".csv":
+		return formatSeparated, nil
+	}
+
+	snippet, err := br.Peek(sniffSize)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return formatClrMamePro, err
+	}
+
+	ss := string(snippet)
+	if strings.HasPrefix(ss, xmlPrefix) || strings.HasPrefix(ss, xmlPrefixWithBOM) {
+		return formatXML, nil
+	}
+
+	firstLine := snippet
+	if i := bytes.IndexByte(snippet, '\n'); i >= 0 {
+		firstLine = snippet[:i]
+	}
+	firstLine = bytes.TrimPrefix(firstLine, []byte("\xef\xbb\xbf"))
+	firstLine = bytes.ToLower(bytes.TrimSpace(firstLine))
+
+	switch {
+	case bytes.HasPrefix(firstLine, []byte("[credits]")) || bytes.HasPrefix(firstLine, []byte("[dat]")):
+		return formatRomCenter, nil
+	case bytes.Contains(firstLine, []byte("game name")) && bytes.Contains(firstLine, []byte("rom name")):
+		return formatSeparated, nil
+	}
+	return formatClrMamePro, nil
+}
+
+func parseReader(r io.Reader, path string, encoding string) (*types.Dat, []byte, error) {
+	hr := hashingReader{
+		ir: r,
+		h:  sha1.New(),
+	}
+
+	dr, name, err := decodingReader(hr, encoding)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	br := bufio.NewReaderSize(dr, sniffSize)
+
+	format, err := sniffFormat(br, path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var d *types.Dat
+	switch format {
+	case formatXML:
+		d, _, err = ParseXml(br, path)
+	case formatRomCenter:
+		d, _, err = ParseRomCenter(br, path)
+	case formatSeparated:
+		d, _, err = ParseSeparated(br, path)
+	case formatHashFile:
+		d, _, err = ParseHashFile(br, path)
+	default:
+		d, _, err = ParseDat(br, path)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	d.Encoding = name
+	return d, hr.h.Sum(nil), nil
+}
+
+func parseReaderWithListener(r io.Reader, path string, encoding string, pl ParseListener) ([]byte, error) {
+	hr := hashingReader{
+		ir: r,
+		h:  sha1.New(),
+	}
+
+	dr, name, err := decodingReader(hr, encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReaderSize(dr, sniffSize)
+
+	format, err := sniffFormat(br, path)
+	if err != nil {
+		return nil, err
+	}
+
+	el := &encodingListener{
+		pl:       pl,
+		encoding: name,
+	}
+
+	switch format {
+	case formatXML:
+		_, err = ParseXmlWithListener(br, path, el)
+	case formatRomCenter:
+		_, err = ParseRomCenterWithListener(br, path, el)
+	case formatSeparated:
+		_, err = ParseSeparatedWithListener(br, path, el)
+	case formatHashFile:
+		_, err = ParseHashFileWithListener(br, path, el)
+	default:
+		_, err = ParseDatWithListener(br, path, el)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return hr.h.Sum(nil), nil
+}
+
+// encodingListener records the encoding a DAT was read in before handing it
+// on. The SHA1 of a DAT is always taken over its bytes as they are on disk,
+// before they are converted to UTF-8.
+type encodingListener struct {
+	pl       ParseListener
+	encoding string
+}
+
+func (el *encodingListener) ParsedDatStmt(dat *types.Dat) error {
+	dat.Encoding = el.encoding
+	return el.pl.ParsedDatStmt(dat)
+}
+
+func (el *encodingListener) ParsedGameStmt(game *types.Game) error {
+	return el.pl.ParsedGameStmt(game)
+}
+
+// datCollector is the ParseListener behind the parse functions of the formats
+// that are parsed with a listener only.
+type datCollector struct {
+	d *types.Dat
+}
+
+func (dc *datCollector) ParsedDatStmt(dat *types.Dat) error {
+	dc.d = dat
+	return nil
+}
+
+func (dc *datCollector) ParsedGameStmt(game *types.Game) error {
+	dc.d.Games = append(dc.d.Games, game)
+	return nil
+}
+
+func collect(parse func(pl ParseListener) ([]byte, error)) (*types.Dat, []byte, error) {
+	dc := new(datCollector)
+	sha1Bytes, err := parse(dc)
+	if err != nil {
+		return nil, nil, err
+	}
+	dc.d.Normalize()
+	return dc.d, sha1Bytes, nil
+}
+
+// emitDat hands a DAT collected in memory to pl, normalizing it the way the
+// streaming parsers do.
+func emitDat(d *types.Dat, pl ParseListener) error {
+	games := d.Games
+	d.Games = nil
+	d.Normalize()
+
+	err := pl.ParsedDatStmt(d)
+	if err != nil {
+		return err
+	}
+	for _, g := range games {
+		g.Normalize()
+		err = pl.ParsedGameStmt(g)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gameCollector groups rom lines of line oriented formats into games, in the
+// order games first appear.
+type gameCollector struct {
+	games  []*types.Game
+	byName map[string]*types.Game
+}
+
+func newGameCollector() *gameCollector {
+	return &gameCollector{
+		byName: make(map[string]*types.Game),
+	}
+}
+
+func (gc *gameCollector) game(name string) (*types.Game, bool) {
+	g, ok := gc.byName[name]
+	if !ok {
+		g = &types.Game{Name: name, Description: name}
+		gc.byName[name] = g
+		gc.games = append(gc.games, g)
+	}
+	return g, !ok
+}
@@ -0,0 +1,232 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package parser
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+const romCenterText = `[CREDITS]
+author=MAMEDev
+version=0.226
+comment=arcade
+[DAT]
+version=2.50
+plugin=arcade.dll
+split=1
+merge=0
+[EMULATOR]
+refname=MAME
+version=MAME 0.226
+[RESOURCES]
+¬neogeo¬Neo-Geo MV-6F¬neogeo¬Neo-Geo MV-6F¬sp-s2.sp1¬9036d879¬131072¬¬¬
+[GAMES]
+¬mslug¬Metal Slug¬mslug¬Metal Slug¬201-p1.p1¬08d8daa5¬2097152¬neogeo¬¬
+¬mslug¬Metal Slug¬mslug¬Metal Slug¬sp-s2.sp1¬9036d879¬131072¬neogeo¬sp-s2.sp1¬
+¬mslug¬Metal Slug¬mslugb¬Metal Slug (bootleg)¬b.p1¬18d8daa5¬2097152¬mslug¬¬
+`
+
+const separatedText = `"File Name"	"Internal Name"	"Description"	"Game Name"	"Game Description"	"Type"	"Rom Name"	"Disk Name"	"Size"	"CRC"	"MD5"	"SHA1"	"SHA256"	"Nodump"
+"gb.dat"	"Nintendo - Game Boy"	"Nintendo - Game Boy (20200101)"	"Tetris (World)"	"Tetris (World)"	"rom"	"Tetris (World).gb"	""	"32768"	"63f9407d"	""	"74591cc9501af93873f9a5d3eb12da12c0723bbc"	""	"None"
+"gb.dat"	"Nintendo - Game Boy"	"Nintendo - Game Boy (20200101)"	"Tetris (World) (Rev 1)"	"Tetris (World) (Rev 1)"	"rom"	"Tetris (World) (Rev 1).gb"	""	"32768"	"46df91ad"	""	"b0e6ea4ec0d9a1c07b3e9a9ea1bd1b2f3d0d1a3c"	""	"Baddump"
+"gb.dat"	"Nintendo - Game Boy"	"Nintendo - Game Boy (20200101)"	"Kinst"	"Kinst"	"disk"	""	"kinst"	""	""	""	"81d833236e994528d1482979261401b198d1ca53"	""	"None"
+`
+
+func writeTemp(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	err := ioutil.WriteFile(path, []byte(content), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// parseBoth parses path with and without listener and checks both agree.
+func parseBoth(t *testing.T, path string) *types.Dat {
+	dat, sha1Bytes, err := Parse(path)
+	if err != nil {
+		t.Fatalf("error parsing %s: %v", path, err)
+	}
+
+	xpl := new(parseListener)
+	lsha1Bytes, err := ParseWithListener(path, xpl)
+	if err != nil {
+		t.Fatalf("error parsing %s with listener: %v", path, err)
+	}
+
+	sort.Sort(xpl.d.Games)
+	if !bytes.Equal(sha1Bytes, lsha1Bytes) || dat.Name != xpl.d.Name || !dat.Games.Equals(xpl.d.Games) {
+		t.Fatalf("parsing %s with and without listener differs", path)
+	}
+	return dat
+}
+
+func TestParseRomCenter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "romcenter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	utf8Path := writeTemp(t, dir, "mame.dat", romCenterText)
+	latin1Path := writeTemp(t, dir, "mame-latin1.dat", strings.Replace(romCenterText, "¬", "\xac", -1))
+
+	for _, path := range []string{utf8Path, latin1Path} {
+		dat := parseBoth(t, path)
+
+		if dat.Name != "MAME" || dat.Description != "MAME 0.226" || dat.Version != "0.226" || dat.Author != "MAMEDev" {
+			t.Fatalf("unexpected dat header: %+v", dat)
+		}
+		if len(dat.Games) != 3 {
+			t.Fatalf("expected 3 games, got %d", len(dat.Games))
+		}
+
+		bios := findGame(dat, "neogeo")
+		if bios == nil || !bios.Bios() || len(bios.Roms) != 1 {
+			t.Fatalf("unexpected neogeo: %+v", bios)
+		}
+
+		mslug := findGame(dat, "mslug")
+		if mslug == nil || mslug.CloneOf != "" || mslug.RomOf != "neogeo" || len(mslug.Roms) != 2 {
+			t.Fatalf("unexpected mslug: %+v", mslug)
+		}
+		r := findRom(mslug, "sp-s2.sp1")
+		if r == nil || r.Merge != "sp-s2.sp1" || r.Size != 131072 || len(r.Crc) != 4 {
+			t.Fatalf("unexpected mslug rom: %+v", r)
+		}
+
+		clone := findGame(dat, "mslugb")
+		if clone == nil || clone.CloneOf != "mslug" || clone.RomOf != "mslug" || clone.Description != "Metal Slug (bootleg)" {
+			t.Fatalf("unexpected mslugb: %+v", clone)
+		}
+	}
+}
+
+func TestParseSeparated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "separated")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	csvText := strings.Replace(separatedText, "\t", ",", -1)
+
+	for _, path := range []string{
+		writeTemp(t, dir, "gb.tsv", separatedText),
+		writeTemp(t, dir, "gb.csv", csvText),
+		writeTemp(t, dir, "gb-sniffed.dat", separatedText),
+	} {
+		dat := parseBoth(t, path)
+
+		if dat.Name != "Nintendo - Game Boy" || dat.Description != "Nintendo - Game Boy (20200101)" {
+			t.Fatalf("unexpected dat header in %s: %+v", path, dat)
+		}
+		if len(dat.Games) != 3 {
+			t.Fatalf("expected 3 games in %s, got %d", path, len(dat.Games))
+		}
+
+		tetris := findGame(dat, "Tetris (World)")
+		if tetris == nil || len(tetris.Roms) != 1 || tetris.Roms[0].Size != 32768 ||
+			len(tetris.Roms[0].Sha1) != 20 || tetris.Roms[0].Status != "" {
+			t.Fatalf("unexpected tetris in %s: %+v", path, tetris)
+		}
+
+		rev := findGame(dat, "Tetris (World) (Rev 1)")
+		if rev == nil || len(rev.Roms) != 1 || rev.Roms[0].Status != "baddump" {
+			t.Fatalf("unexpected tetris rev 1 in %s: %+v", path, rev)
+		}
+
+		kinst := findGame(dat, "Kinst")
+		if kinst == nil || len(kinst.Roms) != 0 || len(kinst.Disks) != 1 || kinst.Disks[0].Name != "kinst" {
+			t.Fatalf("unexpected kinst in %s: %+v", path, kinst)
+		}
+	}
+}
+
+func TestParseHashFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hashfiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sfv := writeTemp(t, dir, "Some Dump.sfv", `; Generated by QuickSFV
+track01.bin 63F9407D
+track 02.bin 0a1b2c3d
+`)
+	md5 := writeTemp(t, dir, "Some Dump.md5", `# md5sum
+0123456789abcdef0123456789abcdef *track01.bin
+fedcba9876543210fedcba9876543210  track 02.bin
+MD5 (track03.bin) = 00112233445566778899aabbccddeeff
+`)
+	sha1 := writeTemp(t, dir, "Some Dump.sha1", `74591cc9501af93873f9a5d3eb12da12c0723bbc  track01.bin
+`)
+
+	dat := parseBoth(t, sfv)
+	if dat.Name != "Some Dump" || len(dat.Games) != 1 || len(dat.Games[0].Roms) != 2 || !dat.MissingSha1s {
+		t.Fatalf("unexpected sfv dat: %+v", dat)
+	}
+	r := findRom(dat.Games[0], "track 02.bin")
+	if r == nil || r.Size != types.SizeUnknown || len(r.Crc) != 4 || !r.Valid() {
+		t.Fatalf("unexpected sfv rom: %+v", r)
+	}
+
+	dat = parseBoth(t, md5)
+	if len(dat.Games) != 1 || len(dat.Games[0].Roms) != 3 {
+		t.Fatalf("unexpected md5 dat: %+v", dat)
+	}
+	r = findRom(dat.Games[0], "track03.bin")
+	if r == nil || len(r.Md5) != 16 || r.Md5[0] != 0x00 || r.Md5[15] != 0xff {
+		t.Fatalf("unexpected md5 rom: %+v", r)
+	}
+	if findRom(dat.Games[0], "track 02.bin") == nil {
+		t.Fatalf("missing md5 rom with space in its name")
+	}
+
+	dat = parseBoth(t, sha1)
+	if len(dat.Games) != 1 || len(dat.Games[0].Roms) != 1 || len(dat.Games[0].Roms[0].Sha1) != 20 || dat.MissingSha1s {
+		t.Fatalf("unexpected sha1 dat: %+v", dat)
+	}
+
+	bad := writeTemp(t, dir, "bad.sfv", "track01.bin 63F9407Z\n")
+	_, _, err = Parse(bad)
+	if err == nil || ErrorLineNumber(err) != 1 {
+		t.Fatalf("expected error on line 1 parsing bad sfv, got %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package parser
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// ParseHashFile parses a .sfv, .md5 or .sha1 manifest into a DAT with one game
+// named after the manifest. The hash type is taken from the extension of path.
+func ParseHashFile(r io.Reader, path string) (*types.Dat, []byte, error) {
+	return collect(func(pl ParseListener) ([]byte, error) {
+		return ParseHashFileWithListener(r, path, pl)
+	})
+}
+
+func ParseHashFileWithListener(r io.Reader, path string, pl ParseListener) ([]byte, error) {
+	hr := hashingReader{
+		ir: r,
+		h:  sha1.New(),
+	}
+
+	ext := strings.ToLower(filepath.Ext(path))
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+
+	d := new(types.Dat)
+	d.Name = name
+	d.Description = name
+	d.Path = path
+
+	g := &types.Game{Name: name, Description: name}
+
+	scanner := bufio.NewScanner(hr)
+	lnr := 0
+	for scanner.Scan() {
+		lnr++
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "\ufeff"))
+		if line == "" || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var rom *types.Rom
+		var err error
+
+		switch ext {
+		case ".sfv":
+			rom, err = sfvLine(line)
+		case ".md5":
+			rom, err = hashsumLine(line, "MD5", 32)
+		case ".sha1":
+			rom, err = hashsumLine(line, "SHA1", 40)
+		default:
+			err = fmt.Errorf("unknown hash file type %s", ext)
+		}
+		if err != nil {
+			derrStr := fmt.Sprintf("error in file %s on line %d: %v", path, lnr, err)
+			return nil, ParseError.NewWith(derrStr, setErrorFilePath(path), setErrorLineNumber(lnr))
+		}
+
+		if rom.Sha1 == nil {
+			d.MissingSha1s = true
+		}
+		g.Roms = append(g.Roms, rom)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(g.Roms) > 0 {
+		d.Games = types.GameSlice{g}
+	}
+
+	err := emitDat(d, pl)
+	if err != nil {
+		return nil, err
+	}
+	return hr.h.Sum(nil), nil
+}
+
+// sfvLine parses "<file name> <crc>".
+func sfvLine(line string) (*types.Rom, error) {
+	i := strings.LastIndexAny(line, " \t")
+	if i < 0 {
+		return nil, fmt.Errorf("expected file name and crc, got %q", line)
+	}
+
+	crc, err := stringValue2Bytes(line[i+1:], 8)
+	if err != nil || len(crc) != 4 {
+		return nil, fmt.Errorf("bad crc in %q", line)
+	}
+
+	return &types.Rom{
+		Name: strings.TrimSpace(line[:i]),
+		Size: types.SizeUnknown,
+		Crc:  crc,
+	}, nil
+}
+
+// hashsumLine parses md5sum/sha1sum output, "<hash>  <file name>" or
+// "<hash> *<file name>", and the BSD style "<algo> (<file name>) = <hash>".
+func hashsumLine(line, algo string, hexLen int) (*types.Rom, error) {
+	var name, hexStr string
+
+	if strings.HasPrefix(line, algo+" (") {
+		i := strings.LastIndex(line, ") = ")
+		if i < 0 {
+			return nil, fmt.Errorf("expected %s (<file name>) = <hash>, got %q", algo, line)
+		}
+		name = line[len(algo)+2 : i]
+		hexStr = line[i+4:]
+	} else {
+		i := strings.IndexAny(line, " \t")
+		if i < 0 {
+			return nil, fmt.Errorf("expected hash and file name, got %q", line)
+		}
+		hexStr = line[:i]
+		name = strings.TrimPrefix(strings.TrimLeft(line[i:], " \t"), "*")
+	}
+
+	hexStr = strings.TrimSpace(hexStr)
+	if len(hexStr) != hexLen {
+		return nil, fmt.Errorf("bad %s in %q", strings.ToLower(algo), line)
+	}
+
+	bs, err := stringValue2Bytes(hexStr, hexLen)
+	if err != nil {
+		return nil, fmt.Errorf("bad %s in %q", strings.ToLower(algo), line)
+	}
+
+	rom := &types.Rom{
+		Name: name,
+		Size: types.SizeUnknown,
+	}
+	if algo == "MD5" {
+		rom.Md5 = bs
+	} else {
+		rom.Sha1 = bs
+	}
+	return rom, nil
+}
@@ -62,6 +62,25 @@ const (
 	itemClrMamePro
 	itemForceZipping
 	itemForcePacking
+	itemResource
+	itemDisk
+	itemSample
+	itemSampleOf
+	itemCloneOf
+	itemRomOf
+	itemMerge
+	itemBios
+	itemBiosSet
+	itemDeviceRef
+	itemRegion
+	itemOffset
+	itemDefault
+	itemYear
+	itemManufacturer
+	itemDate
+	itemHomepage
+	itemUrl
+	itemComment
 )
 
 var itemTypePrettyPrint = map[itemType]string{
@@ -116,6 +135,25 @@ var key = map[string]itemType{
 	"clrmamepro":   itemClrMamePro,
 	"forcezipping": itemForceZipping,
 	"forcepacking": itemForcePacking,
+	"resource":     itemResource,
+	"disk":         itemDisk,
+	"sample":       itemSample,
+	"sampleof":     itemSampleOf,
+	"cloneof":      itemCloneOf,
+	"romof":        itemRomOf,
+	"merge":        itemMerge,
+	"bios":         itemBios,
+	"biosset":      itemBiosSet,
+	"device_ref":   itemDeviceRef,
+	"region":       itemRegion,
+	"offset":       itemOffset,
+	"default":      itemDefault,
+	"year":         itemYear,
+	"manufacturer": itemManufacturer,
+	"date":         itemDate,
+	"homepage":     itemHomepage,
+	"url":          itemUrl,
+	"comment":      itemComment,
 }
 
 // isSpace reports whether r is a space character.
@@ -154,6 +192,7 @@ type lexer struct {
 	err   error         // last read error
 	ln    int           // line number
 	eofed bool          // reached eof
+	saved *item         // item handed back with backupItem
 }
 
 // next returns the next rune in the input.
@@ -249,7 +288,15 @@ func (l *lexer) errorf(format string, args ...interface{}) stateFn {
 
 // nextItem returns the next item from the input.
 func (l *lexer) nextItem() item {
+	if l.saved != nil {
+		i := *l.saved
+		l.saved = nil
+		return i
+	}
 	for {
+		if l.state == nil {
+			return item{itemEOF, ""}
+		}
 		select {
 		case item := <-l.items:
 			return item
@@ -260,6 +307,17 @@ func (l *lexer) nextItem() item {
 	panic("not reached")
 }
 
+// backupItem hands i back so the next call of nextItem returns it again. Can only
+// be called once per call of nextItem.
+func (l *lexer) backupItem(i item) {
+	l.saved = &i
+}
+
+// done reports whether the lexer stopped after an error item.
+func (l *lexer) done() bool {
+	return l.state == nil
+}
+
 // lex creates a new scanner for the input string.
 func lex(name string, rd io.Reader) (*lexer, error) {
 	l := &lexer{
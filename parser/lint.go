@@ -0,0 +1,231 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package parser
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/spacemonkeygo/errors"
+	"github.com/uwedeportivo/romba/types"
+)
+
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+const (
+	ProblemSyntax            = "syntax"
+	ProblemBadHash           = "bad-hash"
+	ProblemHashLength        = "hash-length"
+	ProblemNoHash            = "no-hash"
+	ProblemDuplicateGame     = "duplicate-game"
+	ProblemDuplicateRom      = "duplicate-rom"
+	ProblemConflictingHashes = "conflicting-hashes"
+	ProblemUnknownToken      = "unknown-token"
+	ProblemUnsafeName        = "unsafe-name"
+)
+
+// Problem is something wrong with a DAT file found by Lint. Line is 0 if the
+// format doesn't give line numbers for it.
+type Problem struct {
+	Path     string `json:"path"`
+	Line     int    `json:"line,omitempty"`
+	Severity string `json:"severity"`
+	Kind     string `json:"kind"`
+	Message  string `json:"message"`
+}
+
+func (pr *Problem) String() string {
+	if pr.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s: %s [%s]", pr.Path, pr.Line, pr.Severity, pr.Message, pr.Kind)
+	}
+	return fmt.Sprintf("%s: %s: %s [%s]", pr.Path, pr.Severity, pr.Message, pr.Kind)
+}
+
+// linter collects the problems of one DAT. The clrmamepro and xml parsers check
+// games before normalizing them, which drops roms without hashes.
+type linter struct {
+	path     string
+	problems []*Problem
+	games    map[string]int
+}
+
+func newLinter(path string) *linter {
+	return &linter{
+		path:  path,
+		games: make(map[string]int),
+	}
+}
+
+func (l *linter) add(line int, severity, kind, format string, args ...interface{}) {
+	l.problems = append(l.problems, &Problem{
+		Path:     l.path,
+		Line:     line,
+		Severity: severity,
+		Kind:     kind,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+func (l *linter) checkDat(dat *types.Dat) {
+	l.checkName(0, "dat", dat.Name)
+}
+
+func (l *linter) checkGame(line int, g *types.Game) {
+	if firstLine, ok := l.games[g.Name]; ok {
+		l.add(line, SeverityError, ProblemDuplicateGame, "game %s already defined on line %d", g.Name, firstLine)
+	} else {
+		l.games[g.Name] = line
+	}
+	l.checkName(line, "game", g.Name)
+
+	roms := make(map[string]*types.Rom)
+	for _, r := range g.Roms {
+		l.checkRom(line, g, r)
+
+		if prev, ok := roms[r.Name]; ok {
+			if prev.Size == r.Size && bytes.Equal(prev.Crc, r.Crc) &&
+				bytes.Equal(prev.Md5, r.Md5) && bytes.Equal(prev.Sha1, r.Sha1) {
+				l.add(line, SeverityWarning, ProblemDuplicateRom, "game %s lists rom %s twice", g.Name, r.Name)
+			} else {
+				l.add(line, SeverityError, ProblemConflictingHashes, "game %s lists rom %s twice with different size or hashes",
+					g.Name, r.Name)
+			}
+		} else {
+			roms[r.Name] = r
+		}
+	}
+}
+
+// lintListener checks the games of the formats that are parsed without a linter.
+type lintListener struct {
+	l *linter
+}
+
+func (ll lintListener) ParsedDatStmt(dat *types.Dat) error {
+	if ll.l != nil {
+		ll.l.checkDat(dat)
+	}
+	return nil
+}
+
+func (ll lintListener) ParsedGameStmt(g *types.Game) error {
+	if ll.l != nil {
+		ll.l.checkGame(0, g)
+	}
+	return nil
+}
+
+func (l *linter) checkRom(line int, g *types.Game, r *types.Rom) {
+	l.checkName(line, "rom", r.Name)
+
+	for _, h := range []struct {
+		name string
+		v    []byte
+		size int
+	}{
+		{"crc", r.Crc, types.KeySizeCrc},
+		{"md5", r.Md5, types.KeySizeMd5},
+		{"sha1", r.Sha1, types.KeySizeSha1},
+	} {
+		if h.v != nil && len(h.v) != h.size {
+			l.add(line, SeverityError, ProblemHashLength, "rom %s in game %s has a %s of %d instead of %d bytes",
+				r.Name, g.Name, h.name, len(h.v), h.size)
+		}
+	}
+
+	if r.Size != 0 && r.Crc == nil && r.Md5 == nil && r.Sha1 == nil && r.Status != "nodump" {
+		l.add(line, SeverityError, ProblemNoHash, "rom %s in game %s has a size but no hash", r.Name, g.Name)
+	}
+}
+
+// checkName reports names that can't be used as is for the files and
+// directories build writes.
+func (l *linter) checkName(line int, what, name string) {
+	if reason := types.UnsafeNameReason(name); reason != "" {
+		l.add(line, SeverityError, ProblemUnsafeName, "%s name %q %s", what, name, reason)
+	}
+}
+
+// Lint parses the DAT file at path leniently and returns every problem found
+// in it, reading it in the character encoding called encoding if that is not
+// empty. The error is only set if the file can't be read.
+func Lint(path string, encoding string) ([]*Problem, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err := file.Close()
+		if err != nil {
+			glog.Errorf("error, failed to close file %s: %v", path, err)
+		}
+	}()
+
+	dr, _, err := decodingReader(file, encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReaderSize(dr, sniffSize)
+
+	format, err := sniffFormat(br, path)
+	if err != nil {
+		return nil, err
+	}
+
+	l := newLinter(path)
+
+	switch format {
+	case formatClrMamePro:
+		_, err = parseDatWithListener(br, path, lintListener{}, l)
+	case formatXML:
+		_, err = parseXmlWithListener(br, path, lintListener{}, l)
+	default:
+		_, err = parseReaderWithListener(br, path, encodingUTF8, lintListener{l})
+	}
+
+	if err != nil {
+		if !ParseError.Contains(err) && !XMLParseError.Contains(err) {
+			return nil, err
+		}
+		line := ErrorLineNumber(err)
+		msg := strings.TrimPrefix(errors.GetMessage(err), fmt.Sprintf("error in file %s on line %d: ", path, line))
+		l.add(line, SeverityError, ProblemSyntax, "%s", msg)
+	}
+	return l.problems, nil
+}
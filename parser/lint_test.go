@@ -0,0 +1,186 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package parser
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+const lintDatText = `clrmamepro (
+	name "Lint Test"
+	description "Lint Test"
+	forcenodump required
+)
+
+game (
+	name "Good Game"
+	description "Good Game"
+	rom ( name good.bin size 16 crc 8b9f4c2e sha1 5c5f9ae1a5c96f1e1e08d0b4bea5f2a0c9e5d3d1 )
+)
+
+game (
+	name "Bad Hash"
+	rom ( name bad.bin size 16 crc zz9f4c2e sha1 5c5f9ae1a5c96f1e1e08d0b4bea5f2a0c9e5d3d1 )
+	rom ( name short.bin size 16 md5 12345 )
+	rom ( name nohash.bin size 16 )
+	rom ( name empty.bin size 0 )
+)
+
+game (
+	name "Good Game"
+	rom ( name twice.bin size 4 crc 00000001 )
+	rom ( name twice.bin size 4 crc 00000001 )
+	rom ( name clash.bin size 4 crc 00000002 )
+	rom ( name clash.bin size 4 crc 00000003 )
+	rom ( name ../escape.bin size 4 crc 00000004 colour blue )
+)
+
+game (
+	name "Broken"
+	rom ( name broken.bin size notanumber )
+)
+
+game (
+	name "After Broken"
+	rom ( name after.bin size 4 crc 00000005 )
+)
+`
+
+const lintXmlText = `<?xml version="1.0"?>
+<datafile>
+	<header>
+		<name>Lint Test</name>
+	</header>
+	<game name="first">
+		<rom name="a.bin" size="4" crc="0000000g" md5="0123456789abcdef0123456789abcdef"/>
+	</game>
+	<game name="C:game">
+		<rom name="b.bin" size="4" crc="00000001" sha1="5c5f9ae1a5c96f1e1e08d0b4bea5f2a0c9e5d3"/>
+	</game>
+</datafile>
+`
+
+type expectedProblem struct {
+	line int
+	kind string
+}
+
+func checkProblems(t *testing.T, problems []*Problem, expected []expectedProblem) {
+	for _, ep := range expected {
+		found := false
+		for _, pr := range problems {
+			if pr.Line == ep.line && pr.Kind == ep.kind {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("expected %s problem on line %d", ep.kind, ep.line)
+		}
+	}
+	if len(problems) != len(expected) {
+		for _, pr := range problems {
+			t.Logf("%v", pr)
+		}
+		t.Fatalf("expected %d problems, got %d", len(expected), len(problems))
+	}
+}
+
+func lintText(t *testing.T, name, text string) []*Problem {
+	dir, err := ioutil.TempDir("", "lint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	problems, err := Lint(writeTemp(t, dir, name, text), "")
+	if err != nil {
+		t.Fatalf("error linting %s: %v", name, err)
+	}
+	return problems
+}
+
+func TestLintDat(t *testing.T) {
+	problems := lintText(t, "lint.dat", lintDatText)
+
+	checkProblems(t, problems, []expectedProblem{
+		{4, ProblemUnknownToken},
+		{15, ProblemBadHash},
+		{16, ProblemHashLength},
+		{13, ProblemNoHash},
+		{21, ProblemDuplicateGame},
+		{21, ProblemDuplicateRom},
+		{21, ProblemConflictingHashes},
+		{27, ProblemUnknownToken},
+		{21, ProblemUnsafeName},
+		{32, ProblemSyntax},
+	})
+
+	for _, pr := range problems {
+		if !strings.HasSuffix(pr.Path, "lint.dat") {
+			t.Fatalf("unexpected problem path %s", pr.Path)
+		}
+	}
+}
+
+func TestLintXml(t *testing.T) {
+	problems := lintText(t, "lint.xml", lintXmlText)
+
+	checkProblems(t, problems, []expectedProblem{
+		{6, ProblemBadHash},
+		{9, ProblemUnsafeName},
+		{9, ProblemHashLength},
+	})
+}
+
+func TestParseDropsRomWithBadHash(t *testing.T) {
+	dat, _, err := ParseDat(strings.NewReader(lintDatText[:strings.Index(lintDatText, "game (\n\tname \"Broken\"")]), "testing/dat")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+
+	g := findGame(dat, "Bad Hash")
+	if g == nil || len(g.Roms) != 2 || findRom(g, "bad.bin") != nil || findRom(g, "empty.bin") == nil {
+		t.Fatalf("expected rom with bad hash to be dropped and the rest of the game kept, got %+v", g)
+	}
+
+	xdat, _, err := ParseXml(strings.NewReader(lintXmlText), "testing/xml")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+	r := findRom(findGame(xdat, "first"), "a.bin")
+	if r == nil || r.Crc != nil {
+		t.Fatalf("expected undecodable crc to be dropped, got %+v", r)
+	}
+}
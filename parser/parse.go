@@ -38,7 +38,6 @@ import (
 	"fmt"
 	"hash"
 	"io"
-	"io/ioutil"
 	"os"
 	"strconv"
 	"strings"
@@ -55,9 +54,10 @@ const (
 )
 
 type parser struct {
-	ll *lexer
-	d  *types.Dat
-	pl ParseListener
+	ll   *lexer
+	d    *types.Dat
+	pl   ParseListener
+	lint *linter
 }
 
 var (
@@ -186,13 +186,62 @@ func (p *parser) consumeIntegerValue() (int64, error) {
 
 func (p *parser) consumeHexBytes(expectedLength int) ([]byte, error) {
 	i := p.ll.nextItem()
-	if i.typ == itemValue {
-		return stringValue2Bytes(i.val, expectedLength)
+	var val string
+	switch i.typ {
+	case itemValue:
+		val = i.val
+	case itemQuotedString:
+		val = i.val[1 : len(i.val)-1]
+	default:
+		return nil, fmt.Errorf("expected value, got %v", i)
 	}
-	if i.typ == itemQuotedString {
-		return stringValue2Bytes(i.val[1:len(i.val)-1], expectedLength)
+
+	if hexLen := len(strings.TrimPrefix(strings.TrimSpace(val), "0x")); val != "-" && hexLen > 0 && hexLen < expectedLength {
+		p.report(SeverityWarning, ProblemHashLength, "hash %s has %d instead of %d hex digits", val, hexLen, expectedLength)
+	}
+	return stringValue2Bytes(val, expectedLength)
+}
+
+// report records a problem at the current line when linting.
+func (p *parser) report(severity, kind, format string, args ...interface{}) {
+	if p.lint != nil {
+		p.lint.add(p.ll.lineNumber(), severity, kind, format, args...)
+	}
+}
+
+func (p *parser) badHash(hashName, what, name string, err error) {
+	glog.Errorf("failed to decode %s for %s %s in file %s: %v", hashName, what, name, p.ll.name, err)
+	p.report(SeverityError, ProblemBadHash, "invalid %s for %s %s: %v", hashName, what, name, err)
+}
+
+// unknownToken consumes a key we don't know together with its value or block.
+func (p *parser) unknownToken(i item) error {
+	if i.typ == itemOpenBrace {
+		return p.skipBlock()
 	}
-	return nil, fmt.Errorf("expected value, got %v", i)
+
+	next := p.ll.nextItem()
+	switch next.typ {
+	case itemOpenBrace:
+		// driver, video, chip and the like; we don't keep them
+		return p.skipBlock()
+	case itemValue, itemQuotedString:
+		p.report(SeverityWarning, ProblemUnknownToken, "unknown key %s with value %s", i, next)
+	default:
+		p.ll.backupItem(next)
+		p.report(SeverityWarning, ProblemUnknownToken, "unknown token %s", i)
+	}
+	return nil
+}
+
+// lenient records err as a syntax problem when linting, so that parsing can go
+// on with the next statement.
+func (p *parser) lenient(err error) bool {
+	if p.lint == nil {
+		return false
+	}
+	p.report(SeverityError, ProblemSyntax, "%v", err)
+	return true
 }
 
 func (p *parser) consumeBoolValue() (bool, error) {
@@ -236,12 +285,52 @@ func (p *parser) datStmt() error {
 			if err != nil {
 				return err
 			}
+		case i.typ == itemVersion:
+			p.d.Version, err = p.consumeStringValue()
+			if err != nil {
+				return err
+			}
+		case i.typ == itemAuthor:
+			p.d.Author, err = p.consumeStringValue()
+			if err != nil {
+				return err
+			}
+		case i.typ == itemCategory:
+			p.d.Category, err = p.consumeStringValue()
+			if err != nil {
+				return err
+			}
+		case i.typ == itemDate:
+			p.d.Date, err = p.consumeStringValue()
+			if err != nil {
+				return err
+			}
+		case i.typ == itemHomepage:
+			p.d.Homepage, err = p.consumeStringValue()
+			if err != nil {
+				return err
+			}
+		case i.typ == itemUrl:
+			p.d.Url, err = p.consumeStringValue()
+			if err != nil {
+				return err
+			}
+		case i.typ == itemComment:
+			p.d.Comment, err = p.consumeStringValue()
+			if err != nil {
+				return err
+			}
 		case i.typ == itemForceZipping || i.typ == itemForcePacking:
 			bv, err := p.consumeForceZipping()
 			if err != nil {
 				return err
 			}
 			p.d.UnzipGames = !bv
+		default:
+			err = p.unknownToken(i)
+			if err != nil {
+				return err
+			}
 		}
 	}
 
@@ -279,6 +368,57 @@ func (p *parser) gameStmt() (*types.Game, error) {
 			if err != nil {
 				return nil, err
 			}
+		case i.typ == itemCloneOf:
+			g.CloneOf, err = p.consumeStringValue()
+			if err != nil {
+				return nil, err
+			}
+		case i.typ == itemRomOf:
+			g.RomOf, err = p.consumeStringValue()
+			if err != nil {
+				return nil, err
+			}
+		case i.typ == itemSampleOf:
+			g.SampleOf, err = p.consumeStringValue()
+			if err != nil {
+				return nil, err
+			}
+		case i.typ == itemYear:
+			g.Year, err = p.consumeStringValue()
+			if err != nil {
+				return nil, err
+			}
+		case i.typ == itemManufacturer:
+			g.Manufacturer, err = p.consumeStringValue()
+			if err != nil {
+				return nil, err
+			}
+		case i.typ == itemSample:
+			sn, err := p.consumeStringValue()
+			if err != nil {
+				return nil, err
+			}
+			g.Samples = append(g.Samples, &types.Sample{Name: sn})
+		case i.typ == itemDeviceRef:
+			dn, err := p.consumeStringValue()
+			if err != nil {
+				return nil, err
+			}
+			g.DeviceRefs = append(g.DeviceRefs, &types.DeviceRef{Name: dn})
+		case i.typ == itemBiosSet:
+			bs, err := p.biosSetStmt()
+			if err != nil {
+				return nil, err
+			}
+			g.BiosSets = append(g.BiosSets, bs)
+		case i.typ == itemDisk:
+			d, err := p.diskStmt()
+			if err != nil {
+				return nil, err
+			}
+			if d != nil {
+				g.Disks = append(g.Disks, d)
+			}
 		case i.typ == itemRom:
 			r, err := p.romStmt()
 			if err != nil {
@@ -292,6 +432,11 @@ func (p *parser) gameStmt() (*types.Game, error) {
 					p.d.MissingSha1s = true
 				}
 			}
+		default:
+			err = p.unknownToken(i)
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
 
@@ -325,6 +470,26 @@ func (p *parser) romStmt() (*types.Rom, error) {
 			if err != nil {
 				return nil, err
 			}
+		case i.typ == itemMerge:
+			r.Merge, err = p.consumeStringValue()
+			if err != nil {
+				return nil, err
+			}
+		case i.typ == itemBios:
+			r.Bios, err = p.consumeStringValue()
+			if err != nil {
+				return nil, err
+			}
+		case i.typ == itemRegion:
+			r.Region, err = p.consumeStringValue()
+			if err != nil {
+				return nil, err
+			}
+		case i.typ == itemOffset:
+			r.Offset, err = p.consumeStringValue()
+			if err != nil {
+				return nil, err
+			}
 		case i.typ == itemSize:
 			r.Size, err = p.consumeIntegerValue()
 			if err != nil {
@@ -333,20 +498,25 @@ func (p *parser) romStmt() (*types.Rom, error) {
 		case i.typ == itemMd5:
 			r.Md5, err = p.consumeHexBytes(32)
 			if err != nil {
-				glog.Errorf("failed to decode md5 for rom %s in file %s: %v", r.Name, p.ll.name, err)
-				return nil, nil
+				p.badHash("md5", "rom", r.Name, err)
+				return nil, p.skipBlock()
 			}
 		case i.typ == itemCrc:
 			r.Crc, err = p.consumeHexBytes(8)
 			if err != nil {
-				glog.Errorf("failed to decode crc for rom %s in file %s: %v", r.Name, p.ll.name, err)
-				return nil, nil
+				p.badHash("crc", "rom", r.Name, err)
+				return nil, p.skipBlock()
 			}
 		case i.typ == itemSha1:
 			r.Sha1, err = p.consumeHexBytes(40)
 			if err != nil {
-				glog.Errorf("failed to decode sha1 for rom %s in file %s: %v", r.Name, p.ll.name, err)
-				return nil, nil
+				p.badHash("sha1", "rom", r.Name, err)
+				return nil, p.skipBlock()
+			}
+		default:
+			err = p.unknownToken(i)
+			if err != nil {
+				return nil, err
 			}
 		}
 	}
@@ -360,6 +530,134 @@ func (p *parser) romStmt() (*types.Rom, error) {
 	return r, nil
 }
 
+func (p *parser) diskStmt() (*types.Disk, error) {
+	i := p.ll.nextItem()
+	err := p.match(i, itemOpenBrace)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &types.Disk{}
+
+	for i = p.ll.nextItem(); i.typ != itemCloseBrace && i.typ != itemEOF && i.typ != itemError; i = p.ll.nextItem() {
+		switch {
+		case i.typ == itemName:
+			d.Name, err = p.consumeStringValue()
+			if err != nil {
+				return nil, err
+			}
+		case i.typ == itemFlags:
+			d.Status, err = p.consumeStringValue()
+			if err != nil {
+				return nil, err
+			}
+		case i.typ == itemMerge:
+			d.Merge, err = p.consumeStringValue()
+			if err != nil {
+				return nil, err
+			}
+		case i.typ == itemRegion:
+			d.Region, err = p.consumeStringValue()
+			if err != nil {
+				return nil, err
+			}
+		case i.typ == itemValue && i.val == "index":
+			d.Index, err = p.consumeStringValue()
+			if err != nil {
+				return nil, err
+			}
+		case i.typ == itemMd5:
+			d.Md5, err = p.consumeHexBytes(32)
+			if err != nil {
+				p.badHash("md5", "disk", d.Name, err)
+				return nil, p.skipBlock()
+			}
+		case i.typ == itemSha1:
+			d.Sha1, err = p.consumeHexBytes(40)
+			if err != nil {
+				p.badHash("sha1", "disk", d.Name, err)
+				return nil, p.skipBlock()
+			}
+		default:
+			err = p.unknownToken(i)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if i.typ == itemEOF {
+		return nil, fmt.Errorf("unexpected end of input")
+	}
+	if i.typ == itemError {
+		return nil, lexError(i)
+	}
+	return d, nil
+}
+
+func (p *parser) biosSetStmt() (*types.BiosSet, error) {
+	i := p.ll.nextItem()
+	err := p.match(i, itemOpenBrace)
+	if err != nil {
+		return nil, err
+	}
+
+	bs := &types.BiosSet{}
+
+	for i = p.ll.nextItem(); i.typ != itemCloseBrace && i.typ != itemEOF && i.typ != itemError; i = p.ll.nextItem() {
+		switch {
+		case i.typ == itemName:
+			bs.Name, err = p.consumeStringValue()
+			if err != nil {
+				return nil, err
+			}
+		case i.typ == itemDescription:
+			bs.Description, err = p.consumeStringValue()
+			if err != nil {
+				return nil, err
+			}
+		case i.typ == itemDefault:
+			bs.Default, err = p.consumeStringValue()
+			if err != nil {
+				return nil, err
+			}
+		default:
+			err = p.unknownToken(i)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if i.typ == itemEOF {
+		return nil, fmt.Errorf("unexpected end of input")
+	}
+	if i.typ == itemError {
+		return nil, lexError(i)
+	}
+	return bs, nil
+}
+
+// skipBlock consumes everything up to and including the close brace matching
+// an already consumed open brace.
+func (p *parser) skipBlock() error {
+	depth := 1
+	for depth > 0 {
+		i := p.ll.nextItem()
+		switch i.typ {
+		case itemOpenBrace:
+			depth++
+		case itemCloseBrace:
+			depth--
+		case itemEOF:
+			return fmt.Errorf("unexpected end of input")
+		case itemError:
+			return lexError(i)
+		}
+	}
+	return nil
+}
+
 func (p *parser) parse() error {
 	var i item
 
@@ -368,8 +666,14 @@ func (p *parser) parse() error {
 		case i.typ == itemClrMamePro:
 			err := p.datStmt()
 			if err != nil {
+				if p.lenient(err) {
+					continue
+				}
 				return err
 			}
+			if p.lint != nil {
+				p.lint.checkDat(p.d)
+			}
 			if p.pl != nil {
 				p.d.Normalize()
 				err = p.pl.ParsedDatStmt(p.d)
@@ -377,12 +681,22 @@ func (p *parser) parse() error {
 					return err
 				}
 			}
-		case i.typ == itemGame:
+		case i.typ == itemGame || i.typ == itemResource:
+			line := p.ll.lineNumber()
 			g, err := p.gameStmt()
 			if err != nil {
+				if p.lenient(err) {
+					continue
+				}
 				return err
 			}
 			if g != nil {
+				if i.typ == itemResource {
+					g.IsBios = "yes"
+				}
+				if p.lint != nil {
+					p.lint.checkGame(line, g)
+				}
 				if p.pl != nil {
 					g.Normalize()
 					err = p.pl.ParsedGameStmt(g)
@@ -396,7 +710,11 @@ func (p *parser) parse() error {
 		}
 	}
 	if i.typ == itemError {
-		return lexError(i)
+		err := lexError(i)
+		if p.lenient(err) {
+			return nil
+		}
+		return err
 	}
 	return nil
 }
@@ -414,6 +732,10 @@ type ParseListener interface {
 }
 
 func ParseDatWithListener(r io.Reader, path string, pl ParseListener) ([]byte, error) {
+	return parseDatWithListener(r, path, pl, nil)
+}
+
+func parseDatWithListener(r io.Reader, path string, pl ParseListener, lint *linter) ([]byte, error) {
 	hr := hashingReader{
 		ir: r,
 		h:  sha1.New(),
@@ -425,9 +747,10 @@ func ParseDatWithListener(r io.Reader, path string, pl ParseListener) ([]byte, e
 	}
 
 	p := &parser{
-		ll: ll,
-		d:  &types.Dat{},
-		pl: pl,
+		ll:   ll,
+		d:    &types.Dat{},
+		pl:   pl,
+		lint: lint,
 	}
 
 	p.d.Path = path
@@ -474,60 +797,55 @@ type hashingReader struct {
 
 func (r hashingReader) Read(buf []byte) (int, error) {
 	n, err := r.ir.Read(buf)
-	if err == nil {
-		r.h.Write(buf[:n])
-	}
+	r.h.Write(buf[:n])
 	return n, err
 }
 
+// lineCountingReader counts the lines read through it. It is a ByteReader so that
+// the xml decoder doesn't read ahead and line reflects the decoder's position.
 type lineCountingReader struct {
-	ir   io.Reader
+	br   *bufio.Reader
 	line int
 }
 
-func (r lineCountingReader) Read(buf []byte) (int, error) {
-	n, err := r.ir.Read(buf)
-	if err == nil {
-		for _, b := range buf[:n] {
-			if b == '\n' {
-				r.line++
-			}
-		}
+func newLineCountingReader(r io.Reader) *lineCountingReader {
+	return &lineCountingReader{
+		br:   bufio.NewReader(r),
+		line: 1,
 	}
-	return n, err
 }
 
-func isXML(path string) (bool, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return false, err
-	}
-	defer func() {
-		err := file.Close()
-		if err != nil {
-			glog.Errorf("error, failed to close file %s: %v", path, err)
+func (r *lineCountingReader) Read(buf []byte) (int, error) {
+	n, err := r.br.Read(buf)
+	for _, b := range buf[:n] {
+		if b == '\n' {
+			r.line++
 		}
-	}()
-
-	lr := io.LimitedReader{
-		R: file,
-		N: 21,
 	}
+	return n, err
+}
 
-	snippet, err := ioutil.ReadAll(&lr)
-	if err != nil {
-		return false, err
+func (r *lineCountingReader) ReadByte() (byte, error) {
+	b, err := r.br.ReadByte()
+	if err == nil && b == '\n' {
+		r.line++
 	}
-
-	ss := string(snippet)
-
-	return strings.HasPrefix(ss, xmlPrefix) || strings.HasPrefix(ss, xmlPrefixWithBOM), nil
+	return b, err
 }
 
 func Parse(path string) (*types.Dat, []byte, error) {
-	isXML, err := isXML(path)
-	if err != nil {
-		return nil, nil, err
+	return ParseWithEncoding(path, "")
+}
+
+// ParseWithEncoding parses the DAT at path, reading it in the character
+// encoding called encoding instead of the detected one if encoding is not empty.
+func ParseWithEncoding(path string, encoding string) (*types.Dat, []byte, error) {
+	if _, err := os.Stat(path); err != nil {
+		if archivePath, inner, ok := SplitArchivePath(path); ok {
+			return parseInArchive(archivePath, inner, encoding)
+		}
+	} else if IsDatArchive(path) {
+		return parseInArchive(path, "", encoding)
 	}
 
 	file, err := os.Open(path)
@@ -541,16 +859,22 @@ func Parse(path string) (*types.Dat, []byte, error) {
 		}
 	}()
 
-	if isXML {
-		return ParseXml(file, path)
-	}
-	return ParseDat(file, path)
+	return parseReader(file, path, encoding)
 }
 
 func ParseWithListener(path string, pl ParseListener) ([]byte, error) {
-	isXML, err := isXML(path)
-	if err != nil {
-		return nil, err
+	return ParseWithListenerAndEncoding(path, "", pl)
+}
+
+// ParseWithListenerAndEncoding is ParseWithListener reading the DAT in the
+// character encoding called encoding if encoding is not empty.
+func ParseWithListenerAndEncoding(path string, encoding string, pl ParseListener) ([]byte, error) {
+	if _, err := os.Stat(path); err != nil {
+		if archivePath, inner, ok := SplitArchivePath(path); ok {
+			return parseInArchiveWithListener(archivePath, inner, encoding, pl)
+		}
+	} else if IsDatArchive(path) {
+		return parseInArchiveWithListener(path, "", encoding, pl)
 	}
 
 	file, err := os.Open(path)
@@ -564,62 +888,86 @@ func ParseWithListener(path string, pl ParseListener) ([]byte, error) {
 		}
 	}()
 
-	if isXML {
-		return ParseXmlWithListener(file, path, pl)
+	return parseReaderWithListener(file, path, encoding, pl)
+}
+
+func decodeHash(field []byte, hashName string) ([]byte, error) {
+	if len(field) == 0 {
+		return nil, nil
+	}
+	v, err := hex.DecodeString(string(field))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q", hashName, field)
 	}
-	return ParseDatWithListener(file, path, pl)
+	return v, nil
 }
 
-func fixHashes(rom *types.Rom) {
-	if rom.Crc != nil {
-		strV := string(rom.Crc)
-		if strV != "" {
-			v, err := hex.DecodeString(string(rom.Crc))
-			if err != nil {
-				rom.Crc = nil
-			}
-			rom.Crc = v
-		} else {
-			rom.Crc = nil
-		}
+// fixHashes decodes the hex hashes the xml decoder left in rom. Hashes that don't
+// decode are dropped and reported.
+func fixHashes(rom *types.Rom) []error {
+	var errs []error
+	var err error
+
+	rom.Crc, err = decodeHash(rom.Crc, "crc")
+	if err != nil {
+		errs = append(errs, fmt.Errorf("rom %s: %v", rom.Name, err))
 	}
-	if rom.Md5 != nil {
-		strV := string(rom.Md5)
-		if strV != "" {
-			v, err := hex.DecodeString(string(rom.Md5))
-			if err != nil {
-				rom.Md5 = nil
-			}
-			rom.Md5 = v
-		} else {
-			rom.Md5 = nil
-		}
+	rom.Md5, err = decodeHash(rom.Md5, "md5")
+	if err != nil {
+		errs = append(errs, fmt.Errorf("rom %s: %v", rom.Name, err))
 	}
-	if rom.Sha1 != nil {
-		strV := string(rom.Sha1)
-		if strV != "" {
-			v, err := hex.DecodeString(string(rom.Sha1))
-			if err != nil {
-				rom.Sha1 = nil
-			}
-			rom.Sha1 = v
-		} else {
-			rom.Sha1 = nil
-		}
+	rom.Sha1, err = decodeHash(rom.Sha1, "sha1")
+	if err != nil {
+		errs = append(errs, fmt.Errorf("rom %s: %v", rom.Name, err))
 	}
+	return errs
 }
 
-func ParseXml(r io.Reader, path string) (*types.Dat, []byte, error) {
-	br := bufio.NewReader(r)
+func fixDiskHashes(disk *types.Disk) []error {
+	var errs []error
+	var err error
 
+	disk.Md5, err = decodeHash(disk.Md5, "md5")
+	if err != nil {
+		errs = append(errs, fmt.Errorf("disk %s: %v", disk.Name, err))
+	}
+	disk.Sha1, err = decodeHash(disk.Sha1, "sha1")
+	if err != nil {
+		errs = append(errs, fmt.Errorf("disk %s: %v", disk.Name, err))
+	}
+	return errs
+}
+
+func fixGameHashes(g *types.Game) []error {
+	var errs []error
+	for _, rom := range g.Roms {
+		errs = append(errs, fixHashes(rom)...)
+	}
+	for _, rom := range g.Parts {
+		errs = append(errs, fixHashes(rom)...)
+	}
+	for _, rom := range g.Regions {
+		errs = append(errs, fixHashes(rom)...)
+	}
+	for _, disk := range g.Disks {
+		errs = append(errs, fixDiskHashes(disk)...)
+	}
+	return errs
+}
+
+func logHashErrors(path string, errs []error) {
+	for _, err := range errs {
+		glog.Errorf("failed to decode hash in file %s: %v", path, err)
+	}
+}
+
+func ParseXml(r io.Reader, path string) (*types.Dat, []byte, error) {
 	hr := hashingReader{
-		ir: br,
+		ir: r,
 		h:  sha1.New(),
 	}
 
-	lr := lineCountingReader{
-		ir: hr,
-	}
+	lr := newLineCountingReader(hr)
 
 	d := new(types.Dat)
 	decoder := xml.NewDecoder(lr)
@@ -632,39 +980,15 @@ func ParseXml(r io.Reader, path string) (*types.Dat, []byte, error) {
 	}
 
 	for _, g := range d.Games {
-		for _, rom := range g.Roms {
-			fixHashes(rom)
-		}
-		for _, rom := range g.Parts {
-			fixHashes(rom)
-		}
-		for _, rom := range g.Regions {
-			fixHashes(rom)
-		}
+		logHashErrors(path, fixGameHashes(g))
 	}
 
 	for _, g := range d.Software {
-		for _, rom := range g.Roms {
-			fixHashes(rom)
-		}
-		for _, rom := range g.Parts {
-			fixHashes(rom)
-		}
-		for _, rom := range g.Regions {
-			fixHashes(rom)
-		}
+		logHashErrors(path, fixGameHashes(g))
 	}
 
 	for _, g := range d.Machines {
-		for _, rom := range g.Roms {
-			fixHashes(rom)
-		}
-		for _, rom := range g.Parts {
-			fixHashes(rom)
-		}
-		for _, rom := range g.Regions {
-			fixHashes(rom)
-		}
+		logHashErrors(path, fixGameHashes(g))
 	}
 
 	d.Normalize()
@@ -675,24 +999,32 @@ func ParseXml(r io.Reader, path string) (*types.Dat, []byte, error) {
 type xmlDatHeader struct {
 	Name        string            `xml:"name"`
 	Description string            `xml:"description"`
+	Version     string            `xml:"version"`
+	Author      string            `xml:"author"`
+	Category    string            `xml:"category"`
+	Date        string            `xml:"date"`
+	Homepage    string            `xml:"homepage"`
+	Url         string            `xml:"url"`
+	Comment     string            `xml:"comment"`
 	Clr         *types.Clrmamepro `xml:"clrmamepro"`
 }
 
 func ParseXmlWithListener(r io.Reader, path string, pl ParseListener) ([]byte, error) {
-	br := bufio.NewReader(r)
+	return parseXmlWithListener(r, path, pl, nil)
+}
 
+func parseXmlWithListener(r io.Reader, path string, pl ParseListener, lint *linter) ([]byte, error) {
 	hr := hashingReader{
-		ir: br,
+		ir: r,
 		h:  sha1.New(),
 	}
 
-	lr := lineCountingReader{
-		ir: hr,
-	}
+	lr := newLineCountingReader(hr)
 
 	decoder := xml.NewDecoder(lr)
 
 	var inElement string
+	datSeen := false
 	for {
 		t, err := decoder.Token()
 		if err != nil {
@@ -723,10 +1055,21 @@ func ParseXmlWithListener(r io.Reader, path string, pl ParseListener) ([]byte, e
 
 				d.Name = hdr.Name
 				d.Description = hdr.Description
+				d.Version = hdr.Version
+				d.Author = hdr.Author
+				d.Category = hdr.Category
+				d.Date = hdr.Date
+				d.Homepage = hdr.Homepage
+				d.Url = hdr.Url
+				d.Comment = hdr.Comment
 				d.Clr = hdr.Clr
 
+				if lint != nil {
+					lint.checkDat(d)
+				}
 				d.Normalize()
 
+				datSeen = true
 				err = pl.ParsedDatStmt(d)
 				if err != nil {
 					derrStr := fmt.Sprintf("error in file %s on line %d: %v", path, lr.line, err)
@@ -734,6 +1077,19 @@ func ParseXmlWithListener(r io.Reader, path string, pl ParseListener) ([]byte, e
 					return nil, derr
 				}
 			} else if inElement == "game" || inElement == "software" || inElement == "machine" {
+				if !datSeen {
+					// MAME listxml has no header element
+					d := new(types.Dat)
+					d.Path = path
+					datSeen = true
+					err = pl.ParsedDatStmt(d)
+					if err != nil {
+						derrStr := fmt.Sprintf("error in file %s on line %d: %v", path, lr.line, err)
+						derr := XMLParseError.NewWith(derrStr, setErrorFilePath(path), setErrorLineNumber(lr.line))
+						return nil, derr
+					}
+				}
+				line := lr.line
 				g := new(types.Game)
 				err = decoder.DecodeElement(g, &se)
 				if err != nil {
@@ -741,14 +1097,14 @@ func ParseXmlWithListener(r io.Reader, path string, pl ParseListener) ([]byte, e
 					derr := XMLParseError.NewWith(derrStr, setErrorFilePath(path), setErrorLineNumber(lr.line))
 					return nil, derr
 				}
-				for _, rom := range g.Roms {
-					fixHashes(rom)
-				}
-				for _, rom := range g.Parts {
-					fixHashes(rom)
-				}
-				for _, rom := range g.Regions {
-					fixHashes(rom)
+				errs := fixGameHashes(g)
+				if lint != nil {
+					for _, err := range errs {
+						lint.add(line, SeverityError, ProblemBadHash, "%v", err)
+					}
+					lint.checkGame(line, g)
+				} else {
+					logHashErrors(path, errs)
 				}
 				g.Normalize()
 
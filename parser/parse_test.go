@@ -31,7 +31,9 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package parser
 
 import (
+	"bytes"
 	"fmt"
+	"reflect"
 	"sort"
 	"strings"
 	"testing"
@@ -564,3 +566,409 @@ func TestParseXmlWithListener(t *testing.T) {
 	}
 }
 
+
+const mameXmlText = `<?xml version="1.0"?>
+<!DOCTYPE mame>
+<mame build="0.226 (mame0226)" debug="no" mameconfig="10">
+	<machine name="neogeo" sourcefile="neogeo/neogeo.cpp" isbios="yes">
+		<description>Neo-Geo MV-6F</description>
+		<year>1990</year>
+		<manufacturer>SNK</manufacturer>
+		<biosset name="euro" description="Europe MVS (Ver. 2)" default="yes"/>
+		<biosset name="japan" description="Japan MVS (Ver. 3)"/>
+		<rom name="sp-s2.sp1" bios="euro" size="131072" crc="9036d879" sha1="4f5ed7105b7128794654ce82b51723e16e389543" region="mainbios" offset="0"/>
+		<rom name="sm1.sm1" size="131072" crc="94416d67" sha1="42f9d7ddd6c0931fd64226a60dc73602b2819dcf" region="audiobios" offset="0"/>
+		<device_ref name="ym2610"/>
+	</machine>
+	<machine name="mslug" sourcefile="neogeo/neogeo.cpp" romof="neogeo">
+		<description>Metal Slug - Super Vehicle-001</description>
+		<year>1996</year>
+		<manufacturer>Nazca</manufacturer>
+		<rom name="sp-s2.sp1" merge="sp-s2.sp1" bios="euro" size="131072" crc="9036d879" sha1="4f5ed7105b7128794654ce82b51723e16e389543" region="mainbios" offset="0"/>
+		<rom name="201-p1.p1" size="2097152" crc="08d8daa5" sha1="b53e36a4b89e3e3ee0dd4c2a7f79a6bfd3d1ae5f" region="cpu" offset="100000"/>
+		<rom name="201-c1.c1" size="4194304" status="baddump" crc="72813676" sha1="7b045d1a48980cb1a140699011cb1a3d4acdc4d1" region="sprites" offset="0"/>
+	</machine>
+	<machine name="mslugb" sourcefile="neogeo/neogeo.cpp" cloneof="mslug" romof="mslug" sampleof="mslug">
+		<description>Metal Slug (bootleg)</description>
+		<year>1996</year>
+		<manufacturer>bootleg</manufacturer>
+		<rom name="b.p1" size="2097152" crc="18d8daa5" sha1="c53e36a4b89e3e3ee0dd4c2a7f79a6bfd3d1ae5f"/>
+		<sample name="shot"/>
+		<sample name="explosion"/>
+	</machine>
+	<machine name="kinst" sourcefile="midway/kinst.cpp">
+		<description>Killer Instinct (v1.5d)</description>
+		<year>1994</year>
+		<manufacturer>Rare / Nintendo</manufacturer>
+		<rom name="ki-l15d.u98" size="524288" crc="7b65ca3d" sha1="607394d4ba1aea2b8f2d3e8bd9ee05c2ab4a0e13" region="user1" offset="0"/>
+		<disk name="kinst" sha1="81d833236e994528d1482979261401b198d1ca53" region="ata:0:hdd:image" index="0" writable="no"/>
+	</machine>
+	<machine name="ym2610" sourcefile="sound/2610intf.cpp" isdevice="yes" runnable="no">
+		<description>YM2610</description>
+	</machine>
+</mame>
+`
+
+func findGame(dat *types.Dat, name string) *types.Game {
+	for _, g := range dat.Games {
+		if g.Name == name {
+			return g
+		}
+	}
+	return nil
+}
+
+func findRom(g *types.Game, name string) *types.Rom {
+	for _, r := range g.Roms {
+		if r.Name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+func checkFullSchema(t *testing.T, dat *types.Dat) {
+	bios := findGame(dat, "neogeo")
+	if bios == nil {
+		t.Fatalf("missing neogeo")
+	}
+	if !bios.Bios() || bios.Device() || bios.Year != "1990" || bios.Manufacturer != "SNK" {
+		t.Fatalf("unexpected neogeo game attributes: %+v", bios)
+	}
+	if len(bios.BiosSets) != 2 || bios.BiosSets[0].Name != "euro" || bios.BiosSets[0].Default != "yes" ||
+		bios.BiosSets[1].Description != "Japan MVS (Ver. 3)" {
+		t.Fatalf("unexpected neogeo biossets: %+v", bios.BiosSets)
+	}
+	if len(bios.DeviceRefs) != 1 || bios.DeviceRefs[0].Name != "ym2610" {
+		t.Fatalf("unexpected neogeo device refs: %+v", bios.DeviceRefs)
+	}
+	r := findRom(bios, "sp-s2.sp1")
+	if r == nil || r.Bios != "euro" || r.Region != "mainbios" || r.Offset != "0" {
+		t.Fatalf("unexpected neogeo rom: %+v", r)
+	}
+
+	mslug := findGame(dat, "mslug")
+	if mslug == nil || mslug.RomOf != "neogeo" || mslug.CloneOf != "" {
+		t.Fatalf("unexpected mslug: %+v", mslug)
+	}
+	r = findRom(mslug, "sp-s2.sp1")
+	if r == nil || r.Merge != "sp-s2.sp1" {
+		t.Fatalf("unexpected mslug merged rom: %+v", r)
+	}
+	r = findRom(mslug, "201-c1.c1")
+	if r == nil || r.Status != "baddump" || r.Offset != "0" || r.Region != "sprites" {
+		t.Fatalf("unexpected mslug baddump rom: %+v", r)
+	}
+
+	clone := findGame(dat, "mslugb")
+	if clone == nil || clone.CloneOf != "mslug" || clone.RomOf != "mslug" || clone.SampleOf != "mslug" {
+		t.Fatalf("unexpected mslugb: %+v", clone)
+	}
+	if len(clone.Samples) != 2 || clone.Samples[0].Name != "shot" || clone.Samples[1].Name != "explosion" {
+		t.Fatalf("unexpected mslugb samples: %+v", clone.Samples)
+	}
+
+	dev := findGame(dat, "ym2610")
+	if dev == nil || !dev.Device() || dev.Bios() {
+		t.Fatalf("unexpected ym2610: %+v", dev)
+	}
+}
+
+func TestParseXmlFullSchema(t *testing.T) {
+	dat, _, err := ParseXml(strings.NewReader(mameXmlText), "testing/mamexml")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+	checkFullSchema(t, dat)
+}
+
+func TestParseXmlWithListenerFullSchema(t *testing.T) {
+	xpl := new(parseListener)
+	_, err := ParseXmlWithListener(strings.NewReader(mameXmlText), "testing/mamexml", xpl)
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+	checkFullSchema(t, xpl.d)
+}
+
+const mameDatText = `clrmamepro (
+	name "MAME"
+	description "MAME 0.226"
+	version 0.226
+	author "MAMEDev"
+)
+
+resource (
+	name "neogeo"
+	description "Neo-Geo MV-6F"
+	year 1990
+	manufacturer "SNK"
+	biosset ( name euro description "Europe MVS (Ver. 2)" default yes )
+	biosset ( name japan description "Japan MVS (Ver. 3)" )
+	rom ( name sp-s2.sp1 bios euro size 131072 crc 9036d879 sha1 4f5ed7105b7128794654ce82b51723e16e389543 region mainbios offset 0 )
+	rom ( name sm1.sm1 size 131072 crc 94416d67 sha1 42f9d7ddd6c0931fd64226a60dc73602b2819dcf region audiobios offset 0 )
+	device_ref ym2610
+)
+
+game (
+	name "mslug"
+	description "Metal Slug - Super Vehicle-001"
+	year 1996
+	manufacturer "Nazca"
+	romof "neogeo"
+	rom ( name sp-s2.sp1 merge sp-s2.sp1 bios euro size 131072 crc 9036d879 sha1 4f5ed7105b7128794654ce82b51723e16e389543 region mainbios offset 0 )
+	rom ( name 201-p1.p1 size 2097152 crc 08d8daa5 sha1 b53e36a4b89e3e3ee0dd4c2a7f79a6bfd3d1ae5f region cpu offset 100000 )
+	rom ( name 201-c1.c1 size 4194304 crc 72813676 sha1 7b045d1a48980cb1a140699011cb1a3d4acdc4d1 region sprites offset 0 flags baddump )
+	driver ( status imperfect emulation good savestate supported )
+)
+
+game (
+	name "mslugb"
+	description "Metal Slug (bootleg)"
+	year 1996
+	manufacturer "bootleg"
+	cloneof "mslug"
+	romof "mslug"
+	sampleof "mslug"
+	rom ( name b.p1 size 2097152 crc 18d8daa5 sha1 c53e36a4b89e3e3ee0dd4c2a7f79a6bfd3d1ae5f )
+	sample shot
+	sample "explosion"
+	video ( screen raster orientation horizontal x 320 y 224 )
+)
+
+game (
+	name "kinst"
+	description "Killer Instinct (v1.5d)"
+	year 1994
+	manufacturer "Rare / Nintendo"
+	rom ( name ki-l15d.u98 size 524288 crc 7b65ca3d sha1 607394d4ba1aea2b8f2d3e8bd9ee05c2ab4a0e13 region user1 offset 0 )
+	disk ( name kinst sha1 81d833236e994528d1482979261401b198d1ca53 region ata:0:hdd:image index 0 )
+)
+`
+
+// sameGames compares everything both formats can carry; clrmamepro has no
+// way to mark a device, so devices are skipped.
+func sameGames(t *testing.T, xmlDat, cmpDat *types.Dat) {
+	for _, xg := range xmlDat.Games {
+		if xg.Device() {
+			continue
+		}
+		cg := findGame(cmpDat, xg.Name)
+		if cg == nil {
+			t.Fatalf("game %s missing from clrmamepro dat", xg.Name)
+		}
+		if !reflect.DeepEqual(xg, cg) {
+			t.Fatalf("game %s differs:\nxml      %+v\ncmpro    %+v", xg.Name, xg, cg)
+		}
+	}
+}
+
+func TestParseDatFullSchema(t *testing.T) {
+	dat, _, err := ParseDat(strings.NewReader(mameDatText), "testing/mamedat")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+
+	if dat.Version != "0.226" || dat.Author != "MAMEDev" {
+		t.Fatalf("unexpected dat header: %+v", dat)
+	}
+
+	xmlDat, _, err := ParseXml(strings.NewReader(mameXmlText), "testing/mamexml")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+
+	if len(dat.Games) != len(xmlDat.Games)-1 {
+		t.Fatalf("expected %d games, got %d", len(xmlDat.Games)-1, len(dat.Games))
+	}
+	sameGames(t, xmlDat, dat)
+
+	kinst := findGame(dat, "kinst")
+	if len(kinst.Disks) != 1 || kinst.Disks[0].Index != "0" || len(kinst.Disks[0].Sha1) != 20 {
+		t.Fatalf("unexpected kinst disks: %+v", kinst.Disks)
+	}
+}
+
+func TestComposeFullSchema(t *testing.T) {
+	dat, _, err := ParseXml(strings.NewReader(mameXmlText), "testing/mamexml")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+
+	out := string(types.PrintCompliantDat(dat))
+
+	for _, expected := range []string{
+		`cloneof "mslug"`,
+		`romof "neogeo"`,
+		`sampleof "mslug"`,
+		`year "1996"`,
+		`manufacturer "Nazca"`,
+		`sample "explosion"`,
+		`merge "sp-s2.sp1" bios "euro" region "mainbios" offset 0`,
+		`flags baddump`,
+		`resource (`,
+		`biosset ( name "euro" description "Europe MVS (Ver. 2)" default yes )`,
+		`device_ref "ym2610"`,
+		`disk ( name "kinst" sha1 81d833236e994528d1482979261401b198d1ca53 region "ata:0:hdd:image" index 0 )`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Fatalf("composed dat is missing %s:\n%s", expected, out)
+		}
+	}
+
+	// the clrmamepro parser must still read back what we compose
+	dat2, _, err := ParseDat(strings.NewReader(out), "testing/composed")
+	if err != nil {
+		t.Fatalf("error parsing composed dat: %v", err)
+	}
+	if !dat.Games.Equals(dat2.Games) {
+		t.Fatalf("composed dat parses to different games")
+	}
+	sameGames(t, dat, dat2)
+}
+
+const headerDatText = `clrmamepro (
+	name "Nintendo - Game Boy"
+	description "Nintendo - Game Boy (20200101-000000)"
+	version 20200101-000000
+	author "aci68, Arctic Circle System, Hiccup"
+	date "2020-01-01"
+	homepage "No-Intro"
+	url "http://www.no-intro.org"
+	category "Console"
+	comment "complete set"
+)
+
+game (
+	name "Tetris (World)"
+	description "Tetris (World)"
+	rom ( name "Tetris (World).gb" size 32768 crc 63f9407d sha1 74591cc9501af93873f9a5d3eb12da12c0723bbc )
+)
+`
+
+const headerXmlText = `<?xml version="1.0"?>
+<!DOCTYPE datafile PUBLIC "-//Logiqx//DTD ROM Management Datafile//EN" "http://www.logiqx.com/Dats/datafile.dtd">
+<datafile>
+	<header>
+		<name>Nintendo - Game Boy</name>
+		<description>Nintendo - Game Boy (20200101-000000)</description>
+		<version>20200101-000000</version>
+		<date>2020-01-01</date>
+		<author>aci68, Arctic Circle System, Hiccup</author>
+		<homepage>No-Intro</homepage>
+		<url>http://www.no-intro.org</url>
+		<category>Console</category>
+		<comment>complete set</comment>
+	</header>
+	<game name="Tetris (World)">
+		<description>Tetris (World)</description>
+		<rom name="Tetris (World).gb" size="32768" crc="63f9407d" sha1="74591cc9501af93873f9a5d3eb12da12c0723bbc"/>
+	</game>
+</datafile>
+`
+
+func checkHeader(t *testing.T, dat *types.Dat) {
+	if dat.Version != "20200101-000000" || dat.Author != "aci68, Arctic Circle System, Hiccup" ||
+		dat.Date != "2020-01-01" || dat.Homepage != "No-Intro" || dat.Url != "http://www.no-intro.org" ||
+		dat.Category != "Console" || dat.Comment != "complete set" {
+		t.Fatalf("unexpected dat header: %+v", dat)
+	}
+}
+
+func TestParseDatHeader(t *testing.T) {
+	dat, _, err := ParseDat(strings.NewReader(headerDatText), "testing/headerdat")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+	checkHeader(t, dat)
+
+	dat, _, err = ParseXml(strings.NewReader(headerXmlText), "testing/headerxml")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+	checkHeader(t, dat)
+
+	xpl := new(parseListener)
+	_, err = ParseXmlWithListener(strings.NewReader(headerXmlText), "testing/headerxml", xpl)
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+	checkHeader(t, xpl.d)
+
+	dat2, _, err := ParseDat(strings.NewReader(string(types.PrintCompliantDat(dat))), "testing/composed")
+	if err != nil {
+		t.Fatalf("error parsing composed dat: %v", err)
+	}
+	checkHeader(t, dat2)
+
+	derived := new(types.Dat)
+	derived.CopyHeader(dat)
+	if derived.Version != dat.Version || derived.Url != dat.Url ||
+		derived.Comment != "derived from Nintendo - Game Boy 20200101-000000" {
+		t.Fatalf("unexpected derived header: %+v", derived)
+	}
+}
+
+func TestComposeXMLDat(t *testing.T) {
+	dat, _, err := ParseXml(strings.NewReader(mameXmlText), "testing/mamexml")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+
+	var buf bytes.Buffer
+	err = types.ComposeXMLDat(dat, &buf)
+	if err != nil {
+		t.Fatalf("error composing xml dat: %v", err)
+	}
+
+	dat2, _, err := ParseXml(&buf, "testing/composedxml")
+	if err != nil {
+		t.Fatalf("error parsing composed xml dat: %v", err)
+	}
+	if len(dat2.Games) != len(dat.Games) {
+		t.Fatalf("expected %d games, got %d", len(dat.Games), len(dat2.Games))
+	}
+	if strings.Contains(buf.String(), "device_ref") {
+		t.Fatalf("composed logiqx dat contains device_ref elements")
+	}
+	for _, g := range dat.Games {
+		g.DeviceRefs = nil
+	}
+	sameGames(t, dat, dat2)
+
+	dat, _, err = ParseDat(strings.NewReader(headerDatText), "testing/headerdat")
+	if err != nil {
+		t.Fatalf("error parsing test data: %v", err)
+	}
+	dat.Games[0].Description = `Tetris "Deluxe" <Tom & Jerry>`
+
+	buf.Reset()
+	err = types.ComposeXMLDat(dat, &buf)
+	if err != nil {
+		t.Fatalf("error composing xml dat: %v", err)
+	}
+	if !strings.Contains(buf.String(), "<!DOCTYPE datafile") {
+		t.Fatalf("composed xml dat is missing the doctype:\n%s", buf.String())
+	}
+
+	xpl := new(parseListener)
+	_, err = ParseXmlWithListener(&buf, "testing/composedxml", xpl)
+	if err != nil {
+		t.Fatalf("error parsing composed xml dat: %v", err)
+	}
+	checkHeader(t, xpl.d)
+	if len(xpl.d.Games) != 1 || xpl.d.Games[0].Description != dat.Games[0].Description ||
+		!xpl.d.Games[0].Roms.Equals(dat.Games[0].Roms) {
+		t.Fatalf("unexpected games in composed xml dat: %+v", xpl.d.Games)
+	}
+
+	dat.Games[0].Roms[0].Size = types.SizeUnknown
+	buf.Reset()
+	err = types.ComposeXMLDat(dat, &buf)
+	if err != nil {
+		t.Fatalf("error composing xml dat: %v", err)
+	}
+	if strings.Contains(buf.String(), `size="-1"`) {
+		t.Fatalf("composed xml dat has a size for a rom of unknown size:\n%s", buf.String())
+	}
+}
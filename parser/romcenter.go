@@ -0,0 +1,206 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package parser
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+const romCenterSeparator = "\u00ac"
+
+// ParseRomCenter parses a RomCenter 2.x DAT. Games in the [RESOURCES] section
+// are BIOS sets.
+func ParseRomCenter(r io.Reader, path string) (*types.Dat, []byte, error) {
+	return collect(func(pl ParseListener) ([]byte, error) {
+		return ParseRomCenterWithListener(r, path, pl)
+	})
+}
+
+func ParseRomCenterWithListener(r io.Reader, path string, pl ParseListener) ([]byte, error) {
+	hr := hashingReader{
+		ir: r,
+		h:  sha1.New(),
+	}
+
+	d := new(types.Dat)
+	d.Path = path
+
+	gc := newGameCollector()
+
+	var section, emuName, emuVersion string
+
+	scanner := bufio.NewScanner(hr)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lnr := 0
+	for scanner.Scan() {
+		lnr++
+		line := strings.TrimSpace(strings.TrimPrefix(latin1(scanner.Text()), "\ufeff"))
+		if line == "" || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(line[1 : len(line)-1])
+			continue
+		}
+
+		switch section {
+		case "credits", "emulator":
+			i := strings.Index(line, "=")
+			if i < 0 {
+				continue
+			}
+			key := strings.ToLower(strings.TrimSpace(line[:i]))
+			value := strings.TrimSpace(line[i+1:])
+
+			if section == "emulator" {
+				switch key {
+				case "refname":
+					emuName = value
+				case "version":
+					emuVersion = value
+				}
+				continue
+			}
+
+			switch key {
+			case "author":
+				d.Author = value
+			case "version":
+				d.Version = value
+			case "date":
+				d.Date = value
+			case "homepage":
+				d.Homepage = value
+			case "url":
+				d.Url = value
+			case "comment":
+				d.Comment = value
+			}
+		case "games", "resources":
+			err := romCenterGameLine(line, section == "resources", gc, d)
+			if err != nil {
+				derrStr := fmt.Sprintf("error in file %s on line %d: %v", path, lnr, err)
+				return nil, ParseError.NewWith(derrStr, setErrorFilePath(path), setErrorLineNumber(lnr))
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	d.Name = emuName
+	if d.Name == "" {
+		d.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	d.Description = emuVersion
+	if d.Description == "" {
+		d.Description = d.Name
+	}
+	d.Games = gc.games
+
+	err := emitDat(d, pl)
+	if err != nil {
+		return nil, err
+	}
+	return hr.h.Sum(nil), nil
+}
+
+// romCenterGameLine parses
+// ¬parent name¬parent description¬game name¬game description¬rom name¬rom crc¬rom size¬romof name¬merge name¬
+func romCenterGameLine(line string, resource bool, gc *gameCollector, d *types.Dat) error {
+	fields := strings.Split(strings.TrimPrefix(line, romCenterSeparator), romCenterSeparator)
+	if len(fields) < 7 {
+		return fmt.Errorf("expected at least 7 fields separated by %s, got %d", romCenterSeparator, len(fields))
+	}
+
+	g, created := gc.game(fields[2])
+	if created {
+		g.Description = fields[3]
+		if fields[0] != "" && fields[0] != fields[2] {
+			g.CloneOf = fields[0]
+		}
+		if len(fields) > 7 && fields[7] != "" {
+			g.RomOf = fields[7]
+		}
+		if resource {
+			g.IsBios = "yes"
+		}
+	}
+
+	if fields[4] == "" {
+		return nil
+	}
+
+	rom := &types.Rom{Name: fields[4]}
+
+	var err error
+	rom.Crc, err = stringValue2Bytes(fields[5], 8)
+	if err != nil {
+		return fmt.Errorf("bad crc %q for rom %s", fields[5], rom.Name)
+	}
+
+	if fields[6] != "" {
+		rom.Size, err = stringValue2Int(fields[6])
+		if err != nil {
+			return fmt.Errorf("bad size %q for rom %s", fields[6], rom.Name)
+		}
+	}
+
+	if len(fields) > 8 {
+		rom.Merge = fields[8]
+	}
+
+	d.MissingSha1s = true
+	g.Roms = append(g.Roms, rom)
+	return nil
+}
+
+// latin1 returns s unchanged if it is valid UTF-8 and otherwise reads it as
+// ISO 8859-1, the encoding of most RomCenter DATs.
+func latin1(s string) string {
+	if utf8.ValidString(s) {
+		return s
+	}
+	rs := make([]rune, len(s))
+	for i := 0; i < len(s); i++ {
+		rs[i] = rune(s[i])
+	}
+	return string(rs)
+}
@@ -0,0 +1,197 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package parser
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+// ParseSeparated parses the tab or comma separated DATs written by SabreTools.
+// Columns are found by their header names.
+func ParseSeparated(r io.Reader, path string) (*types.Dat, []byte, error) {
+	return collect(func(pl ParseListener) ([]byte, error) {
+		return ParseSeparatedWithListener(r, path, pl)
+	})
+}
+
+func ParseSeparatedWithListener(r io.Reader, path string, pl ParseListener) ([]byte, error) {
+	hr := hashingReader{
+		ir: r,
+		h:  sha1.New(),
+	}
+	br := bufio.NewReader(hr)
+
+	header, err := br.ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	cr := csv.NewReader(io.MultiReader(strings.NewReader(header), br))
+	cr.LazyQuotes = true
+	cr.FieldsPerRecord = -1
+	if strings.Contains(header, "\t") {
+		cr.Comma = '\t'
+	}
+
+	parseErr := func(lnr int, err error) error {
+		derrStr := fmt.Sprintf("error in file %s on line %d: %v", path, lnr, err)
+		return ParseError.NewWith(derrStr, setErrorFilePath(path), setErrorLineNumber(lnr))
+	}
+
+	names, err := cr.Read()
+	if err != nil {
+		return nil, parseErr(1, err)
+	}
+
+	columns := make(map[string]int)
+	for i, name := range names {
+		columns[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))] = i
+	}
+
+	for _, required := range []string{"game name", "rom name"} {
+		if _, ok := columns[required]; !ok {
+			return nil, parseErr(1, fmt.Errorf("missing column %q", required))
+		}
+	}
+
+	d := new(types.Dat)
+	d.Path = path
+
+	gc := newGameCollector()
+
+	lnr := 1
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		lnr++
+		if err != nil {
+			return nil, parseErr(lnr, err)
+		}
+
+		field := func(name string) string {
+			i, ok := columns[name]
+			if !ok || i >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[i])
+		}
+
+		if d.Name == "" {
+			d.Name = field("internal name")
+			d.Description = field("description")
+		}
+
+		g, created := gc.game(field("game name"))
+		if created && field("game description") != "" {
+			g.Description = field("game description")
+		}
+
+		status := strings.ToLower(field("nodump"))
+		if status == "" {
+			status = strings.ToLower(field("status"))
+		}
+		if status == "none" || status == "good" {
+			status = ""
+		}
+
+		md5, err := stringValue2Bytes(field("md5"), 32)
+		if err != nil {
+			return nil, parseErr(lnr, fmt.Errorf("bad md5 %q", field("md5")))
+		}
+		sha1Bytes, err := stringValue2Bytes(field("sha1"), 40)
+		if err != nil {
+			return nil, parseErr(lnr, fmt.Errorf("bad sha1 %q", field("sha1")))
+		}
+
+		if strings.ToLower(field("type")) == "disk" {
+			g.Disks = append(g.Disks, &types.Disk{
+				Name:   field("disk name"),
+				Md5:    md5,
+				Sha1:   sha1Bytes,
+				Status: status,
+			})
+			continue
+		}
+
+		if field("rom name") == "" {
+			continue
+		}
+
+		rom := &types.Rom{
+			Name:   field("rom name"),
+			Size:   types.SizeUnknown,
+			Md5:    md5,
+			Sha1:   sha1Bytes,
+			Status: status,
+		}
+
+		rom.Crc, err = stringValue2Bytes(field("crc"), 8)
+		if err != nil {
+			return nil, parseErr(lnr, fmt.Errorf("bad crc %q", field("crc")))
+		}
+
+		if field("size") != "" {
+			rom.Size, err = stringValue2Int(field("size"))
+			if err != nil {
+				return nil, parseErr(lnr, fmt.Errorf("bad size %q", field("size")))
+			}
+		}
+
+		if rom.Sha1 == nil {
+			d.MissingSha1s = true
+		}
+		g.Roms = append(g.Roms, rom)
+	}
+
+	if d.Name == "" {
+		d.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	if d.Description == "" {
+		d.Description = d.Name
+	}
+	d.Games = gc.games
+
+	err = emitDat(d, pl)
+	if err != nil {
+		return nil, err
+	}
+	return hr.h.Sum(nil), nil
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/golang/glog"
+
+	"github.com/uwedeportivo/commander"
+
+	"github.com/uwedeportivo/romba/db"
+)
+
+func (rs *RombaService) dbBackupWork(cmd *commander.Command, args []string) error {
+	outPath := cmd.Flag.Lookup("out").Value.Get().(string)
+
+	if outPath == "" {
+		_, err := fmt.Fprintf(cmd.Stdout, "-out argument required")
+		if err != nil {
+			return err
+		}
+		return errors.New("missing out argument")
+	}
+
+	outPath, err := filepath.Abs(outPath)
+	if err != nil {
+		return err
+	}
+
+	glog.Infof("backing up db into %s", outPath)
+
+	startTime := time.Now()
+
+	manifest, err := rs.romDB.Backup(outPath)
+	if err != nil {
+		return err
+	}
+
+	var numKeys int64
+	for _, bs := range manifest.Stores {
+		numKeys += bs.NumKeys
+	}
+
+	endMsg := fmt.Sprintf("db-backup finished in %s, wrote %d keys of %d stores into %s",
+		db.FormatDuration(time.Since(startTime)), numKeys, len(manifest.Stores), outPath)
+
+	glog.Infof(endMsg)
+	_, err = fmt.Fprintf(cmd.Stdout, endMsg)
+	if err != nil {
+		return err
+	}
+	rs.broadCastProgress(time.Now(), false, true, endMsg, nil)
+	return nil
+}
+
+// dbBackup runs as a job so that no other job writes to the db while the
+// stores are read.
+func (rs *RombaService) dbBackup(cmd *commander.Command, args []string) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if rs.busy {
+		p := rs.pt.GetProgress()
+
+		_, err := fmt.Fprintf(cmd.Stdout, "still busy with %s: (%d of %d files) and (%s of %s) \n", rs.jobName,
+			p.FilesSoFar, p.TotalFiles, humanize.IBytes(uint64(p.BytesSoFar)), humanize.IBytes(uint64(p.TotalBytes)))
+		return err
+	}
+
+	rs.pt.Reset()
+	rs.busy = true
+	rs.jobName = "db-backup"
+
+	go func() {
+		ticker := time.NewTicker(time.Second * 5)
+		stopTicker := make(chan bool)
+		go func() {
+			glog.Infof("starting progress broadcaster")
+			for {
+				select {
+				case t := <-ticker.C:
+					rs.broadCastProgress(t, false, false, "", nil)
+				case <-stopTicker:
+					glog.Info("stopped progress broadcaster")
+					return
+				}
+			}
+		}()
+
+		err := rs.dbBackupWork(cmd, args)
+		if err != nil {
+			glog.Errorf("error db-backup: %v", err)
+		}
+
+		ticker.Stop()
+		stopTicker <- true
+
+		rs.jobMutex.Lock()
+		rs.busy = false
+		rs.jobName = ""
+		rs.jobMutex.Unlock()
+
+		glog.Infof("db-backup finished")
+		rs.pt.Finished()
+		rs.broadCastProgress(time.Now(), false, true, "db-backup finished", err)
+	}()
+
+	glog.Infof("service starting db-backup")
+	_, err := fmt.Fprintf(cmd.Stdout, "started db-backup")
+	return err
+}
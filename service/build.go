@@ -31,15 +31,20 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package service
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/golang/glog"
 	"github.com/uwedeportivo/commander"
 	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/config"
 	"github.com/uwedeportivo/romba/dedup"
 	"github.com/uwedeportivo/romba/parser"
 	"github.com/uwedeportivo/romba/types"
@@ -51,6 +56,12 @@ type buildWorker struct {
 }
 
 func (pw *buildWorker) Process(path string, size int64) error {
+	if parser.IsDatArchive(path) {
+		return parser.ForEachDatInArchive(path, "", func(dat *types.Dat, sha1Bytes []byte) error {
+			return pw.buildDat(dat, parser.LogicalPath(dat.Path))
+		})
+	}
+
 	hashes, err := archive.HashesForFile(path)
 	if err != nil {
 		return err
@@ -71,10 +82,19 @@ func (pw *buildWorker) Process(path string, size int64) error {
 		glog.V(4).Infof("parsed dat=%s", types.PrintShortDat(dat))
 	}
 
+	return pw.buildDat(dat, path)
+}
+
+// buildDat builds dat into the output folder mirroring where path is in the
+// DAT tree.
+func (pw *buildWorker) buildDat(dat *types.Dat, path string) error {
 	reldatdir, err := filepath.Rel(pw.pm.commonRootPath, filepath.Dir(path))
 	if err != nil {
 		return err
 	}
+	if reldatdir == ".." || strings.HasPrefix(reldatdir, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("dat %s is outside of %s", path, pw.pm.commonRootPath)
+	}
 
 	datdir := filepath.Join(pw.pm.outpath, reldatdir)
 	if pw.pm.sha1Tree > 0 {
@@ -88,6 +108,18 @@ func (pw *buildWorker) Process(path string, size int64) error {
 		return err
 	}
 
+	if pw.pm.filter.Active() {
+		dat = pw.pm.filter.Apply(dat)
+		dat.Description = fmt.Sprintf("%s [%s]", dat.Description, pw.pm.filter)
+
+		derivedPath := filepath.Join(datdir, "filtered-"+dat.Filename()+types.FormatSuffix(pw.pm.format))
+		err = writeDat(dat, derivedPath, pw.pm.format)
+		if err != nil {
+			return err
+		}
+		glog.Infof("selected %d games of dat %s into %s", len(dat.Games), dat.Name, derivedPath)
+	}
+
 	for _, game := range dat.Games {
 		for _, rom := range game.Roms {
 			_, err = pw.pm.rs.romDB.CompleteRom(rom)
@@ -97,12 +129,13 @@ func (pw *buildWorker) Process(path string, size int64) error {
 		}
 	}
 
-	datInComplete := false
+	var stats *archive.DatStats
 	if pw.pm.fixdatOnly {
-		datInComplete, err = pw.pm.rs.depot.FixDat(dat, datdir, pw.pm.numSubWorkers, pw.pm.deduper, pw.pm.bloomOnly)
+		stats, err = pw.pm.rs.depot.FixDat(dat, datdir, pw.pm.numSubWorkers, pw.pm.deduper, pw.pm.bloomOnly,
+			pw.pm.format)
 	} else {
-		datInComplete, err = pw.pm.rs.depot.BuildDat(dat, datdir, pw.pm.numSubWorkers, pw.pm.deduper,
-			pw.pm.unzipAllGames, pw.pm.sha1Tree)
+		stats, err = pw.pm.rs.depot.BuildDat(dat, datdir, pw.pm.numSubWorkers, pw.pm.deduper,
+			pw.pm.unzipAllGames, pw.pm.sha1Tree, pw.pm.keepGoing, pw.pm.format, pw.pm.names)
 	}
 
 	if err != nil {
@@ -110,9 +143,10 @@ func (pw *buildWorker) Process(path string, size int64) error {
 	}
 
 	glog.Infof("finished building dat %s in directory %s", dat.Name, datdir)
-	if datInComplete {
+	if stats.Incomplete() {
 		glog.Info("dat has missing roms")
 	}
+	pw.pm.addStats(stats)
 	return nil
 }
 
@@ -131,7 +165,82 @@ type buildGru struct {
 	bloomOnly      bool
 	unzipAllGames  bool
 	sha1Tree       int
+	keepGoing      bool
+	format         string
+	filter         *types.GameFilter
+	names          *types.NameMapper
 	deduper        dedup.Deduper
+	statsMutex     sync.Mutex
+	stats          []*archive.DatStats
+}
+
+// nameMapper returns the mapping of DAT names to safe paths configured in the
+// names section of the config.
+func nameMapper() (*types.NameMapper, error) {
+	return types.NewNameMapper(config.GlobalConfig.Names.Replacement, config.GlobalConfig.Names.Map)
+}
+
+func (pm *buildGru) addStats(stats *archive.DatStats) {
+	pm.statsMutex.Lock()
+	defer pm.statsMutex.Unlock()
+
+	pm.stats = append(pm.stats, stats)
+}
+
+// writeReport writes the per DAT stats as json into the output dir and returns a
+// short summary for the terminal message.
+func (pm *buildGru) writeReport(jobName string) (string, error) {
+	pm.statsMutex.Lock()
+	defer pm.statsMutex.Unlock()
+
+	sort.Slice(pm.stats, func(i, j int) bool {
+		return pm.stats[i].Path < pm.stats[j].Path
+	})
+
+	reportPath := filepath.Join(pm.outpath,
+		fmt.Sprintf("%s-report-%s.json", jobName, time.Now().Format(archive.ResumeDateFormat)))
+
+	reportFile, err := os.Create(reportPath)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		err := reportFile.Close()
+		if err != nil {
+			glog.Errorf("error, failed to close %s: %v", reportPath, err)
+		}
+	}()
+
+	enc := json.NewEncoder(reportFile)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(pm.stats)
+	if err != nil {
+		return "", err
+	}
+
+	var games, complete, partial, missing, failed, incompleteDats int
+	var bytesWritten int64
+	for _, ds := range pm.stats {
+		games += ds.GamesTotal
+		complete += ds.GamesComplete
+		partial += ds.GamesPartial
+		missing += ds.GamesMissing
+		failed += ds.GamesFailed
+		bytesWritten += ds.BytesWritten
+		if ds.Incomplete() {
+			incompleteDats++
+		}
+	}
+
+	summary := fmt.Sprintf("%d dats (%d incomplete): %d of %d games complete, %d partial, %d missing",
+		len(pm.stats), incompleteDats, complete, games, partial, missing)
+	if failed > 0 {
+		summary += fmt.Sprintf(", %d failed", failed)
+	}
+	if !pm.fixdatOnly {
+		summary += fmt.Sprintf(", %s written", humanize.IBytes(uint64(bytesWritten)))
+	}
+	return summary + fmt.Sprintf(", report in %s", reportPath), nil
 }
 
 func (pm *buildGru) CalculateWork() bool {
@@ -143,8 +252,7 @@ func (pm *buildGru) NeedsSizeInfo() bool {
 }
 
 func (pm *buildGru) Accept(path string) bool {
-	ext := filepath.Ext(path)
-	return ext == ".dat" || ext == ".xml"
+	return parser.IsDatFile(path) || parser.IsDatArchive(path)
 }
 
 func (pm *buildGru) NewWorker(workerIndex int) worker.Worker {
@@ -204,6 +312,24 @@ func (rs *RombaService) build(cmd *commander.Command, args []string) error {
 	bloomOnly := cmd.Flag.Lookup("bloomOnly").Value.Get().(bool)
 	unzipAllGames := cmd.Flag.Lookup("unzipAllGames").Value.Get().(bool)
 	sha1Tree := cmd.Flag.Lookup("sha1Tree").Value.Get().(int)
+	keepGoing := cmd.Flag.Lookup("keep-going").Value.Get().(bool)
+	format := cmd.Flag.Lookup("format").Value.Get().(string)
+	if err := types.CheckFormat(format); err != nil {
+		return err
+	}
+
+	filter, err := types.NewGameFilter(cmd.Flag.Lookup("include-regex").Value.Get().(string),
+		cmd.Flag.Lookup("exclude-regex").Value.Get().(string),
+		cmd.Flag.Lookup("exclude-clones").Value.Get().(bool),
+		cmd.Flag.Lookup("1g1r").Value.Get().(string))
+	if err != nil {
+		return err
+	}
+
+	names, err := nameMapper()
+	if err != nil {
+		return err
+	}
 
 	numWorkers := cmd.Flag.Lookup("workers").Value.Get().(int)
 	numSubWorkers := cmd.Flag.Lookup("subworkers").Value.Get().(int)
@@ -220,7 +346,7 @@ func (rs *RombaService) build(cmd *commander.Command, args []string) error {
 		return err
 	}
 
-	deduper, err := dedup.NewLevelDBDeduper()
+	deduper, err := dedup.New()
 	if err != nil {
 		return err
 	}
@@ -257,6 +383,10 @@ func (rs *RombaService) build(cmd *commander.Command, args []string) error {
 			bloomOnly:     bloomOnly,
 			unzipAllGames: unzipAllGames,
 			sha1Tree:      sha1Tree,
+			keepGoing:     keepGoing,
+			format:        format,
+			filter:        filter,
+			names:         names,
 			deduper:       deduper,
 		}
 
@@ -265,6 +395,17 @@ func (rs *RombaService) build(cmd *commander.Command, args []string) error {
 			glog.Errorf("error building dats: %v", err)
 		}
 
+		jobName := "build"
+		if fixdatOnly {
+			jobName = "fixdat"
+		}
+		summary, rerr := pm.writeReport(jobName)
+		if rerr != nil {
+			glog.Errorf("error writing %s report: %v", jobName, rerr)
+		} else {
+			endMsg = endMsg + summary + "\n"
+		}
+
 		ticker.Stop()
 		stopTicker <- true
 
@@ -290,6 +431,11 @@ func (rs *RombaService) dir2dat(cmd *commander.Command, args []string) error {
 	outpath := cmd.Flag.Lookup("out").Value.Get().(string)
 
 	srcpath := cmd.Flag.Lookup("source").Value.Get().(string)
+	format := cmd.Flag.Lookup("format").Value.Get().(string)
+	if err := types.CheckFormat(format); err != nil {
+		return err
+	}
+
 	srcInfo, err := os.Stat(srcpath)
 	if err != nil {
 		return err
@@ -299,15 +445,27 @@ func (rs *RombaService) dir2dat(cmd *commander.Command, args []string) error {
 		return fmt.Errorf("%s is not a directory", srcpath)
 	}
 
+	names, err := nameMapper()
+	if err != nil {
+		return err
+	}
+
 	dat := new(types.Dat)
 	dat.Name = cmd.Flag.Lookup("name").Value.Get().(string)
 	dat.Description = cmd.Flag.Lookup("description").Value.Get().(string)
 
-	err = archive.Dir2Dat(dat, srcpath, outpath)
+	renames, err := archive.Dir2Dat(dat, srcpath, outpath, format, names)
 	if err != nil {
 		return err
 	}
 
+	for _, r := range renames {
+		_, err = fmt.Fprintln(cmd.Stdout, r)
+		if err != nil {
+			return err
+		}
+	}
+
 	_, err = fmt.Fprintf(cmd.Stdout, "dir2dat successfully completed a DAT in %s for directory %s", outpath, srcpath)
 	return err
 }
@@ -0,0 +1,82 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/archive"
+)
+
+func TestBuildWriteReport(t *testing.T) {
+	outpath := t.TempDir()
+	pm := &buildGru{
+		outpath: outpath,
+		stats: []*archive.DatStats{
+			{Dat: "b", Path: "/dats/b.dat", GamesTotal: 2, GamesComplete: 2, RomsHave: 4, BytesWritten: 2048},
+			{Dat: "a", Path: "/dats/a.dat", GamesTotal: 4, GamesComplete: 1, GamesPartial: 1,
+				GamesMissing: 1, GamesFailed: 1, RomsHave: 3, RomsMiss: 5, BytesWritten: 1024},
+		},
+	}
+
+	summary, err := pm.writeReport("build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "2 dats (1 incomplete): 3 of 6 games complete, 1 partial, 1 missing, 1 failed, 3.0 KiB written"
+	if !strings.HasPrefix(summary, expected) {
+		t.Fatalf("unexpected summary %q, expected it to start with %q", summary, expected)
+	}
+
+	matches, err := filepath.Glob(filepath.Join(outpath, "build-report-*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 {
+		t.Fatalf("expected one report file, found %v", matches)
+	}
+	bs, err := ioutil.ReadFile(matches[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats []*archive.DatStats
+	err = json.Unmarshal(bs, &stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 || stats[0].Dat != "a" || stats[0].GamesFailed != 1 || stats[1].RomsHave != 4 {
+		t.Fatalf("unexpected report contents: %s", bs)
+	}
+}
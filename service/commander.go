@@ -111,7 +111,7 @@ func splitIntoArgs(argLine string) ([]string, error) {
 func newCommand(writer io.Writer, rs *RombaService) *commander.Command {
 	cmd := new(commander.Command)
 	cmd.UsageLine = "Romba"
-	cmd.Subcommands = make([]*commander.Command, 19)
+	cmd.Subcommands = make([]*commander.Command, 28)
 	cmd.Flag = *flag.NewFlagSet("romba", flag.ContinueOnError)
 	cmd.Stdout = writer
 	cmd.Stderr = writer
@@ -124,7 +124,18 @@ func newCommand(writer io.Writer, rs *RombaService) *commander.Command {
 Refreshes the DAT index from the files in the DAT master directory tree.
 Detects any changes in the DAT master directory tree and updates the DAT index
 accordingly, marking deleted or overwritten dats as orphaned and updating
-contents of any changed dats.`,
+contents of any changed dats. Only files that are new or whose size or
+modification time changed since the last refresh are parsed again, and the
+numbers of added, changed, unchanged and removed files are reported.
+Afterwards the ROMs of DATs without have and miss counters are looked up in the
+depot and counted for datstatus.
+Besides clrmamepro and Logiqx XML DATs, RomCenter DATs, SabreTools .tsv/.csv
+files and .sfv, .md5 and .sha1 hash files are read.
+DAT files inside zip, gz and 7z files are indexed as well.
+The character encoding of each DAT is detected from a byte order mark, the xml
+declaration or the content, and DATs are converted to UTF-8 before they are
+indexed. With -encoding all DATs are read in the given encoding instead, e.g.
+shift_jis or latin1, and DATs already in the index are indexed again.`,
 		Flag:   *flag.NewFlagSet("romba-refresh-dats", flag.ContinueOnError),
 		Stdout: writer,
 		Stderr: writer,
@@ -133,6 +144,7 @@ contents of any changed dats.`,
 	cmd.Subcommands[0].Flag.Int("workers", config.GlobalConfig.General.Workers,
 		"how many workers to launch for the job")
 	cmd.Subcommands[0].Flag.String("missingSha1s", "", "write paths of dats with missing sha1s into this file")
+	cmd.Subcommands[0].Flag.String("encoding", "", "read the dats in this character encoding instead of the detected one")
 
 	cmd.Subcommands[1] = &commander.Command{
 		Run:       rs.startArchive,
@@ -192,7 +204,8 @@ structure. It also deletes the specified DATs from the DAT index.`,
 		Short:     "Creates a DAT file for the specified input directory and saves it to the -out filename.",
 		Long: `
 Walks the specified input directory and builds a DAT file that mirrors its
-structure. Saves this DAT file in specified output filename.`,
+structure. Saves this DAT file in specified output filename. File names are
+made safe as paths the way build does it and every rename is printed.`,
 		Flag:   *flag.NewFlagSet("romba-dir2dat", flag.ContinueOnError),
 		Stdout: writer,
 		Stderr: writer,
@@ -202,6 +215,7 @@ structure. Saves this DAT file in specified output filename.`,
 	cmd.Subcommands[3].Flag.String("source", "", "source directory")
 	cmd.Subcommands[3].Flag.String("name", "untitled", "name value in DAT header")
 	cmd.Subcommands[3].Flag.String("description", "", "description value in DAT header")
+	cmd.Subcommands[3].Flag.String("format", "dat", "format of written DAT files: dat (clrmamepro) or xml (Logiqx)")
 
 	cmd.Subcommands[4] = &commander.Command{
 		Run:       rs.diffdat,
@@ -220,6 +234,7 @@ in -old DAT file. Ignores those entries in -old that are not in -new.`,
 	cmd.Subcommands[4].Flag.String("new", "", "new DAT file")
 	cmd.Subcommands[4].Flag.String("name", "", "name for out DAT file")
 	cmd.Subcommands[4].Flag.String("description", "", "description for out DAT file")
+	cmd.Subcommands[4].Flag.String("format", "dat", "format of written DAT files: dat (clrmamepro) or xml (Logiqx)")
 
 	cmd.Subcommands[5] = &commander.Command{
 		Run:       rs.build,
@@ -230,7 +245,15 @@ For each specified DAT file it creates the torrentzip files in the specified
 output dir. The files will be placed in the specified location using a folder
 structure according to the original DAT master directory tree structure unless
 the flag sha1Tree is used in which case the directory tree structure is the depot
-sha1 directories.`,
+sha1 directories.
+The filter flags select a subset of the games of each DAT. The selected subset
+is written as filtered-<dat>.dat (.xml with -format xml) next to the built games.
+DAT files inside zip, gz and 7z files are built as if the archive was unpacked
+into a folder of the same name.
+Game and ROM names that would leave the output dir fail the DAT. Names are
+converted to NFC, characters illegal on FAT, exFAT and NTFS are replaced as
+configured in the names section of the config and names that collide ignoring
+case get a number appended. Every rename is listed in the build report.`,
 		Flag:   *flag.NewFlagSet("romba-build", flag.ContinueOnError),
 		Stdout: writer,
 		Stderr: writer,
@@ -249,6 +272,12 @@ keep compressed gzip, if value > 1 uncompress into destination sha1`)
 		"how many subworkers to launch for each worker")
 
 	cmd.Subcommands[5].Flag.Bool("bloomOnly", false, "pretend bloom positives are 100% true. only used in fixdatOnly case")
+	cmd.Subcommands[5].Flag.Bool("keep-going", false, "skip games that fail to build and report them in a build-errors json file")
+	cmd.Subcommands[5].Flag.String("include-regex", "", "only build games whose name matches this regex")
+	cmd.Subcommands[5].Flag.String("exclude-regex", "", "skip games whose name matches this regex")
+	cmd.Subcommands[5].Flag.Bool("exclude-clones", false, "skip games that are clones of another game")
+	cmd.Subcommands[5].Flag.String("1g1r", "", `build only the best game per title, ranked by this comma separated region and language priority, like "USA,Europe,World,Japan"`)
+	cmd.Subcommands[5].Flag.String("format", "dat", "format of written DAT files: dat (clrmamepro) or xml (Logiqx)")
 
 	cmd.Subcommands[6] = &commander.Command{
 		Run:       rs.lookup,
@@ -362,6 +391,7 @@ in -old DAT files. Ignores those entries in -old that are not in -new.`,
 	cmd.Subcommands[14].Flag.String("out", "", "output dir")
 	cmd.Subcommands[14].Flag.String("old", "", "old DAT file")
 	cmd.Subcommands[14].Flag.String("new", "", "new DAT file")
+	cmd.Subcommands[14].Flag.String("format", "dat", "format of written DAT files: dat (clrmamepro) or xml (Logiqx)")
 
 	cmd.Subcommands[15] = &commander.Command{
 		Run:       rs.datstats,
@@ -386,6 +416,7 @@ Exports the hashes associations as a DAT file.`,
 	}
 
 	cmd.Subcommands[16].Flag.String("out", "", "output DAT file")
+	cmd.Subcommands[16].Flag.String("format", "dat", "format of written DAT files: dat (clrmamepro) or xml (Logiqx)")
 
 	cmd.Subcommands[17] = &commander.Command{
 		Run:       rs.imprt,
@@ -417,5 +448,183 @@ Populate the bloom filter.`,
 	cmd.Subcommands[18].Flag.Int("subworkers", config.GlobalConfig.General.Workers,
 		"how many subworkers to launch for each worker")
 
+	cmd.Subcommands[19] = &commander.Command{
+		Run:       rs.fix,
+		UsageLine: "fix -dat <datfile> [-backup <backupdir>] [-dry-run] [-report <reportfile>] <setdir>",
+		Short:     "Fixes an existing ROM set in place from the depot.",
+		Long: `
+Scans the specified set directory against the DAT file and reports correct,
+misnamed, unneeded and missing entries. Misnamed entries are renamed,
+unneeded files are moved into the -backup directory and missing ROMs are
+added from the depot. Zip files that change are rewritten as torrentzips.
+With -dry-run only the audit report is written. Game and ROM names of the DAT
+are made safe as paths the way build does it and the renames are listed in
+the report.`,
+		Flag:   *flag.NewFlagSet("romba-fix", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[19].Flag.String("dat", "", "DAT file describing the set")
+	cmd.Subcommands[19].Flag.String("backup", "", "backup directory for unneeded files")
+	cmd.Subcommands[19].Flag.String("report", "", "audit report file (defaults to a file in the log dir)")
+	cmd.Subcommands[19].Flag.Bool("dry-run", false, "only audit the set, don't change anything")
+
+	cmd.Subcommands[20] = &commander.Command{
+		Run:       rs.miss,
+		UsageLine: "miss -out <outputdir> [-form game|rom|sha1|md5|crc] [-csv] <list of DAT files or folders with DAT files>",
+		Short:     "For each specified DAT file it creates a miss file and a have file.",
+		Long: `
+For each specified DAT file it creates a miss file and a have file in the
+specified output dir, named <dat>_miss.txt and <dat>_have.txt. The files are
+placed using a folder structure according to the original DAT master directory
+tree structure. -form selects what is listed: game names, rom names or unique
+SHA1, MD5 or CRC hashes. With -csv the lists are written as csv files that
+include sizes.`,
+		Flag:   *flag.NewFlagSet("romba-miss", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[20].Flag.String("out", "", "output dir")
+	cmd.Subcommands[20].Flag.String("form", "game", "list game names (game), rom names (rom) or hashes (sha1, md5, crc)")
+	cmd.Subcommands[20].Flag.Bool("csv", false, "write csv files including sizes")
+	cmd.Subcommands[20].Flag.Bool("bloomOnly", false, "pretend bloom positives are 100% true")
+	cmd.Subcommands[20].Flag.Int("workers", config.GlobalConfig.General.Workers,
+		"how many workers to launch for the job")
+
+	cmd.Subcommands[21] = &commander.Command{
+		Run:       rs.datLint,
+		UsageLine: "dat-lint [-json] [-encoding name] <list of DAT files or folders with DAT files>",
+		Short:     "Checks DAT files and reports every problem found in them.",
+		Long: `
+Parses the specified DAT files leniently and reports every problem found with
+file and line number: syntax errors, invalid or wrong-length hashes, ROMs with
+a size but no hash, duplicate game names, duplicate ROM names within a game,
+conflicting hashes for the same ROM name, unknown tokens and names that are
+unsafe as file system paths. With -json the problems are written as JSON.
+The character encoding of each DAT is detected unless -encoding is given.`,
+		Flag:   *flag.NewFlagSet("romba-dat-lint", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[21].Flag.Bool("json", false, "write the problems as JSON")
+	cmd.Subcommands[21].Flag.String("encoding", "", "read the DATs in this character encoding instead of the detected one")
+
+	cmd.Subcommands[22] = &commander.Command{
+		Run:       rs.dbMigrate,
+		UsageLine: "db-migrate -out <dbdir> [-backend leveldb|goleveldb]",
+		Short:     "Copies the DB into a new DB kept in another key-value store backend.",
+		Long: `
+Copies all records of the DB into a new DB in the specified output dir, kept
+in the specified key-value store backend. The current DB is left untouched.
+To switch over, point db at the new dir and set backend in the [index]
+section of the ini file, then restart romba. The goleveldb backend is pure Go
+and needs no LevelDB library installed.`,
+		Flag:   *flag.NewFlagSet("romba-db-migrate", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[22].Flag.String("out", "", "output dir of the new DB")
+	cmd.Subcommands[22].Flag.String("backend", defaultMigrateBackend(), "key-value store backend of the new DB")
+
+	cmd.Subcommands[23] = &commander.Command{
+		Run:       rs.purgeDelete,
+		UsageLine: "purge-delete [-keep-generations <n>]",
+		Short:     "Deletes DAT index entries for orphaned DATs.",
+		Long: `
+Deletes the DATs that were not found by the last refresh-dats from the DAT
+index, together with all references from ROM hashes to their games, and
+compacts the DB. With -keep-generations n the DATs that were found by one of
+the last n refreshes are kept as well. Reports how many DATs, games and ROM
+references were deleted and how much the DB shrank.`,
+		Flag:   *flag.NewFlagSet("romba-purge-delete", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[23].Flag.Int("keep-generations", 0, "also keep DATs orphaned by the last n refreshes")
+
+	cmd.Subcommands[24] = &commander.Command{
+		Run:       rs.dbBackup,
+		UsageLine: "db-backup -out <file>",
+		Short:     "Writes a consistent backup of the DB into a single file.",
+		Long: `
+Writes all stores of the DB into the specified zip file, together with a
+manifest listing the generation and the number of keys and a SHA256 checksum
+of each store. No other command runs while the backup is written, so the
+stores are consistent with each other. Start rombaserver with -restore <file>
+to rebuild the DB from such a backup.`,
+		Flag:   *flag.NewFlagSet("romba-db-backup", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[24].Flag.String("out", "", "backup file")
+
+	cmd.Subcommands[25] = &commander.Command{
+		Run:       rs.dbFsck,
+		UsageLine: "db-fsck [-repair] [-depot]",
+		Short:     "Checks that the stores of the DB agree with each other.",
+		Long: `
+Walks all stores of the DB and cross-checks them: games without a DAT, ROMs of
+games that their hashes don't reference, hash references to missing DATs or
+games or to games without that ROM, and DAT paths and generations of missing
+DATs. With -depot the CRC and MD5 to SHA1 mappings are also checked against
+the gzip headers of the ROMs in the depot. The problems found are reported by
+category. With -repair they are fixed: dangling entries are deleted, missing
+references are added and mappings are corrected from the depot.`,
+		Flag:   *flag.NewFlagSet("romba-db-fsck", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[25].Flag.Bool("repair", false, "fix the problems found")
+	cmd.Subcommands[25].Flag.Bool("depot", false, "check the hash mappings against the depot")
+
+	cmd.Subcommands[26] = &commander.Command{
+		Run:       rs.depotRescan,
+		UsageLine: "depot-rescan [-resume resumelog] [depot root]",
+		Short:     "Rebuilds the hash mappings of the DB from the depot.",
+		Long: `
+Rebuilds the CRC and MD5 to SHA1 mappings of the DB from the ROMs in the depot.
+Walks the specified depot root, or all depot roots if none is given, and indexes
+every ROM with the hashes and size stored in its gzip header. ROMs whose header
+doesn't hold them are hashed. An interrupted rescan can be continued with
+-resume from its resume log, or with -resume latest from the most recent one.`,
+		Flag:   *flag.NewFlagSet("romba-depot-rescan", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[26].Flag.String("resume", "", "resume a previously interrupted depot-rescan from the specified path")
+	cmd.Subcommands[26].Flag.Int("workers", config.GlobalConfig.General.Workers,
+		"how many workers to launch for the job")
+
+	cmd.Subcommands[27] = &commander.Command{
+		Run:       rs.datStatus,
+		UsageLine: "datstatus [-sort path|percent|missing|changed] [-reverse] [-incomplete] [-games] [path prefix]",
+		Short:     "Lists how complete the DATs are.",
+		Long: `
+Lists the DATs of the DAT index with the percentage of their ROMs in the depot,
+the size of the missing ROMs and the time this last changed. Only DATs whose
+path, or path relative to the DAT master directory, starts with the given
+prefix are listed. The counts are kept in the DB: refresh-dats counts new DATs
+and archive, merge and purge update them as ROMs come and go, so the depot
+isn't touched. With -games the incomplete games of each DAT are listed too.`,
+		Flag:   *flag.NewFlagSet("romba-datstatus", flag.ContinueOnError),
+		Stdout: writer,
+		Stderr: writer,
+	}
+
+	cmd.Subcommands[27].Flag.String("sort", "path", "sort by path, percent, missing or changed")
+	cmd.Subcommands[27].Flag.Bool("reverse", false, "reverse the sort order")
+	cmd.Subcommands[27].Flag.Bool("incomplete", false, "only list DATs with missing ROMs")
+	cmd.Subcommands[27].Flag.Float64("min-percent", 0, "only list DATs at least this complete")
+	cmd.Subcommands[27].Flag.Float64("max-percent", 100, "only list DATs at most this complete")
+	cmd.Subcommands[27].Flag.Bool("games", false, "also list the incomplete games of each DAT")
+
 	return cmd
 }
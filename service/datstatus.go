@@ -0,0 +1,166 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/uwedeportivo/commander"
+
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/types"
+)
+
+type datStatusEntry struct {
+	sha1 []byte
+	dat  *types.Dat
+	ds   *db.DatStatus
+}
+
+var datStatusOrders = map[string]func(a, b *datStatusEntry) bool{
+	"path": func(a, b *datStatusEntry) bool {
+		return a.dat.Path < b.dat.Path
+	},
+	"percent": func(a, b *datStatusEntry) bool {
+		return a.ds.Percent() < b.ds.Percent()
+	},
+	"missing": func(a, b *datStatusEntry) bool {
+		return a.ds.MissBytes() < b.ds.MissBytes()
+	},
+	"changed": func(a, b *datStatusEntry) bool {
+		return a.ds.Changed < b.ds.Changed
+	},
+}
+
+func formatDatStatus(ds *db.DatStatus) string {
+	return fmt.Sprintf("%7.2f%% %6d/%-6d roms %10s missing  %s", ds.Percent(), ds.NumHave, ds.NumRoms,
+		humanize.IBytes(uint64(ds.MissBytes())), time.Unix(0, ds.Changed).Format("2006-01-02 15:04"))
+}
+
+func (rs *RombaService) datStatus(cmd *commander.Command, args []string) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	sortBy := cmd.Flag.Lookup("sort").Value.Get().(string)
+	reverse := cmd.Flag.Lookup("reverse").Value.Get().(bool)
+	incomplete := cmd.Flag.Lookup("incomplete").Value.Get().(bool)
+	minPercent := cmd.Flag.Lookup("min-percent").Value.Get().(float64)
+	maxPercent := cmd.Flag.Lookup("max-percent").Value.Get().(float64)
+	games := cmd.Flag.Lookup("games").Value.Get().(bool)
+
+	less, ok := datStatusOrders[sortBy]
+	if !ok {
+		_, err := fmt.Fprintf(cmd.Stdout, "unknown -sort %s, use path, percent, missing or changed", sortBy)
+		return err
+	}
+
+	if len(args) > 1 {
+		_, err := fmt.Fprintf(cmd.Stdout, "datstatus takes at most one path prefix")
+		return err
+	}
+
+	prefix := ""
+	if len(args) == 1 {
+		prefix = args[0]
+	}
+
+	var entries []*datStatusEntry
+
+	err := rs.romDB.ForEachDatStatus(func(sha1Bytes []byte, dat *types.Dat, ds *db.DatStatus) error {
+		if dat.Generation != rs.romDB.Generation() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(rs.dats, dat.Path)
+		if err != nil {
+			relPath = dat.Path
+		}
+		if !strings.HasPrefix(dat.Path, prefix) && !strings.HasPrefix(relPath, prefix) {
+			return nil
+		}
+
+		percent := ds.Percent()
+		if (incomplete && ds.NumHave == ds.NumRoms) || percent < minPercent || percent > maxPercent {
+			return nil
+		}
+
+		entries = append(entries, &datStatusEntry{
+			sha1: append([]byte(nil), sha1Bytes...),
+			dat:  dat,
+			ds:   ds,
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if reverse {
+			return less(entries[j], entries[i])
+		}
+		return less(entries[i], entries[j])
+	})
+
+	var numComplete int
+	var missBytes int64
+
+	for _, e := range entries {
+		if e.ds.NumHave == e.ds.NumRoms {
+			numComplete++
+		}
+		missBytes += e.ds.MissBytes()
+
+		fmt.Fprintf(cmd.Stdout, "%s  %s\n", formatDatStatus(e.ds), e.dat.Path)
+
+		if games {
+			err := rs.romDB.ForEachGameStatus(e.sha1, func(game *types.Game, gs *db.DatStatus) error {
+				if gs.NumHave == gs.NumRoms {
+					return nil
+				}
+				_, err := fmt.Fprintf(cmd.Stdout, "    %s  %s\n", formatDatStatus(gs), game.Name)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = fmt.Fprintf(cmd.Stdout, "%d dats, %d complete, %s missing\n", len(entries), numComplete,
+		humanize.IBytes(uint64(missBytes)))
+	return err
+}
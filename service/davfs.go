@@ -0,0 +1,691 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/webdav"
+
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/parser"
+	"github.com/uwedeportivo/romba/types"
+)
+
+const davZipSuffix = ".zip"
+
+// gameZipInfo is what we remember about a synthesized torrentzip. Torrentzips are
+// deterministic, so a game with the same roms always produces the same bytes.
+type gameZipInfo struct {
+	size int64
+	crc  uint32
+	sha1 []byte
+}
+
+func (zi *gameZipInfo) etag() string {
+	return `"` + hex.EncodeToString(zi.sha1) + `"`
+}
+
+type gameZipCache struct {
+	sync.Mutex
+	infos map[string]*gameZipInfo
+}
+
+func newGameZipCache() *gameZipCache {
+	return &gameZipCache{
+		infos: make(map[string]*gameZipInfo),
+	}
+}
+
+func gameZipKey(game *types.Game) string {
+	h := sha1.New()
+	for _, rom := range game.Roms {
+		fmt.Fprintf(h, "%s\x00%d\x00%x\x00%x\x00%x\x00", rom.Name, rom.Size, rom.Crc, rom.Md5, rom.Sha1)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (zc *gameZipCache) get(game *types.Game) *gameZipInfo {
+	zc.Lock()
+	defer zc.Unlock()
+	return zc.infos[gameZipKey(game)]
+}
+
+func (zc *gameZipCache) put(game *types.Game, zi *gameZipInfo) {
+	zc.Lock()
+	defer zc.Unlock()
+	zc.infos[gameZipKey(game)] = zi
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	cw.n += int64(len(p))
+	return len(p), nil
+}
+
+// writeGameZip writes the torrentzip for game to w and remembers its size and hashes
+// if all roms of the game were found in the depot.
+func writeGameZip(depot *archive.Depot, zc *gameZipCache, game *types.Game, w io.Writer) (*gameZipInfo, error) {
+	cw := new(countingWriter)
+	crc := crc32.NewIEEE()
+	hSha1 := sha1.New()
+	n, err := depot.WriteGameZip(game, io.MultiWriter(w, cw, crc, hSha1))
+	if err != nil {
+		return nil, err
+	}
+
+	zi := &gameZipInfo{
+		size: cw.n,
+		crc:  crc.Sum32(),
+		sha1: hSha1.Sum(nil),
+	}
+
+	if n == len(game.Roms) {
+		zc.put(game, zi)
+	}
+	return zi, nil
+}
+
+// measureGameZip returns the size and hashes of the torrentzip for game, synthesizing
+// it without keeping the bytes if it hasn't been built before.
+func measureGameZip(depot *archive.Depot, zc *gameZipCache, game *types.Game) (*gameZipInfo, error) {
+	if zi := zc.get(game); zi != nil {
+		return zi, nil
+	}
+	return writeGameZip(depot, zc, game, ioutil.Discard)
+}
+
+// buildGameZip synthesizes the torrentzip for game into a temp file. The caller is
+// responsible for closing and removing the returned file.
+func buildGameZip(depot *archive.Depot, zc *gameZipCache, game *types.Game) (*os.File, *gameZipInfo, error) {
+	tmpFile, err := ioutil.TempFile(config.GlobalConfig.General.TmpDir, "romba-game-")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	zi, err := writeGameZip(depot, zc, game, tmpFile)
+	if err == nil {
+		_, err = tmpFile.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return nil, nil, err
+	}
+	return tmpFile, zi, nil
+}
+
+// davFS is a read-only webdav.FileSystem mirroring the DAT directory tree. Every DAT file
+// shows up as a directory and every game in it as a torrentzip built from the depot on demand.
+type davFS struct {
+	rs       *RombaService
+	allGames bool
+	zips     *gameZipCache
+
+	mutex sync.Mutex
+	dats  map[string]*davDat
+}
+
+type davDat struct {
+	modTime time.Time
+	size    int64
+	dat     *types.Dat
+	games   map[string]*types.Game
+	dirs    map[string][]string
+}
+
+// davListingKey marks the context of PROPFIND requests. Listings only report the
+// sizes of torrentzips that have been built before, synthesizing them is left to
+// GET and HEAD.
+type davListingKey struct{}
+
+func isDavListing(ctx context.Context) bool {
+	listing, _ := ctx.Value(davListingKey{}).(bool)
+	return listing
+}
+
+// NewWebDAVHandler returns a handler serving the read-only virtual DAT tree under prefix.
+// Unless allGames is set, only games complete in the depot are listed.
+func (rs *RombaService) NewWebDAVHandler(prefix string, allGames bool) http.Handler {
+	fs := &davFS{
+		rs:       rs,
+		allGames: allGames,
+		zips:     rs.gameZips,
+		dats:     make(map[string]*davDat),
+	}
+
+	h := &webdav.Handler{
+		Prefix:     prefix,
+		FileSystem: fs,
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				glog.Errorf("webdav %s %s: %v", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS":
+			h.ServeHTTP(w, r)
+		case "PROPFIND":
+			// a missing depth means infinity, which would walk every game of every DAT
+			if depth := r.Header.Get("Depth"); depth != "0" && depth != "1" {
+				http.Error(w, "PROPFIND depth must be 0 or 1", http.StatusForbidden)
+				return
+			}
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), davListingKey{}, true)))
+		default:
+			http.Error(w, "read-only file system", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func (fs *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (fs *davFS) RemoveAll(ctx context.Context, name string) error {
+	return os.ErrPermission
+}
+
+func (fs *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	return os.ErrPermission
+}
+
+func (fs *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	n, err := fs.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return n.info, nil
+}
+
+func (fs *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, os.ErrPermission
+	}
+
+	n, err := fs.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.game == nil {
+		entries, err := fs.readDir(n)
+		if err != nil {
+			return nil, err
+		}
+		return &davDir{info: n.info, entries: entries}, nil
+	}
+
+	if !isDavListing(ctx) {
+		game := n.game
+		n.info.measure = func() (*gameZipInfo, error) {
+			return measureGameZip(fs.rs.depot, fs.zips, game)
+		}
+	}
+	return &davZip{fs: fs, game: n.game, info: n.info}, nil
+}
+
+// davNode is a resolved path in the virtual tree. It is either a real directory below
+// the DATs root, the top of a DAT, a directory inside a DAT or a game.
+type davNode struct {
+	info    *davFileInfo
+	dirPath string
+	datDir  *davDat
+	inDat   string
+	game    *types.Game
+}
+
+func (fs *davFS) resolve(name string) (*davNode, error) {
+	name = path.Clean("/" + name)
+	comps := strings.Split(strings.TrimPrefix(name, "/"), "/")
+	if name == "/" {
+		comps = nil
+	}
+
+	cur := fs.rs.dats
+	fi, err := os.Stat(cur)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, comp := range comps {
+		next := filepath.Join(cur, comp)
+		fi, err = os.Stat(next)
+		if err == nil && fi.IsDir() {
+			cur = next
+			continue
+		}
+
+		datPath, dfi, err := findDatFile(next)
+		if err != nil {
+			return nil, err
+		}
+		dd, err := fs.loadDat(datPath, dfi)
+		if err != nil {
+			return nil, err
+		}
+		return fs.resolveInDat(dd, strings.Join(comps[i+1:], "/"), comp)
+	}
+
+	return &davNode{
+		info:    &davFileInfo{name: fi.Name(), modTime: fi.ModTime(), dir: true},
+		dirPath: cur,
+	}, nil
+}
+
+func findDatFile(pathNoExt string) (string, os.FileInfo, error) {
+	for _, ext := range []string{".dat", ".xml"} {
+		fi, err := os.Stat(pathNoExt + ext)
+		if err == nil && !fi.IsDir() {
+			return pathNoExt + ext, fi, nil
+		}
+	}
+	return "", nil, os.ErrNotExist
+}
+
+func (fs *davFS) resolveInDat(dd *davDat, inDat string, datName string) (*davNode, error) {
+	if _, ok := dd.dirs[inDat]; ok {
+		base := path.Base(inDat)
+		if inDat == "" {
+			base = datName
+		}
+		return &davNode{
+			info:   &davFileInfo{name: base, modTime: dd.modTime, dir: true},
+			datDir: dd,
+			inDat:  inDat,
+		}, nil
+	}
+
+	game, ok := dd.games[inDat]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	visible, err := fs.gameVisible(game)
+	if err != nil {
+		return nil, err
+	}
+	if !visible {
+		return nil, os.ErrNotExist
+	}
+
+	return &davNode{
+		info:   fs.gameInfo(path.Base(inDat), dd, game),
+		datDir: dd,
+		inDat:  inDat,
+		game:   game,
+	}, nil
+}
+
+func (fs *davFS) gameVisible(game *types.Game) (bool, error) {
+	if fs.allGames {
+		return true, nil
+	}
+	return fs.rs.depot.GameComplete(game)
+}
+
+func (fs *davFS) gameInfo(name string, dd *davDat, game *types.Game) *davFileInfo {
+	return &davFileInfo{
+		name:    name,
+		modTime: dd.modTime,
+		zi:      fs.zips.get(game),
+	}
+}
+
+func (fs *davFS) readDir(n *davNode) ([]os.FileInfo, error) {
+	var entries []os.FileInfo
+
+	if n.datDir == nil {
+		fis, err := ioutil.ReadDir(n.dirPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range fis {
+			if fi.IsDir() {
+				entries = append(entries, &davFileInfo{name: fi.Name(), modTime: fi.ModTime(), dir: true})
+				continue
+			}
+			ext := filepath.Ext(fi.Name())
+			if ext == ".dat" || ext == ".xml" {
+				entries = append(entries, &davFileInfo{name: strings.TrimSuffix(fi.Name(), ext),
+					modTime: fi.ModTime(), dir: true})
+			}
+		}
+		return entries, nil
+	}
+
+	dd := n.datDir
+	for _, child := range dd.dirs[n.inDat] {
+		childPath := child
+		if n.inDat != "" {
+			childPath = n.inDat + "/" + child
+		}
+
+		if _, ok := dd.dirs[childPath]; ok {
+			entries = append(entries, &davFileInfo{name: child, modTime: dd.modTime, dir: true})
+			continue
+		}
+
+		game := dd.games[childPath]
+		visible, err := fs.gameVisible(game)
+		if err != nil {
+			return nil, err
+		}
+		if visible {
+			entries = append(entries, fs.gameInfo(child, dd, game))
+		}
+	}
+	return entries, nil
+}
+
+func (fs *davFS) loadDat(datPath string, fi os.FileInfo) (*davDat, error) {
+	fs.mutex.Lock()
+	dd, ok := fs.dats[datPath]
+	fs.mutex.Unlock()
+
+	if ok && dd.modTime.Equal(fi.ModTime()) && dd.size == fi.Size() {
+		return dd, nil
+	}
+
+	hashes, err := archive.HashesForFile(datPath)
+	if err != nil {
+		return nil, err
+	}
+
+	dat, err := fs.rs.romDB.GetDat(hashes.Sha1)
+	if err != nil {
+		return nil, err
+	}
+
+	if dat == nil {
+		glog.Warningf("did not find a DAT for %s, parsing it", datPath)
+		dat, _, err = parser.Parse(datPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dd = &davDat{
+		modTime: fi.ModTime(),
+		size:    fi.Size(),
+		dat:     dat,
+		games:   make(map[string]*types.Game),
+		dirs:    make(map[string][]string),
+	}
+	dd.dirs[""] = nil
+
+	for _, game := range dat.Games {
+		gamePath := strings.Trim(filepath.ToSlash(game.Name), "/") + davZipSuffix
+		if _, ok := dd.games[gamePath]; ok {
+			continue
+		}
+		dd.games[gamePath] = game
+
+		parent := path.Dir(gamePath)
+		child := path.Base(gamePath)
+		for {
+			if parent == "." {
+				parent = ""
+			}
+			_, seen := dd.dirs[parent]
+			dd.dirs[parent] = append(dd.dirs[parent], child)
+			if parent == "" || seen {
+				break
+			}
+			child = path.Base(parent)
+			parent = path.Dir(parent)
+		}
+	}
+
+	for _, children := range dd.dirs {
+		sort.Strings(children)
+	}
+
+	fs.mutex.Lock()
+	fs.dats[datPath] = dd
+	fs.mutex.Unlock()
+
+	return dd, nil
+}
+
+// davFileInfo describes a directory or a game. The size of a game is only known once
+// its torrentzip has been synthesized. Games opened for reading have measure set, which
+// gets called on first use; elsewhere the size is 0 until the zip has been built.
+type davFileInfo struct {
+	name    string
+	modTime time.Time
+	dir     bool
+	zi      *gameZipInfo
+	measure func() (*gameZipInfo, error)
+	err     error
+}
+
+func (fi *davFileInfo) zipInfo() (*gameZipInfo, error) {
+	if fi.zi == nil && fi.err == nil && fi.measure != nil {
+		fi.zi, fi.err = fi.measure()
+	}
+	return fi.zi, fi.err
+}
+
+func (fi *davFileInfo) Size() int64 {
+	if fi.dir {
+		return 0
+	}
+	zi, err := fi.zipInfo()
+	if err != nil {
+		glog.Errorf("failed to synthesize zip for %s: %v", fi.name, err)
+		return 0
+	}
+	if zi == nil {
+		return 0
+	}
+	return zi.size
+}
+
+func (fi *davFileInfo) Name() string       { return fi.name }
+func (fi *davFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *davFileInfo) IsDir() bool        { return fi.dir }
+func (fi *davFileInfo) Sys() interface{}   { return nil }
+
+func (fi *davFileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0555
+	}
+	return 0444
+}
+
+func (fi *davFileInfo) ETag(ctx context.Context) (string, error) {
+	if fi.dir {
+		return "", webdav.ErrNotImplemented
+	}
+	zi, err := fi.zipInfo()
+	if err != nil {
+		return "", err
+	}
+	if zi == nil {
+		return "", webdav.ErrNotImplemented
+	}
+	return zi.etag(), nil
+}
+
+func (fi *davFileInfo) ContentType(ctx context.Context) (string, error) {
+	if fi.dir {
+		return "", webdav.ErrNotImplemented
+	}
+	return "application/zip", nil
+}
+
+type davDir struct {
+	info    *davFileInfo
+	entries []os.FileInfo
+	pos     int
+}
+
+func (d *davDir) Close() error { return nil }
+
+func (d *davDir) Read(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (d *davDir) Seek(offset int64, whence int) (int64, error) {
+	return 0, os.ErrInvalid
+}
+
+func (d *davDir) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (d *davDir) Stat() (os.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *davDir) Readdir(count int) ([]os.FileInfo, error) {
+	rest := d.entries[d.pos:]
+	if count <= 0 {
+		d.pos = len(d.entries)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(rest) {
+		count = len(rest)
+	}
+	d.pos += count
+	return rest[:count], nil
+}
+
+// davZip serves a synthesized torrentzip. Listings and HEAD requests only stat or seek it,
+// so the temp file holding the zip is built on the first Read and removed on close.
+type davZip struct {
+	fs   *davFS
+	game *types.Game
+	info *davFileInfo
+	file *os.File
+	pos  int64
+}
+
+func (z *davZip) Read(p []byte) (int, error) {
+	if z.file == nil {
+		file, zi, err := buildGameZip(z.fs.rs.depot, z.fs.zips, z.game)
+		if err != nil {
+			return 0, err
+		}
+		z.file = file
+		z.info.zi = zi
+		_, err = z.file.Seek(z.pos, io.SeekStart)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := z.file.Read(p)
+	z.pos += int64(n)
+	return n, err
+}
+
+func (z *davZip) Seek(offset int64, whence int) (int64, error) {
+	if z.file != nil {
+		pos, err := z.file.Seek(offset, whence)
+		if err == nil {
+			z.pos = pos
+		}
+		return pos, err
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += z.pos
+	case io.SeekEnd:
+		zi, err := z.info.zipInfo()
+		if err != nil {
+			return 0, err
+		}
+		if zi == nil {
+			return 0, os.ErrInvalid
+		}
+		offset += zi.size
+	default:
+		return 0, os.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	z.pos = offset
+	return z.pos, nil
+}
+
+func (z *davZip) Close() error {
+	if z.file == nil {
+		return nil
+	}
+	err := z.file.Close()
+	rerr := os.Remove(z.file.Name())
+	if err == nil {
+		err = rerr
+	}
+	return err
+}
+
+func (z *davZip) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+func (z *davZip) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (z *davZip) Stat() (os.FileInfo, error) {
+	return z.info, nil
+}
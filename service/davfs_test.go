@@ -0,0 +1,224 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/config"
+	"github.com/uwedeportivo/romba/db"
+)
+
+func davDatText() string {
+	return `clrmamepro (
+	name "Test Dat"
+)
+
+game (
+	name "baz"
+	` + testRomLine("baz.bin", "baz!") + `
+)
+
+game (
+	name "foo/bar"
+	` + testRomLine("bar.bin", "bar!") + `
+)
+`
+}
+
+func numGameTempFiles(t *testing.T) int {
+	matches, err := filepath.Glob(filepath.Join(config.GlobalConfig.General.TmpDir, "romba-game-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(matches)
+}
+
+func davTestService(t *testing.T) *RombaService {
+	datsDir := filepath.Join(t.TempDir(), "dats")
+	err := os.MkdirAll(filepath.Join(datsDir, "sub"), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(datsDir, "sub", "test.dat"), []byte(davDatText()), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	depot := testDepot(t, map[string]string{
+		"baz.bin": "baz!",
+		"bar.bin": "bar!",
+	})
+
+	return &RombaService{
+		romDB:    new(db.NoOpDB),
+		depot:    depot,
+		dats:     datsDir,
+		gameZips: newGameZipCache(),
+	}
+}
+
+func TestDavFSTree(t *testing.T) {
+	rs := davTestService(t)
+	fs := &davFS{
+		rs:       rs,
+		allGames: false,
+		zips:     rs.gameZips,
+		dats:     make(map[string]*davDat),
+	}
+	ctx := context.Background()
+
+	fi, err := fs.Stat(ctx, "/sub/test")
+	if err != nil {
+		t.Fatalf("stat of dat dir failed: %v", err)
+	}
+	if !fi.IsDir() {
+		t.Fatalf("expected dat to show up as directory")
+	}
+
+	tmpBefore := numGameTempFiles(t)
+
+	fi, err = fs.Stat(ctx, "/sub/test/foo/bar.zip")
+	if err != nil {
+		t.Fatalf("stat of nested game failed: %v", err)
+	}
+	if fi.IsDir() {
+		t.Fatalf("expected game to show up as file")
+	}
+	if fi.Size() != 0 {
+		t.Fatalf("expected stat not to measure the game zip, got size %d", fi.Size())
+	}
+
+	_, err = fs.Stat(ctx, "/sub/test/nope.zip")
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected not exist error, got %v", err)
+	}
+
+	f, err := fs.OpenFile(ctx, "/sub/test", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("open of dat dir failed: %v", err)
+	}
+	fis, err := f.Readdir(0)
+	if err != nil {
+		t.Fatalf("readdir failed: %v", err)
+	}
+	if len(fis) != 2 || fis[0].Name() != "baz.zip" || fis[1].Name() != "foo" || !fis[1].IsDir() {
+		t.Fatalf("unexpected dat dir listing: %v", fis)
+	}
+
+	_, err = fs.OpenFile(ctx, "/sub/test/baz.zip", os.O_RDWR, 0)
+	if err != os.ErrPermission {
+		t.Fatalf("expected permission error for write open, got %v", err)
+	}
+
+	gf, err := fs.OpenFile(ctx, "/sub/test/foo/bar.zip", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("open of game failed: %v", err)
+	}
+	size, err := gf.Seek(0, io.SeekEnd)
+	if err != nil || size <= 0 {
+		t.Fatalf("seek to end returned %d, %v", size, err)
+	}
+	if n := numGameTempFiles(t); n != tmpBefore {
+		t.Fatalf("expected zip not to be built before the first read, found %d temp files", n-tmpBefore)
+	}
+
+	_, err = gf.Seek(0, io.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := ioutil.ReadAll(gf)
+	if err != nil {
+		t.Fatalf("reading game zip failed: %v", err)
+	}
+	if int64(len(bs)) != size || len(bs) < 22 || string(bs[:4]) != "PK\x03\x04" {
+		t.Fatalf("unexpected game zip of %d bytes, seek said %d", len(bs), size)
+	}
+	err = gf.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := numGameTempFiles(t); n != tmpBefore {
+		t.Fatalf("expected temp zip to be removed on close, found %d temp files", n-tmpBefore)
+	}
+	fi, err = fs.Stat(ctx, "/sub/test/foo/bar.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != size {
+		t.Fatalf("expected stat to report the measured size %d, got %d", size, fi.Size())
+	}
+}
+
+func TestDavListing(t *testing.T) {
+	rs := davTestService(t)
+	h := rs.NewWebDAVHandler("/dav", false)
+
+	propfind := func(depth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PROPFIND", "/dav/sub/test/", nil)
+		if depth != "" {
+			req.Header.Set("Depth", depth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, depth := range []string{"", "infinity"} {
+		if w := propfind(depth); w.Code != http.StatusForbidden {
+			t.Fatalf("expected depth %q to be rejected, got status %d", depth, w.Code)
+		}
+	}
+
+	tmpBefore := numGameTempFiles(t)
+
+	w := propfind("1")
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("expected multistatus for depth 1, got status %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "baz.zip") {
+		t.Fatalf("expected baz.zip in listing, got %s", w.Body.String())
+	}
+	if n := numGameTempFiles(t); n != tmpBefore {
+		t.Fatalf("expected listing not to build zips, found %d temp files", n-tmpBefore)
+	}
+	if n := len(rs.gameZips.infos); n != 0 {
+		t.Fatalf("expected listing not to measure zips, found %d measured", n)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"hash/crc32"
+	"testing"
+
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/types"
+)
+
+// testDepot returns a depot holding the given contents, keyed by rom name.
+func testDepot(t *testing.T, files map[string]string) *archive.Depot {
+	depot := archive.NewTestDepot(t, new(db.NoOpDB))
+	for name, content := range files {
+		archive.AddTestRom(t, depot, name, content, true)
+	}
+	return depot
+}
+
+// testRom returns the DAT rom for a rom with the given content.
+func testRom(name, content string) *types.Rom {
+	crc := crc32.ChecksumIEEE([]byte(content))
+	sha1Bytes := sha1.Sum([]byte(content))
+	return &types.Rom{
+		Name: name,
+		Size: int64(len(content)),
+		Crc:  []byte{byte(crc >> 24), byte(crc >> 16), byte(crc >> 8), byte(crc)},
+		Sha1: sha1Bytes[:],
+	}
+}
+
+// testRomLine returns the DAT rom line for a rom with the given content.
+func testRomLine(name, content string) string {
+	return fmt.Sprintf("rom ( name %s size %d crc %08x sha1 %x )", name, len(content),
+		crc32.ChecksumIEEE([]byte(content)), sha1.Sum([]byte(content)))
+}
@@ -56,7 +56,11 @@ func (rs *RombaService) diffdat(cmd *commander.Command, args []string) error {
 	outPath := cmd.Flag.Lookup("out").Value.Get().(string)
 	givenName := cmd.Flag.Lookup("name").Value.Get().(string)
 	givenDescription := cmd.Flag.Lookup("description").Value.Get().(string)
+	format := cmd.Flag.Lookup("format").Value.Get().(string)
 
+	if err := types.CheckFormat(format); err != nil {
+		return err
+	}
 	if oldDatPath == "" {
 		_, err := fmt.Fprintf(cmd.Stdout, "-old argument required")
 		if err != nil {
@@ -99,7 +103,7 @@ func (rs *RombaService) diffdat(cmd *commander.Command, args []string) error {
 		givenDescription = givenName
 	}
 
-	dd, err := dedup.NewLevelDBDeduper()
+	dd, err := dedup.New()
 	if err != nil {
 		return err
 	}
@@ -121,7 +125,7 @@ func (rs *RombaService) diffdat(cmd *commander.Command, args []string) error {
 	}
 
 	diffDat = diffDat.FilterRoms(func(r *types.Rom) bool {
-		return r.Size > 0
+		return r.Size != 0
 	})
 
 	var endMsg string
@@ -150,7 +154,7 @@ func (rs *RombaService) diffdat(cmd *commander.Command, args []string) error {
 			}
 		}()
 
-		err = types.ComposeCompliantDat(diffDat, diffWriter)
+		err = types.ComposeDatAs(diffDat, format, diffWriter)
 		if err != nil {
 			return err
 		}
@@ -228,7 +232,11 @@ func (rs *RombaService) ediffdatWork(cmd *commander.Command, args []string) erro
 	oldDatPath := cmd.Flag.Lookup("old").Value.Get().(string)
 	newDatPath := cmd.Flag.Lookup("new").Value.Get().(string)
 	outPath := cmd.Flag.Lookup("out").Value.Get().(string)
+	format := cmd.Flag.Lookup("format").Value.Get().(string)
 
+	if err := types.CheckFormat(format); err != nil {
+		return err
+	}
 	if oldDatPath == "" {
 		_, err := fmt.Fprintf(cmd.Stdout, "-old argument required")
 		if err != nil {
@@ -258,7 +266,7 @@ func (rs *RombaService) ediffdatWork(cmd *commander.Command, args []string) erro
 
 	glog.Infof("ediffdat new dat %s and old dat %s into %s", newDatPath, oldDatPath, outPath)
 
-	dd, err := dedup.NewLevelDBDeduper()
+	dd, err := dedup.New()
 	if err != nil {
 		return err
 	}
@@ -279,8 +287,7 @@ func (rs *RombaService) ediffdatWork(cmd *commander.Command, args []string) erro
 				return nil
 			}
 
-			ext := filepath.Ext(path)
-			if ext == ".dat" || ext == ".xml" {
+			if parser.IsDatFile(path) {
 				rs.pt.DeclareFile(path)
 
 				_, err := parser.ParseWithListener(path, ipl)
@@ -309,8 +316,7 @@ func (rs *RombaService) ediffdatWork(cmd *commander.Command, args []string) erro
 				return nil
 			}
 
-			ext := filepath.Ext(path)
-			if ext == ".dat" || ext == ".xml" {
+			if parser.IsDatFile(path) {
 				rs.pt.DeclareFile(path)
 
 				ipl := new(dedupParseListener)
@@ -326,7 +332,7 @@ func (rs *RombaService) ediffdatWork(cmd *commander.Command, args []string) erro
 
 				if len(oneDiffDat.Games) > 0 {
 					oneDiffDat = oneDiffDat.FilterRoms(func(r *types.Rom) bool {
-						return r.Size > 0
+						return r.Size != 0
 					})
 					if oneDiffDat != nil {
 						commonRoot := worker.CommonRoot(path, outPath)
@@ -337,7 +343,7 @@ func (rs *RombaService) ediffdatWork(cmd *commander.Command, args []string) erro
 							return err
 						}
 
-						err = writeDat(oneDiffDat, filepath.Join(destDir, oneDiffDat.Name+".dat"))
+						err = writeDat(oneDiffDat, filepath.Join(destDir, oneDiffDat.Name+types.FormatSuffix(format)), format)
 					}
 				}
 
@@ -414,7 +420,7 @@ func (rs *RombaService) ediffdat(cmd *commander.Command, args []string) error {
 	return err
 }
 
-func writeDat(dat *types.Dat, outPath string) error {
+func writeDat(dat *types.Dat, outPath, format string) error {
 	dat.Path = outPath
 
 	file, err := os.Create(outPath)
@@ -436,5 +442,5 @@ func writeDat(dat *types.Dat, outPath string) error {
 		}
 	}()
 
-	return types.ComposeCompliantDat(dat, writer)
+	return types.ComposeDatAs(dat, format, writer)
 }
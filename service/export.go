@@ -73,7 +73,11 @@ func (pgc *progressCombiner) Close() error {
 
 func (rs *RombaService) exportWork(cmd *commander.Command, args []string) error {
 	outPath := cmd.Flag.Lookup("out").Value.Get().(string)
+	format := cmd.Flag.Lookup("format").Value.Get().(string)
 
+	if err := types.CheckFormat(format); err != nil {
+		return err
+	}
 	if outPath == "" {
 		_, err := fmt.Fprintf(cmd.Stdout, "-out argument required")
 		if err != nil {
@@ -89,7 +93,7 @@ func (rs *RombaService) exportWork(cmd *commander.Command, args []string) error
 		return err
 	}
 
-	combiner, err := combine.NewLevelDBCombiner(tempPath)
+	combiner, err := combine.New(tempPath)
 	if err != nil {
 		return err
 	}
@@ -136,12 +140,14 @@ func (rs *RombaService) exportWork(cmd *commander.Command, args []string) error
 		}
 	}()
 
-	err = types.ComposeCompliantDat(exportDat, writer)
-	if err != nil {
-		return err
+	if format == types.FormatXML {
+		err = types.ComposeXMLDatHeader(exportDat, writer)
+	} else {
+		err = types.ComposeCompliantDat(exportDat, writer)
+		if err == nil {
+			_, err = writer.WriteString("\n")
+		}
 	}
-
-	_, err = writer.WriteString("\n")
 	if err != nil {
 		return err
 	}
@@ -157,7 +163,11 @@ func (rs *RombaService) exportWork(cmd *commander.Command, args []string) error
 			exportGame.Name = rom.Name
 			exportGame.Description = rom.Name
 
-			err = types.ComposeGame(exportGame, writer)
+			if format == types.FormatXML {
+				err = types.ComposeXMLGame(exportGame, writer)
+			} else {
+				err = types.ComposeGame(exportGame, writer)
+			}
 			if err != nil {
 				return err
 			}
@@ -170,6 +180,13 @@ func (rs *RombaService) exportWork(cmd *commander.Command, args []string) error
 		return err
 	}
 
+	if format == types.FormatXML {
+		err = types.ComposeXMLDatFooter(writer)
+		if err != nil {
+			return err
+		}
+	}
+
 	var endMsg string
 
 	endMsg = fmt.Sprintf("export finished, %d roms written to exportdat file %s",
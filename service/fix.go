@@ -0,0 +1,176 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/golang/glog"
+	"github.com/uwedeportivo/commander"
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/parser"
+)
+
+func (rs *RombaService) fix(cmd *commander.Command, args []string) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if rs.busy {
+		p := rs.pt.GetProgress()
+
+		_, err := fmt.Fprintf(cmd.Stdout, "still busy with %s: (%d of %d files) and (%s of %s) \n", rs.jobName,
+			p.FilesSoFar, p.TotalFiles, humanize.IBytes(uint64(p.BytesSoFar)), humanize.IBytes(uint64(p.TotalBytes)))
+		return err
+	}
+
+	datPath := cmd.Flag.Lookup("dat").Value.Get().(string)
+	backupPath := cmd.Flag.Lookup("backup").Value.Get().(string)
+	reportPath := cmd.Flag.Lookup("report").Value.Get().(string)
+	dryRun := cmd.Flag.Lookup("dry-run").Value.Get().(bool)
+
+	if datPath == "" {
+		_, err := fmt.Fprintf(cmd.Stdout, "-dat flag is required")
+		return err
+	}
+
+	if len(args) != 1 {
+		_, err := fmt.Fprintf(cmd.Stdout, "expected exactly one set directory")
+		return err
+	}
+
+	setPath, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+
+	setInfo, err := os.Stat(setPath)
+	if err != nil {
+		return err
+	}
+	if !setInfo.IsDir() {
+		return fmt.Errorf("%s is not a directory", setPath)
+	}
+
+	if !dryRun {
+		if backupPath == "" {
+			_, err := fmt.Fprintf(cmd.Stdout, "-backup flag is required unless -dry-run is set")
+			return err
+		}
+		backupPath, err = filepath.Abs(backupPath)
+		if err != nil {
+			return err
+		}
+		if backupPath == setPath || strings.HasPrefix(backupPath, setPath+string(filepath.Separator)) {
+			return fmt.Errorf("backup dir %s must not be inside the set dir %s", backupPath, setPath)
+		}
+	}
+
+	if reportPath == "" {
+		reportPath = filepath.Join(rs.logDir,
+			fmt.Sprintf("fix-%s-%s.txt", strings.TrimSuffix(filepath.Base(datPath), filepath.Ext(datPath)),
+				time.Now().Format(archive.ResumeDateFormat)))
+	}
+
+	dat, _, err := parser.Parse(datPath)
+	if err != nil {
+		return err
+	}
+
+	names, err := nameMapper()
+	if err != nil {
+		return err
+	}
+
+	rs.pt.Reset()
+	rs.busy = true
+	rs.jobName = "fix"
+
+	go func() {
+		glog.Infof("service starting fix")
+		rs.broadCastProgress(time.Now(), true, false, "", nil)
+
+		var endMsg string
+
+		report, err := rs.depot.FixSet(dat, setPath, backupPath, dryRun, names)
+		if err != nil {
+			glog.Errorf("error fixing %s: %v", setPath, err)
+		} else {
+			err = writeFixReport(report, reportPath)
+			if err != nil {
+				glog.Errorf("error writing fix report %s: %v", reportPath, err)
+			}
+			verb := "fixed"
+			if dryRun {
+				verb = "audited"
+			}
+			endMsg = fmt.Sprintf("fix %s %s against %s: %s, report in %s", verb, setPath, dat.Name,
+				report.Summary(), reportPath)
+		}
+
+		rs.jobMutex.Lock()
+		rs.busy = false
+		rs.jobName = ""
+		rs.jobMutex.Unlock()
+
+		rs.broadCastProgress(time.Now(), false, true, endMsg, err)
+		glog.Infof("service finished fix")
+	}()
+
+	_, err = fmt.Fprintf(cmd.Stdout, "started fix")
+	return err
+}
+
+func writeFixReport(report *archive.FixReport, reportPath string) error {
+	reportFile, err := os.Create(reportPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := reportFile.Close()
+		if err != nil {
+			glog.Errorf("error, failed to close %s: %v", reportPath, err)
+		}
+	}()
+
+	reportWriter := bufio.NewWriter(reportFile)
+
+	err = report.Print(reportWriter)
+	if err != nil {
+		return err
+	}
+	return reportWriter.Flush()
+}
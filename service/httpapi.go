@@ -0,0 +1,242 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/uwedeportivo/romba/types"
+)
+
+const romAPIPrefix = "/api/rom/"
+
+func allowGetHead(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == "GET" || r.Method == "HEAD" {
+		return true
+	}
+	w.Header().Set("Allow", "GET, HEAD")
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+func decodeSha1Param(s string) ([]byte, error) {
+	bs, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(bs) != types.KeySizeSha1 {
+		return nil, fmt.Errorf("%s is not a sha1", s)
+	}
+	return bs, nil
+}
+
+func setAttachment(w http.ResponseWriter, filename string) {
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": filename}))
+}
+
+func etagMatches(r *http.Request, etag string) bool {
+	for _, v := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		v = strings.TrimSpace(v)
+		if v == etag || v == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeGame handles GET /api/game?dat=<sha1>&game=<name> and streams the game as a torrentzip
+// built from the depot. Games with roms missing from the depot are refused with 409 unless
+// partial=1 is given, in which case the names of the missing roms are listed in
+// X-Romba-Missing-Rom headers.
+func (rs *RombaService) ServeGame(w http.ResponseWriter, r *http.Request) {
+	if !allowGetHead(w, r) {
+		return
+	}
+
+	datSha1, err := decodeSha1Param(r.FormValue("dat"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	gameName := r.FormValue("game")
+
+	dat, err := rs.romDB.GetDat(datSha1)
+	if err != nil {
+		glog.Errorf("error getting dat %s: %v", r.FormValue("dat"), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if dat == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	var game *types.Game
+	for _, g := range dat.Games {
+		if g.Name == gameName {
+			game = g
+			break
+		}
+	}
+	if game == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	missing, err := rs.depot.MissingGameRoms(game)
+	if err != nil {
+		glog.Errorf("error checking game %s: %v", game.Name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(missing) > 0 {
+		if r.FormValue("partial") != "1" {
+			http.Error(w, fmt.Sprintf("game %s is missing %d of %d roms in the depot",
+				game.Name, len(missing), len(game.Roms)), http.StatusConflict)
+			return
+		}
+		for _, rom := range missing {
+			w.Header().Add("X-Romba-Missing-Rom", rom.Name)
+		}
+	}
+
+	filename := path.Base(strings.Replace(game.Name, "\\", "/", -1)) + ".zip"
+
+	if zi := rs.gameZips.get(game); zi != nil {
+		w.Header().Set("ETag", zi.etag())
+		if etagMatches(r, zi.etag()) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if r.Method == "HEAD" {
+			setAttachment(w, filename)
+			w.Header().Set("Content-Type", "application/zip")
+			w.Header().Set("Content-Length", strconv.FormatInt(zi.size, 10))
+			return
+		}
+	}
+
+	zipFile, zi, err := buildGameZip(rs.depot, rs.gameZips, game)
+	if err != nil {
+		glog.Errorf("error building game %s: %v", game.Name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		zipFile.Close()
+		err := os.Remove(zipFile.Name())
+		if err != nil {
+			glog.Errorf("error, failed to remove %s: %v", zipFile.Name(), err)
+		}
+	}()
+
+	w.Header().Set("ETag", zi.etag())
+	w.Header().Set("Content-Type", "application/zip")
+	setAttachment(w, filename)
+	http.ServeContent(w, r, filename, time.Time{}, zipFile)
+}
+
+// ServeRom handles GET /api/rom/<sha1> and streams the uncompressed rom from the depot.
+func (rs *RombaService) ServeRom(w http.ResponseWriter, r *http.Request) {
+	if !allowGetHead(w, r) {
+		return
+	}
+
+	sha1Hex := strings.ToLower(strings.TrimPrefix(r.URL.Path, romAPIPrefix))
+	sha1Bytes, err := decodeSha1Param(sha1Hex)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	etag := `"` + sha1Hex + `"`
+	w.Header().Set("ETag", etag)
+
+	rr, err := rs.depot.OpenRom(sha1Hex)
+	if err != nil {
+		glog.Errorf("error opening rom %s: %v", sha1Hex, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rr == nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer func() {
+		err := rr.Close()
+		if err != nil {
+			glog.Errorf("error, failed to close rom %s: %v", sha1Hex, err)
+		}
+	}()
+
+	filename, err := rs.romFilename(sha1Bytes)
+	if err != nil {
+		glog.Errorf("error looking up dats for rom %s: %v", sha1Hex, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	setAttachment(w, filename)
+	http.ServeContent(w, r, filename, time.Time{}, rr)
+}
+
+// romFilename picks the rom name from the first DAT referencing the rom, falling back to
+// its SHA1.
+func (rs *RombaService) romFilename(sha1Bytes []byte) (string, error) {
+	dats, err := rs.romDB.DatsForRom(&types.Rom{Sha1: sha1Bytes})
+	if err != nil {
+		return "", err
+	}
+
+	for _, dat := range dats {
+		for _, game := range dat.Games {
+			for _, rom := range game.Roms {
+				if bytes.Equal(rom.Sha1, sha1Bytes) {
+					return path.Base(strings.Replace(rom.Name, "\\", "/", -1)), nil
+				}
+			}
+		}
+	}
+	return hex.EncodeToString(sha1Bytes), nil
+}
@@ -0,0 +1,202 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/types"
+)
+
+// datDB serves a single DAT for every lookup.
+type datDB struct {
+	db.NoOpDB
+	dat *types.Dat
+}
+
+func (ddb *datDB) GetDat(sha1 []byte) (*types.Dat, error) {
+	return ddb.dat, nil
+}
+
+func newTestAPIService(t *testing.T) *RombaService {
+	depot := testDepot(t, map[string]string{
+		"a.bin": "contents of rom a",
+		"b.bin": "contents of rom b, a bit longer",
+	})
+
+	dat := &types.Dat{
+		Name: "test",
+		Games: types.GameSlice{
+			{
+				Name: "complete",
+				Roms: types.RomSlice{
+					testRom("a.bin", "contents of rom a"),
+					testRom("b.bin", "contents of rom b, a bit longer"),
+				},
+			},
+			{
+				Name: "partial",
+				Roms: types.RomSlice{
+					testRom("a.bin", "contents of rom a"),
+					testRom("c.bin", "not in the depot"),
+				},
+			},
+		},
+	}
+
+	return &RombaService{
+		romDB:    &datDB{dat: dat},
+		depot:    depot,
+		gameZips: newGameZipCache(),
+	}
+}
+
+func serveTest(handler http.HandlerFunc, method, target string, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+func gameURL(game string, extra string) string {
+	v := url.Values{}
+	v.Set("dat", hex.EncodeToString(make([]byte, sha1.Size)))
+	v.Set("game", game)
+	return "/api/game?" + v.Encode() + extra
+}
+
+func TestServeGame(t *testing.T) {
+	rs := newTestAPIService(t)
+
+	w := serveTest(rs.ServeGame, "GET", gameURL("complete", ""), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 for complete game, got %d: %s", w.Code, w.Body.String())
+	}
+	full := w.Body.Bytes()
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatalf("expected an ETag for the game zip")
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(full), int64(len(full)))
+	if err != nil {
+		t.Fatalf("served game is not a zip: %v", err)
+	}
+	if len(zr.File) != 2 || zr.File[0].Name != "a.bin" || zr.File[1].Name != "b.bin" {
+		t.Fatalf("unexpected zip entries %v", zr.File)
+	}
+
+	w = serveTest(rs.ServeGame, "GET", gameURL("complete", ""), map[string]string{"If-None-Match": etag})
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("expected 304 for matching ETag, got %d", w.Code)
+	}
+
+	w = serveTest(rs.ServeGame, "HEAD", gameURL("complete", ""), nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Length") != strconv.Itoa(len(full)) {
+		t.Fatalf("unexpected HEAD response %d with length %s, expected %d", w.Code,
+			w.Header().Get("Content-Length"), len(full))
+	}
+
+	w = serveTest(rs.ServeGame, "GET", gameURL("complete", ""), map[string]string{"Range": "bytes=10-29"})
+	if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), full[10:30]) {
+		t.Fatalf("unexpected range response %d: %q", w.Code, w.Body.Bytes())
+	}
+
+	w = serveTest(rs.ServeGame, "GET", gameURL("partial", ""), nil)
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for incomplete game, got %d", w.Code)
+	}
+
+	w = serveTest(rs.ServeGame, "GET", gameURL("partial", "&partial=1"), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 for partial opt-in, got %d", w.Code)
+	}
+	if missing := w.Header()["X-Romba-Missing-Rom"]; len(missing) != 1 || missing[0] != "c.bin" {
+		t.Fatalf("unexpected missing rom header %v", missing)
+	}
+
+	w = serveTest(rs.ServeGame, "GET", gameURL("nope", ""), nil)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown game, got %d", w.Code)
+	}
+}
+
+func TestServeRom(t *testing.T) {
+	rs := newTestAPIService(t)
+
+	content := "contents of rom b, a bit longer"
+	sha1Hex := hex.EncodeToString(testRom("b.bin", content).Sha1)
+
+	w := serveTest(rs.ServeRom, "GET", romAPIPrefix+sha1Hex, nil)
+	if w.Code != http.StatusOK || w.Body.String() != content {
+		t.Fatalf("unexpected rom response %d: %q", w.Code, w.Body.String())
+	}
+
+	w = serveTest(rs.ServeRom, "GET", romAPIPrefix+sha1Hex, map[string]string{"Range": "bytes=12-16"})
+	if w.Code != http.StatusPartialContent || w.Body.String() != content[12:17] {
+		t.Fatalf("unexpected range response %d: %q", w.Code, w.Body.String())
+	}
+
+	// a second range before the first forces the reader to seek backwards
+	w = serveTest(rs.ServeRom, "GET", romAPIPrefix+sha1Hex, map[string]string{"Range": "bytes=20-24,2-5"})
+	if w.Code != http.StatusPartialContent ||
+		!bytes.Contains(w.Body.Bytes(), []byte(content[20:25])) ||
+		!bytes.Contains(w.Body.Bytes(), []byte(content[2:6])) {
+		t.Fatalf("unexpected multi range response %d: %q", w.Code, w.Body.String())
+	}
+
+	w = serveTest(rs.ServeRom, "GET", romAPIPrefix+sha1Hex, map[string]string{"Range": "bytes=-6"})
+	if w.Code != http.StatusPartialContent || w.Body.String() != content[len(content)-6:] {
+		t.Fatalf("unexpected suffix range response %d: %q", w.Code, w.Body.String())
+	}
+
+	w = serveTest(rs.ServeRom, "GET", romAPIPrefix+sha1Hex, map[string]string{"If-None-Match": `"` + sha1Hex + `"`})
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("expected 304 for matching ETag, got %d", w.Code)
+	}
+
+	w = serveTest(rs.ServeRom, "GET", romAPIPrefix+hex.EncodeToString(make([]byte, sha1.Size)), nil)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown rom, got %d", w.Code)
+	}
+}
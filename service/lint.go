@@ -0,0 +1,129 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/karrick/godirwalk"
+
+	"github.com/uwedeportivo/commander"
+	"github.com/uwedeportivo/romba/parser"
+)
+
+func lintDats(root string) ([]string, error) {
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return []string{root}, nil
+	}
+
+	var paths []string
+	err = godirwalk.Walk(root, &godirwalk.Options{
+		Callback: func(path string, info *godirwalk.Dirent) error {
+			if !info.IsDir() && parser.IsDatFile(path) {
+				paths = append(paths, path)
+			}
+			return nil
+		},
+	})
+	return paths, err
+}
+
+func (rs *RombaService) datLint(cmd *commander.Command, args []string) error {
+	jsonOut := cmd.Flag.Lookup("json").Value.Get().(bool)
+	encoding := cmd.Flag.Lookup("encoding").Value.Get().(string)
+
+	if len(args) == 0 {
+		_, err := fmt.Fprintf(cmd.Stdout, "no DAT files or folders specified")
+		if err != nil {
+			return err
+		}
+		return errors.New("missing DAT arguments")
+	}
+
+	if encoding != "" {
+		_, err := parser.EncodingName(encoding)
+		if err != nil {
+			return err
+		}
+	}
+
+	problems := make([]*parser.Problem, 0)
+	numFiles := 0
+
+	for _, arg := range args {
+		paths, err := lintDats(arg)
+		if err != nil {
+			return err
+		}
+		sort.Strings(paths)
+
+		for _, path := range paths {
+			fileProblems, err := parser.Lint(path, encoding)
+			if err != nil {
+				return err
+			}
+			sort.SliceStable(fileProblems, func(i, j int) bool {
+				return fileProblems[i].Line < fileProblems[j].Line
+			})
+			problems = append(problems, fileProblems...)
+			numFiles++
+		}
+	}
+
+	if jsonOut {
+		enc := json.NewEncoder(cmd.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(problems)
+	}
+
+	numErrors := 0
+	for _, pr := range problems {
+		if pr.Severity == parser.SeverityError {
+			numErrors++
+		}
+		_, err := fmt.Fprintln(cmd.Stdout, pr)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := fmt.Fprintf(cmd.Stdout, "linted %d DAT files: %d errors, %d warnings\n",
+		numFiles, numErrors, len(problems)-numErrors)
+	return err
+}
@@ -0,0 +1,387 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/golang/glog"
+	"github.com/uwedeportivo/commander"
+	"github.com/uwedeportivo/romba/archive"
+	"github.com/uwedeportivo/romba/parser"
+	"github.com/uwedeportivo/romba/types"
+	"github.com/uwedeportivo/romba/worker"
+)
+
+type missWorker struct {
+	pm *missGru
+}
+
+func (pw *missWorker) Process(path string, size int64) error {
+	hashes, err := archive.HashesForFile(path)
+	if err != nil {
+		return err
+	}
+
+	dat, err := pw.pm.rs.romDB.GetDat(hashes.Sha1)
+	if err != nil {
+		return err
+	}
+
+	if dat == nil {
+		glog.Warningf("did not find a DAT for %s, parsing it", path)
+		dat, _, err = parser.Parse(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	reldatdir, err := filepath.Rel(pw.pm.commonRootPath, filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+
+	datdir := filepath.Join(pw.pm.outpath, reldatdir)
+	err = os.MkdirAll(datdir, 0777)
+	if err != nil {
+		return err
+	}
+
+	have, miss, err := pw.pm.rs.depot.HaveMiss(dat, pw.pm.bloomOnly)
+	if err != nil {
+		return err
+	}
+
+	ext := ".txt"
+	if pw.pm.csv {
+		ext = ".csv"
+	}
+
+	if pw.pm.form == "game" {
+		// a game only counts as had if none of its roms are missing
+		missing := make(map[string]bool)
+		for _, g := range miss.Games {
+			missing[g.Name] = true
+		}
+		complete := have.Games[:0]
+		for _, g := range have.Games {
+			if !missing[g.Name] {
+				complete = append(complete, g)
+			}
+		}
+		have.Games = complete
+	}
+
+	err = pw.pm.writeList(have, filepath.Join(datdir, dat.Filename()+"_have"+ext))
+	if err != nil {
+		return err
+	}
+	return pw.pm.writeList(miss, filepath.Join(datdir, dat.Filename()+"_miss"+ext))
+}
+
+func (pw *missWorker) Close() error {
+	return nil
+}
+
+type missGru struct {
+	rs             *RombaService
+	numWorkers     int
+	pt             worker.ProgressTracker
+	commonRootPath string
+	outpath        string
+	form           string
+	csv            bool
+	bloomOnly      bool
+}
+
+func (pm *missGru) CalculateWork() bool {
+	return true
+}
+func (pm *missGru) NeedsSizeInfo() bool {
+	return false
+}
+func (pm *missGru) Accept(path string) bool {
+	return parser.IsDatFile(path)
+}
+func (pm *missGru) NewWorker(workerIndex int) worker.Worker {
+	return &missWorker{
+		pm: pm,
+	}
+}
+func (pm *missGru) NumWorkers() int {
+	return pm.numWorkers
+}
+func (pm *missGru) ProgressTracker() worker.ProgressTracker {
+	return pm.pt
+}
+func (pm *missGru) FinishUp() error {
+	return nil
+}
+func (pm *missGru) Start() error {
+	return nil
+}
+func (pm *missGru) Scanned(numFiles int, numBytes int64, commonRootPath string) {
+	pm.commonRootPath = commonRootPath
+	fi, err := os.Stat(pm.commonRootPath)
+	if err != nil {
+		pm.commonRootPath = "/"
+		return
+	}
+	if !fi.IsDir() {
+		pm.commonRootPath = filepath.Dir(pm.commonRootPath)
+	}
+}
+
+func romHash(rom *types.Rom, form string) []byte {
+	switch form {
+	case "sha1":
+		return rom.Sha1
+	case "md5":
+		return rom.Md5
+	case "crc":
+		return rom.Crc
+	}
+	return nil
+}
+
+func gameSize(game *types.Game) int64 {
+	var size int64
+	for _, rom := range game.Roms {
+		if rom.Size > 0 {
+			size += rom.Size
+		}
+	}
+	return size
+}
+
+// writeList writes the games or roms of dat in the form selected by the miss flags. Hash
+// lists have one unique hash per line.
+func (pm *missGru) writeList(dat *types.Dat, outPath string) error {
+	file, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err := file.Close()
+		if err != nil {
+			glog.Errorf("error, failed to close %s: %v", outPath, err)
+		}
+	}()
+
+	bw := bufio.NewWriter(file)
+
+	if pm.csv {
+		err = pm.writeCSV(dat, bw)
+	} else {
+		err = pm.writeText(dat, bw)
+	}
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func (pm *missGru) writeText(dat *types.Dat, w io.Writer) error {
+	seen := make(map[string]bool)
+
+	for _, game := range dat.Games {
+		if pm.form == "game" {
+			_, err := fmt.Fprintln(w, game.Name)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		for _, rom := range game.Roms {
+			var line string
+			if pm.form == "rom" {
+				line = game.Name + "/" + rom.Name
+			} else {
+				h := romHash(rom, pm.form)
+				if h == nil {
+					continue
+				}
+				line = hex.EncodeToString(h)
+				if seen[line] {
+					continue
+				}
+				seen[line] = true
+			}
+			_, err := fmt.Fprintln(w, line)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (pm *missGru) writeCSV(dat *types.Dat, w io.Writer) error {
+	cw := csv.NewWriter(w)
+	seen := make(map[string]bool)
+
+	switch pm.form {
+	case "game":
+		cw.Write([]string{"game", "size"})
+	case "rom":
+		cw.Write([]string{"game", "rom", "size", "crc", "md5", "sha1"})
+	default:
+		cw.Write([]string{pm.form, "size"})
+	}
+
+	for _, game := range dat.Games {
+		if pm.form == "game" {
+			cw.Write([]string{game.Name, strconv.FormatInt(gameSize(game), 10)})
+			continue
+		}
+
+		for _, rom := range game.Roms {
+			size := strconv.FormatInt(rom.Size, 10)
+			if pm.form == "rom" {
+				cw.Write([]string{game.Name, rom.Name, size, hex.EncodeToString(rom.Crc),
+					hex.EncodeToString(rom.Md5), hex.EncodeToString(rom.Sha1)})
+				continue
+			}
+
+			h := romHash(rom, pm.form)
+			if h == nil {
+				continue
+			}
+			hs := hex.EncodeToString(h)
+			if seen[hs] {
+				continue
+			}
+			seen[hs] = true
+			cw.Write([]string{hs, size})
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func (rs *RombaService) miss(cmd *commander.Command, args []string) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if rs.busy {
+		p := rs.pt.GetProgress()
+
+		_, err := fmt.Fprintf(cmd.Stdout, "still busy with %s: (%d of %d files) and (%s of %s) \n", rs.jobName,
+			p.FilesSoFar, p.TotalFiles, humanize.IBytes(uint64(p.BytesSoFar)), humanize.IBytes(uint64(p.TotalBytes)))
+		return err
+	}
+
+	outpath := cmd.Flag.Lookup("out").Value.Get().(string)
+	if outpath == "" {
+		_, err := fmt.Fprintf(cmd.Stdout, "-out flag is required")
+		return err
+	}
+
+	form := cmd.Flag.Lookup("form").Value.Get().(string)
+	switch form {
+	case "game", "rom", "sha1", "md5", "crc":
+	default:
+		_, err := fmt.Fprintf(cmd.Stdout, "-form must be one of game, rom, sha1, md5 or crc")
+		return err
+	}
+
+	outpath, err := filepath.Abs(outpath)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(outpath, 0777); err != nil {
+		return err
+	}
+
+	pm := &missGru{
+		rs:         rs,
+		numWorkers: cmd.Flag.Lookup("workers").Value.Get().(int),
+		pt:         rs.pt,
+		outpath:    outpath,
+		form:       form,
+		csv:        cmd.Flag.Lookup("csv").Value.Get().(bool),
+		bloomOnly:  cmd.Flag.Lookup("bloomOnly").Value.Get().(bool),
+	}
+
+	rs.pt.Reset()
+	rs.busy = true
+	rs.jobName = "miss"
+
+	go func() {
+		glog.Infof("service starting miss")
+		rs.broadCastProgress(time.Now(), true, false, "", nil)
+		ticker := time.NewTicker(time.Second * 5)
+		stopTicker := make(chan bool)
+		go func() {
+			glog.Infof("starting progress broadcaster")
+			for {
+				select {
+				case t := <-ticker.C:
+					rs.broadCastProgress(t, false, false, "", nil)
+				case <-stopTicker:
+					glog.Info("stopped progress broadcaster")
+					return
+				}
+			}
+		}()
+
+		endMsg, err := worker.Work("miss dats", args, pm)
+		if err != nil {
+			glog.Errorf("error creating miss files: %v", err)
+		}
+
+		ticker.Stop()
+		stopTicker <- true
+
+		rs.jobMutex.Lock()
+		rs.busy = false
+		rs.jobName = ""
+		rs.jobMutex.Unlock()
+
+		rs.broadCastProgress(time.Now(), false, true, endMsg, err)
+		glog.Infof("service finished miss")
+	}()
+
+	_, err = fmt.Fprintf(cmd.Stdout, "started miss")
+	return err
+}
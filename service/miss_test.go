@@ -0,0 +1,131 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/uwedeportivo/romba/db"
+)
+
+func TestMissWorker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "miss")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	depot := testDepot(t, map[string]string{"present.bin": "present rom"})
+
+	datsDir := filepath.Join(dir, "dats")
+	err = os.Mkdir(datsDir, 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+	datPath := filepath.Join(datsDir, "test.dat")
+	err = ioutil.WriteFile(datPath, []byte(`clrmamepro (
+	name "test"
+)
+
+game (
+	name "mixed"
+	`+testRomLine("present.bin", "present rom")+`
+	`+testRomLine("missing.bin", "missing rom")+`
+	`+testRomLine("empty.bin", "")+`
+)
+
+game (
+	name "complete"
+	`+testRomLine("present.bin", "present rom")+`
+)
+`), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rs := &RombaService{
+		romDB: new(db.NoOpDB),
+		depot: depot,
+	}
+
+	tests := []struct {
+		form string
+		csv  bool
+		have string
+		miss string
+	}{
+		{"game", false, "complete\n", "mixed\n"},
+		{"rom", false, "complete/present.bin\nmixed/empty.bin\nmixed/present.bin\n", "mixed/missing.bin\n"},
+		{"sha1", false, hex.EncodeToString(testRom("p", "present rom").Sha1) + "\n" + hex.EncodeToString(testRom("e", "").Sha1) + "\n",
+			hex.EncodeToString(testRom("m", "missing rom").Sha1) + "\n"},
+		{"game", true, "game,size\ncomplete,11\n", "game,size\nmixed,11\n"},
+	}
+
+	for _, test := range tests {
+		outpath := filepath.Join(dir, "out-"+test.form)
+		err = os.MkdirAll(outpath, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pm := &missGru{
+			rs:             rs,
+			commonRootPath: datsDir,
+			outpath:        outpath,
+			form:           test.form,
+			csv:            test.csv,
+		}
+		pw := pm.NewWorker(0)
+		err = pw.Process(datPath, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ext := ".txt"
+		if test.csv {
+			ext = ".csv"
+		}
+		for suffix, expected := range map[string]string{"_have": test.have, "_miss": test.miss} {
+			bs, err := ioutil.ReadFile(filepath.Join(outpath, "test.dat"+suffix+ext))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Replace(string(bs), "\r\n", "\n", -1); got != expected {
+				t.Errorf("form %s csv %v: %s list is %q, expected %q", test.form, test.csv, suffix, got, expected)
+			}
+		}
+	}
+}
@@ -98,3 +98,72 @@ func (rs *RombaService) purge(cmd *commander.Command, args []string) error {
 	_, err := fmt.Fprintf(cmd.Stdout, "started purging")
 	return err
 }
+
+func (rs *RombaService) purgeDelete(cmd *commander.Command, args []string) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if rs.busy {
+		p := rs.pt.GetProgress()
+
+		_, err := fmt.Fprintf(cmd.Stdout, "still busy with %s: (%d of %d files) and (%s of %s) \n", rs.jobName,
+			p.FilesSoFar, p.TotalFiles, humanize.IBytes(uint64(p.BytesSoFar)), humanize.IBytes(uint64(p.TotalBytes)))
+		return err
+	}
+
+	keepGenerations := cmd.Flag.Lookup("keep-generations").Value.Get().(int)
+	if keepGenerations < 0 {
+		_, err := fmt.Fprintf(cmd.Stdout, "-keep-generations must not be negative")
+		return err
+	}
+
+	rs.pt.Reset()
+	rs.busy = true
+	rs.jobName = "purge-delete"
+
+	go func() {
+		glog.Infof("service starting purge-delete")
+		rs.broadCastProgress(time.Now(), true, false, "", nil)
+		ticker := time.NewTicker(time.Second * 5)
+		stopTicker := make(chan bool)
+		go func() {
+			glog.Infof("starting progress broadcaster")
+			for {
+				select {
+				case t := <-ticker.C:
+					rs.broadCastProgress(t, false, false, "", nil)
+				case <-stopTicker:
+					glog.Info("stopped progress broadcaster")
+					return
+				}
+			}
+		}()
+
+		var endMsg string
+
+		stats, err := rs.romDB.PurgeDats(int64(keepGenerations))
+		if err != nil {
+			glog.Errorf("error purging dats: %v", err)
+		} else {
+			endMsg = fmt.Sprintf("purge-delete finished, deleted %d dats with %d games and %d rom references"+
+				" (%s of records), db size went from %s to %s",
+				stats.NumDats, stats.NumGames, stats.NumRefs, humanize.IBytes(uint64(stats.RecordBytes)),
+				humanize.IBytes(uint64(stats.DiskBefore)), humanize.IBytes(uint64(stats.DiskAfter)))
+			glog.Info(endMsg)
+		}
+
+		ticker.Stop()
+		stopTicker <- true
+
+		rs.jobMutex.Lock()
+		rs.busy = false
+		rs.jobName = ""
+		rs.jobMutex.Unlock()
+
+		rs.broadCastProgress(time.Now(), false, true, endMsg, err)
+		glog.Infof("service finished purge-delete")
+	}()
+
+	_, err := fmt.Fprintf(cmd.Stdout, "started purge-delete")
+	return err
+}
@@ -38,6 +38,7 @@ import (
 	"github.com/golang/glog"
 	"github.com/uwedeportivo/commander"
 	"github.com/uwedeportivo/romba/db"
+	"github.com/uwedeportivo/romba/parser"
 )
 
 func (rs *RombaService) startRefreshDats(cmd *commander.Command, args []string) error {
@@ -52,6 +53,14 @@ func (rs *RombaService) startRefreshDats(cmd *commander.Command, args []string)
 		return err
 	}
 
+	encoding := cmd.Flag.Lookup("encoding").Value.Get().(string)
+	if encoding != "" {
+		_, err := parser.EncodingName(encoding)
+		if err != nil {
+			return err
+		}
+	}
+
 	rs.pt.Reset()
 	rs.busy = true
 	rs.jobName = "refresh-dats"
@@ -77,7 +86,7 @@ func (rs *RombaService) startRefreshDats(cmd *commander.Command, args []string)
 		numWorkers := cmd.Flag.Lookup("workers").Value.Get().(int)
 		missingSha1s := cmd.Flag.Lookup("missingSha1s").Value.Get().(string)
 
-		endMsg, err := db.Refresh(rs.romDB, rs.dats, numWorkers, rs.pt, missingSha1s)
+		endMsg, err := db.Refresh(rs.romDB, rs.dats, numWorkers, rs.pt, missingSha1s, encoding, rs.depot.HaveRom)
 		if err != nil {
 			glog.Errorf("error refreshing dats: %v", err)
 		}
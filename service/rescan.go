@@ -0,0 +1,122 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package service
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/golang/glog"
+	"github.com/uwedeportivo/commander"
+)
+
+func (rs *RombaService) depotRescan(cmd *commander.Command, args []string) error {
+	rs.jobMutex.Lock()
+	defer rs.jobMutex.Unlock()
+
+	if rs.busy {
+		p := rs.pt.GetProgress()
+
+		_, err := fmt.Fprintf(cmd.Stdout, "still busy with %s: (%d of %d files) and (%s of %s) \n", rs.jobName,
+			p.FilesSoFar, p.TotalFiles, humanize.IBytes(uint64(p.BytesSoFar)), humanize.IBytes(uint64(p.TotalBytes)))
+		return err
+	}
+
+	if len(args) > 1 {
+		_, err := fmt.Fprintf(cmd.Stdout, "depot-rescan takes at most one depot root")
+		return err
+	}
+
+	root := ""
+	if len(args) == 1 {
+		root = args[0]
+	}
+
+	resume := cmd.Flag.Lookup("resume").Value.Get().(string)
+	if resume == "latest" {
+		latestResume, err := findLatestResumeLog("depot-rescan-resume-", rs.logDir)
+		if err != nil {
+			glog.Errorf("error finding the latest resume point: %v", err)
+			return err
+		}
+		resume = latestResume
+		if len(resume) == 0 {
+			glog.Errorf("no resume file found")
+			return errors.New("no resume file found")
+		}
+	}
+
+	rs.pt.Reset()
+	rs.busy = true
+	rs.jobName = "depot-rescan"
+
+	go func() {
+		glog.Infof("service starting depot-rescan")
+		rs.broadCastProgress(time.Now(), true, false, "", nil)
+		ticker := time.NewTicker(time.Second * 5)
+		stopTicker := make(chan bool)
+		go func() {
+			glog.Infof("starting progress broadcaster")
+			for {
+				select {
+				case t := <-ticker.C:
+					rs.broadCastProgress(t, false, false, "", nil)
+				case <-stopTicker:
+					glog.Info("stopped progress broadcaster")
+					return
+				}
+			}
+		}()
+
+		numWorkers := cmd.Flag.Lookup("workers").Value.Get().(int)
+
+		endMsg, err := rs.depot.Rescan(root, resume, numWorkers, rs.logDir, rs.pt)
+		if err != nil {
+			glog.Errorf("error rescanning depot: %v", err)
+		}
+
+		ticker.Stop()
+		stopTicker <- true
+
+		rs.jobMutex.Lock()
+		rs.busy = false
+		rs.jobName = ""
+		rs.jobMutex.Unlock()
+
+		rs.broadCastProgress(time.Now(), false, true, endMsg, err)
+		glog.Infof("service finished depot-rescan")
+	}()
+
+	_, err := fmt.Fprintf(cmd.Stdout, "started depot-rescan")
+	return err
+}
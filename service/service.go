@@ -81,6 +81,7 @@ type RombaService struct {
 	jobName           string
 	progressMutex     *sync.Mutex
 	progressListeners map[string]chan *ProgressNessage
+	gameZips          *gameZipCache
 }
 
 type TerminalRequest struct {
@@ -103,6 +104,7 @@ func NewRombaService(romDB db.RomDB, depot *archive.Depot, cfg *config.Config) *
 	rs.jobMutex = new(sync.Mutex)
 	rs.progressMutex = new(sync.Mutex)
 	rs.progressListeners = make(map[string]chan *ProgressNessage)
+	rs.gameZips = newGameZipCache()
 	glog.Info("Service init finished")
 	return rs
 }
@@ -144,7 +144,7 @@ func (rs *RombaService) datstats(cmd *commander.Command, args []string) error {
 			}
 		}()
 
-		deduper, err := dedup.NewLevelDBDeduper()
+		deduper, err := dedup.New()
 		if err != nil {
 			glog.Errorf("error datstats: %v", err)
 			rs.broadCastProgress(time.Now(), false, true, "error collecting datstats", err)
@@ -31,15 +31,44 @@ OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
 package types
 
 import (
+	"encoding/binary"
+
 	"github.com/uwedeportivo/romba/util"
 )
 
 const (
-	KeySizeCrc  = 4
-	KeySizeMd5  = 16
-	KeySizeSha1 = 20
+	KeySizeCrc       = 4
+	KeySizeMd5       = 16
+	KeySizeSha1      = 20
+	KeySizeGameIndex = 4
 )
 
+// GameKey is the key of the game with the given index in the DAT with SHA1 datSha1.
+func GameKey(datSha1 []byte, index int) []byte {
+	key := make([]byte, KeySizeSha1+KeySizeGameIndex)
+	copy(key[:KeySizeSha1], datSha1)
+	binary.BigEndian.PutUint32(key[KeySizeSha1:], uint32(index))
+	return key
+}
+
+// GameIndex returns the game index at the end of a key built with GameKey or
+// one of the Rom game reference keys.
+func GameIndex(key []byte) int {
+	return int(binary.BigEndian.Uint32(key[len(key)-KeySizeGameIndex:]))
+}
+
+func gameRefKey(prefix, datSha1 []byte, index int) []byte {
+	if prefix == nil || datSha1 == nil {
+		return nil
+	}
+
+	n := len(prefix)
+	key := make([]byte, n+KeySizeSha1+KeySizeGameIndex)
+	copy(key[:n], prefix)
+	copy(key[n:], GameKey(datSha1, index))
+	return key
+}
+
 func (ar *Rom) CrcWithSizeKey() []byte {
 	if ar.Crc == nil {
 		return nil
@@ -106,3 +135,21 @@ func (ar *Rom) Sha1Sha1Key(sha1Bytes []byte) []byte {
 	copy(key[KeySizeSha1:], sha1Bytes)
 	return key
 }
+
+// Sha1GameKey references the game with the given index in the DAT with SHA1 datSha1
+// from the rom's SHA1.
+func (ar *Rom) Sha1GameKey(datSha1 []byte, index int) []byte {
+	return gameRefKey(ar.Sha1, datSha1, index)
+}
+
+// Md5WithSizeGameKey references the game with the given index in the DAT with SHA1
+// datSha1 from the rom's MD5 and size.
+func (ar *Rom) Md5WithSizeGameKey(datSha1 []byte, index int) []byte {
+	return gameRefKey(ar.Md5WithSizeKey(), datSha1, index)
+}
+
+// CrcWithSizeGameKey references the game with the given index in the DAT with SHA1
+// datSha1 from the rom's CRC and size.
+func (ar *Rom) CrcWithSizeGameKey(datSha1 []byte, index int) []byte {
+	return gameRefKey(ar.CrcWithSizeKey(), datSha1, index)
+}
@@ -0,0 +1,335 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package types
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// illegalNameChars are the characters besides path separators and control
+// characters that FAT, exFAT and NTFS don't allow in names.
+const illegalNameChars = `<>:"|?*`
+
+// defaultNameReplacement replaces illegal characters unless configured
+// otherwise.
+const defaultNameReplacement = "_"
+
+var reservedNames = map[string]bool{
+	"con": true, "prn": true, "aux": true, "nul": true,
+	"com1": true, "com2": true, "com3": true, "com4": true, "com5": true,
+	"com6": true, "com7": true, "com8": true, "com9": true,
+	"lpt1": true, "lpt2": true, "lpt3": true, "lpt4": true, "lpt5": true,
+	"lpt6": true, "lpt7": true, "lpt8": true, "lpt9": true,
+}
+
+// escapeReason returns why a game or rom called name would end up outside the
+// folder it is built into, or an empty string if it wouldn't. Drive letters
+// are harmless once the colon is mapped.
+func escapeReason(name string) string {
+	if name == "" {
+		return "is empty"
+	}
+
+	slashed := strings.Replace(name, "\\", "/", -1)
+	if strings.HasPrefix(slashed, "/") {
+		return "is an absolute path"
+	}
+	for _, part := range strings.Split(slashed, "/") {
+		if part == ".." {
+			return "leaves its parent directory"
+		}
+	}
+	return ""
+}
+
+// UnsafeNameReason returns why name can't be used as is for the files and
+// directories build writes, or an empty string if it can.
+func UnsafeNameReason(name string) string {
+	if reason := escapeReason(name); reason != "" {
+		return reason
+	}
+	if len(name) > 1 && name[1] == ':' {
+		return "is an absolute path"
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return "contains control characters"
+		}
+		if strings.ContainsRune(illegalNameChars, r) {
+			return fmt.Sprintf("contains %q, which is illegal on Windows file systems", r)
+		}
+	}
+	return ""
+}
+
+// Rename records a DAT, game or rom name that was changed to make it usable
+// as a path. Rom is empty for renamed games and Game for a renamed DAT.
+type Rename struct {
+	Dat    string `json:"dat,omitempty"`
+	Game   string `json:"game,omitempty"`
+	Rom    string `json:"rom,omitempty"`
+	To     string `json:"to"`
+	Reason string `json:"reason"`
+}
+
+func (r *Rename) String() string {
+	if r.Dat != "" {
+		return fmt.Sprintf("dat %s renamed to %s: %s", r.Dat, r.To, r.Reason)
+	}
+	if r.Rom != "" {
+		return fmt.Sprintf("rom %s of game %s renamed to %s: %s", r.Rom, r.Game, r.To, r.Reason)
+	}
+	return fmt.Sprintf("game %s renamed to %s: %s", r.Game, r.To, r.Reason)
+}
+
+// NameMapper turns game and rom names of DATs into names that are safe to
+// use as paths on FAT, exFAT and NTFS file systems and don't collide on case
+// insensitive ones.
+type NameMapper struct {
+	replacement string
+	mapped      map[rune]string
+}
+
+// NewNameMapper returns a NameMapper that replaces characters illegal on
+// Windows file systems with replacement, or with _ if replacement is empty.
+// Each of mappings has the form c=r and replaces the character c with r
+// instead, e.g. :=- or ?= to drop question marks.
+func NewNameMapper(replacement string, mappings []string) (*NameMapper, error) {
+	if replacement == "" {
+		replacement = defaultNameReplacement
+	}
+
+	nm := &NameMapper{
+		replacement: replacement,
+		mapped:      make(map[rune]string),
+	}
+
+	if reason := nm.unsafeReplacement(replacement); reason != "" {
+		return nil, fmt.Errorf("replacement %q %s", replacement, reason)
+	}
+
+	for _, m := range mappings {
+		c, size := utf8.DecodeRuneInString(m)
+		if size == 0 || !strings.HasPrefix(m[size:], "=") {
+			return nil, fmt.Errorf("name mapping %q is not of the form c=r", m)
+		}
+		r := m[size+1:]
+		if reason := nm.unsafeReplacement(r); reason != "" {
+			return nil, fmt.Errorf("name mapping %q %s", m, reason)
+		}
+		nm.mapped[c] = r
+	}
+	return nm, nil
+}
+
+func (nm *NameMapper) unsafeReplacement(r string) string {
+	if strings.ContainsAny(r, "/\\") {
+		return "contains a path separator"
+	}
+	if r != "" && UnsafeNameReason(r) != "" {
+		return "contains illegal characters"
+	}
+	return ""
+}
+
+// MapName returns name with / as path separator, converted to NFC and with
+// illegal characters, trailing dots and spaces and reserved device names
+// replaced. The reason is empty if name didn't need any of that besides
+// changing separators.
+func (nm *NameMapper) MapName(name string) (string, string) {
+	var reason string
+
+	nfc := norm.NFC.String(name)
+	if nfc != name {
+		reason = "converted to NFC"
+	}
+
+	parts := strings.FieldsFunc(nfc, func(r rune) bool {
+		return r == '/' || r == '\\'
+	})
+
+	mappedParts := make([]string, 0, len(parts))
+	for _, part := range parts {
+		if part == "." {
+			continue
+		}
+		mapped, partReason := nm.mapPart(part)
+		if reason == "" {
+			reason = partReason
+		}
+		mappedParts = append(mappedParts, mapped)
+	}
+	return strings.Join(mappedParts, "/"), reason
+}
+
+func (nm *NameMapper) mapPart(part string) (string, string) {
+	var reason string
+	var sb strings.Builder
+
+	for _, r := range part {
+		if v, ok := nm.mapped[r]; ok {
+			sb.WriteString(v)
+			reason = "contains illegal characters"
+		} else if unicode.IsControl(r) || strings.ContainsRune(illegalNameChars, r) {
+			sb.WriteString(nm.replacement)
+			reason = "contains illegal characters"
+		} else {
+			sb.WriteRune(r)
+		}
+	}
+	mapped := sb.String()
+
+	if trimmed := strings.TrimRight(mapped, ". "); trimmed != mapped {
+		mapped = trimmed + nm.replacement
+		if reason == "" {
+			reason = "ends in a dot or space"
+		}
+	}
+
+	if reservedNames[strings.ToLower(strings.SplitN(mapped, ".", 2)[0])] {
+		mapped = nm.replacement + mapped
+		if reason == "" {
+			reason = "is a reserved device name"
+		}
+	}
+	return mapped, reason
+}
+
+// claimName reserves name in taken, a set of names that must not collide on a
+// case insensitive file system. If name is taken already, a number is added
+// to it, before the extension if withExt is set. It returns the name claimed
+// and the name it collided with.
+func claimName(taken map[string]string, name, original string, withExt bool) (string, string) {
+	key := strings.ToLower(name)
+	other, ok := taken[key]
+	if !ok {
+		taken[key] = original
+		return name, ""
+	}
+
+	stem, ext := name, ""
+	if withExt {
+		ext = path.Ext(name)
+		stem = strings.TrimSuffix(name, ext)
+	}
+	for i := 2; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", stem, i, ext)
+		key = strings.ToLower(candidate)
+		if _, ok := taken[key]; !ok {
+			taken[key] = original
+			return candidate, other
+		}
+	}
+}
+
+// SanitizeDat returns a copy of dat with all game and rom names mapped by nm
+// and names that collide within the DAT, or within a game for roms, made
+// unique. Every name that changed is listed in the renames. Names that would
+// end up outside the output folder are rejected with an error.
+func (nm *NameMapper) SanitizeDat(dat *Dat) (*Dat, []*Rename, error) {
+	sd := new(Dat)
+	*sd = *dat
+	sd.Games = make(GameSlice, 0, len(dat.Games))
+
+	var renames []*Rename
+
+	// the DAT is built into a single folder named after it
+	name, reason := nm.mapPart(strings.NewReplacer("/", nm.replacement, "\\", nm.replacement).Replace(
+		norm.NFC.String(dat.Name)))
+	if name != dat.Name {
+		switch {
+		case strings.ContainsAny(dat.Name, "/\\"):
+			reason = "contains path separators"
+		case reason == "":
+			reason = "converted to NFC"
+		}
+		sd.Name = name
+		renames = append(renames, &Rename{Dat: dat.Name, To: name, Reason: reason})
+	}
+
+	games := make(map[string]string)
+
+	for _, g := range dat.Games {
+		if reason := escapeReason(g.Name); reason != "" {
+			return nil, nil, fmt.Errorf("dat %s: game name %q %s", dat.Name, g.Name, reason)
+		}
+
+		sg := new(Game)
+		*sg = *g
+
+		name, reason := nm.MapName(g.Name)
+		if name == "" {
+			return nil, nil, fmt.Errorf("dat %s: game name %q is empty as a path", dat.Name, g.Name)
+		}
+		name, other := claimName(games, name, g.Name, false)
+		if other != "" {
+			reason = fmt.Sprintf("collides with game %s", other)
+		}
+		sg.Name = name
+		if reason != "" {
+			renames = append(renames, &Rename{Game: g.Name, To: name, Reason: reason})
+		}
+
+		sg.Roms = make(RomSlice, 0, len(g.Roms))
+		roms := make(map[string]string)
+
+		for _, r := range g.Roms {
+			if reason := escapeReason(r.Name); reason != "" {
+				return nil, nil, fmt.Errorf("dat %s: rom name %q of game %s %s", dat.Name, r.Name, g.Name, reason)
+			}
+
+			sr := new(Rom)
+			*sr = *r
+
+			name, reason := nm.MapName(r.Name)
+			if name == "" {
+				return nil, nil, fmt.Errorf("dat %s: rom name %q of game %s is empty as a path", dat.Name, r.Name, g.Name)
+			}
+			name, other := claimName(roms, name, r.Name, true)
+			if other != "" {
+				reason = fmt.Sprintf("collides with rom %s", other)
+			}
+			sr.Name = name
+			if reason != "" {
+				renames = append(renames, &Rename{Game: g.Name, Rom: r.Name, To: name, Reason: reason})
+			}
+			sg.Roms = append(sg.Roms, sr)
+		}
+		sd.Games = append(sd.Games, sg)
+	}
+	return sd, renames, nil
+}
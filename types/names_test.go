@@ -0,0 +1,128 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package types
+
+import (
+	"testing"
+)
+
+func TestMapName(t *testing.T) {
+	nm, err := NewNameMapper("", []string{":=-", "?="})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		mapped string
+		change bool
+	}{
+		{"Tetris (World)", "Tetris (World)", false},
+		{"dir\\rom.bin", "dir/rom.bin", false},
+		{"Zelda: A Link to the Past", "Zelda- A Link to the Past", true},
+		{"Who? Me", "Who Me", true},
+		{"a<b>|c*", "a_b__c_", true},
+		{"tab\there", "tab_here", true},
+		{"trailing. ", "trailing_", true},
+		{"con.txt", "_con.txt", true},
+		{"Pokemon/Poke\u0301mon", "Pokemon/Pok\u00e9mon", true},
+	}
+
+	for _, test := range tests {
+		mapped, reason := nm.MapName(test.name)
+		if mapped != test.mapped || (reason != "") != test.change {
+			t.Errorf("%q: got %q (reason %q), want %q", test.name, mapped, reason, test.mapped)
+		}
+	}
+
+	_, err = NewNameMapper("/", nil)
+	if err == nil {
+		t.Errorf("expected error for replacement with a path separator")
+	}
+	_, err = NewNameMapper("", []string{":"})
+	if err == nil {
+		t.Errorf("expected error for mapping without replacement")
+	}
+}
+
+func TestSanitizeDat(t *testing.T) {
+	nm, err := NewNameMapper("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dat := &Dat{
+		Name: "Nintendo - Game Boy",
+		Games: GameSlice{
+			{Name: "Tetris", Roms: RomSlice{{Name: "tetris.gb"}, {Name: "TETRIS.GB"}, {Name: "Tetris.gb"}}},
+			{Name: "tetris", Roms: RomSlice{{Name: "a.gb"}}},
+			{Name: "Caf\u0065\u0301", Roms: RomSlice{{Name: "b:c.gb"}}},
+		},
+	}
+
+	sd, renames, err := nm.SanitizeDat(dat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"Tetris", "tetris (2)", "Caf\u00e9"}
+	for i, g := range sd.Games {
+		if g.Name != want[i] {
+			t.Errorf("game %d: got name %q, want %q", i, g.Name, want[i])
+		}
+	}
+	wantRoms := []string{"tetris.gb", "TETRIS (2).GB", "Tetris (3).gb"}
+	for i, r := range sd.Games[0].Roms {
+		if r.Name != wantRoms[i] {
+			t.Errorf("rom %d: got name %q, want %q", i, r.Name, wantRoms[i])
+		}
+	}
+	if sd.Games[2].Roms[0].Name != "b_c.gb" {
+		t.Errorf("got rom name %q, want b_c.gb", sd.Games[2].Roms[0].Name)
+	}
+	if len(renames) != 5 {
+		t.Errorf("got %d renames, want 5: %v", len(renames), renames)
+	}
+	if dat.Games[1].Name != "tetris" || dat.Games[0].Roms[1].Name != "TETRIS.GB" {
+		t.Errorf("sanitizing changed the original DAT")
+	}
+
+	for _, bad := range []string{"../evil", "a/../../evil", "/etc/passwd", "\\evil", "..\\evil"} {
+		_, _, err = nm.SanitizeDat(&Dat{Games: GameSlice{{Name: "g", Roms: RomSlice{{Name: bad}}}}})
+		if err == nil {
+			t.Errorf("rom name %q: expected an error", bad)
+		}
+		_, _, err = nm.SanitizeDat(&Dat{Games: GameSlice{{Name: bad}}})
+		if err == nil {
+			t.Errorf("game name %q: expected an error", bad)
+		}
+	}
+}
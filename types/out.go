@@ -41,51 +41,48 @@ import (
 const datTemplate = `
 dat (
 	name "{{.Name}}"
-	description "{{omitQuote .Description}}"
-	{{if .FixDat}}category "FIXDATFILE"{{end}}
+	description "{{omitQuote .Description}}"{{datheader .}}
 	path "{{.Path}}"
 	{{if .UnzipGames}}forcezipping "no"{{end}}
 )
 {{with .Games}}{{range .}}
-game (
-	name "{{.Name}}"
-	description "{{omitQuote .Description}}"
+{{gamekind .}} (
+	name "{{.Name}}"{{gameparents .}}
+	description "{{omitQuote .Description}}"{{gameinfo .}}
 	{{with .Roms}}{{range .}}
-	rom ( name "{{.Name}}" size {{.Size}}{{hexcrc .Crc}}{{hexmd5 .Md5}}{{hexsha1 .Sha1}} ){{end}}{{end}}
+	rom ( name "{{.Name}}" size {{.Size}}{{hexcrc .Crc}}{{hexmd5 .Md5}}{{hexsha1 .Sha1}}{{romextras .}} ){{end}}{{end}}{{gametrailer .}}
 ){{end}}{{end}}
 `
 
 const compliantDatTemplate = `clrmamepro (
 	name "{{.Name}}"
-	description "{{omitQuote .Description}}"
-	{{if .FixDat}}category "FIXDATFILE"{{end}}
+	description "{{omitQuote .Description}}"{{datheader .}}
 	{{if .UnzipGames}}forcezipping "no"{{end}}
 ){{with .Games}}{{range .}}
-game (
-	name "{{.Name}}"
-	description "{{omitQuote .Description}}"
+{{gamekind .}} (
+	name "{{.Name}}"{{gameparents .}}
+	description "{{omitQuote .Description}}"{{gameinfo .}}
 	{{with .Roms}}{{range .}}
-	rom ( name "{{.Name}}" size {{.Size}}{{hexcrc .Crc}}{{hexmd5 .Md5}}{{hexsha1 .Sha1}} ){{end}}{{end}}
+	rom ( name "{{.Name}}" size {{.Size}}{{hexcrc .Crc}}{{hexmd5 .Md5}}{{hexsha1 .Sha1}}{{romextras .}} ){{end}}{{end}}{{gametrailer .}}
 ){{end}}{{end}}
 `
 
 const romTemplate = `
-rom ( name "{{.Name}}" size {{.Size}}{{hexcrc .Crc}}{{hexmd5 .Md5}}{{hexsha1 .Sha1}} )
+rom ( name "{{.Name}}" size {{.Size}}{{hexcrc .Crc}}{{hexmd5 .Md5}}{{hexsha1 .Sha1}}{{romextras .}} )
 `
 
-const gameTemplate = `game (
-	name "{{.Name}}"
-	description "{{omitQuote .Description}}"
+const gameTemplate = `{{gamekind .}} (
+	name "{{.Name}}"{{gameparents .}}
+	description "{{omitQuote .Description}}"{{gameinfo .}}
 	{{with .Roms}}{{range .}}
-	rom ( name "{{.Name}}" size {{.Size}}{{hexcrc .Crc}}{{hexmd5 .Md5}}{{hexsha1 .Sha1}} ){{end}}{{end}}
+	rom ( name "{{.Name}}" size {{.Size}}{{hexcrc .Crc}}{{hexmd5 .Md5}}{{hexsha1 .Sha1}}{{romextras .}} ){{end}}{{end}}{{gametrailer .}}
 )
 `
 
 const datShortTemplate = `
 dat (
 	name "{{.Name}}"
-	description "{{omitQuote .Description}}"
-	{{if .FixDat}}category "FIXDATFILE"{{end}}
+	description "{{omitQuote .Description}}"{{datheader .}}
 	path "{{.Path}}"
 	{{if .UnzipGames}}forcezipping "no"{{end}}
 )
@@ -99,8 +96,7 @@ const datsTemplate = `
 {{range .}}
 dat (
 	name "{{.Name}}"
-	description "{{omitQuote .Description}}"
-	{{if .FixDat}}category "FIXDATFILE"{{end}}
+	description "{{omitQuote .Description}}"{{datheader .}}
 	path "{{.Path}}"
 	{{if .UnzipGames}}forcezipping "no"{{end}}
 )
@@ -135,11 +131,101 @@ func omitQuote(v string) string {
 	}, v)
 }
 
+func attrstr(which, v string) string {
+	if v == "" {
+		return ""
+	}
+	return " " + which + " \"" + omitQuote(v) + "\""
+}
+
+func datHeader(d *Dat) string {
+	category := d.Category
+	if d.FixDat {
+		category = "FIXDATFILE"
+	}
+	return gameLine("version", d.Version) + gameLine("author", d.Author) +
+		gameLine("date", d.Date) + gameLine("homepage", d.Homepage) +
+		gameLine("url", d.Url) + gameLine("category", category) +
+		gameLine("comment", d.Comment)
+}
+
+func gameLine(which, v string) string {
+	if v == "" {
+		return ""
+	}
+	return "\n\t" + which + " \"" + omitQuote(v) + "\""
+}
+
+func gameParents(g *Game) string {
+	return gameLine("cloneof", g.CloneOf) + gameLine("romof", g.RomOf) + gameLine("sampleof", g.SampleOf)
+}
+
+func gameKind(g *Game) string {
+	if g.Bios() {
+		return "resource"
+	}
+	return "game"
+}
+
+func gameInfo(g *Game) string {
+	s := gameLine("year", g.Year) + gameLine("manufacturer", g.Manufacturer)
+	for _, bs := range g.BiosSets {
+		s += "\n\tbiosset ( name \"" + omitQuote(bs.Name) + "\"" + attrstr("description", bs.Description)
+		if bs.Default != "" {
+			s += " default " + bs.Default
+		}
+		s += " )"
+	}
+	return s
+}
+
+func gameTrailer(g *Game) string {
+	var sb strings.Builder
+	for _, d := range g.Disks {
+		sb.WriteString("\n\tdisk ( name \"" + omitQuote(d.Name) + "\"")
+		sb.WriteString(hexstr("sha1", d.Sha1))
+		sb.WriteString(hexstr("md5", d.Md5))
+		sb.WriteString(attrstr("merge", d.Merge))
+		sb.WriteString(attrstr("region", d.Region))
+		if d.Index != "" {
+			sb.WriteString(" index " + d.Index)
+		}
+		if d.Status != "" && d.Status != "good" {
+			sb.WriteString(" flags " + d.Status)
+		}
+		sb.WriteString(" )")
+	}
+	for _, dr := range g.DeviceRefs {
+		sb.WriteString(gameLine("device_ref", dr.Name))
+	}
+	for _, s := range g.Samples {
+		sb.WriteString(gameLine("sample", s.Name))
+	}
+	return sb.String()
+}
+
+func romExtras(r *Rom) string {
+	s := attrstr("merge", r.Merge) + attrstr("bios", r.Bios) + attrstr("region", r.Region)
+	if r.Offset != "" {
+		s += " offset " + r.Offset
+	}
+	if r.Status != "" && r.Status != "good" {
+		s += " flags " + r.Status
+	}
+	return s
+}
+
 var ff = template.FuncMap{
-	"hexcrc":    crcstr,
-	"hexmd5":    md5str,
-	"hexsha1":   sha1str,
-	"omitQuote": omitQuote,
+	"hexcrc":      crcstr,
+	"hexmd5":      md5str,
+	"hexsha1":     sha1str,
+	"omitQuote":   omitQuote,
+	"datheader":   datHeader,
+	"gamekind":    gameKind,
+	"gameparents": gameParents,
+	"gameinfo":    gameInfo,
+	"gametrailer": gameTrailer,
+	"romextras":   romExtras,
 }
 
 var dt = template.Must(template.New("datout").Funcs(ff).Parse(datTemplate))
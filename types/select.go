@@ -0,0 +1,256 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package types
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// GameFilter selects a subset of the games in a DAT. Include and Exclude are matched
+// against game names. If Priority is set only the best game per title is kept, ranked
+// by the first region or language tag that appears in Priority. Games without any of
+// those tags rank last but are still kept if nothing better is available.
+type GameFilter struct {
+	Include       *regexp.Regexp
+	Exclude       *regexp.Regexp
+	ExcludeClones bool
+	Priority      []string
+}
+
+// NewGameFilter builds a GameFilter from command line style arguments. priority is a comma
+// separated list like "USA,Europe,World,Japan".
+func NewGameFilter(include, exclude string, excludeClones bool, priority string) (*GameFilter, error) {
+	gf := &GameFilter{
+		ExcludeClones: excludeClones,
+	}
+
+	var err error
+	if include != "" {
+		gf.Include, err = regexp.Compile(include)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if exclude != "" {
+		gf.Exclude, err = regexp.Compile(exclude)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, p := range strings.Split(priority, ",") {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			gf.Priority = append(gf.Priority, p)
+		}
+	}
+	return gf, nil
+}
+
+// Active reports whether the filter would drop anything at all.
+func (gf *GameFilter) Active() bool {
+	return gf != nil && (gf.Include != nil || gf.Exclude != nil || gf.ExcludeClones || len(gf.Priority) > 0)
+}
+
+func (gf *GameFilter) String() string {
+	var parts []string
+	if gf.Include != nil {
+		parts = append(parts, "include "+gf.Include.String())
+	}
+	if gf.Exclude != nil {
+		parts = append(parts, "exclude "+gf.Exclude.String())
+	}
+	if gf.ExcludeClones {
+		parts = append(parts, "no clones")
+	}
+	if len(gf.Priority) > 0 {
+		parts = append(parts, "1G1R "+strings.Join(gf.Priority, ","))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Apply returns a new DAT with the header of dat and the selected games.
+func (gf *GameFilter) Apply(dat *Dat) *Dat {
+	res := new(Dat)
+	res.CopyHeader(dat)
+
+	hasClones := false
+	for _, g := range dat.Games {
+		if g.CloneOf != "" {
+			hasClones = true
+			break
+		}
+	}
+
+	var candidates []*Game
+	for _, g := range dat.Games {
+		if gf.Include != nil && !gf.Include.MatchString(g.Name) {
+			continue
+		}
+		if gf.Exclude != nil && gf.Exclude.MatchString(g.Name) {
+			continue
+		}
+		if gf.ExcludeClones && g.CloneOf != "" {
+			continue
+		}
+		candidates = append(candidates, g)
+	}
+
+	if len(gf.Priority) == 0 {
+		res.Games = candidates
+		return res
+	}
+
+	groups := make(map[string][]*Game)
+	var order []string
+	for _, g := range candidates {
+		var key string
+		if hasClones {
+			key = g.Name
+			if g.CloneOf != "" {
+				key = g.CloneOf
+			}
+		} else {
+			key = strings.ToLower(ParseTitle(g.Name).Base)
+		}
+		if _, ok := groups[key]; !ok {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], g)
+	}
+
+	for _, key := range order {
+		if best := gf.best(groups[key]); best != nil {
+			res.Games = append(res.Games, best)
+		}
+	}
+	return res
+}
+
+func (gf *GameFilter) priorityOf(ti *TitleInfo) int {
+	for i, p := range gf.Priority {
+		for _, tag := range ti.Tags {
+			if strings.EqualFold(tag, p) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+type rankedGame struct {
+	game     *Game
+	priority int
+	info     *TitleInfo
+	index    int
+}
+
+func (gf *GameFilter) best(games []*Game) *Game {
+	var ranked []*rankedGame
+	for i, g := range games {
+		ti := ParseTitle(g.Name)
+		p := gf.priorityOf(ti)
+		if p < 0 {
+			p = len(gf.Priority)
+		}
+		ranked = append(ranked, &rankedGame{game: g, priority: p, info: ti, index: i})
+	}
+
+	if len(ranked) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		if a.priority != b.priority {
+			return a.priority < b.priority
+		}
+		if a.info.Prerelease != b.info.Prerelease {
+			return !a.info.Prerelease
+		}
+		if a.info.Revision != b.info.Revision {
+			return a.info.Revision > b.info.Revision
+		}
+		if (a.game.CloneOf == "") != (b.game.CloneOf == "") {
+			return a.game.CloneOf == ""
+		}
+		return a.index < b.index
+	})
+	return ranked[0].game
+}
+
+// TitleInfo is what we can tell from a No-Intro style game name like
+// "Title (USA, Europe) (En,Fr) (Rev 1)".
+type TitleInfo struct {
+	Base       string
+	Tags       []string
+	Prerelease bool
+	Revision   int
+}
+
+var (
+	titleTagRE   = regexp.MustCompile(`\(([^)]*)\)`)
+	revisionRE   = regexp.MustCompile(`^(?:Rev|v)\s*([0-9]+)(?:\.([0-9]+))?`)
+	prereleaseRE = regexp.MustCompile(`^(?i:beta|proto|prototype|demo|sample|alpha|preview)\b`)
+)
+
+func ParseTitle(name string) *TitleInfo {
+	ti := new(TitleInfo)
+
+	base := name
+	if i := strings.IndexAny(name, "(["); i >= 0 {
+		base = name[:i]
+	}
+	ti.Base = strings.TrimSpace(base)
+
+	for _, m := range titleTagRE.FindAllStringSubmatch(name, -1) {
+		for _, tag := range strings.Split(m[1], ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "" {
+				continue
+			}
+			ti.Tags = append(ti.Tags, tag)
+
+			if prereleaseRE.MatchString(tag) {
+				ti.Prerelease = true
+			}
+			if rm := revisionRE.FindStringSubmatch(tag); rm != nil {
+				major, _ := strconv.Atoi(rm[1])
+				minor, _ := strconv.Atoi(rm[2])
+				ti.Revision = major*1000 + minor
+			}
+		}
+	}
+	return ti
+}
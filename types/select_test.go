@@ -0,0 +1,158 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package types
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTitle(t *testing.T) {
+	tests := []struct {
+		name       string
+		base       string
+		tags       []string
+		prerelease bool
+		revision   int
+	}{
+		{"Tetris (World)", "Tetris", []string{"World"}, false, 0},
+		{"Title (USA, Europe) (En,Fr) (Rev 1)", "Title", []string{"USA", "Europe", "En", "Fr", "Rev 1"}, false, 1000},
+		{"Game (Japan) (v1.2)", "Game", []string{"Japan", "v1.2"}, false, 1002},
+		{"Game (USA) (Beta 2)", "Game", []string{"USA", "Beta 2"}, true, 0},
+		{"Game (Europe) (Proto)", "Game", []string{"Europe", "Proto"}, true, 0},
+		{"Game [b1] (USA)", "Game", []string{"USA"}, false, 0},
+		{"No Tags", "No Tags", nil, false, 0},
+		{"Betamax (USA)", "Betamax", []string{"USA"}, false, 0},
+	}
+
+	for _, test := range tests {
+		ti := ParseTitle(test.name)
+		if ti.Base != test.base || !reflect.DeepEqual(ti.Tags, test.tags) ||
+			ti.Prerelease != test.prerelease || ti.Revision != test.revision {
+			t.Errorf("ParseTitle(%q) = %+v, expected base %q tags %v prerelease %v revision %d",
+				test.name, ti, test.base, test.tags, test.prerelease, test.revision)
+		}
+	}
+}
+
+func gameNames(dat *Dat) []string {
+	var names []string
+	for _, g := range dat.Games {
+		names = append(names, g.Name)
+	}
+	return names
+}
+
+func TestGameFilter1G1R(t *testing.T) {
+	gf, err := NewGameFilter("", "", false, "USA, Europe,Japan")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dat := &Dat{
+		Name: "test",
+		Games: GameSlice{
+			{Name: "Alpha (Europe)"},
+			{Name: "Alpha (USA) (Beta)"},
+			{Name: "Alpha (USA)"},
+			{Name: "Alpha (USA) (Rev 1)"},
+			{Name: "Bravo (Japan)"},
+			{Name: "Bravo (Europe)"},
+			{Name: "Charlie (Brazil)"},
+			{Name: "Charlie (Korea)"},
+			{Name: "Delta (Japan) (Proto)"},
+			{Name: "Delta (Germany)"},
+		},
+	}
+
+	res := gf.Apply(dat)
+	expected := []string{"Alpha (USA) (Rev 1)", "Bravo (Europe)", "Charlie (Brazil)", "Delta (Japan) (Proto)"}
+	if names := gameNames(res); !reflect.DeepEqual(names, expected) {
+		t.Fatalf("1G1R selected %v, expected %v", names, expected)
+	}
+}
+
+func TestGameFilter1G1RClones(t *testing.T) {
+	gf, err := NewGameFilter("", "", false, "USA,Europe")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dat := &Dat{
+		Name: "test",
+		Games: GameSlice{
+			{Name: "Echo (Japan)"},
+			{Name: "Echo (Europe)", CloneOf: "Echo (Japan)"},
+			{Name: "Echo Special (USA)", CloneOf: "Echo (Japan)"},
+			{Name: "Foxtrot (Japan)"},
+			{Name: "Foxtrot (Korea)", CloneOf: "Foxtrot (Japan)"},
+			{Name: "Golf (USA)"},
+			{Name: "Golf (USA) (Alt)", CloneOf: "Golf (USA)"},
+		},
+	}
+
+	res := gf.Apply(dat)
+	expected := []string{"Echo Special (USA)", "Foxtrot (Japan)", "Golf (USA)"}
+	if names := gameNames(res); !reflect.DeepEqual(names, expected) {
+		t.Fatalf("1G1R selected %v, expected %v", names, expected)
+	}
+
+	gf.ExcludeClones = true
+	res = gf.Apply(dat)
+	expected = []string{"Echo (Japan)", "Foxtrot (Japan)", "Golf (USA)"}
+	if names := gameNames(res); !reflect.DeepEqual(names, expected) {
+		t.Fatalf("1G1R without clones selected %v, expected %v", names, expected)
+	}
+}
+
+func TestGameFilterRegex(t *testing.T) {
+	gf, err := NewGameFilter("^A", "Beta", false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gf.Active() {
+		t.Fatalf("expected filter with regexes to be active")
+	}
+
+	dat := &Dat{
+		Name: "test",
+		Games: GameSlice{
+			{Name: "Alpha (USA)"},
+			{Name: "Alpha (USA) (Beta)"},
+			{Name: "Bravo (USA)"},
+		},
+	}
+	res := gf.Apply(dat)
+	expected := []string{"Alpha (USA)"}
+	if names := gameNames(res); !reflect.DeepEqual(names, expected) {
+		t.Fatalf("filter selected %v, expected %v", names, expected)
+	}
+}
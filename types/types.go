@@ -46,6 +46,13 @@ type Dat struct {
 	Name          string      `xml:"header>name"`
 	OriginalName  string
 	Description   string      `xml:"header>description"`
+	Version       string      `xml:"header>version"`
+	Author        string      `xml:"header>author"`
+	Category      string      `xml:"header>category"`
+	Date          string      `xml:"header>date"`
+	Homepage      string      `xml:"header>homepage"`
+	Url           string      `xml:"header>url"`
+	Comment       string      `xml:"header>comment"`
 	Clr           *Clrmamepro `xml:"header>clrmamepro"`
 	Games         GameSlice   `xml:"game"`
 	Generation    int64
@@ -55,16 +62,28 @@ type Dat struct {
 	UnzipGames    bool
 	FixDat        bool
 	MissingSha1s  bool
+	Encoding      string
 	SLName        string `xml:"name,attr"`
 	SLDescription string `xml:"description,attr"`
 }
 
 type Game struct {
-	Name        string   `xml:"name,attr"`
-	Description string   `xml:"description"`
-	Roms        RomSlice `xml:"rom"`
-	Parts       RomSlice `xml:"part>dataarea>rom"`
-	Regions     RomSlice `xml:"region>rom"`
+	Name         string       `xml:"name,attr"`
+	CloneOf      string       `xml:"cloneof,attr"`
+	RomOf        string       `xml:"romof,attr"`
+	SampleOf     string       `xml:"sampleof,attr"`
+	IsBios       string       `xml:"isbios,attr"`
+	IsDevice     string       `xml:"isdevice,attr"`
+	Description  string       `xml:"description"`
+	Year         string       `xml:"year"`
+	Manufacturer string       `xml:"manufacturer"`
+	Roms         RomSlice     `xml:"rom"`
+	Parts        RomSlice     `xml:"part>dataarea>rom"`
+	Regions      RomSlice     `xml:"region>rom"`
+	Disks        []*Disk      `xml:"disk"`
+	Samples      []*Sample    `xml:"sample"`
+	BiosSets     []*BiosSet   `xml:"biosset"`
+	DeviceRefs   []*DeviceRef `xml:"device_ref"`
 }
 
 type GameSlice []*Game
@@ -75,10 +94,56 @@ type Rom struct {
 	Crc    []byte `xml:"crc,attr"`
 	Md5    []byte `xml:"md5,attr"`
 	Sha1   []byte `xml:"sha1,attr"`
+	Merge  string `xml:"merge,attr"`
+	Bios   string `xml:"bios,attr"`
+	Region string `xml:"region,attr"`
+	Offset string `xml:"offset,attr"`
 	Status string `xml:"status,attr"`
 	Path   string
 }
 
+type Disk struct {
+	Name   string `xml:"name,attr"`
+	Md5    []byte `xml:"md5,attr"`
+	Sha1   []byte `xml:"sha1,attr"`
+	Merge  string `xml:"merge,attr"`
+	Region string `xml:"region,attr"`
+	Index  string `xml:"index,attr"`
+	Status string `xml:"status,attr"`
+}
+
+type Sample struct {
+	Name string `xml:"name,attr"`
+}
+
+type BiosSet struct {
+	Name        string `xml:"name,attr"`
+	Description string `xml:"description,attr"`
+	Default     string `xml:"default,attr"`
+}
+
+type DeviceRef struct {
+	Name string `xml:"name,attr"`
+}
+
+func yes(v string) bool {
+	return v == "yes" || v == "true" || v == "1"
+}
+
+// Bios reports whether the game is a BIOS set.
+func (g *Game) Bios() bool {
+	return yes(g.IsBios)
+}
+
+// Device reports whether the game is a device.
+func (g *Game) Device() bool {
+	return yes(g.IsDevice)
+}
+
+// SizeUnknown is the size of roms from sources that don't record sizes, like
+// sfv or md5 files.
+const SizeUnknown = -1
+
 type RomSlice []*Rom
 
 func (ar *Rom) HashesMatch(br *Rom) bool {
@@ -185,6 +250,10 @@ func (g *Game) Normalize() {
 	}
 	sort.Sort(g.Roms)
 
+	for _, d := range g.Disks {
+		d.Name = strings.Replace(d.Name, "\\", "/", -1)
+	}
+
 	filteredRoms := make([]*Rom, 0, len(g.Roms))
 
 	for _, r := range g.Roms {
@@ -212,6 +281,10 @@ func (d *Dat) Normalize() {
 		d.Description = d.SLDescription
 	}
 
+	if d.Category == "FIXDATFILE" {
+		d.FixDat = true
+	}
+
 	if d.Clr != nil && (d.Clr.ForcePacking == "unzip" || d.Clr.ForcePacking == "false" || d.Clr.ForcePacking == "no" ||
 		d.Clr.ForceZipping == "unzip" || d.Clr.ForceZipping == "false" || d.Clr.ForceZipping == "no") {
 		d.UnzipGames = true
@@ -235,12 +308,8 @@ func (d *Dat) Normalize() {
 
 func (d *Dat) NarrowToRom(rom *Rom) *Dat {
 	dc := new(Dat)
-	dc.Name = d.Name
-	dc.Path = d.Path
-	dc.Description = d.Description
-	dc.FixDat = d.FixDat
-	dc.Generation = d.Generation
-	dc.UnzipGames = d.UnzipGames
+	dc.CopyHeader(d)
+	dc.Comment = d.Comment
 
 	for _, g := range d.Games {
 		gc := new(Game)
@@ -286,16 +355,30 @@ func (d *Dat) FilterRoms(fn func(*Rom) bool) *Dat {
 	return nil
 }
 
+// CopyHeader copies the header of src into d and notes in the comment which
+// DAT release d was derived from.
 func (d *Dat) CopyHeader(src *Dat) {
 	d.Name = src.Name
 	d.OriginalName = src.OriginalName
 	d.Path = src.Path
 	d.Description = src.Description
+	d.Version = src.Version
+	d.Author = src.Author
+	d.Category = src.Category
+	d.Date = src.Date
+	d.Homepage = src.Homepage
+	d.Url = src.Url
+	d.Comment = src.DerivedNote()
 	d.FixDat = src.FixDat
 	d.Generation = src.Generation
 	d.UnzipGames = src.UnzipGames
 }
 
+// DerivedNote returns the comment put into DATs generated from d.
+func (d *Dat) DerivedNote() string {
+	return strings.TrimSpace("derived from " + d.Name + " " + d.Version)
+}
+
 func (d *Dat) Filename() string {
 	if d.Path != "" {
 		return filepath.Base(d.Path)
@@ -305,11 +388,22 @@ func (d *Dat) Filename() string {
 
 func (g *Game) CopyHeader(src *Game) {
 	g.Name = src.Name
+	g.CloneOf = src.CloneOf
+	g.RomOf = src.RomOf
+	g.SampleOf = src.SampleOf
+	g.IsBios = src.IsBios
+	g.IsDevice = src.IsDevice
 	g.Description = src.Description
+	g.Year = src.Year
+	g.Manufacturer = src.Manufacturer
+	g.Disks = src.Disks
+	g.Samples = src.Samples
+	g.BiosSets = src.BiosSets
+	g.DeviceRefs = src.DeviceRefs
 }
 
 func (r *Rom) Valid() bool {
-	return !(r.Size > 0 && len(r.Crc) == 0 && len(r.Md5) == 0 && len(r.Sha1) == 0) && r.Status != "nodump"
+	return !(r.Size != 0 && len(r.Crc) == 0 && len(r.Md5) == 0 && len(r.Sha1) == 0) && r.Status != "nodump"
 }
 
 func (r *Rom) Copy(src *Rom) {
@@ -319,5 +413,9 @@ func (r *Rom) Copy(src *Rom) {
 	r.Md5 = src.Md5
 	r.Sha1 = src.Sha1
 	r.Size = src.Size
+	r.Merge = src.Merge
+	r.Bios = src.Bios
+	r.Region = src.Region
+	r.Offset = src.Offset
 	r.Status = src.Status
 }
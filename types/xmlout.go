@@ -0,0 +1,228 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package types
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+)
+
+// Formats for DATs written by romba.
+const (
+	FormatDat = "dat"
+	FormatXML = "xml"
+)
+
+func CheckFormat(format string) error {
+	if format != FormatDat && format != FormatXML {
+		return fmt.Errorf("unknown DAT format %q, expected %s or %s", format, FormatDat, FormatXML)
+	}
+	return nil
+}
+
+// FormatSuffix returns the file suffix for DATs written in format.
+func FormatSuffix(format string) string {
+	if format == FormatXML {
+		return ".xml"
+	}
+	return ".dat"
+}
+
+// ComposeDatAs writes d either as a clrmamepro DAT or as a Logiqx XML DAT.
+func ComposeDatAs(d *Dat, format string, w io.Writer) error {
+	if format == FormatXML {
+		return ComposeXMLDat(d, w)
+	}
+	return ComposeCompliantDat(d, w)
+}
+
+const xmlDatPrologue = `<?xml version="1.0"?>
+<!DOCTYPE datafile PUBLIC "-//Logiqx//DTD ROM Management Datafile//EN" "http://www.logiqx.com/Dats/datafile.dtd">
+`
+
+type xmlWriter struct {
+	bw  *bufio.Writer
+	err error
+}
+
+func (xw *xmlWriter) str(s string) {
+	if xw.err == nil {
+		_, xw.err = xw.bw.WriteString(s)
+	}
+}
+
+func (xw *xmlWriter) text(s string) {
+	if xw.err == nil {
+		xw.err = xml.EscapeText(xw.bw, []byte(s))
+	}
+}
+
+func (xw *xmlWriter) attr(name, v string) {
+	if v == "" {
+		return
+	}
+	xw.str(" " + name + "=\"")
+	xw.text(v)
+	xw.str("\"")
+}
+
+func (xw *xmlWriter) hexAttr(name string, bs []byte) {
+	if len(bs) == 0 {
+		return
+	}
+	xw.str(" " + name + "=\"" + hex.EncodeToString(bs) + "\"")
+}
+
+func (xw *xmlWriter) elem(indent, name, v string) {
+	if v == "" {
+		return
+	}
+	xw.str(indent + "<" + name + ">")
+	xw.text(v)
+	xw.str("</" + name + ">\n")
+}
+
+func (xw *xmlWriter) flush() error {
+	if xw.err != nil {
+		return xw.err
+	}
+	return xw.bw.Flush()
+}
+
+func (xw *xmlWriter) header(d *Dat) {
+	category := d.Category
+	if d.FixDat {
+		category = "FIXDATFILE"
+	}
+
+	xw.str(xmlDatPrologue)
+	xw.str("<datafile>\n\t<header>\n")
+	xw.elem("\t\t", "name", d.Name)
+	xw.elem("\t\t", "description", d.Description)
+	xw.elem("\t\t", "category", category)
+	xw.elem("\t\t", "version", d.Version)
+	xw.elem("\t\t", "date", d.Date)
+	xw.elem("\t\t", "author", d.Author)
+	xw.elem("\t\t", "homepage", d.Homepage)
+	xw.elem("\t\t", "url", d.Url)
+	xw.elem("\t\t", "comment", d.Comment)
+	if d.UnzipGames {
+		xw.str("\t\t<clrmamepro forcepacking=\"unzip\"/>\n")
+	}
+	xw.str("\t</header>\n")
+}
+
+func (xw *xmlWriter) game(g *Game) {
+	xw.str("\t<game")
+	xw.attr("name", g.Name)
+	xw.attr("cloneof", g.CloneOf)
+	xw.attr("romof", g.RomOf)
+	xw.attr("sampleof", g.SampleOf)
+	xw.attr("isbios", g.IsBios)
+	xw.attr("isdevice", g.IsDevice)
+	xw.str(">\n")
+	xw.elem("\t\t", "description", g.Description)
+	xw.elem("\t\t", "year", g.Year)
+	xw.elem("\t\t", "manufacturer", g.Manufacturer)
+	for _, bs := range g.BiosSets {
+		xw.str("\t\t<biosset")
+		xw.attr("name", bs.Name)
+		xw.attr("description", bs.Description)
+		xw.attr("default", bs.Default)
+		xw.str("/>\n")
+	}
+	for _, r := range g.Roms {
+		xw.str("\t\t<rom")
+		xw.attr("name", r.Name)
+		if r.Size != SizeUnknown {
+			xw.str(fmt.Sprintf(" size=\"%d\"", r.Size))
+		}
+		xw.hexAttr("crc", r.Crc)
+		xw.hexAttr("md5", r.Md5)
+		xw.hexAttr("sha1", r.Sha1)
+		xw.attr("merge", r.Merge)
+		xw.attr("bios", r.Bios)
+		xw.attr("region", r.Region)
+		xw.attr("offset", r.Offset)
+		xw.attr("status", r.Status)
+		xw.str("/>\n")
+	}
+	for _, d := range g.Disks {
+		xw.str("\t\t<disk")
+		xw.attr("name", d.Name)
+		xw.hexAttr("md5", d.Md5)
+		xw.hexAttr("sha1", d.Sha1)
+		xw.attr("merge", d.Merge)
+		xw.attr("region", d.Region)
+		xw.attr("index", d.Index)
+		xw.attr("status", d.Status)
+		xw.str("/>\n")
+	}
+	for _, s := range g.Samples {
+		xw.str("\t\t<sample")
+		xw.attr("name", s.Name)
+		xw.str("/>\n")
+	}
+	xw.str("\t</game>\n")
+}
+
+// ComposeXMLDat writes d as a Logiqx XML DAT.
+func ComposeXMLDat(d *Dat, w io.Writer) error {
+	xw := &xmlWriter{bw: bufio.NewWriter(w)}
+	xw.header(d)
+	for _, g := range d.Games {
+		xw.game(g)
+	}
+	xw.str("</datafile>\n")
+	return xw.flush()
+}
+
+// ComposeXMLDatHeader, ComposeXMLGame and ComposeXMLDatFooter write a Logiqx
+// XML DAT piecewise, for DATs too large to hold in memory.
+func ComposeXMLDatHeader(d *Dat, w io.Writer) error {
+	xw := &xmlWriter{bw: bufio.NewWriter(w)}
+	xw.header(d)
+	return xw.flush()
+}
+
+func ComposeXMLGame(g *Game, w io.Writer) error {
+	xw := &xmlWriter{bw: bufio.NewWriter(w)}
+	xw.game(g)
+	return xw.flush()
+}
+
+func ComposeXMLDatFooter(w io.Writer) error {
+	_, err := io.WriteString(w, "</datafile>\n")
+	return err
+}
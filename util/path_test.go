@@ -0,0 +1,62 @@
+// Copyright (c) 2013 Uwe Hoffmann. All rights reserved.
+
+/*
+Redistribution and use in source and binary forms, with or without
+modification, are permitted provided that the following conditions are
+met:
+
+   * Redistributions of source code must retain the above copyright
+notice, this list of conditions and the following disclaimer.
+   * Redistributions in binary form must reproduce the above
+copyright notice, this list of conditions and the following disclaimer
+in the documentation and/or other materials provided with the
+distribution.
+   * Neither the name of Google Inc. nor the names of its
+contributors may be used to endorse or promote products derived from
+this software without specific prior written permission.
+
+THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS
+"AS IS" AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT
+LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR
+A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT
+OWNER OR CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL,
+SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT
+LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY
+THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT
+(INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+*/
+
+package util
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestArchiveEntryName(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		clean string
+		ok    bool
+	}{
+		{"a.bin", "a.bin", true},
+		{"sub\\a.bin", filepath.Join("sub", "a.bin"), true},
+		{"sub/../a.bin", "a.bin", true},
+		{"./sub//a.bin", filepath.Join("sub", "a.bin"), true},
+		{"../a.bin", "", false},
+		{"sub/../../a.bin", "", false},
+		{"..\\a.bin", "", false},
+		{"/etc/a.bin", "", false},
+		{"\\a.bin", "", false},
+		{"c:a.bin", "", false},
+		{"..", "", false},
+		{".", "", false},
+	} {
+		clean, ok := ArchiveEntryName(tc.name)
+		if clean != tc.clean || ok != tc.ok {
+			t.Errorf("ArchiveEntryName(%q) = %q, %v, expected %q, %v", tc.name, clean, ok, tc.clean, tc.ok)
+		}
+	}
+}